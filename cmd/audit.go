@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/audit"
+	"github.com/spf13/cobra"
+)
+
+var flagAuditKey string
+
+var auditCmdGroup = &cobra.Command{
+	Use:   "audit <command>",
+	Short: "Inspect the audit log of the Conductor",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var verifyAuditCmd = &cobra.Command{
+	Use:   "verify <file|url>",
+	Short: "Verify the integrity of an exported audit log",
+	Long: `Verify the integrity of the audit log exported by a Conductor on
+/dispers/audit. The export can be read from a file, from the standard input
+with "-", or directly fetched from the Conductor with its URL.
+
+With the public key of the Conductor, given by /dispers/audit/key and kept
+apart, the signature of every entry is checked too: the chain cannot have been
+rewritten by someone who only had access to the Conductor's database.`,
+	Example: "$ cozy-dispers audit verify https://conductor.example.net/dispers/audit",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+
+		var r io.Reader
+		switch source := args[0]; {
+		case source == "-":
+			r = os.Stdin
+		case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+			res, err := http.Get(source)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("Unexpected HTTP status code: %s", res.Status)
+			}
+			r = res.Body
+		default:
+			f, err := os.Open(source)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		var entries []*audit.Entry
+		if err := json.NewDecoder(r).Decode(&entries); err != nil {
+			return err
+		}
+		var key *ecdsa.PublicKey
+		if flagAuditKey != "" {
+			data, err := ioutil.ReadFile(flagAuditKey)
+			if err != nil {
+				return err
+			}
+			if key, err = audit.ParsePublicKey(data); err != nil {
+				return err
+			}
+		}
+		if err := audit.Verify(entries, key); err != nil {
+			errFatalf("Error: %s\n", err)
+		}
+
+		if len(entries) == 0 {
+			fmt.Println("OK, the audit log is empty.")
+			return nil
+		}
+		fmt.Printf("OK, the entries %d to %d are valid.\n", entries[0].Index, entries[len(entries)-1].Index)
+		return nil
+	},
+}
+
+func init() {
+	verifyAuditCmd.Flags().StringVar(&flagAuditKey, "key", "", "PEM file of the public key signing the entries")
+	auditCmdGroup.AddCommand(verifyAuditCmd)
+	RootCmd.AddCommand(auditCmdGroup)
+}
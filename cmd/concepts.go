@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/client/request"
+	"github.com/cozy/cozy-stack/pkg/dispers"
+	"github.com/spf13/cobra"
+)
+
+var flagFixOrphans bool
+
+var conceptsCmdGroup = &cobra.Command{
+	Use:   "concepts <command>",
+	Short: "Maintain the concepts of the Conductor and the Concept Indexor",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var reconcileConceptsCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Detect the concepts and lists of instances left by failed creations",
+	Long: `Compare the concepts of the Concept Indexor with the lists of
+instances of the Conductor. The concepts without a list and the lists without a
+concept are orphans left by interrupted creations. With --fix, they are
+deleted.`,
+	Example: "$ cozy-dispers concepts reconcile --fix",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		method := http.MethodGet
+		if flagFixOrphans {
+			method = http.MethodDelete
+		}
+
+		c := newAdminClient()
+		res, err := c.Req(&request.Options{
+			Method: method,
+			Path:   "/dispers/concepts/orphans",
+		})
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		var orphans enclave.Orphans
+		if err := json.NewDecoder(res.Body).Decode(&orphans); err != nil {
+			return err
+		}
+
+		verb := "Found"
+		if flagFixOrphans {
+			verb = "Deleted"
+		}
+		fmt.Printf("%s %d orphaned concepts on the Concept Indexor.\n", verb, len(orphans.Concepts))
+		fmt.Printf("%s %d orphaned lists of instances on the Conductor.\n", verb, len(orphans.SubscribeDocs))
+		for _, doc := range orphans.SubscribeDocs {
+			fmt.Printf("  %s (%d subscribers)\n", doc.ID, doc.Subscribers)
+		}
+		return nil
+	},
+}
+
+func init() {
+	reconcileConceptsCmd.Flags().BoolVar(&flagFixOrphans, "fix", false, "Delete the orphaned documents")
+	conceptsCmdGroup.AddCommand(reconcileConceptsCmd)
+	RootCmd.AddCommand(conceptsCmdGroup)
+}
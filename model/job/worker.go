@@ -32,6 +32,11 @@ type (
 	// global variable used by the worker.
 	WorkerInitFunc func() error
 
+	// WorkerShutdownFunc is optionally called when the worker is shut down,
+	// once its jobs have ended. It can be useful to stop what has been started
+	// by the WorkerInitFunc.
+	WorkerShutdownFunc func() error
+
 	// WorkerStartFunc is optionally called at the beginning of the each job
 	// process and can produce a context value.
 	WorkerStartFunc func(ctx *WorkerContext) (*WorkerContext, error)
@@ -57,18 +62,19 @@ type (
 	// system. It contains parameters of the worker along with the worker main
 	// function that perform the work against a job's message.
 	WorkerConfig struct {
-		WorkerInit   WorkerInitFunc
-		WorkerStart  WorkerStartFunc
-		WorkerFunc   WorkerFunc
-		WorkerCommit WorkerCommit
-		WorkerType   string
-		BeforeHook   WorkerBeforeHook
-		ErrorHook    JobErrorCheckerHook
-		Concurrency  int
-		MaxExecCount int
-		AdminOnly    bool
-		Timeout      time.Duration
-		RetryDelay   time.Duration
+		WorkerInit     WorkerInitFunc
+		WorkerShutdown WorkerShutdownFunc
+		WorkerStart    WorkerStartFunc
+		WorkerFunc     WorkerFunc
+		WorkerCommit   WorkerCommit
+		WorkerType     string
+		BeforeHook     WorkerBeforeHook
+		ErrorHook      JobErrorCheckerHook
+		Concurrency    int
+		MaxExecCount   int
+		AdminOnly      bool
+		Timeout        time.Duration
+		RetryDelay     time.Duration
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
@@ -251,6 +257,11 @@ func (w *Worker) Shutdown(ctx context.Context) error {
 		case <-w.closed:
 		}
 	}
+	if w.Conf.WorkerShutdown != nil {
+		if err := w.Conf.WorkerShutdown(); err != nil {
+			return fmt.Errorf("Could not shut down worker %s: %s", w.Type, err)
+		}
+	}
 	return nil
 }
 
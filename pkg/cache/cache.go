@@ -10,6 +10,9 @@ import (
 	"github.com/go-redis/redis"
 )
 
+// setIfAbsentMu serializes the SetIfAbsent calls on the in-memory caches
+var setIfAbsentMu sync.Mutex
+
 type cacheEntry struct {
 	payload   []byte
 	expiredAt time.Time
@@ -73,6 +76,28 @@ func (c Cache) Set(key string, data []byte, expiration time.Duration) {
 	}
 }
 
+// SetIfAbsent stores an asset to the given key only if there is no asset for
+// this key yet, and returns true if it has been stored. The check and the
+// store are made at once.
+func (c Cache) SetIfAbsent(key string, data []byte, expiration time.Duration) bool {
+	if c.client == nil {
+		setIfAbsentMu.Lock()
+		defer setIfAbsentMu.Unlock()
+		if value, ok := c.m.Load(key); ok {
+			if time.Now().Before(value.(cacheEntry).expiredAt) {
+				return false
+			}
+		}
+		c.m.Store(key, cacheEntry{
+			payload:   data,
+			expiredAt: time.Now().Add(expiration),
+		})
+		return true
+	}
+	stored, err := c.client.SetNX(key, data, expiration).Result()
+	return err == nil && stored
+}
+
 // GetCompressed works like Get but expect a compressed asset that is
 // uncompressed.
 func (c Cache) GetCompressed(key string) (io.Reader, bool) {
@@ -2,6 +2,8 @@ package cache
 
 import (
 	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,3 +24,26 @@ func TestCacheInMemory(t *testing.T) {
 	_, ok = c.Get(key)
 	assert.False(t, ok)
 }
+
+func TestSetIfAbsentInMemory(t *testing.T) {
+	c := New(nil)
+
+	var stored int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.SetIfAbsent("nonce", []byte{1}, time.Minute) {
+				atomic.AddInt32(&stored, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), stored)
+
+	// An expired asset can be replaced
+	assert.True(t, c.SetIfAbsent("expired", []byte{1}, -time.Second))
+	assert.True(t, c.SetIfAbsent("expired", []byte{1}, time.Minute))
+	assert.False(t, c.SetIfAbsent("expired", []byte{1}, time.Minute))
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -88,10 +90,14 @@ type Config struct {
 
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
+	ConceptKey              string
+	NextConceptKey          string
+	CatalogueKey            string
 
 	DevMode bool
 
 	RemoteCozyDISPERS map[string]string
+	Dispers           Dispers
 
 	RemoteAssets map[string]string
 
@@ -130,6 +136,9 @@ type Config struct {
 type Vault struct {
 	credsEncryptor *keymgmt.NACLKey
 	credsDecryptor *keymgmt.NACLKey
+	conceptKey     []byte
+	nextConceptKey []byte
+	catalogueKey   []byte
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -144,6 +153,24 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// ConceptKey returns the secret key used by the Concept Indexor to hash the
+// concepts.
+func (v *Vault) ConceptKey() []byte {
+	return v.conceptKey
+}
+
+// NextConceptKey returns the key the concepts are re-keyed with when the key
+// of the Concept Indexor is rotated.
+func (v *Vault) NextConceptKey() []byte {
+	return v.nextConceptKey
+}
+
+// CatalogueKey returns the secret key used by the Conductor to draw the noise
+// of the counts of the catalogue.
+func (v *Vault) CatalogueKey() []byte {
+	return v.catalogueKey
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth      *url.Userinfo
@@ -171,6 +198,97 @@ type Jobs struct {
 	DefaultDurationToKeep string
 }
 
+// Dispers contains the configuration values used to secure the communication
+// between Cozy-DISPERS actors
+type Dispers struct {
+	// Certificate and key identifying this actor. They are used both by the
+	// HTTPS server and as client certificate when calling other actors.
+	CertificateFile string
+	KeyFile         string
+	// RootCAFile is used to verify the certificates of the other actors, who
+	// call this actor on PeersAddr
+	RootCAFile             string
+	PeersAddr              string
+	PinnedKey              string
+	InsecureSkipValidation bool
+	Client                 *http.Client
+
+	// SignatureName is the name under which the other actors know this actor,
+	// usually its public host. SignatureKeys contains a shared key for every
+	// peer, and SignatureRoles its role, indexed by the peer's name. When keys
+	// are given, every request between actors is signed.
+	SignatureName   string
+	SignatureKeys   map[string][]byte
+	SignatureRoles  map[string]string
+	SignatureMaxAge time.Duration
+
+	// QuerierTokenSecret is used by the Conductor to sign the queriers' tokens
+	QuerierTokenSecret []byte
+
+	// Default quotas of the queriers, zero meaning no limit. A query is
+	// considered as running for at most RunningQueryTTL.
+	QueriesPerDay     int
+	ConcurrentQueries int
+	MaxTargets        int
+	RunningQueryTTL   time.Duration
+
+	// CatalogueEpsilon is the privacy budget of the noisy subscriber counts
+	// given in the concepts' catalogue
+	CatalogueEpsilon float64
+
+	// SubscriptionShards is the number of buckets a new concept's list of
+	// instances is split into, and SubscriptionBucketSize the number of
+	// instances of a bucket over which the number of buckets is doubled
+	SubscriptionShards     int
+	SubscriptionBucketSize int
+
+	// CompressionMinSize is the size in bytes from which the requests to
+	// other actors are compressed, a negative size disabling the compression
+	CompressionMinSize int
+
+	// AuditSigningKeyFile is the path to the ECDSA private key signing the
+	// entries of the audit log
+	AuditSigningKeyFile string
+
+	// LocalQueryPolicyFile is the path to the policy of the local queries:
+	// the doctypes, fields and Mango operators they can use
+	LocalQueryPolicyFile string
+
+	// MaxRowsPerInstance is the maximal number of rows Target fetches from an
+	// instance, and StackConcurrency the number of requests it makes to the
+	// stacks at the same time. DeleteIndexes tells if the indexes created on
+	// the stacks for a query are deleted afterwards.
+	MaxRowsPerInstance int
+	StackConcurrency   int
+	DeleteIndexes      bool
+
+	// FoldTimeout is the time given to a Data Aggregator to compute a fold,
+	// a failed copy being sent to another one at most MaxFoldRetries times,
+	// nil keeping the default
+	FoldTimeout    time.Duration
+	MaxFoldRetries *int
+
+	// PollingInterval is the interval at which the deadlines of the target
+	// phases and of the folds are checked, a negative one disabling the checks
+	PollingInterval time.Duration
+
+	// LeadDebounce is the time during which the requests to lead a query are
+	// gathered into a single job, zero or a negative value pushing a job for
+	// every request, nil keeping the default
+	LeadDebounce *time.Duration
+}
+
+// SigningEnabled returns true if the requests between actors are signed
+func (d *Dispers) SigningEnabled() bool {
+	return d.SignatureName != "" && len(d.SignatureKeys) > 0
+}
+
+// TLSEnabled returns true if this actor has its own certificate and should
+// authenticate the other actors with theirs.
+func (d *Dispers) TLSEnabled() bool {
+	return d.CertificateFile != "" && d.KeyFile != ""
+}
+
 // Konnectors contains the configuration values for the konnectors
 type Konnectors struct {
 	Cmd string
@@ -370,12 +488,32 @@ func Setup(cfgFile string) (err error) {
 	return UseViper(viper.GetViper())
 }
 
+// stringMap returns the string values of a map read in the configuration
+func stringMap(value interface{}) map[string]string {
+	m := make(map[string]string)
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			m[k] = fmt.Sprint(v)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range value {
+			m[fmt.Sprint(k)] = fmt.Sprint(v)
+		}
+	}
+	return m
+}
+
 func applyDefaults(v *viper.Viper) {
 	v.SetDefault("password_reset_interval", defaultPasswordResetInterval)
 	v.SetDefault("jobs.imagemagick_convert_cmd", "convert")
 	v.SetDefault("jobs.defaultDurationToKeep", "2W")
 	v.SetDefault("assets_polling_disabled", false)
 	v.SetDefault("assets_polling_interval", 2*time.Minute)
+	v.SetDefault("dispers.signature.max_age", time.Minute)
+	v.SetDefault("dispers.peers_addr", "localhost:8443")
+	v.SetDefault("dispers.quotas.running_ttl", 24*time.Hour)
+	v.SetDefault("dispers.catalogue.epsilon", 1.0)
 }
 
 func envMap() map[string]string {
@@ -442,6 +580,63 @@ func UseViper(v *viper.Viper) error {
 		return err
 	}
 
+	dispersClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
+		Timeout:    5 * time.Minute,
+		RootCAFile: v.GetString("dispers.root_ca"),
+		ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
+			CertificateFile: v.GetString("dispers.cert"),
+			KeyFile:         v.GetString("dispers.key"),
+		},
+		PinnedKey:              v.GetString("dispers.pinned_key"),
+		InsecureSkipValidation: v.GetBool("dispers.insecure_skip_validation"),
+	})
+	if err != nil {
+		return err
+	}
+
+	signatureKeys := make(map[string][]byte)
+	signatureRoles := make(map[string]string)
+	for peer, value := range v.GetStringMap("dispers.signature.keys") {
+		// The names of the peers are hosts, they cannot be read as viper keys
+		entry := stringMap(value)
+		key, err := hex.DecodeString(entry["key"])
+		if err != nil {
+			return fmt.Errorf("config: could not decode the signature key of %q: %s", peer, err)
+		}
+		if len(key) < 16 {
+			return fmt.Errorf("config: the signature key of %q is too short", peer)
+		}
+		role := entry["role"]
+		if role == "" {
+			return fmt.Errorf("config: the role of %q is missing", peer)
+		}
+		signatureKeys[peer] = key
+		signatureRoles[peer] = role
+	}
+
+	// Zero retries is a valid value, the default is only kept when the key
+	// is not set
+	var maxFoldRetries *int
+	if v.IsSet("dispers.aggregation.max_retries") {
+		retries := v.GetInt("dispers.aggregation.max_retries")
+		maxFoldRetries = &retries
+	}
+
+	// A zero debounce pushes a job for every request to lead a query
+	var leadDebounce *time.Duration
+	if v.IsSet("dispers.lead_debounce") {
+		debounce := v.GetDuration("dispers.lead_debounce")
+		leadDebounce = &debounce
+	}
+
+	var querierTokenSecret []byte
+	if hexSecret := v.GetString("dispers.queriers.token_secret"); hexSecret != "" {
+		querierTokenSecret, err = hex.DecodeString(hexSecret)
+		if err != nil {
+			return fmt.Errorf("config: could not decode the queriers' token secret: %s", err)
+		}
+	}
+
 	regs, err := makeRegistries(v)
 	if err != nil {
 		return err
@@ -591,11 +786,45 @@ func UseViper(v *viper.Viper) error {
 		PasswordResetInterval: v.GetDuration("password_reset_interval"),
 
 		RemoteCozyDISPERS: v.GetStringMapString("remote_cozy_dispers"),
+		Dispers: Dispers{
+			CertificateFile:        v.GetString("dispers.cert"),
+			KeyFile:                v.GetString("dispers.key"),
+			RootCAFile:             v.GetString("dispers.root_ca"),
+			PeersAddr:              v.GetString("dispers.peers_addr"),
+			PinnedKey:              v.GetString("dispers.pinned_key"),
+			InsecureSkipValidation: v.GetBool("dispers.insecure_skip_validation"),
+			Client:                 dispersClient,
+			SignatureName:          v.GetString("dispers.signature.name"),
+			SignatureKeys:          signatureKeys,
+			SignatureRoles:         signatureRoles,
+			SignatureMaxAge:        v.GetDuration("dispers.signature.max_age"),
+			QuerierTokenSecret:     querierTokenSecret,
+			QueriesPerDay:          v.GetInt("dispers.quotas.queries_per_day"),
+			ConcurrentQueries:      v.GetInt("dispers.quotas.concurrent_queries"),
+			MaxTargets:             v.GetInt("dispers.quotas.max_targets"),
+			RunningQueryTTL:        v.GetDuration("dispers.quotas.running_ttl"),
+			CatalogueEpsilon:       v.GetFloat64("dispers.catalogue.epsilon"),
+			SubscriptionShards:     v.GetInt("dispers.subscriptions.shards"),
+			SubscriptionBucketSize: v.GetInt("dispers.subscriptions.bucket_size"),
+			CompressionMinSize:     v.GetInt("dispers.compression.min_size"),
+			LocalQueryPolicyFile:   v.GetString("dispers.local_query_policy"),
+			AuditSigningKeyFile:    v.GetString("dispers.audit.signing_key"),
+			MaxRowsPerInstance:     v.GetInt("dispers.target.max_rows_per_instance"),
+			StackConcurrency:       v.GetInt("dispers.target.stack_concurrency"),
+			DeleteIndexes:          v.GetBool("dispers.target.delete_indexes"),
+			FoldTimeout:            v.GetDuration("dispers.aggregation.fold_timeout"),
+			MaxFoldRetries:         maxFoldRetries,
+			PollingInterval:        v.GetDuration("dispers.polling_interval"),
+			LeadDebounce:           leadDebounce,
+		},
 
 		RemoteAssets: v.GetStringMapString("remote_assets"),
 
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
+		ConceptKey:              v.GetString("vault.concept_key"),
+		NextConceptKey:          v.GetString("vault.next_concept_key"),
+		CatalogueKey:            v.GetString("vault.catalogue_key"),
 
 		DevMode: v.GetBool("dev.mode"),
 
@@ -692,13 +921,78 @@ func MakeVault(c *Config) error {
 		}
 	}
 
+	var conceptKey []byte
+	if conceptKeyFile := config.ConceptKey; conceptKeyFile != "" {
+		var err error
+		conceptKey, err = readHexKey(conceptKeyFile)
+		if err != nil {
+			return fmt.Errorf("config: could not read the concept key: %s", err)
+		}
+	}
+
+	var nextConceptKey []byte
+	if nextConceptKeyFile := config.NextConceptKey; nextConceptKeyFile != "" {
+		var err error
+		nextConceptKey, err = readHexKey(nextConceptKeyFile)
+		if err != nil {
+			return fmt.Errorf("config: could not read the next concept key: %s", err)
+		}
+	}
+
+	var catalogueKey []byte
+	if catalogueKeyFile := config.CatalogueKey; catalogueKeyFile != "" {
+		var err error
+		catalogueKey, err = readHexKey(catalogueKeyFile)
+		if err != nil {
+			return fmt.Errorf("config: could not read the catalogue key: %s", err)
+		}
+	}
+
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		conceptKey:     conceptKey,
+		nextConceptKey: nextConceptKey,
+		catalogueKey:   catalogueKey,
 	}
 	return nil
 }
 
+// readHexKey reads a hex-encoded secret key from a file
+func readHexKey(filename string) ([]byte, error) {
+	keyBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(keyBytes)))
+}
+
+// DevKey returns a secret key for the development mode. It is generated the
+// first time, and kept in $HOME/.cozy so that the data it protects can still
+// be read after a restart.
+func DevKey(name string) ([]byte, error) {
+	filename := filepath.Join(utils.AbsPath("$HOME/.cozy"), "dev-"+name+".key")
+	key, err := readHexKey(filename)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filename, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
 func makeRegistries(v *viper.Viper) (map[string][]*url.URL, error) {
 	regs := make(map[string][]*url.URL)
 
@@ -790,9 +1084,21 @@ func UseTestFile() {
 		panic(fmt.Errorf("fatal error test config: could not generate key: %s", err))
 	}
 
+	conceptKey := make([]byte, 32)
+	if _, err := rand.Read(conceptKey); err != nil {
+		panic(fmt.Errorf("fatal error test config: could not generate key: %s", err))
+	}
+
+	catalogueKey := make([]byte, 32)
+	if _, err := rand.Read(catalogueKey); err != nil {
+		panic(fmt.Errorf("fatal error test config: could not generate key: %s", err))
+	}
+
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		conceptKey:     conceptKey,
+		catalogueKey:   catalogueKey,
 	}
 }
 
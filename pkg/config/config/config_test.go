@@ -1,6 +1,7 @@
 package config
 
 import (
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -104,3 +105,26 @@ func regsToStrings(regs []*url.URL) []string {
 	}
 	return ss
 }
+
+func TestDevKey(t *testing.T) {
+	home, err := ioutil.TempDir("", "cozy-devkey")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	key, err := DevKey("concept")
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	// The key is kept between the restarts
+	again, err := DevKey("concept")
+	assert.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	other, err := DevKey("catalogue")
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+}
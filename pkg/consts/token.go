@@ -11,6 +11,7 @@ const (
 	RegistrationTokenAudience = "registration" // OAuth registration tokens
 	AccessTokenAudience       = "access"       // OAuth access tokens
 	RefreshTokenAudience      = "refresh"      // OAuth refresh tokens
+	QuerierAudience           = "querier"      // DISPERS queriers
 )
 
 // TokenValidityDuration is the duration where a token is valid in seconds (1 week)
@@ -22,4 +23,10 @@ var (
 	CLITokenValidityDuration       = 30 * time.Minute
 
 	AccessTokenValidityDuration = 7 * 24 * time.Hour
+
+	QuerierTokenValidityDuration = 30 * 24 * time.Hour
+
+	// InstanceTokenValidityDuration is used when an instance subscribes to
+	// Cozy-DISPERS without telling when its token expires
+	InstanceTokenValidityDuration = 90 * 24 * time.Hour
 )
@@ -45,7 +45,8 @@ var globalIndexes = []*mango.Index{
 
 // ConceptIndexorIndexes is the index list required by an instance to run properly.
 var conceptIndexorIndexes = []*mango.Index{
-	mango.IndexOnFields("io.cozy.hashconcept", "concept-index", []string{"concept"}),
+	mango.IndexOnFields("io.cozy.hashconcept", "concept-hash", []string{"hash"}),
+	mango.IndexOnFields("io.cozy.hashconcept", "concept-name", []string{"concept"}),
 }
 
 // ConductorIndexes is the index list required by an instance to run properly.
@@ -54,6 +55,8 @@ var conductorIndexes = []*mango.Index{
 	mango.IndexOnFields("io.cozy.async", "async-task", []string{"_id", "query_id", "da_layer_id", "da_id"}),
 	mango.IndexOnFields("io.cozy.async", "async-tasks", []string{"query_id", "da_layer_id"}),
 	mango.IndexOnFields("io.cozy.async", "async-metadata", []string{"query_id"}),
+	mango.IndexOnFields("io.cozy.async", "async-states", []string{"da_state"}),
+	mango.IndexOnFields("io.cozy.query", "query-running", []string{"running_until"}),
 	mango.IndexOnFields("io.cozy.execution.metadata", "metadata-index", []string{"query"}),
 }
 
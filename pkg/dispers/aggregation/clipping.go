@@ -0,0 +1,66 @@
+package aggregations
+
+import (
+	"math"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+)
+
+// Bound is the range of the values of a field. A value out of the range is
+// clipped to the nearest bound, or the whole row is rejected when Reject is
+// set. A missing bound does not limit the values.
+type Bound struct {
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Reject bool     `json:"reject,omitempty"`
+}
+
+// Check checks that the range of the bound is not empty
+func (b Bound) Check() error {
+	if b.Min != nil && b.Max != nil && *b.Min > *b.Max {
+		return errors.ErrInvalidClipping
+	}
+	return nil
+}
+
+// ClipRow clips the bounded fields of a row in place. It returns true if a
+// value has been clipped, and false if the row has to be rejected: a bounded
+// field is not a finite number, or is out of range with Reject.
+func ClipRow(row map[string]interface{}, bounds map[string]Bound) (clipped bool, kept bool) {
+
+	for key, bound := range bounds {
+		raw, ok := row[key]
+		if !ok {
+			continue
+		}
+
+		var value float64
+		switch raw := raw.(type) {
+		case float64:
+			value = raw
+		case int:
+			value = float64(raw)
+		default:
+			return false, false
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return false, false
+		}
+
+		switch {
+		case bound.Min != nil && value < *bound.Min:
+			value = *bound.Min
+		case bound.Max != nil && value > *bound.Max:
+			value = *bound.Max
+		default:
+			continue
+		}
+		if bound.Reject {
+			return false, false
+		}
+		row[key] = value
+		clipped = true
+	}
+
+	return clipped, true
+}
@@ -106,6 +106,33 @@ func Preprocessing(result *map[string]interface{}, row map[string]interface{}, a
 	return nil
 }
 
+// asVector returns theta as a vector. A theta given by the querier is decoded
+// as a list of numbers, the integers of CBOR being decoded as int64 or uint64.
+func asVector(in interface{}) ([]float64, error) {
+	switch in := in.(type) {
+	case []float64:
+		return in, nil
+	case []interface{}:
+		vector := make([]float64, len(in))
+		for index, value := range in {
+			switch value := value.(type) {
+			case float64:
+				vector[index] = value
+			case int:
+				vector[index] = float64(value)
+			case int64:
+				vector[index] = float64(value)
+			case uint64:
+				vector[index] = float64(value)
+			default:
+				return nil, errors.ErrInvalidKey
+			}
+		}
+		return vector, nil
+	}
+	return nil, errors.ErrInvalidKey
+}
+
 // hypothesisFunction returns 1 /(1 + exp(-theta*features))
 func hypothesisFunction(theta []float64, features mat.Matrix) float64 {
 	out := 0.0
@@ -116,17 +143,52 @@ func hypothesisFunction(theta []float64, features mat.Matrix) float64 {
 	return 1 / out
 }
 
+// gradientScale returns the factor bringing the norm of the contribution of a
+// row to the gradient down to max_norm, if it is set as arg. A single row
+// cannot steer the gradient this way.
+func gradientScale(residual float64, features mat.Matrix, args map[string]interface{}) (float64, error) {
+
+	if _, ok := args["max_norm"]; !ok {
+		return 1, nil
+	}
+	maxNorm, err := aggregations.AsFloat64(args["max_norm"])
+	if err != nil {
+		return 0, err
+	}
+	if maxNorm <= 0 {
+		return 0, errors.ErrInvalidMaxNorm
+	}
+
+	lenFeatures, _ := features.Dims()
+	norm := 0.0
+	for i := 0; i < lenFeatures; i++ {
+		norm = norm + math.Pow(residual*features.At(i, 0), 2)
+	}
+	norm = math.Sqrt(norm)
+
+	if norm <= maxNorm {
+		return 1, nil
+	}
+	return maxNorm / norm, nil
+}
+
 // LogisticRegressionMap returns Gradient (Resp. & Hessian) to compute SGD (Resp. Newton-Raphson)
 // Inspired from https://papers.nips.cc/paper/3150-map-reduce-for-machine-learning-on-multicore.pdf
 // and https://www.internalpointers.com/post/cost-function-logistic-regression
 // In both case, gradient should be computed on the data received by the mapper
+// With max_norm as arg, the contribution of each row to the gradient is
+// clipped, and the number of clipped rows is given in clipped_gradients.
 func LogisticRegressionMap(result *map[string]interface{}, row map[string]interface{}, args map[string]interface{}) error {
 
 	if err := aggregations.NeedArgs(args, "optimize"); err != nil {
 		return err
 	}
 
-	features := row["features"].(mat.Matrix)
+	// The rows are given by preprocess
+	features, ok := row["features"].(mat.Matrix)
+	if !ok {
+		return errors.ErrKeyNotFound
+	}
 	lenFeatures, _ := features.Dims()
 
 	// Check if the parameters of the Logistic Regression are set as args
@@ -140,7 +202,11 @@ func LogisticRegressionMap(result *map[string]interface{}, row map[string]interf
 		}
 		(*result)["theta"] = theta
 	} else {
-		theta = args["theta"].([]float64)
+		var err error
+		theta, err = asVector(args["theta"])
+		if err != nil {
+			return err
+		}
 		if len(theta) != lenFeatures {
 			return errors.ErrLengthConsistency
 		}
@@ -161,11 +227,24 @@ func LogisticRegressionMap(result *map[string]interface{}, row map[string]interf
 	}
 	prediction := hypothesisFunction(theta, features)
 
+	// The contribution of the row to the gradient can be clipped
+	scale, err := gradientScale(truth-prediction, features, args)
+	if err != nil {
+		return err
+	}
+	if _, ok := args["max_norm"]; ok {
+		clipped, _ := (*result)["clipped_gradients"].(float64)
+		if scale < 1 {
+			clipped = clipped + 1
+		}
+		(*result)["clipped_gradients"] = clipped
+	}
+
 	// Compute gradient and hessian (if Newton Raphson method is chosen)
 	i := 0
 	for i < lenFeatures {
 		j := i // hessian is symmetric
-		(*result)["gradient"].([]float64)[i] = (*result)["gradient"].([]float64)[i] + (truth-prediction)*features.At(i, 0)
+		(*result)["gradient"].([]float64)[i] = (*result)["gradient"].([]float64)[i] + scale*(truth-prediction)*features.At(i, 0)
 		for args["optimize"].(string) == "nr" && j < lenFeatures {
 			value := (*result)["hessian"].(map[[2]int]float64)[[2]int{i, j}] + prediction*(prediction-1)*features.At(i, 0)*features.At(j, 0)
 			(*result)["hessian"].(map[[2]int]float64)[[2]int{i, j}] = value
@@ -192,6 +271,16 @@ func LogisticRegressionReduce(result *map[string]interface{}, row map[string]int
 		(*result)["hessian"] = make(map[[2]int]float64)
 	}
 
+	// sum up the number of clipped gradients, if they have been clipped
+	if _, ok := row["clipped_gradients"]; ok {
+		clipped, err := aggregations.AsFloat64(row["clipped_gradients"])
+		if err != nil {
+			return err
+		}
+		previous, _ := (*result)["clipped_gradients"].(float64)
+		(*result)["clipped_gradients"] = previous + clipped
+	}
+
 	// sum up gradient and hessian
 	i := 0
 	for i < len(row["gradient"].([]float64)) {
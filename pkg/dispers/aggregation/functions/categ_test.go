@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"gonum.org/v1/gonum/mat"
 )
 
 func TestPreprocessing(t *testing.T) {
@@ -74,3 +75,49 @@ func TestPreprocessing(t *testing.T) {
 	*/
 
 }
+
+func TestClippedGradient(t *testing.T) {
+
+	args := map[string]interface{}{
+		"optimize": "gd",
+		"theta":    []float64{0, 0},
+		"max_norm": 1.0,
+	}
+	rows := []map[string]interface{}{
+		{"features": mat.NewDense(2, 1, []float64{0.3, 0.4}), "truth": true},
+		{"features": mat.NewDense(2, 1, []float64{3000, 4000}), "truth": true},
+	}
+
+	results := make(map[string]interface{})
+	for _, row := range rows {
+		assert.NoError(t, LogisticRegressionMap(&results, row, args))
+	}
+	// The prediction is 0.5: the first row gives (0.15, 0.2), the second one
+	// is brought down to a norm of 1
+	gradient := results["gradient"].([]float64)
+	assert.InDelta(t, 0.75, gradient[0], 1e-9)
+	assert.InDelta(t, 1.0, gradient[1], 1e-9)
+	assert.Equal(t, 1.0, results["clipped_gradients"])
+
+	args["max_norm"] = 0.0
+	assert.Error(t, LogisticRegressionMap(&results, rows[0], args))
+}
+
+func TestGradientArgs(t *testing.T) {
+
+	row := map[string]interface{}{"features": mat.NewDense(2, 1, []float64{0.3, 0.4}), "truth": true}
+
+	// theta is decoded as a list of numbers when it is given by the querier
+	results := make(map[string]interface{})
+	args := map[string]interface{}{"optimize": "gd", "theta": []interface{}{0.0, uint64(0)}}
+	assert.NoError(t, LogisticRegressionMap(&results, row, args))
+	gradient := results["gradient"].([]float64)
+	assert.InDelta(t, 0.15, gradient[0], 1e-9)
+
+	args["theta"] = []interface{}{"0", "0"}
+	assert.Error(t, LogisticRegressionMap(&results, row, args))
+
+	// The features are given by preprocess
+	args["theta"] = []float64{0, 0}
+	assert.Error(t, LogisticRegressionMap(&results, map[string]interface{}{"truth": true}, args))
+}
@@ -0,0 +1,66 @@
+package functions
+
+import (
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+)
+
+// Collect keeps every value of a key, for the estimators that need to sort
+// them. The values are saved under an intermediate key, which is never given
+// to the conductor.
+// - key : Value to collect. The specified key should be one of the keys from Data.
+func Collect(result *map[string]interface{}, row map[string]interface{}, args map[string]interface{}) error {
+
+	key := args["key"].(string)
+
+	value, err := aggregations.AsFloat64(row[key])
+	if err != nil {
+		return err
+	}
+
+	values, _ := (*result)["_values_"+key].([]float64)
+	(*result)["_values_"+key] = append(values, value)
+
+	return nil
+}
+
+// GroupSums sums the values of a key in several groups. The rows have been
+// shuffled, they are dealt to the groups in turn.
+// - key : Value on which compute the sums. The specified key should be one of the keys from Data.
+// - groups : Number of groups
+func GroupSums(result *map[string]interface{}, row map[string]interface{}, args map[string]interface{}) error {
+
+	key := args["key"].(string)
+
+	groups, err := aggregations.AsFloat64(args["groups"])
+	if err != nil {
+		return err
+	}
+	if groups < 1 {
+		return errors.ErrInvalidGroups
+	}
+
+	value, err := aggregations.AsFloat64(row[key])
+	if err != nil {
+		return err
+	}
+
+	sums, ok := (*result)["_group_sums_"+key].([]float64)
+	lengths, _ := (*result)["_group_lengths_"+key].([]float64)
+	if !ok {
+		sums = make([]float64, int(groups))
+		lengths = make([]float64, int(groups))
+		(*result)["_group_sums_"+key] = sums
+		(*result)["_group_lengths_"+key] = lengths
+	}
+
+	seen := 0.0
+	for _, length := range lengths {
+		seen = seen + length
+	}
+	group := int(seen) % len(sums)
+	sums[group] = sums[group] + value
+	lengths[group] = lengths[group] + 1
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package patches
+
+import (
+	"sort"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+)
+
+// TrimmedMean computes the mean of the values collected for a key, without
+// the lowest and the highest ones. The number of trimmed values is given.
+func TrimmedMean(results *map[string]interface{}, args map[string]interface{}) error {
+
+	key := args["key"].(string)
+
+	trim, err := aggregations.AsFloat64(args["trim"])
+	if err != nil {
+		return err
+	}
+	if trim < 0 || trim >= 0.5 {
+		return errors.ErrInvalidTrim
+	}
+
+	values, _ := (*results)["_values_"+key].([]float64)
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	// The same fraction of values is removed at both ends
+	trimmed := int(trim * float64(len(sorted)))
+	kept := sorted[trimmed : len(sorted)-trimmed]
+
+	if len(kept) == 0 {
+		return errors.ErrNotEnoughDataToComputeQuery
+	}
+	sum := 0.0
+	for _, value := range kept {
+		sum = sum + value
+	}
+
+	(*results)["trimmed_mean_"+key] = sum / float64(len(kept))
+	(*results)["trimmed_rows_"+key] = 2 * trimmed
+	return nil
+}
+
+// MedianOfMeans computes the median of the means of the groups of values of
+// a key. A few absurd values only spoil the means of a few groups.
+func MedianOfMeans(results *map[string]interface{}, args map[string]interface{}) error {
+
+	key := args["key"].(string)
+
+	sums, _ := (*results)["_group_sums_"+key].([]float64)
+	lengths, _ := (*results)["_group_lengths_"+key].([]float64)
+
+	means := []float64{}
+	for group := range sums {
+		if lengths[group] > 0 {
+			means = append(means, sums[group]/lengths[group])
+		}
+	}
+	sort.Float64s(means)
+
+	if len(means) == 0 {
+		return errors.ErrNotEnoughDataToComputeQuery
+	}
+	median := means[len(means)/2]
+	if len(means)%2 == 0 {
+		median = (means[len(means)/2-1] + median) / 2
+	}
+
+	(*results)["median_of_means_"+key] = median
+	return nil
+}
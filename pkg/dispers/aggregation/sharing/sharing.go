@@ -0,0 +1,290 @@
+// Package sharing splits the values computed over the rows of data into
+// additive shares over a finite field. Each Data Aggregator of a layer with
+// secret sharing receives one share of every value and sums its shares: no
+// Data Aggregator learns an individual value, and only the sum of the shares
+// of every Data Aggregator reveals the aggregate.
+package sharing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+)
+
+// Modulus is the prime 2^61-1. The shares are elements of the field of the
+// integers modulo Modulus.
+const Modulus uint64 = 1<<61 - 1
+
+// Precision is the number of bits of the fractional part of the values. The
+// absolute value of an aggregate has to stay below 2^(60-Precision).
+const Precision = 20
+
+var scale = math.Ldexp(1, Precision)
+
+// limit is the bound of the absolute value of an aggregate: beyond it, the
+// sum of the shares wraps around the field.
+var limit = math.Ldexp(1, 60-Precision)
+
+// magnitudeKey holds the magnitude of the rows. It is shared with the values,
+// and checked by Reveal before it decodes the aggregate.
+const magnitudeKey = "_magnitude"
+
+// Share holds one share of every value of a row, or of an aggregate. Vectors
+// and matrices are flattened: "gradient[3]", "hessian[1,2]".
+type Share map[string]uint64
+
+// encode converts a value to a fixed-point element of the field. The
+// negative values are the upper half of the field.
+func encode(value float64) (uint64, error) {
+	v := math.Round(value * scale)
+	if math.IsNaN(v) || math.Abs(v) >= float64(Modulus/2) {
+		return 0, errors.WrapErrors(errors.ErrShareOverflow, "")
+	}
+	if v < 0 {
+		return Modulus - uint64(-v), nil
+	}
+	return uint64(v), nil
+}
+
+func decode(v uint64) float64 {
+	if v > Modulus/2 {
+		return -float64(Modulus-v) / scale
+	}
+	return float64(v) / scale
+}
+
+// add returns a+b in the field. a and b are lower than 2^61, their sum does
+// not overflow.
+func add(a, b uint64) uint64 {
+	return (a + b) % Modulus
+}
+
+// random returns an element of the field chosen uniformly
+func random() (uint64, error) {
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		// Modulus is also the mask of the 61 lower bits
+		if v := binary.BigEndian.Uint64(buf[:]) & Modulus; v < Modulus {
+			return v, nil
+		}
+	}
+}
+
+// Flatten returns every value of the contribution of a row. The values are
+// numbers, vectors ([]float64) and sparse matrices (map[[2]int]float64).
+func Flatten(contribution map[string]interface{}) (map[string]float64, error) {
+	values := make(map[string]float64)
+	for key, value := range contribution {
+		switch value := value.(type) {
+		case float64:
+			values[key] = value
+		case int:
+			values[key] = float64(value)
+		case []float64:
+			for i, v := range value {
+				values[key+"["+strconv.Itoa(i)+"]"] = v
+			}
+		case map[[2]int]float64:
+			for ij, v := range value {
+				values[key+"["+strconv.Itoa(ij[0])+","+strconv.Itoa(ij[1])+"]"] = v
+			}
+		default:
+			return nil, errors.WrapErrors(errors.ErrJobNotShareable, key)
+		}
+	}
+	return values, nil
+}
+
+// Magnitude is the sum of the absolute values of the rows split by a Target,
+// rounded up. Every value of an aggregate is lower than the magnitude of its
+// rows: it is shared as an integer along with the rows, so that Reveal can
+// tell whether a sum has wrapped around the field.
+type Magnitude float64
+
+// Split splits every value of the contribution of a row into n shares. The
+// n-1 first shares are random, the last one completes the sum.
+func Split(contribution map[string]interface{}, n int) ([]Share, error) {
+	var m Magnitude
+	return m.Split(contribution, n)
+}
+
+// Split splits the contribution of a row like the Split function, and adds the
+// magnitude of the row to m. It returns ErrShareOverflow once the rows split
+// by this Target are enough to wrap the sum around the field.
+func (m *Magnitude) Split(contribution map[string]interface{}, n int) ([]Share, error) {
+
+	if n < 2 {
+		return nil, errors.WrapErrors(errors.ErrInvalidShare, "")
+	}
+
+	values, err := Flatten(contribution)
+	if err != nil {
+		return nil, err
+	}
+
+	magnitude := 0.0
+	for _, value := range values {
+		magnitude += math.Ceil(math.Abs(value))
+	}
+	if math.IsNaN(magnitude) || float64(*m)+magnitude >= limit {
+		return nil, errors.WrapErrors(errors.ErrShareOverflow, "")
+	}
+	*m += Magnitude(magnitude)
+
+	shares := make([]Share, n)
+	for index := range shares {
+		shares[index] = make(Share, len(values)+1)
+	}
+	for key, value := range values {
+		v, err := encode(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := splitValue(shares, key, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := splitValue(shares, magnitudeKey, uint64(magnitude)); err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+// splitValue splits an element of the field into the shares. The n-1 first
+// shares are random, the last one completes the sum.
+func splitValue(shares []Share, key string, v uint64) error {
+	last := v
+	for index := 0; index < len(shares)-1; index++ {
+		r, err := random()
+		if err != nil {
+			return err
+		}
+		shares[index][key] = r
+		last = add(last, Modulus-r)
+	}
+	shares[len(shares)-1][key] = last
+	return nil
+}
+
+// Add adds another share to this one
+func (s Share) Add(other Share) {
+	for key, v := range other {
+		s[key] = add(s[key], v)
+	}
+}
+
+// Reveal decodes the sum of the shares of every Data Aggregator. It gives the
+// aggregate back, with its vectors and matrices. It returns ErrShareOverflow
+// if the magnitude of the rows is too large for the values to be right.
+func Reveal(s Share) (map[string]interface{}, error) {
+
+	if magnitude, ok := s[magnitudeKey]; ok && float64(magnitude) >= limit {
+		return nil, errors.WrapErrors(errors.ErrShareOverflow, "")
+	}
+
+	values := make(map[string]float64, len(s))
+	for key, v := range s {
+		if key == magnitudeKey {
+			continue
+		}
+		values[key] = decode(v)
+	}
+	return Unflatten(values)
+}
+
+// Unflatten is the reverse of Flatten: it gathers the vectors and the
+// matrices back.
+func Unflatten(values map[string]float64) (map[string]interface{}, error) {
+
+	out := make(map[string]interface{})
+	for key, value := range values {
+		open := strings.Index(key, "[")
+		if open == -1 {
+			out[key] = value
+			continue
+		}
+		if !strings.HasSuffix(key, "]") {
+			return nil, errors.WrapErrors(errors.ErrInvalidShare, key)
+		}
+
+		name := key[:open]
+		indexes := []int{}
+		for _, str := range strings.Split(key[open+1:len(key)-1], ",") {
+			index, err := strconv.Atoi(str)
+			if err != nil || index < 0 {
+				return nil, errors.WrapErrors(errors.ErrInvalidShare, key)
+			}
+			indexes = append(indexes, index)
+		}
+
+		switch len(indexes) {
+		case 1:
+			vector, _ := out[name].([]float64)
+			for len(vector) <= indexes[0] {
+				vector = append(vector, 0)
+			}
+			vector[indexes[0]] = value
+			out[name] = vector
+		case 2:
+			matrix, ok := out[name].(map[[2]int]float64)
+			if !ok {
+				matrix = make(map[[2]int]float64)
+				out[name] = matrix
+			}
+			matrix[[2]int{indexes[0], indexes[1]}] = value
+		default:
+			return nil, errors.WrapErrors(errors.ErrInvalidShare, key)
+		}
+	}
+
+	return out, nil
+}
+
+// Format returns the share with its values as decimal strings: the results of
+// the Data Aggregators are saved as JSON documents, whose numbers cannot hold
+// the elements of the field without losing precision.
+func (s Share) Format() map[string]string {
+	out := make(map[string]string, len(s))
+	for key, v := range s {
+		out[key] = strconv.FormatUint(v, 10)
+	}
+	return out
+}
+
+// Parse reads a share written by Format, once it has been decoded as JSON
+func Parse(in interface{}) (Share, error) {
+
+	strs := make(map[string]string)
+	switch in := in.(type) {
+	case map[string]string:
+		strs = in
+	case map[string]interface{}:
+		for key, value := range in {
+			str, ok := value.(string)
+			if !ok {
+				return nil, errors.WrapErrors(errors.ErrInvalidShare, key)
+			}
+			strs[key] = str
+		}
+	default:
+		return nil, errors.WrapErrors(errors.ErrInvalidShare, "")
+	}
+
+	s := make(Share, len(strs))
+	for key, str := range strs {
+		v, err := strconv.ParseUint(str, 10, 64)
+		if err != nil || v >= Modulus {
+			return nil, errors.WrapErrors(errors.ErrInvalidShare, key)
+		}
+		s[key] = v
+	}
+	return s, nil
+}
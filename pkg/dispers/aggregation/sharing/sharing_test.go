@@ -0,0 +1,115 @@
+package sharing
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAndReveal(t *testing.T) {
+
+	contribution := map[string]interface{}{
+		"sum_amount": -1250.75,
+		"length":     3,
+		"gradient":   []float64{0.5, -0.25, 2},
+		"hessian":    map[[2]int]float64{{0, 0}: -0.125, {0, 1}: 4},
+	}
+
+	shares, err := Split(contribution, 3)
+	assert.NoError(t, err)
+	assert.Len(t, shares, 3)
+
+	// A single share tells nothing about the value
+	assert.NotEqual(t, -1250.75, decode(shares[0]["sum_amount"]))
+
+	total := make(Share)
+	for _, share := range shares {
+		total.Add(share)
+	}
+	revealed, err := Reveal(total)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"sum_amount": -1250.75,
+		"length":     3.0,
+		"gradient":   []float64{0.5, -0.25, 2},
+		"hessian":    map[[2]int]float64{{0, 0}: -0.125, {0, 1}: 4},
+	}, revealed)
+
+	_, err = Split(contribution, 1)
+	assert.Error(t, err)
+	_, err = Split(map[string]interface{}{"label": "shop"}, 3)
+	assert.Error(t, err)
+	_, err = Split(map[string]interface{}{"sum_amount": 1e13}, 3)
+	assert.Error(t, err)
+}
+
+func TestSumOfShares(t *testing.T) {
+
+	// Every Data Aggregator sums its shares of the rows
+	values := []float64{1.5, -3.25, 10, 0.125}
+	aggregators := []Share{make(Share), make(Share)}
+	for _, value := range values {
+		shares, err := Split(map[string]interface{}{"sum_x": value}, len(aggregators))
+		assert.NoError(t, err)
+		for index, share := range shares {
+			aggregators[index].Add(share)
+		}
+	}
+
+	total := make(Share)
+	for _, share := range aggregators {
+		total.Add(share)
+	}
+	revealed, err := Reveal(total)
+	assert.NoError(t, err)
+	assert.InDelta(t, 8.375, revealed["sum_x"], 1e-6)
+}
+
+func TestFormatAndParse(t *testing.T) {
+
+	shares, err := Split(map[string]interface{}{"sum_x": 42.0}, 2)
+	assert.NoError(t, err)
+
+	// The shares go through the JSON documents of the Conductor
+	buf, err := json.Marshal(map[string]interface{}{"shares": shares[0].Format()})
+	assert.NoError(t, err)
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf, &doc))
+
+	parsed, err := Parse(doc["shares"])
+	assert.NoError(t, err)
+	assert.Equal(t, shares[0], parsed)
+
+	_, err = Parse(map[string]interface{}{"sum_x": 12.0})
+	assert.Error(t, err)
+	_, err = Parse(map[string]string{"sum_x": "2305843009213693951"})
+	assert.Error(t, err)
+}
+
+func TestOverflow(t *testing.T) {
+
+	// The rows of a Target cannot wrap the sum around the field
+	var magnitude Magnitude
+	row := map[string]interface{}{"sum_x": 6e11}
+	_, err := magnitude.Split(row, 2)
+	assert.NoError(t, err)
+	_, err = magnitude.Split(row, 2)
+	assert.Error(t, err)
+
+	// Neither can the rows of several Targets
+	aggregators := []Share{make(Share), make(Share)}
+	for target := 0; target < 2; target++ {
+		shares, err := Split(row, len(aggregators))
+		assert.NoError(t, err)
+		for index, share := range shares {
+			aggregators[index].Add(share)
+		}
+	}
+	total := make(Share)
+	for _, share := range aggregators {
+		total.Add(share)
+	}
+	_, err = Reveal(total)
+	assert.Error(t, err)
+}
@@ -0,0 +1,321 @@
+package audit
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	doctypeAudit = "io.cozy.dispers.audit"
+
+	// EventQueryStarted is recorded when the targets of a query have been
+	// selected, right before they are queried
+	EventQueryStarted = "query_started"
+	// EventQueryEnded is recorded when a query ends, whatever its outcome
+	EventQueryEnded = "query_ended"
+
+	// OutcomeFinished means that the query has returned its results
+	OutcomeFinished = "finished"
+	// OutcomeDeleted means that the query has been deleted by its querier
+	OutcomeDeleted = "deleted"
+	// OutcomeFailed means that the query has ended with an error
+	OutcomeFailed = "failed"
+	// OutcomeAbandoned means that the query has not ended before the
+	// running queries are forgotten
+	OutcomeAbandoned = "abandoned"
+
+	// the IDs of the entries are their zero-padded indexes, so that the chain
+	// is sorted by ID and an index cannot be used twice
+	idLength = 16
+)
+
+var (
+	// PrefixerC is exported to easilly pass in dev-mode
+	PrefixerC = prefixer.ConductorPrefixer
+
+	// SigningKey signs the hash of every entry. It is kept out of the
+	// database, so that whoever can write in the database cannot rewrite the
+	// chain without the signatures being broken.
+	SigningKey *ecdsa.PrivateKey
+)
+
+// Entry is a link of the audit chain saved in the Conductor's database. Each
+// entry contains the hash of the previous one, so that an entry cannot be
+// modified or removed without breaking the chain.
+type Entry struct {
+	EntryID       string                 `json:"_id,omitempty"`
+	EntryRev      string                 `json:"_rev,omitempty"`
+	Index         int                    `json:"index"`
+	Date          time.Time              `json:"date"`
+	Event         string                 `json:"event"`
+	QueryID       string                 `json:"query_id"`
+	Querier       string                 `json:"querier,omitempty"`
+	IsEncrypted   bool                   `json:"encrypted,omitempty"`
+	Concepts      [][]byte               `json:"concepts,omitempty"`
+	TargetProfile string                 `json:"target_profile,omitempty"`
+	Doctype       string                 `json:"doctype,omitempty"`
+	Selector      map[string]interface{} `json:"selector,omitempty"`
+	Jobs          []string               `json:"jobs,omitempty"`
+	TargetCount   int                    `json:"target_count,omitempty"`
+	Outcome       string                 `json:"outcome,omitempty"`
+	PreviousHash  string                 `json:"previous_hash,omitempty"`
+	Hash          string                 `json:"hash"`
+	Signature     []byte                 `json:"signature,omitempty"`
+}
+
+// ID returns the EntryID
+func (e *Entry) ID() string {
+	return e.EntryID
+}
+
+// Rev returns the doc's version
+func (e *Entry) Rev() string {
+	return e.EntryRev
+}
+
+// DocType returns the doctype
+func (e *Entry) DocType() string {
+	return doctypeAudit
+}
+
+// Clone copy a brand new version of the doc
+func (e *Entry) Clone() couchdb.Doc {
+	cloned := *e
+	cloned.Concepts = append([][]byte{}, e.Concepts...)
+	cloned.Jobs = append([]string{}, e.Jobs...)
+	return &cloned
+}
+
+// SetID set the EntryID
+func (e *Entry) SetID(id string) {
+	e.EntryID = id
+}
+
+// SetRev set the doc's version
+func (e *Entry) SetRev(rev string) {
+	e.EntryRev = rev
+}
+
+func entryID(index int) string {
+	return fmt.Sprintf("%0*d", idLength, index)
+}
+
+// ComputeHash returns the hash of the entry. It covers every field except the
+// hash itself, its signature and the CouchDB's metadata.
+func (e *Entry) ComputeHash() (string, error) {
+	hashed := *e
+	hashed.EntryID = ""
+	hashed.EntryRev = ""
+	hashed.Hash = ""
+	hashed.Signature = nil
+	data, err := json.Marshal(hashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastEntry returns the last entry of the chain, or nil if the chain is empty
+func lastEntry() (*Entry, error) {
+	var entries []*Entry
+	req := &couchdb.AllDocsRequest{
+		Descending: true,
+		Limit:      1,
+		StartKey:   strings.Repeat("9", idLength),
+	}
+	if err := couchdb.GetAllDocs(PrefixerC, doctypeAudit, req, &entries); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return entries[0], nil
+}
+
+// Append adds an entry at the end of the chain
+func Append(e *Entry) error {
+
+	mu := lock.ReadWrite(PrefixerC, "dispers/audit")
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	last, err := lastEntry()
+	if err != nil {
+		return err
+	}
+
+	e.Index = 0
+	e.PreviousHash = ""
+	if last != nil {
+		e.Index = last.Index + 1
+		e.PreviousHash = last.Hash
+	}
+	e.Date = time.Now().UTC()
+	e.EntryID = ""
+	e.EntryRev = ""
+	e.Hash, err = e.ComputeHash()
+	if err != nil {
+		return err
+	}
+	if SigningKey != nil {
+		if e.Signature, err = sign(SigningKey, e.Hash); err != nil {
+			return err
+		}
+	}
+
+	e.SetID(entryID(e.Index))
+	return couchdb.CreateNamedDocWithDB(PrefixerC, e)
+}
+
+// Export returns the entries of the chain starting at index since. limit is
+// the maximal number of entries returned, 0 meaning no limit.
+func Export(since, limit int) ([]*Entry, error) {
+
+	entries := []*Entry{}
+	req := &couchdb.AllDocsRequest{
+		Limit:    limit,
+		StartKey: entryID(since),
+		EndKey:   strings.Repeat("9", idLength),
+	}
+	if err := couchdb.GetAllDocs(PrefixerC, doctypeAudit, req, &entries); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Verify checks the integrity of a part of the chain, as exported. The first
+// entry is trusted to link to the previous ones, which can be checked by
+// verifying the whole chain. With the public key of the Conductor, every entry
+// has to be signed, and the first one cannot be forged either.
+func Verify(entries []*Entry, key *ecdsa.PublicKey) error {
+
+	for i, e := range entries {
+
+		hash, err := e.ComputeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("audit: entry %d has been modified", e.Index)
+		}
+		if key != nil && !verifySignature(key, e.Hash, e.Signature) {
+			return fmt.Errorf("audit: entry %d is not signed by the Conductor", e.Index)
+		}
+
+		if i == 0 {
+			if e.Index == 0 && e.PreviousHash != "" {
+				return fmt.Errorf("audit: entry 0 should not have a previous hash")
+			}
+			continue
+		}
+
+		previous := entries[i-1]
+		if e.Index != previous.Index+1 {
+			return fmt.Errorf("audit: entries between %d and %d are missing", previous.Index, e.Index)
+		}
+		if e.PreviousHash != previous.Hash {
+			return fmt.Errorf("audit: entry %d is not linked to entry %d", e.Index, previous.Index)
+		}
+	}
+
+	return nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// sign returns the signature of the hash of an entry
+func sign(key *ecdsa.PrivateKey, hash string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(hash))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+func verifySignature(key *ecdsa.PublicKey, hash string, signature []byte) bool {
+	var sig ecdsaSignature
+	if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) > 0 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(hash))
+	return ecdsa.Verify(key, sum[:], sig.R, sig.S)
+}
+
+// LoadSigningKey reads the ECDSA private key signing the entries from a PEM
+// file
+func LoadSigningKey(filename string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("audit: no PEM block in the signing key")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("audit: the signing key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// MarshalPublicKey returns the public key verifying the entries, PEM encoded
+func MarshalPublicKey(key *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePublicKey reads a PEM encoded public key verifying the entries
+func ParsePublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("audit: no PEM block in the public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("audit: the public key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
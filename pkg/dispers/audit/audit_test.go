@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeChain(t *testing.T, size int) []*Entry {
+	entries := []*Entry{}
+	previous := ""
+	for i := 0; i < size; i++ {
+		e := &Entry{
+			Index:        i,
+			Date:         time.Now().UTC(),
+			Event:        EventQueryStarted,
+			QueryID:      "fakequeryid",
+			Concepts:     [][]byte{[]byte("hash")},
+			Selector:     map[string]interface{}{"amount": map[string]interface{}{"$gt": 10}},
+			TargetCount:  i,
+			PreviousHash: previous,
+		}
+		hash, err := e.ComputeHash()
+		assert.NoError(t, err)
+		e.Hash = hash
+		previous = hash
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestVerify(t *testing.T) {
+
+	entries := makeChain(t, 4)
+	assert.NoError(t, Verify(entries, nil))
+	assert.NoError(t, Verify(entries[2:], nil))
+
+	// The hashes do not depend on the export
+	data, err := json.Marshal(entries)
+	assert.NoError(t, err)
+	var exported []*Entry
+	assert.NoError(t, json.Unmarshal(data, &exported))
+	assert.NoError(t, Verify(exported, nil))
+
+	// An entry has been removed
+	assert.Error(t, Verify(append([]*Entry{entries[0]}, entries[2:]...), nil))
+
+	// An entry has been modified
+	entries[1].TargetCount = 1000
+	assert.Error(t, Verify(entries, nil))
+
+	// An entry has been modified and its hash recomputed
+	entries[1].Hash, _ = entries[1].ComputeHash()
+	assert.Error(t, Verify(entries, nil))
+}
+
+func TestVerifySigned(t *testing.T) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	entries := makeChain(t, 3)
+	for _, e := range entries {
+		e.Signature, err = sign(key, e.Hash)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, Verify(entries, &key.PublicKey))
+
+	pem, err := MarshalPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	parsed, err := ParsePublicKey(pem)
+	assert.NoError(t, err)
+	assert.NoError(t, Verify(entries[1:], parsed))
+
+	// The whole chain has been rewritten without the signing key
+	rewritten := makeChain(t, 3)
+	rewritten[1].TargetCount = 1000
+	assert.NoError(t, Verify(rewritten, nil))
+	assert.Error(t, Verify(rewritten, &key.PublicKey))
+}
@@ -0,0 +1,150 @@
+package enclave
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+)
+
+var (
+	// CatalogueEpsilon is the privacy budget of the subscriber counts given in
+	// the catalogue. The smaller it is, the noisier the counts are.
+	CatalogueEpsilon = 1.0
+
+	// CatalogueKey makes the noise of a count unpredictable, but stable as
+	// long as the count does not change, so that it cannot be averaged out by
+	// asking the catalogue again and again. It is held in the vault: a new
+	// key would draw a new noise for every count.
+	CatalogueKey []byte
+)
+
+// CatalogueEntry is a concept of the catalogue, as seen by the queriers
+type CatalogueEntry struct {
+	query.ConceptInfo
+	Subscribers int `json:"subscribers"`
+}
+
+// ConceptNode is a concept of the catalogue with its children in the hierarchy
+// of concepts
+type ConceptNode struct {
+	CatalogueEntry
+	Children []*ConceptNode `json:"children,omitempty"`
+}
+
+// laplaceNoise returns a sample of the Laplace distribution of scale 1/epsilon,
+// drawn from the hash of the given seed
+func laplaceNoise(seed []byte, epsilon float64) float64 {
+	mac := hmac.New(sha256.New, CatalogueKey)
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+
+	// u is uniform in (-0.5, 0.5)
+	u := (float64(binary.BigEndian.Uint64(sum[:8])>>11)+0.5)/(1<<53) - 0.5
+	return -math.Copysign(1/epsilon, u) * math.Log(1-2*math.Abs(u))
+}
+
+// noisyCount adds noise to the number of subscribers of a concept. Adding or
+// removing one instance changes a count by 1, which is the sensitivity of the
+// Laplace mechanism.
+func noisyCount(hash []byte, count int) int {
+	seed := append(append([]byte{}, hash...), []byte(strconv.Itoa(count))...)
+	noisy := int(math.Round(float64(count) + laplaceNoise(seed, CatalogueEpsilon)))
+	if noisy < 0 {
+		return 0
+	}
+	return noisy
+}
+
+// ConceptCatalogue lists the concepts whose name starts with prefix, with a
+// noisy number of subscribers. Neither the salts nor the hashes of the
+// concepts are given.
+func ConceptCatalogue(prefix string) ([]CatalogueEntry, error) {
+
+	if len(CatalogueKey) == 0 {
+		return nil, errors.WrapErrors(errors.ErrNoCatalogueKey, "")
+	}
+
+	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
+	ci.DefineDispersActor("concepts")
+	ci.URL.RawQuery = url.Values{"prefix": {prefix}}.Encode()
+	if err := ci.MakeRequest("GET", "", nil, nil); err != nil {
+		return nil, err
+	}
+	var infos []query.ConceptInfo
+	if err := json.Unmarshal(ci.Out, &infos); err != nil {
+		return nil, err
+	}
+
+	entries := make([]CatalogueEntry, len(infos))
+	for index, info := range infos {
+		count := 0
+		docs, err := retrieveConceptSubscribeDoc(info.Hash, info.PreviousHash)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) == 1 {
+			if count, err = countSubscribers(&docs[0]); err != nil {
+				return nil, err
+			}
+		}
+		entries[index].Subscribers = noisyCount(info.Hash, count)
+		info.Hash = nil
+		info.PreviousHash = nil
+		entries[index].ConceptInfo = info
+	}
+
+	return entries, nil
+}
+
+// ConceptSubtree returns the concept and its descendants as a tree. The
+// concept does not have to exist to be the root of the tree: its node is
+// then only named.
+func ConceptSubtree(concept string) (*ConceptNode, error) {
+
+	entries, err := ConceptCatalogue(concept)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	root := &ConceptNode{}
+	root.Name = concept
+	nodes := map[string]*ConceptNode{concept: root}
+	for _, entry := range entries {
+		if entry.Name == concept {
+			root.CatalogueEntry = entry
+			continue
+		}
+		// The catalogue gives "travailleur" for the prefix "travail"
+		if !query.IsDescendant(entry.Name, concept) {
+			continue
+		}
+
+		// Attach the node to its closest existing ancestor. Parents are
+		// sorted before their children.
+		node := &ConceptNode{CatalogueEntry: entry}
+		parent := root
+		ancestors := query.ConceptAncestors(entry.Name)
+		for index := len(ancestors) - 1; index >= 0; index-- {
+			if found, ok := nodes[ancestors[index]]; ok {
+				parent = found
+				break
+			}
+		}
+		parent.Children = append(parent.Children, node)
+		nodes[entry.Name] = node
+	}
+
+	return root, nil
+}
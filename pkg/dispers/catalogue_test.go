@@ -0,0 +1,25 @@
+package enclave
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoisyCount(t *testing.T) {
+
+	hash := []byte("fakehash")
+
+	// The noise does not change while the count does not change
+	assert.Equal(t, noisyCount(hash, 100), noisyCount(hash, 100))
+
+	assert.True(t, noisyCount(hash, 0) >= 0)
+
+	// The noise is centered on the real count
+	sum := 0
+	for i := 0; i < 10000; i++ {
+		sum += noisyCount([]byte("hash"+strconv.Itoa(i)), 1000)
+	}
+	assert.InDelta(t, 1000, float64(sum)/10000, 0.5)
+}
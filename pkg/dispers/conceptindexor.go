@@ -1,13 +1,21 @@
 package enclave
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/dispers/errors"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
@@ -17,16 +25,40 @@ const (
 	doctypeSalt = "io.cozy.hashconcept"
 )
 
-var PrefixerCI = prefixer.ConceptIndexorPrefixer
+var (
+	PrefixerCI = prefixer.ConceptIndexorPrefixer
+
+	// ConceptKey is the secret key of the Concept Indexor, held in the vault.
+	// The hashes of the concepts cannot be computed again without it, even
+	// with an access to the database.
+	ConceptKey []byte
+
+	// NextConceptKey is the key the concepts are re-keyed with by
+	// RotateConcepts. While it is set, the concepts are found with either
+	// key, and the new ones are created with the next key.
+	NextConceptKey []byte
+)
 
 // ConceptDoc is used to save a concept's salt into Concept Indexor's database
 // hash and salt are saved in byte to avoid string's to be interpreted
+// PreviousHash is only set while the keys are rotated. The name of the
+// concept is not saved in clear: the ID of the doc is a HMAC of the name, and
+// the name is encrypted for the catalogue.
 type ConceptDoc struct {
-	ConceptID  string `json:"_id,omitempty"`
-	ConceptRev string `json:"_rev,omitempty"`
-	Concept    string `json:"concept,omitempty"`
-	Hash       []byte `json:"hash,omitempty"`
-	Salt       []byte `json:"salt,omitempty"`
+	ConceptID     string    `json:"_id,omitempty"`
+	ConceptRev    string    `json:"_rev,omitempty"`
+	EncryptedName []byte    `json:"enc_name,omitempty"`
+	Hash          []byte    `json:"hash,omitempty"`
+	PreviousHash  []byte    `json:"previous_hash,omitempty"`
+	Salt          []byte    `json:"salt,omitempty"`
+	Description   string    `json:"description,omitempty"`
+	Owner         string    `json:"owner,omitempty"`
+	Tags          []string  `json:"tags,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// legacyName is the name of a concept saved in clear by a former
+	// version. It is encrypted when the concept is re-keyed.
+	legacyName string
 }
 
 // ID is used to get ID
@@ -47,6 +79,8 @@ func (t *ConceptDoc) DocType() string {
 // Clone is used to create another ConceptDoc from this ConceptDoc
 func (t *ConceptDoc) Clone() couchdb.Doc {
 	cloned := *t
+	cloned.Tags = append([]string{}, t.Tags...)
+	cloned.EncryptedName = append([]byte{}, t.EncryptedName...)
 	return &cloned
 }
 
@@ -60,17 +94,122 @@ func (t *ConceptDoc) SetRev(rev string) {
 	t.ConceptRev = rev
 }
 
-func createHash(str string) ([]byte, []byte, error) {
+// conceptKeys returns the keys a concept can be keyed with, the next key
+// first
+func conceptKeys() [][]byte {
+	keys := [][]byte{}
+	if len(NextConceptKey) > 0 {
+		keys = append(keys, NextConceptKey)
+	}
+	if len(ConceptKey) > 0 {
+		keys = append(keys, ConceptKey)
+	}
+	return keys
+}
+
+// writeKey returns the key the new concepts are keyed with
+func writeKey() ([]byte, error) {
+	keys := conceptKeys()
+	if len(keys) == 0 {
+		return nil, errors.WrapErrors(errors.ErrNoConceptKey, "")
+	}
+	return keys[0], nil
+}
+
+// deriveKey derives a key for the given usage from a key of the Concept
+// Indexor, so that a key is never used twice for different purposes
+func deriveKey(key []byte, usage string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(usage))
+	return mac.Sum(nil)
+}
+
+// conceptDocID returns the ID of the doc of a concept. The name of a concept
+// cannot be found from its ID without the key.
+func conceptDocID(key []byte, concept string) string {
+	mac := hmac.New(sha256.New, deriveKey(key, "id"))
+	mac.Write([]byte(concept))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sealName encrypts the name of a concept with AES-GCM
+func sealName(key []byte, concept string) ([]byte, error) {
+	block, err := aes.NewCipher(deriveKey(key, "name"))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := crypto.GenerateRandomBytes(gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, []byte(concept), nil), nil
+}
+
+// openName decrypts the name of a concept with the key it has been encrypted
+// with
+func openName(doc *ConceptDoc) (string, error) {
+	if len(doc.EncryptedName) == 0 && doc.legacyName != "" {
+		return doc.legacyName, nil
+	}
+	for _, key := range conceptKeys() {
+		block, err := aes.NewCipher(deriveKey(key, "name"))
+		if err != nil {
+			return "", err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return "", err
+		}
+		if len(doc.EncryptedName) < gcm.NonceSize() {
+			break
+		}
+		nonce := doc.EncryptedName[:gcm.NonceSize()]
+		name, err := gcm.Open(nil, nonce, doc.EncryptedName[gcm.NonceSize():], nil)
+		if err == nil {
+			return string(name), nil
+		}
+	}
+	return "", errors.WrapErrors(errors.ErrNoConceptKey, "")
+}
+
+// createHash computes a HMAC of the concept with the Concept Indexor's key.
+// The random salt makes the hash of a concept change each time it is created.
+func createHash(key []byte, str string) ([]byte, []byte, error) {
+
+	if len(key) == 0 {
+		return nil, nil, errors.WrapErrors(errors.ErrNoConceptKey, "")
+	}
 
 	salt := crypto.GenerateRandomBytes(defaultLenSalt)
 
-	h := sha256.New()
-	h.Write(append([]byte(str), salt...))
-	hash := h.Sum([]byte("concept"))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(append([]byte(str), salt...))
+	hash := mac.Sum(nil)
 
 	return hash, salt, nil
 }
 
+// newConceptDoc builds the doc of a concept keyed with the given key
+func newConceptDoc(key []byte, concept string) (*ConceptDoc, error) {
+
+	hash, salt, err := createHash(key, concept)
+	if err != nil {
+		return nil, err
+	}
+	name, err := sealName(key, concept)
+	if err != nil {
+		return nil, err
+	}
+	return &ConceptDoc{
+		ConceptID:     conceptDocID(key, concept),
+		EncryptedName: name,
+		Hash:          hash,
+		Salt:          salt,
+		CreatedAt:     time.Now(),
+	}, nil
+}
+
 func decryptConcept(in *query.Concept, isEncrypted bool) (string, error) {
 	var concept string
 
@@ -86,64 +225,106 @@ func decryptConcept(in *query.Concept, isEncrypted bool) (string, error) {
 	return concept, nil
 }
 
-func getHash(concept string) ([]byte, error) {
+// conceptDocs returns the docs of a concept: one, or two while the keys are
+// rotated, the doc keyed with the next key first. The docs saved by a former
+// version, until they are re-keyed, come last.
+func conceptDocs(concept string) ([]*ConceptDoc, error) {
+
+	docs := []*ConceptDoc{}
+	for _, key := range conceptKeys() {
+		doc := &ConceptDoc{}
+		err := couchdb.GetDoc(PrefixerCI, doctypeSalt, conceptDocID(key, concept), doc)
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
 
-	// Precise and run a mango query
-	hash := []byte{}
-	var out []ConceptDoc
-	req := &couchdb.FindRequest{Selector: mango.Equal("concept", concept)}
-	err := couchdb.FindDocs(PrefixerCI, doctypeSalt, req, &out)
+	legacy, err := legacyConceptDocs(concept)
 	if err != nil {
-		return hash, errors.WrapErrors(errors.ErrConceptNotFound, "")
+		return nil, err
+	}
+	return append(docs, legacy...), nil
+}
+
+// legacyConceptDocs returns the docs of a concept saved by a former version,
+// with a random ID and the name of the concept in clear
+func legacyConceptDocs(concept string) ([]*ConceptDoc, error) {
 
+	var out []struct {
+		ConceptDoc
+		Concept string `json:"concept"`
+	}
+	req := &couchdb.FindRequest{Selector: mango.Equal("concept", concept)}
+	if err := couchdb.FindDocs(PrefixerCI, doctypeSalt, req, &out); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	// Create a salt if no salt in the database for this concept
-	if len(out) == 1 {
-		hash = out[0].Hash
-	} else if len(out) == 0 {
-		return []byte{}, errors.WrapErrors(errors.ErrConceptNotFound, "")
-	} else {
-		return []byte{}, errors.WrapErrors(errors.ErrTooManyConceptDoc, "")
+	docs := make([]*ConceptDoc, len(out))
+	for index := range out {
+		docs[index] = &out[index].ConceptDoc
+		docs[index].legacyName = out[index].Concept
 	}
+	return docs, nil
+}
+
+func getConceptDoc(concept string) (*ConceptDoc, error) {
 
-	return hash, err
+	docs, err := conceptDocs(concept)
+	if err != nil || len(docs) == 0 {
+		return nil, errors.WrapErrors(errors.ErrConceptNotFound, "")
+	}
+	return docs[0], nil
 }
 
-func isConceptExisting(concept string) (bool, error) {
+func getHash(concept string) ([]byte, error) {
 
-	// Precise and run the mango query
-	var out []ConceptDoc
-	req := &couchdb.FindRequest{Selector: mango.Equal("concept", concept)}
-	err := couchdb.FindDocs(PrefixerCI, doctypeSalt, req, &out)
+	doc, err := getConceptDoc(concept)
 	if err != nil {
-		return false, errors.WrapErrors(errors.ErrConceptNotFound, "")
+		return []byte{}, err
 	}
+	return doc.Hash, nil
+}
 
-	if len(out) > 0 {
-		return true, nil
-	}
+func isConceptExisting(concept string) (bool, error) {
 
-	return false, nil
+	docs, err := conceptDocs(concept)
+	if err != nil {
+		return false, errors.WrapErrors(errors.ErrConceptNotFound, "")
+	}
+	return len(docs) > 0, nil
 }
 
-func saveConcept(concept string) (*ConceptDoc, error) {
+func saveConcept(concept string, meta query.ConceptMetadata) (*ConceptDoc, error) {
 
-	hash, salt, err := createHash(concept)
+	key, err := writeKey()
+	if err != nil {
+		return &ConceptDoc{}, err
+	}
+	conceptDoc, err := newConceptDoc(key, concept)
 	if err != nil {
 		return &ConceptDoc{}, err
 	}
+	conceptDoc.Description = meta.Description
+	conceptDoc.Owner = meta.Owner
+	conceptDoc.Tags = meta.Tags
 
-	conceptDoc := &ConceptDoc{
-		Concept: concept,
-		Hash:    hash,
-		Salt:    salt,
+	err = couchdb.CreateNamedDocWithDB(PrefixerCI, conceptDoc)
+	if couchdb.IsConflictError(err) {
+		return conceptDoc, errors.WrapErrors(errors.ErrConceptAlreadyExisting, "")
 	}
-	return conceptDoc, couchdb.CreateDoc(PrefixerCI, conceptDoc)
+	return conceptDoc, err
 }
 
 // CreateConcept checks if concept exists in db. If yes, return error. If no, create the salt, save the concept in db and return the hash.
-func CreateConcept(in *query.Concept, isEncrypted bool) error {
+// meta describes the concept in the catalogue.
+func CreateConcept(in *query.Concept, isEncrypted bool, meta query.ConceptMetadata) error {
 
 	if err := couchdb.EnsureDBExist(PrefixerCI, doctypeSalt); err != nil {
 		return err
@@ -163,7 +344,7 @@ func CreateConcept(in *query.Concept, isEncrypted bool) error {
 	if isExisting {
 		return errors.WrapErrors(errors.ErrConceptAlreadyExisting, "")
 	}
-	doc, err := saveConcept(concept)
+	doc, err := saveConcept(concept, meta)
 	if err != nil {
 		return err
 	}
@@ -172,6 +353,26 @@ func CreateConcept(in *query.Concept, isEncrypted bool) error {
 	return err
 }
 
+// CreateConcepts creates every concept, or none of them: the concepts already
+// created are deleted when one of them cannot be created. The concepts are
+// returned with their hashes.
+func CreateConcepts(in []query.Concept, isEncrypted bool, metadata map[string]query.ConceptMetadata) ([]query.Concept, error) {
+
+	created := []query.Concept{}
+	for _, concept := range in {
+		meta := metadata[string(concept.EncryptedConcept)]
+		if err := CreateConcept(&concept, isEncrypted, meta); err != nil {
+			if errRollback := DeleteConceptsByHash(created); errRollback != nil {
+				logger.WithNamespace("dispers").Errorf("Cannot roll back the creation of concepts: %s", errRollback)
+			}
+			return nil, err
+		}
+		created = append(created, concept)
+	}
+
+	return created, nil
+}
+
 // GetConcept gets a concept from db. If no, return error.
 func GetConcept(in *query.Concept, isEncrypted bool) error {
 
@@ -180,34 +381,279 @@ func GetConcept(in *query.Concept, isEncrypted bool) error {
 		return err
 	}
 
-	hash, err := getHash(concept)
-	in.Hash = hash
-	return err
+	doc, err := getConceptDoc(concept)
+	if err != nil {
+		in.Hash = []byte{}
+		return err
+	}
+	in.Hash = doc.Hash
+	in.PreviousHash = doc.PreviousHash
+	return nil
+}
+
+// ExpandConcept returns the concept with its hash, followed by its existing
+// ancestors and/or descendants. When descendants are asked, the concept
+// itself does not have to exist: "travail" can be expanded while only
+// "travail>lille" has been created. The ancestors and descendants are only
+// given by their hashes, their names are never sent back.
+func ExpandConcept(in query.Concept, isEncrypted bool, ancestors bool, descendants bool) ([]query.Concept, error) {
+
+	concept, err := decryptConcept(&in, isEncrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []query.Concept{}
+	doc, err := getConceptDoc(concept)
+	if err == nil {
+		in.Hash = doc.Hash
+		in.PreviousHash = doc.PreviousHash
+		out = append(out, in)
+	} else if !descendants {
+		return nil, err
+	}
+
+	if ancestors {
+		for _, ancestor := range query.ConceptAncestors(concept) {
+			doc, err := getConceptDoc(ancestor)
+			if err != nil {
+				// Parents do not have to be created
+				continue
+			}
+			out = append(out, query.Concept{
+				Hash:         doc.Hash,
+				PreviousHash: doc.PreviousHash,
+				Implicit:     true,
+			})
+		}
+	}
+
+	if descendants {
+		infos, err := ListConcepts(concept + query.ConceptSeparator)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			out = append(out, query.Concept{
+				Hash:         info.Hash,
+				PreviousHash: info.PreviousHash,
+				Parent:       in.EncryptedConcept,
+				Implicit:     true,
+			})
+		}
+	}
+
+	if len(out) == 0 {
+		return nil, errors.WrapErrors(errors.ErrConceptNotFound, "")
+	}
+	return out, nil
 }
 
 // DeleteConcept is used to delete a concept in ConceptIndexor Database.
 func DeleteConcept(in *query.Concept, isEncrypted bool) error {
 
-	// Precise and run the mango query
-	var out []ConceptDoc
-	concept, _ := decryptConcept(in, isEncrypted)
-	req := &couchdb.FindRequest{Selector: mango.Equal("concept", concept)}
-	err := couchdb.FindDocs(PrefixerCI, doctypeSalt, req, &out)
+	concept, err := decryptConcept(in, isEncrypted)
+	if err != nil {
+		return err
+	}
+	docs, err := conceptDocs(concept)
 	if err != nil {
 		return err
 	}
 
-	if len(out) == 0 {
+	if len(docs) == 0 {
 		return errors.WrapErrors(errors.ErrConceptNotFound, "")
 	}
 
-	// Delete every doc that match concept
-	for _, element := range out {
-		err = couchdb.DeleteDoc(PrefixerCI, &element)
+	// Delete every doc of the concept, whatever its key
+	for _, doc := range docs {
+		if err := couchdb.DeleteDoc(PrefixerCI, doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteConceptsByHash deletes the concepts with the given hashes. It is used
+// to roll back a creation and to remove the orphaned concepts, whose names
+// are not known by the Conductor. Unknown hashes are ignored.
+func DeleteConceptsByHash(concepts []query.Concept) error {
+
+	for _, concept := range concepts {
+		var out []ConceptDoc
+		req := &couchdb.FindRequest{Selector: mango.Equal("hash", concept.Hash)}
+		err := couchdb.FindDocs(PrefixerCI, doctypeSalt, req, &out)
 		if err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				return nil
+			}
 			return err
 		}
+		for index := range out {
+			if err := couchdb.DeleteDoc(PrefixerCI, &out[index]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ConceptHashes returns the hashes of every concept, without their names
+func ConceptHashes() ([]query.Concept, error) {
+
+	docs, err := allConceptDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]query.Concept, len(docs))
+	for index, doc := range docs {
+		out[index] = query.Concept{Hash: doc.Hash, PreviousHash: doc.PreviousHash}
 	}
+	return out, nil
+}
+
+// ListConcepts returns the catalogue of the concepts whose name starts with
+// prefix. Hierarchical names like "travail>lille" can be searched with the
+// prefix "travail>". The names are encrypted in the database, every concept
+// is read to find the matching ones.
+func ListConcepts(prefix string) ([]query.ConceptInfo, error) {
 
+	docs, err := allConceptDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []query.ConceptInfo{}
+	for _, doc := range docs {
+		name, err := openName(doc)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		infos = append(infos, query.ConceptInfo{
+			Name: name,
+			ConceptMetadata: query.ConceptMetadata{
+				Description: doc.Description,
+				Owner:       doc.Owner,
+				Tags:        doc.Tags,
+			},
+			CreatedAt:    doc.CreatedAt,
+			Hash:         doc.Hash,
+			PreviousHash: doc.PreviousHash,
+		})
+	}
+	return infos, nil
+}
+
+func allConceptDocs() ([]*ConceptDoc, error) {
+
+	var docs []*ConceptDoc
+	err := couchdb.ForeachDocs(PrefixerCI, doctypeSalt, func(_ string, data json.RawMessage) error {
+		doc := &ConceptDoc{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			return err
+		}
+		if len(doc.EncryptedName) == 0 {
+			var legacy struct {
+				Concept string `json:"concept"`
+			}
+			if err := json.Unmarshal(data, &legacy); err != nil {
+				return err
+			}
+			doc.legacyName = legacy.Concept
+		}
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// RotateConcepts re-keys every concept with NextConceptKey and a new salt.
+// The doc of a concept is moved to the ID given by the next key. The former
+// hash of a concept is kept until CommitRotation is called, so that the
+// Conductor can find its lists of instances meanwhile. The concepts already
+// re-keyed are not re-keyed again: an interrupted rotation can be resumed.
+func RotateConcepts() ([]query.Concept, error) {
+
+	if len(NextConceptKey) == 0 {
+		return nil, errors.WrapErrors(errors.ErrNoNextConceptKey, "")
+	}
+
+	docs, err := allConceptDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []query.Concept{}
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		name, err := openName(doc)
+		if err != nil {
+			return nil, err
+		}
+		id := conceptDocID(NextConceptKey, name)
+
+		rotated := doc
+		if doc.ID() != id {
+			rotated, err = newConceptDoc(NextConceptKey, name)
+			if err != nil {
+				return nil, err
+			}
+			rotated.PreviousHash = doc.Hash
+			rotated.Description = doc.Description
+			rotated.Owner = doc.Owner
+			rotated.Tags = doc.Tags
+			rotated.CreatedAt = doc.CreatedAt
+			err = couchdb.CreateNamedDocWithDB(PrefixerCI, rotated)
+			if couchdb.IsConflictError(err) {
+				// The rotation has been interrupted before the former doc
+				// was deleted
+				rotated = &ConceptDoc{}
+				err = couchdb.GetDoc(PrefixerCI, doctypeSalt, id, rotated)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := couchdb.DeleteDoc(PrefixerCI, doc); err != nil {
+				return nil, err
+			}
+		}
+
+		// A concept created with the next key has got no list to move
+		if seen[id] || rotated.PreviousHash == nil {
+			continue
+		}
+		seen[id] = true
+		out = append(out, query.Concept{Hash: rotated.Hash, PreviousHash: rotated.PreviousHash})
+	}
+
+	return out, nil
+}
+
+// CommitRotation forgets the hashes of the concepts before the rotation
+func CommitRotation() error {
+
+	docs, err := allConceptDocs()
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if doc.PreviousHash == nil {
+			continue
+		}
+		doc.PreviousHash = nil
+		if err := couchdb.UpdateDoc(PrefixerCI, doc); err != nil {
+			return err
+		}
+	}
 	return nil
 }
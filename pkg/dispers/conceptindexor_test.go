@@ -1,8 +1,13 @@
 package enclave
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
 	"github.com/stretchr/testify/assert"
@@ -19,10 +24,10 @@ func TestConceptIndexor(t *testing.T) {
 	assert.Equal(t, b, false)
 
 	// Create new conceptDoc with CreateConcept
-	err = CreateConcept(&conceptTest, false)
+	err = CreateConcept(&conceptTest, false, query.ConceptMetadata{})
 	out := conceptTest.Hash
 	assert.NoError(t, err)
-	err2 := CreateConcept(&conceptTestRandom, false)
+	err2 := CreateConcept(&conceptTestRandom, false, query.ConceptMetadata{})
 	assert.NoError(t, err2)
 
 	// Test if concept exist using isConceptExisting
@@ -38,10 +43,10 @@ func TestConceptIndexor(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, out, conceptTest.Hash)
 
-	// Create twice the same concept and check if there is error when getting salt
-	_, errAdd := saveConcept(string(conceptTest.EncryptedConcept))
-	assert.NoError(t, errAdd)
-	errGet := CreateConcept(&conceptTest, false)
+	// Create twice the same concept and check that the second one is refused
+	_, errAdd := saveConcept(string(conceptTest.EncryptedConcept), query.ConceptMetadata{})
+	assert.Error(t, errAdd)
+	errGet := CreateConcept(&conceptTest, false, query.ConceptMetadata{})
 	assert.Error(t, errGet)
 
 	// deleteConcept
@@ -61,33 +66,33 @@ func TestConceptIndexor(t *testing.T) {
 }
 
 func TestAddSalt(t *testing.T) {
-	_, errAdd := saveConcept(string(conceptTestRandom.EncryptedConcept))
+	_, errAdd := saveConcept(string(conceptTestRandom.EncryptedConcept), query.ConceptMetadata{})
 	assert.NoError(t, errAdd)
 }
 
 func TestDeleteConcept(t *testing.T) {
-	saveConcept(string(conceptTestRandom.EncryptedConcept))
+	saveConcept(string(conceptTestRandom.EncryptedConcept), query.ConceptMetadata{})
 	err := DeleteConcept(&conceptTestRandom, false)
 	assert.NoError(t, err)
 }
 
 func TestGetHash(t *testing.T) {
-	saveConcept(string(conceptTestRandom.EncryptedConcept))
+	saveConcept(string(conceptTestRandom.EncryptedConcept), query.ConceptMetadata{})
 	_, err := getHash(string(conceptTestRandom.EncryptedConcept))
 	assert.NoError(t, err)
 }
 
 func TestHash(t *testing.T) {
-	res, _, err := createHash(string(conceptTestRandom.EncryptedConcept))
+	res, _, err := createHash(ConceptKey, string(conceptTestRandom.EncryptedConcept))
 	assert.NoError(t, err)
-	res2, _, _ := createHash(string(conceptTestRandom.EncryptedConcept))
+	res2, _, _ := createHash(ConceptKey, string(conceptTestRandom.EncryptedConcept))
 	assert.NotEqual(t, res, res2)
 	assert.Equal(t, true, len(res) > 0)
 }
 
 func TestCreateConcept(t *testing.T) {
 	conceptTestRandom.EncryptedConcept = crypto.GenerateRandomBytes(50)
-	err := CreateConcept(&conceptTestRandom, false)
+	err := CreateConcept(&conceptTestRandom, false, query.ConceptMetadata{})
 	out := conceptTestRandom.Hash
 	assert.NoError(t, err)
 	assert.Equal(t, true, len(out) > 0)
@@ -100,7 +105,7 @@ func TestCreateConcept(t *testing.T) {
 
 func TestHashIsNotDeterministic(t *testing.T) {
 	conceptTestRandom.EncryptedConcept = crypto.GenerateRandomBytes(50)
-	err := CreateConcept(&conceptTestRandom, false)
+	err := CreateConcept(&conceptTestRandom, false, query.ConceptMetadata{})
 	assert.NoError(t, err)
 	out1 := conceptTestRandom.Hash
 	assert.Equal(t, true, len(out1) > 0)
@@ -108,7 +113,7 @@ func TestHashIsNotDeterministic(t *testing.T) {
 	err = DeleteConcept(&conceptTestRandom, false)
 	assert.NoError(t, err)
 
-	err = CreateConcept(&conceptTestRandom, false)
+	err = CreateConcept(&conceptTestRandom, false, query.ConceptMetadata{})
 	assert.NoError(t, err)
 	out2 := conceptTestRandom.Hash
 	assert.Equal(t, true, len(out2) > 0)
@@ -120,7 +125,7 @@ func TestHashIsNotDeterministic(t *testing.T) {
 
 func TestIsExistantSaltExisting(t *testing.T) {
 	conceptTestRandom.EncryptedConcept = crypto.GenerateRandomBytes(50)
-	saveConcept(string(conceptTestRandom.EncryptedConcept))
+	saveConcept(string(conceptTestRandom.EncryptedConcept), query.ConceptMetadata{})
 	_, err := isConceptExisting(string(conceptTestRandom.EncryptedConcept))
 	assert.NoError(t, err)
 }
@@ -130,3 +135,216 @@ func TestIsUnexistantSaltExisting(t *testing.T) {
 	_, err := isConceptExisting(string(conceptTestRandom.EncryptedConcept))
 	assert.NoError(t, err)
 }
+
+func TestExpandConcept(t *testing.T) {
+	root := hex.EncodeToString(crypto.GenerateRandomBytes(20))
+	child := query.Concept{EncryptedConcept: []byte(root + ">lille")}
+	grandchild := query.Concept{EncryptedConcept: []byte(root + ">lille>centre")}
+	assert.NoError(t, CreateConcept(&child, false, query.ConceptMetadata{}))
+	assert.NoError(t, CreateConcept(&grandchild, false, query.ConceptMetadata{}))
+
+	// The root does not exist but has got descendants
+	parent := query.Concept{EncryptedConcept: []byte(root)}
+	_, err := ExpandConcept(parent, false, false, false)
+	assert.Error(t, err)
+	out, err := ExpandConcept(parent, false, false, true)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	for _, concept := range out {
+		assert.True(t, concept.Implicit)
+		assert.Equal(t, []byte(root), concept.Parent)
+		// The names of the descendants are not given
+		assert.Empty(t, concept.EncryptedConcept)
+	}
+
+	// Only the existing ancestors are given
+	out, err = ExpandConcept(query.Concept{EncryptedConcept: grandchild.EncryptedConcept}, false, true, false)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.Equal(t, grandchild.Hash, out[0].Hash)
+	assert.False(t, out[0].Implicit)
+	assert.Equal(t, child.Hash, out[1].Hash)
+	assert.True(t, out[1].Implicit)
+	assert.Empty(t, out[1].EncryptedConcept)
+
+	assert.NoError(t, DeleteConcept(&child, false))
+	assert.NoError(t, DeleteConcept(&grandchild, false))
+}
+
+func TestRotateConcepts(t *testing.T) {
+	concept := query.Concept{EncryptedConcept: []byte(hex.EncodeToString(crypto.GenerateRandomBytes(20)))}
+	assert.NoError(t, CreateConcept(&concept, false, query.ConceptMetadata{}))
+	before := concept.Hash
+
+	// The concepts are re-keyed with the next key only
+	_, err := RotateConcepts()
+	assert.Error(t, err)
+
+	NextConceptKey = crypto.GenerateRandomBytes(32)
+	defer func() {
+		// The next key becomes the current one after the rotation
+		ConceptKey = NextConceptKey
+		NextConceptKey = nil
+	}()
+
+	rotated, err := RotateConcepts()
+	assert.NoError(t, err)
+	assert.NoError(t, GetConcept(&concept, false))
+	assert.NotEqual(t, before, concept.Hash)
+	assert.Equal(t, before, concept.PreviousHash)
+	assert.Contains(t, rotated, query.Concept{Hash: concept.Hash, PreviousHash: before})
+
+	// An interrupted rotation is resumed without re-keying the concepts
+	_, err = RotateConcepts()
+	assert.NoError(t, err)
+	after := concept.Hash
+	assert.NoError(t, GetConcept(&concept, false))
+	assert.Equal(t, after, concept.Hash)
+
+	assert.NoError(t, CommitRotation())
+	concept.PreviousHash = nil
+	assert.NoError(t, GetConcept(&concept, false))
+	assert.Equal(t, after, concept.Hash)
+	assert.Nil(t, concept.PreviousHash)
+
+	// The concept is found without the former key
+	ConceptKey = nil
+	concept.Hash = nil
+	assert.NoError(t, GetConcept(&concept, false))
+	assert.Equal(t, after, concept.Hash)
+
+	assert.NoError(t, DeleteConcept(&concept, false))
+}
+
+func TestConceptNameNotInClear(t *testing.T) {
+	name := "clear>" + hex.EncodeToString(crypto.GenerateRandomBytes(20))
+	concept := query.Concept{EncryptedConcept: []byte(name)}
+	assert.NoError(t, CreateConcept(&concept, false, query.ConceptMetadata{}))
+
+	doc, err := getConceptDoc(name)
+	assert.NoError(t, err)
+	raw, err := json.Marshal(doc)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), name)
+
+	// The catalogue can still give the name
+	infos, err := ListConcepts("clear>")
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, name, infos[0].Name)
+
+	assert.NoError(t, DeleteConcept(&concept, false))
+}
+
+func TestCreateConceptsRollback(t *testing.T) {
+	existing := query.Concept{EncryptedConcept: []byte(hex.EncodeToString(crypto.GenerateRandomBytes(20)))}
+	fresh := query.Concept{EncryptedConcept: []byte(hex.EncodeToString(crypto.GenerateRandomBytes(20)))}
+	assert.NoError(t, CreateConcept(&existing, false, query.ConceptMetadata{}))
+
+	// The fresh concept is deleted since the other one already exists
+	_, err := CreateConcepts([]query.Concept{fresh, existing}, false, nil)
+	assert.Error(t, err)
+	exists, err := isConceptExisting(string(fresh.EncryptedConcept))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.NoError(t, DeleteConcept(&existing, false))
+	hashes, err := CreateConcepts([]query.Concept{fresh, existing}, false, nil)
+	assert.NoError(t, err)
+	assert.Len(t, hashes, 2)
+
+	assert.NoError(t, DeleteConceptsByHash(hashes))
+	exists, err = isConceptExisting(string(fresh.EncryptedConcept))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestListConceptsPages(t *testing.T) {
+
+	// CouchDB gives 25 documents by default
+	names := []string{}
+	for i := 0; i < 30; i++ {
+		names = append(names, "catalogue>"+strconv.Itoa(i))
+	}
+	for _, name := range names {
+		_, err := saveConcept(name, query.ConceptMetadata{})
+		assert.NoError(t, err)
+	}
+
+	infos, err := ListConcepts("catalogue>")
+	assert.NoError(t, err)
+	found := []string{}
+	for _, info := range infos {
+		found = append(found, info.Name)
+	}
+	assert.ElementsMatch(t, names, found)
+
+	for _, name := range names {
+		concept := query.Concept{EncryptedConcept: []byte(name)}
+		assert.NoError(t, DeleteConcept(&concept, false))
+	}
+}
+
+func TestDeleteConceptsByHash(t *testing.T) {
+	deleted := query.Concept{EncryptedConcept: []byte(hex.EncodeToString(crypto.GenerateRandomBytes(20)))}
+	kept := query.Concept{EncryptedConcept: []byte(hex.EncodeToString(crypto.GenerateRandomBytes(20)))}
+	assert.NoError(t, CreateConcept(&deleted, false, query.ConceptMetadata{}))
+	assert.NoError(t, CreateConcept(&kept, false, query.ConceptMetadata{}))
+
+	// The docs are found with the index on the hashes, unknown hashes are
+	// ignored
+	unknown := query.Concept{Hash: crypto.GenerateRandomBytes(32)}
+	assert.NoError(t, DeleteConceptsByHash([]query.Concept{{Hash: deleted.Hash}, unknown}))
+
+	exists, err := isConceptExisting(string(deleted.EncryptedConcept))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = isConceptExisting(string(kept.EncryptedConcept))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.NoError(t, DeleteConcept(&kept, false))
+}
+
+func TestLegacyConcept(t *testing.T) {
+	name := "legacy>" + hex.EncodeToString(crypto.GenerateRandomBytes(20))
+	hash := crypto.GenerateRandomBytes(32)
+	legacy := couchdb.JSONDoc{Type: doctypeSalt, M: map[string]interface{}{
+		"concept":    name,
+		"hash":       hash,
+		"salt":       crypto.GenerateRandomBytes(defaultLenSalt),
+		"created_at": time.Now(),
+	}}
+	assert.NoError(t, couchdb.CreateDoc(PrefixerCI, &legacy))
+
+	// The concept saved in clear is found by its name
+	concept := query.Concept{EncryptedConcept: []byte(name)}
+	assert.NoError(t, GetConcept(&concept, false))
+	assert.Equal(t, hash, concept.Hash)
+	assert.Error(t, CreateConcept(&concept, false, query.ConceptMetadata{}))
+	child := query.Concept{EncryptedConcept: []byte(name + ">lille")}
+	assert.NoError(t, CreateConcept(&child, false, query.ConceptMetadata{}))
+	out, err := ExpandConcept(child, false, true, false)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.Equal(t, hash, out[1].Hash)
+	assert.NoError(t, DeleteConcept(&child, false))
+
+	// It is still found once re-keyed
+	NextConceptKey = crypto.GenerateRandomBytes(32)
+	defer func() {
+		ConceptKey = NextConceptKey
+		NextConceptKey = nil
+	}()
+	_, err = RotateConcepts()
+	assert.NoError(t, err)
+	assert.NoError(t, CommitRotation())
+	concept.Hash = nil
+	assert.NoError(t, GetConcept(&concept, false))
+	assert.NotEqual(t, hash, concept.Hash)
+	legacyDocs, err := legacyConceptDocs(name)
+	assert.NoError(t, err)
+	assert.Empty(t, legacyDocs)
+
+	assert.NoError(t, DeleteConcept(&concept, false))
+}
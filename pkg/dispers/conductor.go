@@ -1,21 +1,32 @@
 package enclave
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math/rand"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
+	"github.com/cozy/cozy-stack/pkg/dispers/audit"
 	"github.com/cozy/cozy-stack/pkg/dispers/errors"
 	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
 	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/querier"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
 	"github.com/cozy/cozy-stack/pkg/dispers/subscribe"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
@@ -25,26 +36,60 @@ var (
 	// PrefixerC is exported to easilly pass in dev-mode
 	PrefixerC = prefixer.ConductorPrefixer
 
+	// SubscriptionShards is the number of buckets the lists of instances of
+	// the new concepts are split into, and BucketCapacity the number of
+	// instances of a bucket over which the number of buckets of its concept is
+	// doubled
+	SubscriptionShards = 64
+	BucketCapacity     = 256
+
+	// FoldTimeout is the time given to a DA to compute a fold, after which
+	// it is considered as failed, and MaxFoldRetries the number of times a
+	// failed fold is sent to another DA
+	FoldTimeout    = 10 * time.Minute
+	MaxFoldRetries = 2
+
 	executionMetadata *metadata.ExecutionMetadata
 	cursor            = 0
 )
 
+// MinimumRows is the number of rows of data under which a query is not
+// computed
+const MinimumRows = 50
+
+// maxBucketAttempts is the number of times a bucket is updated again when
+// several instances subscribe at the same time
+const maxBucketAttempts = 5
+
+// bucketsPageSize is the number of buckets read at once from the database
+const bucketsPageSize = 8
+
 // QueryDoc saves every information about the query. QueryDoc are saved in the
 // Conductor's database. Thanks to that, CheckPoints can be made, and the process
 // can be followed by the querier.
 type QueryDoc struct {
-	QueryID                   string            `json:"_id,omitempty"`
-	QueryRev                  string            `json:"_rev,omitempty"`
-	IsEncrypted               bool              `json:"encrypted,omitempty"`
-	CheckPoints               map[string]bool   `json:"checkpoints,omitempty"`
-	Layers                    []query.LayerDA   `json:"layers,omitempty"`
-	PseudoConcepts            map[string]string `json:"pseudo_concepts,omitempty"`
-	Results                   interface{}       `json:"results,omitempty"`
-	EncryptedConcepts         []query.Concept   `json:"concepts,omitempty"`
-	EncryptedListsOfAddresses map[string][]byte `json:"enc_instances,omitempty"`
-	EncryptedLocalQuery       []byte            `json:"enc_localquery,omitempty"`
-	EncryptedTargetProfile    []byte            `json:"enc_operation,omitempty"`
-	EncryptedTargets          []byte            `json:"enc_addresses,omitempty"`
+	QueryID                string                        `json:"_id,omitempty"`
+	QueryRev               string                        `json:"_rev,omitempty"`
+	Owner                  string                        `json:"owner,omitempty"`
+	MaxTargets             int                           `json:"max_targets,omitempty"`
+	IsEncrypted            bool                          `json:"encrypted,omitempty"`
+	CheckPoints            map[string]bool               `json:"checkpoints,omitempty"`
+	Layers                 []query.LayerDA               `json:"layers,omitempty"`
+	PseudoConcepts         map[string]string             `json:"pseudo_concepts,omitempty"`
+	Results                interface{}                   `json:"results,omitempty"`
+	EncryptedConcepts      []query.Concept               `json:"concepts,omitempty"`
+	SubscribeDocs          map[string]string             `json:"subscribe_docs,omitempty"`
+	EncryptedLocalQuery    []byte                        `json:"enc_localquery,omitempty"`
+	EncryptedTargetProfile []byte                        `json:"enc_operation,omitempty"`
+	EncryptedTargets       []byte                        `json:"enc_addresses,omitempty"`
+	Clipping               map[string]aggregations.Bound `json:"clipping,omitempty"`
+	ClippedRows            int                           `json:"clipped_rows,omitempty"`
+	RejectedRows           int                           `json:"rejected_rows,omitempty"`
+	Completion             query.Completion              `json:"completion,omitempty"`
+	Targets                query.TargetCounts            `json:"targets,omitempty"`
+	TargetHost             string                        `json:"target_host,omitempty"`
+	Failure                string                        `json:"failure,omitempty"`
+	RunningUntil           *time.Time                    `json:"running_until,omitempty"`
 }
 
 // ID returns the QueryID
@@ -79,13 +124,39 @@ func (q *QueryDoc) SetRev(rev string) {
 }
 
 // NewQuery returns a Query object to lead, resume, get info about the query.
-func NewQuery(in *query.InputNewQuery) (*QueryDoc, error) {
+// owner is the ID of the querier who submitted the query and maxTargets the
+// maximum number of targets allowed for this querier (0 means no limit).
+func NewQuery(in *query.InputNewQuery, owner string, maxTargets int) (*QueryDoc, error) {
 
 	var q *QueryDoc
 
+	if err := checkSecretSharing(in.LayersDA); err != nil {
+		return q, err
+	}
+	if err := checkRedundancy(in.LayersDA); err != nil {
+		return q, err
+	}
+	if err := checkClipping(in.Clipping); err != nil {
+		return q, err
+	}
+	if err := checkPreAggregation(in.LayersDA); err != nil {
+		return q, err
+	}
+	if err := checkCompletion(in.Completion); err != nil {
+		return q, err
+	}
+	// The jobs of an encrypted query cannot be read by the Conductor
+	if !in.IsEncrypted {
+		if err := checkRobustJobs(in.LayersDA); err != nil {
+			return nil, err
+		}
+	}
+
 	if in.IsEncrypted {
 		// Creating the QueryDoc that will be saved in the Conductor's database
 		q = &QueryDoc{
+			Owner:                  owner,
+			MaxTargets:             maxTargets,
 			CheckPoints:            make(map[string]bool),
 			IsEncrypted:            in.IsEncrypted,
 			Layers:                 in.LayersDA,
@@ -93,6 +164,8 @@ func NewQuery(in *query.InputNewQuery) (*QueryDoc, error) {
 			EncryptedConcepts:      in.EncryptedConcepts,
 			EncryptedLocalQuery:    in.EncryptedLocalQuery,
 			EncryptedTargetProfile: in.EncryptedTargetProfile,
+			Clipping:               in.Clipping,
+			Completion:             in.Completion,
 		}
 	} else {
 
@@ -101,13 +174,21 @@ func NewQuery(in *query.InputNewQuery) (*QueryDoc, error) {
 			encryptedConcepts = append(encryptedConcepts, query.Concept{EncryptedConcept: []byte(concept)})
 		}
 
-		encryptedLocalQuery, err := json.Marshal(in.LocalQuery)
+		// The local query only reads the fields allowed by the policy
+		if err := query.Policy.Enforce(&in.LocalQuery); err != nil {
+			return q, err
+		}
+		encryptedLocalQuery, err := wire.Encode(wire.TypeLocalQuery, in.LocalQuery)
+		if err != nil {
+			return q, err
+		}
+		encryptedTargetProfile, err := wire.Encode(wire.TypeTargetProfile, in.TargetProfile)
 		if err != nil {
 			return q, err
 		}
 
 		for index, layer := range in.LayersDA {
-			encryptedJobs, err := json.Marshal(layer.Jobs)
+			encryptedJobs, err := wire.Encode(wire.TypeJobs, layer.Jobs)
 			if err != nil {
 				return q, err
 			}
@@ -115,16 +196,26 @@ func NewQuery(in *query.InputNewQuery) (*QueryDoc, error) {
 		}
 
 		q = &QueryDoc{
+			Owner:                  owner,
+			MaxTargets:             maxTargets,
 			CheckPoints:            make(map[string]bool),
 			IsEncrypted:            in.IsEncrypted,
 			Layers:                 in.LayersDA,
 			PseudoConcepts:         in.PseudoConcepts,
 			EncryptedConcepts:      encryptedConcepts,
 			EncryptedLocalQuery:    encryptedLocalQuery,
-			EncryptedTargetProfile: []byte(in.TargetProfile),
+			EncryptedTargetProfile: encryptedTargetProfile,
+			Clipping:               in.Clipping,
+			Completion:             in.Completion,
 		}
 	}
 
+	// A query that has not ended after RunningQueryTTL is abandoned
+	if querier.RunningQueryTTL > 0 {
+		runningUntil := time.Now().UTC().Add(querier.RunningQueryTTL).Truncate(time.Second)
+		q.RunningUntil = &runningUntil
+	}
+
 	if err := couchdb.CreateDoc(PrefixerC, q); err != nil {
 		return &QueryDoc{}, err
 	}
@@ -145,6 +236,104 @@ func NewQuery(in *query.InputNewQuery) (*QueryDoc, error) {
 	return q, nil
 }
 
+// checkSecretSharing checks that only the first layer splits the data into
+// shares, between several DAs, and that a single DA reconstructs the aggregate
+func checkSecretSharing(layers []query.LayerDA) error {
+	for index, layer := range layers {
+		if !layer.SecretSharing {
+			continue
+		}
+		if index != 0 || layer.Size < 2 || len(layers) < 2 || layers[1].Size != 1 {
+			return errors.WrapErrors(errors.ErrInvalidSecretSharing, "")
+		}
+	}
+	return nil
+}
+
+// checkPreAggregation checks that only the first layer is pre-aggregated by
+// the Targets
+func checkPreAggregation(layers []query.LayerDA) error {
+	for index, layer := range layers {
+		if layer.PreAggregate && index != 0 {
+			return errors.WrapErrors(errors.ErrInvalidPreAggregation, "")
+		}
+	}
+	return nil
+}
+
+// robustJobs are the jobs computed over the values collected in a fold. The
+// values are never given to the Conductor, so the estimator is only computed
+// over every row of the layer when the layer has a single fold.
+var robustJobs = map[string]bool{
+	"trimmed_mean":    true,
+	"median_of_means": true,
+}
+
+// checkRobustJobs checks that the robust estimators are computed by layers
+// with a single DA
+func checkRobustJobs(layers []query.LayerDA) error {
+	for _, layer := range layers {
+		var jobs []query.AggregationJob
+		if err := wire.Decode(layer.EncryptedJobs, wire.TypeJobs, &jobs); err != nil {
+			return errors.WrapErrors(errors.ErrUnmarshal, "")
+		}
+		for _, job := range jobs {
+			if robustJobs[job.Job] && layer.Size != 1 {
+				return errors.WrapErrors(errors.ErrInvalidRobustLayer, job.Job)
+			}
+		}
+	}
+	return nil
+}
+
+// checkCompletion checks the completion policy of a query: a fraction of
+// targets, with a timeout
+func checkCompletion(completion query.Completion) error {
+	if completion.MinFraction < 0 || completion.MinFraction > 1 {
+		return errors.WrapErrors(errors.ErrInvalidCompletion, "completion")
+	}
+	if completion.Timeout == "" {
+		if completion.MinFraction > 0 {
+			return errors.WrapErrors(errors.ErrInvalidCompletion, "completion")
+		}
+		return nil
+	}
+	timeout, err := time.ParseDuration(completion.Timeout)
+	if err != nil || timeout <= 0 {
+		return errors.WrapErrors(errors.ErrInvalidCompletion, "completion")
+	}
+	return nil
+}
+
+// deadline returns the time after which the Targets stop waiting for the
+// instances, zero if every instance is awaited
+func (q *QueryDoc) deadline(now time.Time) time.Time {
+	timeout, err := time.ParseDuration(q.Completion.Timeout)
+	if err != nil || timeout <= 0 {
+		return time.Time{}
+	}
+	return now.Add(timeout)
+}
+
+// quorumReached returns true if enough targets have answered
+func (q *QueryDoc) quorumReached(targets query.TargetCounts) bool {
+	total := targets.Responding + targets.Failed + targets.TimedOut
+	if total == 0 {
+		return true
+	}
+	return float64(targets.Responding) >= q.Completion.MinFraction*float64(total)
+}
+
+// checkClipping checks that the bounds of every field are consistent
+func checkClipping(bounds map[string]aggregations.Bound) error {
+	for key, bound := range bounds {
+		if err := bound.Check(); err != nil {
+			return errors.WrapErrors(err, key)
+		}
+	}
+	return nil
+}
+
 // NewQueryFetchingQueryDoc returns a QueryDoc object to resume the request
 func NewQueryFetchingQueryDoc(queryid string, indexLayer int) (*QueryDoc, error) {
 
@@ -164,6 +353,78 @@ func NewQueryFetchingQueryDoc(queryid string, indexLayer int) (*QueryDoc, error)
 	return q, err
 }
 
+// DeleteQuery removes a QueryDoc from the Conductor's database. A query that
+// has not ended stops counting in the running queries of its owner.
+func (q *QueryDoc) DeleteQuery() error {
+	if err := couchdb.DeleteDoc(PrefixerC, q); err != nil {
+		return err
+	}
+	if q.CheckPoints["da"] != true {
+		if err := q.auditEnded(audit.OutcomeDeleted); err != nil {
+			return err
+		}
+		return querier.ReleaseQuery(q.Owner)
+	}
+	return nil
+}
+
+// auditStarted records in the audit log what is going to be asked to the
+// targets. The Conductor cannot read encrypted queries, so only their
+// concepts' hashes are recorded.
+func (q *QueryDoc) auditStarted() error {
+
+	entry := &audit.Entry{
+		Event:       audit.EventQueryStarted,
+		QueryID:     q.ID(),
+		Querier:     q.Owner,
+		IsEncrypted: q.IsEncrypted,
+	}
+	for _, concept := range q.EncryptedConcepts {
+		entry.Concepts = append(entry.Concepts, concept.Hash)
+	}
+
+	if !q.IsEncrypted {
+		if err := wire.Decode(q.EncryptedTargetProfile, wire.TypeTargetProfile, &entry.TargetProfile); err != nil {
+			return err
+		}
+
+		var localQuery query.LocalQuery
+		if err := wire.Decode(q.EncryptedLocalQuery, wire.TypeLocalQuery, &localQuery); err != nil {
+			return err
+		}
+		entry.Doctype = localQuery.Doctype
+		entry.Selector = localQuery.FindRequest.Selector
+
+		for _, layer := range q.Layers {
+			var jobs []query.AggregationJob
+			if err := wire.Decode(layer.EncryptedJobs, wire.TypeJobs, &jobs); err != nil {
+				return err
+			}
+			for _, job := range jobs {
+				entry.Jobs = append(entry.Jobs, job.Job)
+			}
+		}
+
+		var targets []query.Instance
+		if err := wire.Decode(q.EncryptedTargets, wire.TypeInstances, &targets); err != nil {
+			return err
+		}
+		entry.TargetCount = len(targets)
+	}
+
+	return audit.Append(entry)
+}
+
+// auditEnded records in the audit log the outcome of the query
+func (q *QueryDoc) auditEnded(outcome string) error {
+	return audit.Append(&audit.Entry{
+		Event:   audit.EventQueryEnded,
+		QueryID: q.ID(),
+		Querier: q.Owner,
+		Outcome: outcome,
+	})
+}
+
 // decryptConcept returns a list of hashed concepts from a list of encrypted concepts
 // This function call another Cozy-DISPERS playing the role of Concept Indexor.
 func (q *QueryDoc) decryptConcept() error {
@@ -172,6 +433,9 @@ func (q *QueryDoc) decryptConcept() error {
 	task := metadata.NewTaskMetadata()
 	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
 	ci.DefineDispersActor("concept/" + query.ConceptsToString(q.EncryptedConcepts) + "/" + strconv.FormatBool(q.IsEncrypted))
+	// Concepts are expanded with their descendants for the target profile's
+	// parent concepts to be the union of their children
+	ci.URL.RawQuery = url.Values{"expand": {"descendants"}}.Encode()
 	err := ci.MakeRequest("GET", "", nil, nil)
 	if err != nil {
 		return executionMetadata.HandleError("DecryptConcept", task, err)
@@ -188,23 +452,40 @@ func (q *QueryDoc) decryptConcept() error {
 func (q *QueryDoc) fetchListsOfInstancesFromDB() error {
 
 	task := metadata.NewTaskMetadata()
-	encListsOfA := make(map[string][]byte)
+	subscribeDocs := make(map[string]string)
 
-	// Retrieve the lists of addresses from Conductor's database
+	// Retrieve the lists of addresses from Conductor's database. Only the
+	// SubscribeDocs are saved: their buckets are read when the targets are
+	// selected.
 	for _, concept := range q.EncryptedConcepts {
 
-		s, err := RetrieveSubscribeDoc(concept.Hash)
+		s, err := retrieveConceptSubscribeDoc(concept.Hash, concept.PreviousHash)
 		if err != nil {
 			return executionMetadata.HandleError("FetchListsOfAddresses", task, err)
 		}
 
 		if len(s) == 0 {
+			if concept.Implicit {
+				continue
+			}
 			return executionMetadata.HandleError("FetchListsOfAddresses", task, errors.ErrSubscribeDocNotFound)
 		}
 
+		// The list of a descendant is named after its parent's pseudo
+		// concept, for Target Finder to expand the target profile. The name
+		// of the descendant is not known, its hash tells the lists apart.
+		name := q.PseudoConcepts[string(concept.EncryptedConcept)]
+		if concept.Parent != nil {
+			name = q.PseudoConcepts[string(concept.Parent)] + query.ConceptSeparator + hex.EncodeToString(concept.Hash)
+		}
+
+		if err := splitSubscribeDoc(&s[0]); err != nil {
+			return executionMetadata.HandleError("FetchListsOfAddresses", task, err)
+		}
+
 		executionMetadata.HandleError("FetchListsOfAddresses", task, nil)
-		encListsOfA[q.PseudoConcepts[string(concept.EncryptedConcept)]] = s[0].EncryptedInstances
-		q.EncryptedListsOfAddresses = encListsOfA
+		subscribeDocs[name] = s[0].ID()
+		q.SubscribeDocs = subscribeDocs
 
 	}
 
@@ -217,16 +498,27 @@ func (q *QueryDoc) selectTargets() error {
 
 	task := metadata.NewTaskMetadata()
 
-	// Make a request to Target Finder to retrieve the final list of targets
+	// The instances refused by their stack are not selected again
+	marks, err := staleMarks()
+	if err != nil {
+		return executionMetadata.HandleError("SelectTargets", task, err)
+	}
+
+	// Make a request to Target Finder to retrieve the final list of targets.
+	// The buckets are streamed from the database to the Target Finder.
 	inputTF := query.InputTF{
-		IsEncrypted:               q.IsEncrypted,
-		EncryptedListsOfAddresses: q.EncryptedListsOfAddresses,
-		EncryptedTargetProfile:    q.EncryptedTargetProfile,
-		TaskMetadata:              task,
+		IsEncrypted:            q.IsEncrypted,
+		EncryptedTargetProfile: q.EncryptedTargetProfile,
+		MaxTargets:             q.MaxTargets,
+		TaskMetadata:           task,
+		EncryptedStale:         marks,
 	}
 	tf := network.NewExternalActor(network.RoleTF, network.ModeQuery)
 	tf.DefineDispersActor("addresses")
-	if err := tf.MakeRequest("POST", "", inputTF, nil); err != nil {
+	err = tf.MakeStreamRequest("POST", func(w io.Writer) error {
+		return writeInputTF(w, inputTF, q.SubscribeDocs)
+	})
+	if err != nil {
 		return executionMetadata.HandleError("SelectTargets", task, err)
 	}
 	var outputTF query.OutputTF
@@ -235,16 +527,86 @@ func (q *QueryDoc) selectTargets() error {
 	}
 	executionMetadata.HandleError("SelectTargets", outputTF.TaskMetadata, nil)
 	q.EncryptedTargets = outputTF.EncryptedTargets
+	// The targets cannot be queried if the query is not in the audit log
+	if err := q.auditStarted(); err != nil {
+		return err
+	}
 	q.CheckPoints["tf"] = true
 	return couchdb.UpdateDoc(PrefixerC, q)
 }
 
+// writeInputTF writes the request to the Target Finder, with the buckets of
+// the concepts given by their SubscribeDocs. The buckets are read page by page
+// and written as they are read, so that the lists of instances are never held
+// in memory. The Target Finder reads them the same way (see readInputTF).
+func writeInputTF(w io.Writer, in query.InputTF, subscribeDocs map[string]string) error {
+
+	in.EncryptedBuckets = nil
+	head, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	// The buckets are written as the last field of the object
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, ",\"enc_buckets\":{"); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(subscribeDocs))
+	for name := range subscribeDocs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for index, name := range names {
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		if index > 0 {
+			key = append([]byte(","), key...)
+		}
+		if _, err := w.Write(append(key, ':', '[')); err != nil {
+			return err
+		}
+
+		first := true
+		err = forEachBucket(subscribeDocs[name], func(bucket *subscribe.BucketDoc) error {
+			value, err := json.Marshal(bucket.EncryptedInstances)
+			if err != nil {
+				return err
+			}
+			if !first {
+				value = append([]byte(","), value...)
+			}
+			first = false
+			_, err = w.Write(value)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "]"); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "}}")
+	return err
+}
+
 func (q *QueryDoc) makeLocalQuery() error {
 
 	task := metadata.NewTaskMetadata()
 
+	if len(q.Layers) == 0 {
+		return executionMetadata.HandleError("LocalQuery", task, errors.WrapErrors(errors.ErrInvalidFoldLayout, ""))
+	}
+
 	// Pass the list of targets to anther Cozy-DISPERS as Target
-	// Retrieve an array of encrypted data
+	// Target sends the data to the first layer of DAs, following the layout
 	inputT := query.InputT{
 		IsEncrypted:         q.IsEncrypted,
 		EncryptedLocalQuery: q.EncryptedLocalQuery,
@@ -252,12 +614,31 @@ func (q *QueryDoc) makeLocalQuery() error {
 		TaskMetadata:        task,
 		QueryID:             q.QueryID,
 		ConductorURL:        ConductorURL,
+		Deadline:            q.deadline(time.Now()),
+		Layout: query.FoldLayout{
+			Size:          q.Layers[0].Size,
+			EncryptedJobs: q.Layers[0].EncryptedJobs,
+			SecretSharing: q.Layers[0].SecretSharing,
+			Redundancy:    q.Layers[0].Redundancy,
+			Clipping:      q.Clipping,
+			PreAggregate:  q.Layers[0].PreAggregate,
+		},
 	}
 
 	fmt.Println("ConductorURL", ConductorURL)
 
+	// The Target is recorded before it is asked to query the instances: the
+	// Conductor asks it to send again the failed copies of the first layer
 	t := network.NewExternalActor(network.RoleT, network.ModeQuery)
-	t.DefineDispersActor("query")
+	if host, ok := network.HostByName(q.TargetHost); ok {
+		t.DefineDispersActorOn(host, "query")
+	} else {
+		t.DefineDispersActor("query")
+		q.TargetHost = t.URL.Host
+		if err := couchdb.UpdateDoc(PrefixerC, q); err != nil {
+			return executionMetadata.HandleError("LocalQuery", task, err)
+		}
+	}
 	if err := t.MakeRequest("POST", "", inputT, nil); err != nil {
 		return executionMetadata.HandleError("LocalQuery", task, err)
 	}
@@ -280,7 +661,7 @@ func (q *QueryDoc) ShouldBeComputed(indexLayer int) (bool, error) {
 		return false, nil
 	}
 
-	// ShouldBeComputed returns false if indexLayer finished or Running
+	// ShouldBeComputed returns false if indexLayer finished, Running or Failed
 	stateLayer, err := query.FetchAsyncStateLayer(q.QueryID, indexLayer, q.Layers[indexLayer].Size)
 	if err != nil {
 		return false, err
@@ -290,7 +671,7 @@ func (q *QueryDoc) ShouldBeComputed(indexLayer int) (bool, error) {
 	if indexLayer == 0 && stateLayer == query.Waiting {
 		return true, nil
 	}
-	if stateLayer == query.Finished || stateLayer == query.Running {
+	if stateLayer == query.Finished || stateLayer == query.Running || stateLayer == query.Failed {
 		return false, nil
 	}
 
@@ -310,100 +691,229 @@ func (q *QueryDoc) ShouldBeComputed(indexLayer int) (bool, error) {
 	return false, nil
 }
 
-func (q *QueryDoc) aggregateLayer(indexLayer int, layer *query.LayerDA) error {
+// layerFolds returns the folds of a layer, split from the results of the
+// previous layer. The rows are shuffled with a seed given by the query and the
+// layer, so that a fold can be sent again to another DA.
+func (q *QueryDoc) layerFolds(indexLayer int) ([][]map[string]interface{}, error) {
 
-	// if it is the first layer, data should be retrieved from Target's result
-	// if not, data should be fetched from async tasks' database.
+	// Data are fetched from async tasks' database.
 	var data []map[string]interface{}
-	if indexLayer == 0 {
-		data = layer.Data
-		if len(data) < 50 {
-			return errors.WrapErrors(errors.ErrNotEnoughDataToComputeQuery, "")
-		}
-	} else {
-		for indexDA := 0; indexDA < q.Layers[indexLayer-1].Size; indexDA++ {
-			rowData, err := query.FetchAsyncDataDA(q.ID(), indexLayer-1, indexDA)
-			if err != nil {
-				return err
-			}
-			data = append(data, rowData)
+	for indexDA := 0; indexDA < q.Layers[indexLayer-1].Size; indexDA++ {
+		rowData, err := query.FetchAsyncDataDA(q.ID(), indexLayer-1, indexDA)
+		if err != nil {
+			return nil, err
 		}
+		data = append(data, rowData)
 	}
 
 	if len(data) == 0 {
-		return errors.WrapErrors(errors.ErrNotEnoughDataToComputeQuery, "")
+		return nil, errors.WrapErrors(errors.ErrNotEnoughDataToComputeQuery, "")
 	}
 
-	// Shuffle Data to reduce bias
-	rand.Shuffle(len(data), func(i, j int) {
-		data[i], data[j] = data[j], data[i]
-	})
+	seed := fnv.New64a()
+	seed.Write([]byte(q.ID() + "-" + strconv.Itoa(indexLayer)))
+	rnd := rand.New(rand.NewSource(int64(seed.Sum64())))
 
 	// Distribute data in folds. Each DA will have one fold.
-	seps := make([]int, layer.Size+1)
-	if layer.Size > 1 {
-		if len(data)%layer.Size != 0 {
-			seps[len(seps)-1] = len(data)
-		}
-		for indexSep := 1; indexSep < len(seps)-1; indexSep++ {
-			seps[indexSep] = (len(data) / layer.Size) * indexSep
-		}
-	} else {
-		seps[1] = len(data)
+	return SplitInFolds(data, q.Layers[indexLayer].Size, rnd)
+}
+
+// sendFold sends a fold of a layer to the DA running on host. The copies of
+// a fold are numbered by replica.
+func (q *QueryDoc) sendFold(indexLayer int, indexDA int, replica int, host url.URL, fold []map[string]interface{}) error {
+
+	encData, err := wire.Encode(wire.TypeData, fold)
+	if err != nil {
+		return err
 	}
 
-	// Create InputDA for the layer
+	// The DA following a layer with secret sharing reconstructs the aggregate
 	inputDA := query.InputDA{
-		EncryptedJobs: layer.EncryptedJobs,
 		QueryID:       q.ID(),
+		AggregationID: [2]int{indexLayer, indexDA},
+		ConductorURL:  ConductorURL,
+		EncryptedJobs: q.Layers[indexLayer].EncryptedJobs,
+		EncryptedData: encData,
+		TaskMetadata:  metadata.NewTaskMetadata(),
+		Reconstruct:   q.Layers[indexLayer-1].SecretSharing,
+		Replica:       replica,
+		Host:          host.Host,
 	}
 
-	// Set Conductor's URL
-	inputDA.ConductorURL = ConductorURL
+	da := network.NewExternalActor(network.RoleDA, network.ModeQuery)
+	da.DefineDispersActorOn(host, "aggregation")
+	if err := da.MakeRequest("POST", "", inputDA, nil); err != nil {
+		return err
+	}
+	var out query.OutputDA
+	return json.Unmarshal(da.Out, &out)
+}
 
-	for indexDA := 0; indexDA < layer.Size; indexDA++ {
+func (q *QueryDoc) aggregateLayer(indexLayer int, layer *query.LayerDA) error {
+
+	// The first layer is fed by the Targets, the Conductor never sees its data
+	if indexLayer == 0 {
+		return errors.WrapErrors(errors.ErrInvalidFoldLayout, "")
+	}
+
+	folds, err := q.layerFolds(indexLayer)
+	if err != nil {
+		return err
+	}
+
+	for indexDA, fold := range folds {
 
-		// Fit inputDA for each DA (data, id, ...)
-		encData, err := json.Marshal(data[seps[indexDA]:seps[indexDA+1]])
-		if err != nil {
-			return err
-		}
-		inputDA.EncryptedData = encData
-		inputDA.AggregationID = [2]int{indexLayer, indexDA}
-		inputDA.TaskMetadata = metadata.NewTaskMetadata()
-		// make the request and unmarshal answer
 		// check one last time that DA hasnot been launched to prevent conflict
 		isExisting, err := query.IsAsyncTaskDAExisting(q.ID(), indexLayer, indexDA)
 		if err != nil {
 			return err
 		}
-		if !isExisting {
-			query.NewAsyncTask(q.ID(), query.AsyncAggregation, indexLayer, indexDA)
-			da := network.NewExternalActor(network.RoleDA, network.ModeQuery)
-			da.DefineDispersActor("aggregation")
-			if err := da.MakeRequest("POST", "", inputDA, nil); err != nil {
-				return err
-			}
-			var out query.OutputDA
-			if err := json.Unmarshal(da.Out, &out); err != nil {
-				return err
-			}
-		} else {
+		if isExisting {
 			// The job has already been launch, this means that another worker has taken the job
 			// there is nothing to do
 			// This end of the process prevent conflict in couchdb
 			return nil
 		}
+
+		task, err := query.NewAsyncTask(q.ID(), query.AsyncAggregation, indexLayer, indexDA)
+		if err != nil {
+			return err
+		}
+		// Each copy of the fold is computed on a distinct host
+		hosts, err := network.ChooseHosts(replicas(layer.Redundancy))
+		if err != nil {
+			return err
+		}
+		names := make([]string, len(hosts))
+		for replica, host := range hosts {
+			names[replica] = host.Host
+		}
+		if err := task.SetDispatched(names, foldDeadline(time.Now())); err != nil {
+			return err
+		}
+		for replica, host := range hosts {
+			if err := q.sendFold(indexLayer, indexDA, replica, host, fold); err != nil {
+				return err
+			}
+		}
 	}
 
 	// async tasks is now running
 	return couchdb.UpdateDoc(PrefixerC, q)
 }
 
+// foldsCoverRows returns true if the sizes of the folds given by the Targets
+// match their number of rows: the rows are split among the folds, or every
+// fold holds a share of every row with secret sharing. A fold cannot be empty.
+func foldsCoverRows(folds []int, rows int, secretSharing bool) bool {
+	sum := 0
+	for _, size := range folds {
+		if size <= 0 {
+			return false
+		}
+		if secretSharing && size != rows {
+			return false
+		}
+		sum += size
+	}
+	return secretSharing || sum == rows
+}
+
+// foldHostsValid returns true if the Targets have chosen a distinct host for
+// each copy of every fold
+func foldHostsValid(hosts [][]string, folds int, copies int) bool {
+	if len(hosts) != folds {
+		return false
+	}
+	for _, fold := range hosts {
+		if len(fold) != copies {
+			return false
+		}
+		seen := make(map[string]bool, len(fold))
+		for _, host := range fold {
+			if host == "" || seen[host] {
+				return false
+			}
+			seen[host] = true
+		}
+	}
+	return true
+}
+
+// RegisterFolds is called when the Targets have split the data of the first
+// layer into folds. The Conductor only learns how many rows are in each fold.
+// The async tasks of the first layer are created before the Targets send the
+// folds, so that the results of the Data Aggregators are expected. A Target
+// that has not been able to send the folds gives the error instead, and the
+// query fails, as it does when the quorum is not reached or the rows are too
+// few.
+func (q *QueryDoc) RegisterFolds(out query.OutputT) error {
+
+	if out.Error != "" {
+		return q.Fail(fmt.Errorf("%s: %s", errors.ErrTargetFailed, out.Error))
+	}
+
+	task := metadata.NewTaskMetadata()
+
+	// The querier learns how many instances have answered, whether the query
+	// goes on or not. Without enough instances or rows, the query ends.
+	q.Targets = out.Targets
+	if !q.quorumReached(out.Targets) {
+		return q.Fail(errors.ErrQuorumNotReached)
+	}
+	if out.NumberOfRows < MinimumRows {
+		return q.Fail(errors.ErrNotEnoughDataToComputeQuery)
+	}
+	if len(q.Layers) == 0 || len(out.Folds) != q.Layers[0].Size {
+		return executionMetadata.HandleError("LaunchLayer0", task, errors.WrapErrors(errors.ErrInvalidFoldLayout, ""))
+	}
+	if !foldsCoverRows(out.Folds, out.NumberOfRows, q.Layers[0].SecretSharing) {
+		return executionMetadata.HandleError("LaunchLayer0", task, errors.WrapErrors(errors.ErrInvalidFoldLayout, ""))
+	}
+	if !foldHostsValid(out.Hosts, len(out.Folds), replicas(q.Layers[0].Redundancy)) {
+		return executionMetadata.HandleError("LaunchLayer0", task, errors.WrapErrors(errors.ErrInvalidFoldLayout, ""))
+	}
+
+	for indexDA := range out.Folds {
+		// check that the fold has not been registered yet to prevent conflict
+		isExisting, err := query.IsAsyncTaskDAExisting(q.ID(), 0, indexDA)
+		if err != nil {
+			return err
+		}
+		if !isExisting {
+			// The hosts of the first layer are chosen by the Targets
+			task, err := query.NewAsyncTask(q.ID(), query.AsyncAggregation, 0, indexDA)
+			if err != nil {
+				return err
+			}
+			if err := task.SetDispatched(out.Hosts[indexDA], foldDeadline(time.Now())); err != nil {
+				return err
+			}
+		}
+	}
+
+	q.ClippedRows = out.ClippedRows
+	q.RejectedRows = out.RejectedRows
+	q.CheckPoints["t"] = true
+	if err := couchdb.UpdateDoc(PrefixerC, q); err != nil {
+		return err
+	}
+	return executionMetadata.HandleError("LaunchLayer0", task, nil)
+}
+
 // Lead is the most general method. It will use the 5 previous methods to work.
 // Lead can also be used to resume a query thanks to checkpoints.
 func (q *QueryDoc) Lead() error {
 
+	if q.Failure != "" {
+		return errors.WrapErrors(errors.ErrQueryFailed, "")
+	}
+
+	// A query that has already ended is not ended again when it is resumed
+	if q.CheckPoints["da"] {
+		return nil
+	}
+
 	if q.CheckPoints["ci"] != true {
 		if err := q.decryptConcept(); err != nil {
 			return err
@@ -451,6 +961,10 @@ func (q *QueryDoc) Lead() error {
 
 func (q *QueryDoc) TryToEndQuery() error {
 
+	if q.CheckPoints["da"] {
+		return nil
+	}
+
 	// check if query is finished
 	isQueryFinished := true
 	for indexLayer, layer := range q.Layers {
@@ -458,6 +972,10 @@ func (q *QueryDoc) TryToEndQuery() error {
 		if err != nil {
 			return err
 		}
+		// A fold that cannot be retried anymore fails the query
+		if state == query.Failed {
+			return FailQuery(q.ID(), errors.ErrFoldFailed)
+		}
 		if state != query.Finished {
 			isQueryFinished = false
 		}
@@ -468,25 +986,120 @@ func (q *QueryDoc) TryToEndQuery() error {
 		if err != nil {
 			return err
 		}
+		if q.CheckPoints["da"] {
+			return nil
+		}
 		// get results
 		res, err := query.FetchAsyncDataDA(q.ID(), len(q.Layers)-1, 0)
 		if err != nil {
 			return err
 		}
+		// The querier learns how many rows have been altered by the clipping
+		if len(q.Clipping) > 0 {
+			res["clipped_rows"] = q.ClippedRows
+			res["rejected_rows"] = q.RejectedRows
+		}
+		if q.Completion.Timeout != "" {
+			res["targets"] = q.Targets
+		}
 		q.Results = res
 		// mark checkpoint
 		q.CheckPoints["da"] = true
+		q.RunningUntil = nil
 		executionMetadata.EndExecution(nil)
-		return couchdb.UpdateDoc(PrefixerC, q)
+		// A thread ending the query at the same time has fetched the same
+		// revision: only one update succeeds, and the query is only released
+		// and audited once
+		if err := couchdb.UpdateDoc(PrefixerC, q); err != nil {
+			if couchdb.IsConflictError(err) {
+				return nil
+			}
+			return err
+		}
+		if err := q.auditEnded(audit.OutcomeFinished); err != nil {
+			return err
+		}
+		return querier.ReleaseQuery(q.Owner)
 	}
 
 	return nil
 }
 
-// RetrieveSubscribeDoc is used to get a Subscribe doc from the Conductor's database.
-// It returns either an empty array of SubscribeDoc or an array of length 1
-// It returns an error if there is more than 1 subscribe doc.
-func RetrieveSubscribeDoc(hash []byte) ([]subscribe.SubscribeDoc, error) {
+// Fail ends the query with an error. The querier reads it in the query and
+// its execution metadata, and the query stops counting in the running queries
+// of its owner. A query that has already ended does not fail.
+func (q *QueryDoc) Fail(cause error) error {
+	return q.endWithError(audit.OutcomeFailed, cause)
+}
+
+func (q *QueryDoc) endWithError(outcome string, cause error) error {
+
+	if q.CheckPoints["da"] {
+		return nil
+	}
+	if q.CheckPoints == nil {
+		q.CheckPoints = make(map[string]bool)
+	}
+	q.CheckPoints["da"] = true
+	q.Failure = cause.Error()
+	q.RunningUntil = nil
+	// If another thread has already ended the query, the update fails and the
+	// query is only released once
+	if err := couchdb.UpdateDoc(PrefixerC, q); err != nil {
+		return err
+	}
+
+	execution, err := metadata.RetrieveExecutionMetadata(q.ID())
+	if err != nil {
+		return err
+	}
+	if err := execution.EndExecution(cause); err != nil {
+		return err
+	}
+	if err := q.auditEnded(outcome); err != nil {
+		return err
+	}
+	return querier.ReleaseQuery(q.Owner)
+}
+
+// FailQuery ends a query with an error, see QueryDoc.Fail
+func FailQuery(queryid string, cause error) error {
+
+	q := &QueryDoc{}
+	if err := couchdb.GetDoc(PrefixerC, "io.cozy.query", queryid, q); err != nil {
+		return err
+	}
+	return q.Fail(cause)
+}
+
+// AbandonQueries ends the queries that are still running after
+// RunningQueryTTL, so that they are recorded in the audit log
+func AbandonQueries(now time.Time) error {
+
+	var queries []*QueryDoc
+	req := &couchdb.FindRequest{
+		Selector: mango.Lt("running_until", now.UTC()),
+		Limit:    1000,
+	}
+	if err := couchdb.FindDocs(PrefixerC, "io.cozy.query", req, &queries); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, q := range queries {
+		if err := q.endWithError(audit.OutcomeAbandoned, errors.ErrQueryAbandoned); err != nil && !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetrieveSubscribeDoc is used to get a Subscribe doc from the Conductor's database.
+// It returns either an empty array of SubscribeDoc or an array of length 1
+// It returns an error if there is more than 1 subscribe doc.
+func RetrieveSubscribeDoc(hash []byte) ([]subscribe.SubscribeDoc, error) {
 
 	var out []subscribe.SubscribeDoc
 	req := &couchdb.FindRequest{Selector: mango.Equal("hash", hash)}
@@ -501,9 +1114,70 @@ func RetrieveSubscribeDoc(hash []byte) ([]subscribe.SubscribeDoc, error) {
 	return out, nil
 }
 
-// CreateConceptInConductorDB is used to add a concept to Cozy-DISPERS
+// retrieveConceptSubscribeDoc returns the SubscribeDoc of a concept. While the
+// Concept Indexor's keys are rotated, the SubscribeDoc can still be saved
+// with the previous hash of the concept.
+func retrieveConceptSubscribeDoc(hash []byte, previousHash []byte) ([]subscribe.SubscribeDoc, error) {
+
+	out, err := RetrieveSubscribeDoc(hash)
+	if err != nil || len(out) > 0 || previousHash == nil {
+		return out, err
+	}
+	return RetrieveSubscribeDoc(previousHash)
+}
+
+// RotateConceptKeys asks the Concept Indexor to re-key every concept, then
+// moves the lists of instances to the new hashes. No subscription is lost: a
+// list is found with either hash until the rotation is committed. The
+// rotation can be run again if it has been interrupted. It returns the number
+// of SubscribeDocs that have been moved.
+func RotateConceptKeys() (int, error) {
+
+	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
+	ci.DefineDispersActor("rotation")
+	if err := ci.MakeRequest("POST", "", nil, nil); err != nil {
+		return 0, err
+	}
+	var outputCI query.OutputCI
+	if err := json.Unmarshal(ci.Out, &outputCI); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, concept := range outputCI.Hashes {
+		docs, err := RetrieveSubscribeDoc(concept.PreviousHash)
+		if err != nil {
+			return moved, err
+		}
+		// The list has already been moved, or the concept has no list
+		if len(docs) == 0 {
+			continue
+		}
+		docs[0].Hash = concept.Hash
+		if err := couchdb.UpdateDoc(PrefixerC, &docs[0]); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	ci.DefineDispersActor("rotation")
+	if err := ci.MakeRequest("DELETE", "", nil, nil); err != nil {
+		return moved, err
+	}
+	return moved, nil
+}
+
+// CreateConceptInConductorDB is used to add a concept to Cozy-DISPERS. The
+// concepts are created on both the Concept Indexor and the Conductor, or on
+// none of them: when a step fails, the steps already done are compensated.
 func CreateConceptInConductorDB(in *query.InputCI) error {
 
+	mu := lock.ReadWrite(PrefixerC, "dispers/concepts")
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
 	if !in.IsEncrypted {
 		in.EncryptedConcepts = []query.Concept{}
 		for _, concept := range in.Concepts {
@@ -511,125 +1185,684 @@ func CreateConceptInConductorDB(in *query.InputCI) error {
 		}
 	}
 
-	// try to create concept
+	// The Concept Indexor creates every concept or none of them
 	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
 	ci.DefineDispersActor("concept")
-	errPost := ci.MakeRequest("POST", "", *in, nil)
-
-	// try to get concept
-	path := query.ConceptsToString(in.EncryptedConcepts) + "/" + strconv.FormatBool(in.IsEncrypted)
-	ci.DefineDispersActor("concept/" + path)
-	err := ci.MakeRequest("GET", "", nil, nil)
-
-	// if error, returns the first error that occurred between POST et Get
-	if err != nil {
-		if errPost != nil {
-			return errPost
-		}
+	if err := ci.MakeRequest("POST", "", *in, nil); err != nil {
 		return err
 	}
-
-	// If success, get CI's result
 	var out query.OutputCI
-	err = json.Unmarshal(ci.Out, &out)
-	if err != nil {
+	if err := json.Unmarshal(ci.Out, &out); err != nil {
 		return err
 	}
 
 	// Create a SubscribeDoc for each concept
+	created := []subscribe.SubscribeDoc{}
 	for _, concept := range out.Hashes {
-		s, err := RetrieveSubscribeDoc(concept.Hash)
+		s, err := retrieveConceptSubscribeDoc(concept.Hash, concept.PreviousHash)
 		if err != nil {
-			return err
+			return compensateConcepts(out.Hashes, created, err)
+		}
+		if len(s) > 0 {
+			return compensateConcepts(out.Hashes, created, errors.WrapErrors(errors.ErrConceptAlreadyInConductorDB, ""))
 		}
 
-		// Check if Concept is unexistant
-		if len(s) < 1 {
-			listOfInsts := []query.Instance{}
-			marshaledListOfInsts, err := json.Marshal(listOfInsts)
-			if err != nil {
-				return nil
-			}
-			sub := subscribe.SubscribeDoc{
-				Hash:               concept.Hash,
-				EncryptedInstances: marshaledListOfInsts,
-			}
-			if err := couchdb.CreateDoc(PrefixerC, &sub); err != nil {
-				return err
-			}
-		} else {
-			// TODO : Delete successfully created SubscribeDoc to finish with a statut quo
-			return errors.WrapErrors(errors.ErrConceptAlreadyInConductorDB, "")
+		// The buckets are created by the subscriptions
+		sub := subscribe.SubscribeDoc{
+			Hash:   concept.Hash,
+			Shards: SubscriptionShards,
 		}
+		if err := couchdb.CreateDoc(PrefixerC, &sub); err != nil {
+			return compensateConcepts(out.Hashes, created, err)
+		}
+		created = append(created, sub)
 	}
 
 	return nil
 }
 
-// Subscribe leads the subscription process
-func Subscribe(in *subscribe.InputConductor) error {
+// compensateConcepts rolls back a concepts' creation that failed with cause.
+// If the rollback fails too, the orphaned documents are left to the
+// reconciliation (see FindOrphans).
+func compensateConcepts(hashes []query.Concept, created []subscribe.SubscribeDoc, cause error) error {
+
+	log := logger.WithNamespace("dispers")
+	for index := range created {
+		if err := couchdb.DeleteDoc(PrefixerC, &created[index]); err != nil {
+			log.Errorf("Cannot roll back the creation of a SubscribeDoc: %s", err)
+		}
+	}
+
+	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
+	ci.DefineDispersActor("hashes")
+	if err := ci.MakeRequest("DELETE", "", query.InputCI{EncryptedConcepts: hashes}, nil); err != nil {
+		log.Errorf("Cannot roll back the creation of concepts: %s", err)
+	}
+
+	return cause
+}
+
+// OrphanSubscribeDoc is a list of instances whose concept is unknown by the
+// Concept Indexor
+type OrphanSubscribeDoc struct {
+	ID          string `json:"id"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// Orphans are the documents left by the concepts' creations that have been
+// interrupted before being completed or compensated: the concepts of the
+// Concept Indexor without a list of instances, and the lists of instances
+// without a concept.
+type Orphans struct {
+	Concepts      []query.Concept      `json:"concepts"`
+	SubscribeDocs []OrphanSubscribeDoc `json:"subscribe_docs"`
+}
+
+// FindOrphans compares the concepts of the Concept Indexor with the
+// SubscribeDocs of the Conductor
+func FindOrphans() (*Orphans, error) {
+
+	mu := lock.ReadWrite(PrefixerC, "dispers/concepts")
+	if err := mu.Lock(); err != nil {
+		return nil, err
+	}
+	defer mu.Unlock()
+	return findOrphans()
+}
+
+func findOrphans() (*Orphans, error) {
+
+	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
+	ci.DefineDispersActor("hashes")
+	if err := ci.MakeRequest("GET", "", nil, nil); err != nil {
+		return nil, err
+	}
+	var outputCI query.OutputCI
+	if err := json.Unmarshal(ci.Out, &outputCI); err != nil {
+		return nil, err
+	}
+
+	docs, err := allSubscribeDocs()
+	if err != nil {
+		return nil, err
+	}
+
+	onConductor := make(map[string]bool)
+	for _, doc := range docs {
+		onConductor[string(doc.Hash)] = true
+	}
+	// While the keys are rotated, a SubscribeDoc can have the previous hash
+	onCI := make(map[string]bool)
+	for _, concept := range outputCI.Hashes {
+		onCI[string(concept.Hash)] = true
+		if concept.PreviousHash != nil {
+			onCI[string(concept.PreviousHash)] = true
+		}
+	}
+
+	orphans := &Orphans{
+		Concepts:      []query.Concept{},
+		SubscribeDocs: []OrphanSubscribeDoc{},
+	}
+	for _, concept := range outputCI.Hashes {
+		if !onConductor[string(concept.Hash)] && !onConductor[string(concept.PreviousHash)] {
+			orphans.Concepts = append(orphans.Concepts, query.Concept{Hash: concept.Hash})
+		}
+	}
+	for index := range docs {
+		if onCI[string(docs[index].Hash)] {
+			continue
+		}
+		count, err := countSubscribers(&docs[index])
+		if err != nil {
+			return nil, err
+		}
+		orphans.SubscribeDocs = append(orphans.SubscribeDocs, OrphanSubscribeDoc{
+			ID:          docs[index].ID(),
+			Subscribers: count,
+		})
+	}
+
+	return orphans, nil
+}
+
+// RemoveOrphans deletes the orphaned documents on both sides and returns
+// them. The instances of an orphaned SubscribeDoc cannot be reached by any
+// query, since its concept does not exist anymore.
+func RemoveOrphans() (*Orphans, error) {
+
+	mu := lock.ReadWrite(PrefixerC, "dispers/concepts")
+	if err := mu.Lock(); err != nil {
+		return nil, err
+	}
+	defer mu.Unlock()
+
+	orphans, err := findOrphans()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(orphans.Concepts) > 0 {
+		ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
+		ci.DefineDispersActor("hashes")
+		if err := ci.MakeRequest("DELETE", "", query.InputCI{EncryptedConcepts: orphans.Concepts}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, orphan := range orphans.SubscribeDocs {
+		doc := &subscribe.SubscribeDoc{}
+		if err := couchdb.GetDoc(PrefixerC, "io.cozy.instances", orphan.ID, doc); err != nil {
+			return nil, err
+		}
+		buckets, err := conceptBuckets(orphan.ID)
+		if err != nil {
+			return nil, err
+		}
+		for index := range buckets {
+			if err := couchdb.DeleteDoc(PrefixerC, &buckets[index]); err != nil {
+				return nil, err
+			}
+		}
+		if err := couchdb.DeleteDoc(PrefixerC, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return orphans, nil
+}
+
+// conceptsSubscribeDocs returns the SubscribeDocs of the concepts given by
+// the instance. With withAncestors, the SubscribeDocs of their parent
+// concepts are returned too: subscribing to "travail>lille" counts for
+// "travail".
+func conceptsSubscribeDocs(in *subscribe.InputConductor, withAncestors bool) ([]subscribe.SubscribeDoc, error) {
 
 	// Get Concepts' hash
 	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
 	ci.DefineDispersActor("concept/" + strings.Join(in.Concepts, ":") + "/" + strconv.FormatBool(in.IsEncrypted))
+	if withAncestors {
+		ci.URL.RawQuery = url.Values{"expand": {"ancestors"}}.Encode()
+	}
 	if err := ci.MakeRequest("GET", "", nil, nil); err != nil {
-		return err
+		return nil, err
 	}
 	var outputCI query.OutputCI
 	if err := json.Unmarshal(ci.Out, &outputCI); err != nil {
-		return err
+		return nil, err
 	}
 
 	var docs []subscribe.SubscribeDoc
-	var err error
-	var outEnc subscribe.OutputEncrypt
 	for _, hash := range outputCI.Hashes {
 
 		// Get SubscribeDoc from db
-		docs, err = RetrieveSubscribeDoc(hash.Hash)
+		found, err := retrieveConceptSubscribeDoc(hash.Hash, hash.PreviousHash)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			if hash.Implicit {
+				continue
+			}
+			return nil, errors.WrapErrors(errors.ErrSubscribeDocNotFound, "")
+		}
+		docs = append(docs, found[0])
+	}
+
+	return docs, nil
+}
+
+// forEachBucket calls fn with the existing buckets of the list of instances
+// of a concept. The buckets are read page by page.
+func forEachBucket(conceptID string, fn func(bucket *subscribe.BucketDoc) error) error {
+
+	startKey, endKey := subscribe.BucketsRange(conceptID)
+	req := &couchdb.AllDocsRequest{StartKey: startKey, EndKey: endKey, Limit: bucketsPageSize}
+	for {
+		var buckets []subscribe.BucketDoc
+		err := couchdb.GetAllDocs(PrefixerC, subscribe.DoctypeBucket, req, &buckets)
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		if len(docs) == 0 {
-			return errors.WrapErrors(errors.ErrSubscribeDocNotFound, "")
+		for index := range buckets {
+			if err := fn(&buckets[index]); err != nil {
+				return err
+			}
+		}
+		if len(buckets) < bucketsPageSize {
+			return nil
 		}
-		doc := docs[0]
+		req.StartKey = buckets[len(buckets)-1].ID()
+		req.Skip = 1
+	}
+}
+
+// conceptBuckets returns the existing buckets of the list of instances of a
+// concept
+func conceptBuckets(conceptID string) ([]subscribe.BucketDoc, error) {
+	var buckets []subscribe.BucketDoc
+	err := forEachBucket(conceptID, func(bucket *subscribe.BucketDoc) error {
+		buckets = append(buckets, *bucket)
+		return nil
+	})
+	return buckets, err
+}
+
+// countSubscribers returns the number of instances in the buckets of a
+// concept
+func countSubscribers(doc *subscribe.SubscribeDoc) (int, error) {
+	if err := splitSubscribeDoc(doc); err != nil {
+		return 0, err
+	}
+	count := 0
+	err := forEachBucket(doc.ID(), func(bucket *subscribe.BucketDoc) error {
+		count += bucket.Subscribers
+		return nil
+	})
+	return count, err
+}
 
-		// Ask Target Finder to Decrypt
+// splitSubscribeDoc moves the list of instances saved before the lists were
+// split to the buckets of the concept. The list is kept until every bucket
+// has been saved, so that an interrupted split can be done again.
+func splitSubscribeDoc(doc *subscribe.SubscribeDoc) error {
+
+	if doc.Shards > 0 && len(doc.EncryptedInstances) == 0 {
+		return nil
+	}
+	if doc.Shards == 0 {
+		doc.Shards = SubscriptionShards
+	}
+
+	if len(doc.EncryptedInstances) > 0 {
 		tf := network.NewExternalActor(network.RoleTF, network.ModeSubscribe)
-		tf.DefineDispersActor("decrypt")
-		err = tf.MakeRequest("POST", "", subscribe.InputDecrypt{
-			IsEncrypted:        in.IsEncrypted,
+		tf.DefineDispersActor("split")
+		err := tf.MakeRequest("POST", "", subscribe.InputSplit{
 			EncryptedInstances: doc.EncryptedInstances,
-			EncryptedInstance:  in.EncryptedInstance,
+			Shards:             doc.Shards,
 		}, nil)
 		if err != nil {
 			return err
 		}
+		var out subscribe.OutputSplit
+		if err := json.Unmarshal(tf.Out, &out); err != nil {
+			return err
+		}
+		if err := saveBuckets(doc.ID(), &out, -1); err != nil {
+			return err
+		}
+	}
+
+	doc.EncryptedInstances = nil
+	return couchdb.UpdateDoc(PrefixerC, doc)
+}
 
-		// Ask Target to add instance by following TF's output
-		t := network.NewExternalActor(network.RoleT, network.ModeSubscribe)
-		t.DefineDispersActor("insert")
-		if err := t.MakeRequest("POST", "", nil, tf.Out); err != nil {
+// saveBuckets saves the buckets of a concept given by the Target Finder,
+// except the bucket except
+func saveBuckets(conceptID string, out *subscribe.OutputSplit, except int) error {
+	for bucket, encInstances := range out.Buckets {
+		if bucket == except {
+			continue
+		}
+		b := &subscribe.BucketDoc{
+			BucketID:           subscribe.BucketID(conceptID, bucket),
+			ConceptID:          conceptID,
+			Bucket:             bucket,
+			EncryptedInstances: encInstances,
+			Subscribers:        out.Counts[bucket],
+		}
+		if err := couchdb.Upsert(PrefixerC, b); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// conceptLock returns the lock of the buckets of a concept. It is held for
+// reading by the subscriptions, and for writing when the buckets are split.
+func conceptLock(conceptID string) lock.ErrorRWLocker {
+	return lock.ReadWrite(PrefixerC, "dispers/buckets/"+conceptID)
+}
 
-		// Ask Target Finder to Encrypt by following T's output
-		tf = network.NewExternalActor(network.RoleTF, network.ModeSubscribe)
-		tf.DefineDispersActor("encrypt")
-		if err := tf.MakeRequest("POST", "", nil, t.Out); err != nil {
+// growSubscribeDoc doubles the number of shards of a concept, if it still has
+// got the given number of shards, so that the buckets keep a bounded size
+// whatever the number of subscribers. The instances of the bucket b go to the
+// buckets b and b+shards, and the second one does not exist yet: the buckets
+// are split one by one. The next number of shards is saved first, so that an
+// interrupted growth is finished before the buckets are used again.
+func growSubscribeDoc(doc *subscribe.SubscribeDoc, shards int) error {
+
+	mu := conceptLock(doc.ID())
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	if err := couchdb.GetDoc(PrefixerC, doc.DocType(), doc.ID(), doc); err != nil {
+		return err
+	}
+	// Another subscription has made the concept grow
+	if doc.Shards != shards {
+		return nil
+	}
+	if doc.NextShards == 0 {
+		doc.NextShards = 2 * doc.Shards
+		if err := couchdb.UpdateDoc(PrefixerC, doc); err != nil {
 			return err
 		}
-		if err := json.Unmarshal(tf.Out, &outEnc); err != nil {
+	}
+
+	// The buckets are deleted when they are emptied, they are listed before
+	// being split
+	buckets := []int{}
+	err := forEachBucket(doc.ID(), func(b *subscribe.BucketDoc) error {
+		if b.Bucket < doc.Shards {
+			buckets = append(buckets, b.Bucket)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err := splitBucket(doc, bucket); err != nil {
 			return err
 		}
+	}
+
+	doc.Shards = doc.NextShards
+	doc.NextShards = 0
+	return couchdb.UpdateDoc(PrefixerC, doc)
+}
+
+// splitBucket moves the instances of a bucket to their bucket in the next
+// number of shards of the concept. The new buckets are saved before the
+// bucket is rewritten, so that the split can be done again.
+func splitBucket(doc *subscribe.SubscribeDoc, bucket int) error {
+
+	b := &subscribe.BucketDoc{}
+	err := couchdb.GetDoc(PrefixerC, subscribe.DoctypeBucket, subscribe.BucketID(doc.ID(), bucket), b)
+	if err != nil {
+		return err
+	}
+
+	tf := network.NewExternalActor(network.RoleTF, network.ModeSubscribe)
+	tf.DefineDispersActor("split")
+	err = tf.MakeRequest("POST", "", subscribe.InputSplit{
+		EncryptedInstances: b.EncryptedInstances,
+		Shards:             doc.NextShards,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	var out subscribe.OutputSplit
+	if err := json.Unmarshal(tf.Out, &out); err != nil {
+		return err
+	}
+	if err := saveBuckets(doc.ID(), &out, bucket); err != nil {
+		return err
+	}
+
+	encInstances, ok := out.Buckets[bucket]
+	if !ok {
+		return couchdb.DeleteDoc(PrefixerC, b)
+	}
+	b.EncryptedInstances = encInstances
+	b.Subscribers = out.Counts[bucket]
+	return couchdb.UpdateDoc(PrefixerC, b)
+}
+
+// updateBucket asks the Target to insert, remove or refresh the instance in
+// its bucket of a concept. action is the Target's route. When another
+// subscription has updated the bucket meanwhile, the update is done again, and
+// when the buckets of the concept have been split meanwhile, the bucket of the
+// instance is asked again. A bucket holding more than BucketCapacity instances
+// makes the concept grow.
+func updateBucket(doc *subscribe.SubscribeDoc, bucket int, in *subscribe.InputConductor, action string) error {
+
+	var err error
+	count := 0
+	for attempt := 0; attempt < maxBucketAttempts; attempt++ {
+		count, err = lockedUpdateBucket(doc, bucket, in, action)
+		if err == errors.ErrShardsChanged {
+			if doc.NextShards > 0 {
+				if err := growSubscribeDoc(doc, doc.Shards); err != nil {
+					return err
+				}
+			}
+			buckets, errBucket := instanceBuckets(in, []int{doc.Shards})
+			if errBucket != nil {
+				return errBucket
+			}
+			var ok bool
+			if bucket, ok = buckets[doc.Shards]; !ok {
+				return errors.WrapErrors(errors.ErrUnmarshal, "bucket")
+			}
+			continue
+		}
+		if !couchdb.IsConflictError(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if count > BucketCapacity {
+		return growSubscribeDoc(doc, doc.Shards)
+	}
+	return nil
+}
 
-		// Update subscribe doc
-		doc.EncryptedInstances = outEnc.EncryptedInstances
-		if err := couchdb.UpdateDoc(PrefixerC, &doc); err != nil {
+// lockedUpdateBucket updates the bucket of the instance while the buckets of
+// the concept cannot be split, and returns the number of instances in the
+// bucket
+func lockedUpdateBucket(doc *subscribe.SubscribeDoc, bucket int, in *subscribe.InputConductor, action string) (int, error) {
+
+	mu := conceptLock(doc.ID())
+	if err := mu.RLock(); err != nil {
+		return 0, err
+	}
+	defer mu.RUnlock()
+
+	shards := doc.Shards
+	if err := couchdb.GetDoc(PrefixerC, doc.DocType(), doc.ID(), doc); err != nil {
+		return 0, err
+	}
+	if doc.Shards != shards || doc.NextShards > 0 {
+		return 0, errors.ErrShardsChanged
+	}
+	return tryUpdateBucket(doc, bucket, in, action)
+}
+
+func tryUpdateBucket(doc *subscribe.SubscribeDoc, bucket int, in *subscribe.InputConductor, action string) (int, error) {
+
+	b := &subscribe.BucketDoc{}
+	id := subscribe.BucketID(doc.ID(), bucket)
+	err := couchdb.GetDoc(PrefixerC, subscribe.DoctypeBucket, id, b)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		// An empty bucket has nothing to remove or refresh
+		if action != "insert" {
+			return 0, nil
+		}
+		b = &subscribe.BucketDoc{BucketID: id, ConceptID: doc.ID(), Bucket: bucket}
+	} else if err != nil {
+		return 0, err
+	}
+
+	// Ask Target Finder to Decrypt
+	tf := network.NewExternalActor(network.RoleTF, network.ModeSubscribe)
+	tf.DefineDispersActor("decrypt")
+	err = tf.MakeRequest("POST", "", subscribe.InputDecrypt{
+		IsEncrypted:        in.IsEncrypted,
+		EncryptedInstances: b.EncryptedInstances,
+		EncryptedInstance:  in.EncryptedInstance,
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Ask Target to add or remove instance by following TF's output
+	t := network.NewExternalActor(network.RoleT, network.ModeSubscribe)
+	t.DefineDispersActor(action)
+	if err := t.MakeRequest("POST", "", nil, tf.Out); err != nil {
+		return 0, err
+	}
+
+	// Ask Target Finder to Encrypt by following T's output
+	tf = network.NewExternalActor(network.RoleTF, network.ModeSubscribe)
+	tf.DefineDispersActor("encrypt")
+	if err := tf.MakeRequest("POST", "", nil, t.Out); err != nil {
+		return 0, err
+	}
+	var outEnc subscribe.OutputEncrypt
+	if err := json.Unmarshal(tf.Out, &outEnc); err != nil {
+		return 0, err
+	}
+
+	// Update the bucket
+	b.EncryptedInstances = outEnc.EncryptedInstances
+	b.Subscribers = outEnc.Count
+	if b.Rev() == "" {
+		return b.Subscribers, couchdb.CreateNamedDocWithDB(PrefixerC, b)
+	}
+	return b.Subscribers, couchdb.UpdateDoc(PrefixerC, b)
+}
+
+// updateSubscribeDocs asks the Target to insert, remove or refresh the
+// instance in the list of instances of each concept. Only the bucket of the
+// instance is rewritten: the Target Finder gives it once for every number of
+// shards used by the concepts.
+func updateSubscribeDocs(docs []subscribe.SubscribeDoc, in *subscribe.InputConductor, action string) error {
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	shards := []int{}
+	seen := make(map[int]bool)
+	for index := range docs {
+		if err := splitSubscribeDoc(&docs[index]); err != nil {
 			return err
 		}
+		// A growth that has been interrupted is finished first
+		if docs[index].NextShards > 0 {
+			if err := growSubscribeDoc(&docs[index], docs[index].Shards); err != nil {
+				return err
+			}
+		}
+		if !seen[docs[index].Shards] {
+			seen[docs[index].Shards] = true
+			shards = append(shards, docs[index].Shards)
+		}
 	}
 
+	buckets, err := instanceBuckets(in, shards)
+	if err != nil {
+		return err
+	}
+
+	for index := range docs {
+		bucket, ok := buckets[docs[index].Shards]
+		if !ok {
+			return errors.WrapErrors(errors.ErrUnmarshal, "bucket")
+		}
+		if err := updateBucket(&docs[index], bucket, in, action); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// instanceBuckets asks the Target Finder the bucket of the instance for each
+// number of shards
+func instanceBuckets(in *subscribe.InputConductor, shards []int) (map[int]int, error) {
+
+	tf := network.NewExternalActor(network.RoleTF, network.ModeSubscribe)
+	tf.DefineDispersActor("bucket")
+	err := tf.MakeRequest("POST", "", subscribe.InputBucket{
+		IsEncrypted:       in.IsEncrypted,
+		EncryptedInstance: in.EncryptedInstance,
+		Shards:            shards,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out subscribe.OutputBucket
+	if err := json.Unmarshal(tf.Out, &out); err != nil {
+		return nil, err
+	}
+	return out.Buckets, nil
+}
+
+// Subscribe leads the subscription process
+func Subscribe(in *subscribe.InputConductor) error {
+
+	docs, err := conceptsSubscribeDocs(in, true)
+	if err != nil {
+		return err
+	}
+
+	return updateSubscribeDocs(docs, in, "insert")
+}
+
+// Unsubscribe removes the instance from the lists of instances of the given
+// concepts and of their ancestors, which it has been added to by Subscribe
+func Unsubscribe(in *subscribe.InputConductor) error {
+
+	docs, err := conceptsSubscribeDocs(in, true)
+	if err != nil {
+		return err
+	}
+
+	return updateSubscribeDocs(docs, in, "remove")
+}
+
+// allSubscribeDocs returns the SubscribeDocs of every concept. It is used when
+// the Conductor cannot know which concepts an instance has subscribed to.
+func allSubscribeDocs() ([]subscribe.SubscribeDoc, error) {
+	var docs []subscribe.SubscribeDoc
+	err := couchdb.GetAllDocs(PrefixerC, "io.cozy.instances", nil, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// RefreshToken rotates the token of an instance in every concept it has
+// subscribed to. The Target checks the previous token.
+func RefreshToken(in *subscribe.InputConductor) error {
+
+	docs, err := allSubscribeDocs()
+	if err != nil {
+		return err
+	}
+
+	return updateSubscribeDocs(docs, in, "refresh")
+}
+
+// Withdraw removes the instance from every concept. Then the Target is told
+// to stop querying the instance, even for the running queries.
+func Withdraw(in *subscribe.InputConductor) error {
+
+	docs, err := allSubscribeDocs()
+	if err != nil {
+		return err
+	}
+
+	// The Target checks the instance's token, so that an instance can only
+	// be removed by itself
+	if err := updateSubscribeDocs(docs, in, "remove"); err != nil {
+		return err
+	}
+
+	t := network.NewExternalActor(network.RoleT, network.ModeSubscribe)
+	t.DefineDispersActor("withdraw")
+	return t.MakeRequest("POST", "", subscribe.InputInsert{
+		IsEncrypted:       in.IsEncrypted,
+		EncryptedInstance: in.EncryptedInstance,
+	}, nil)
+}
@@ -1,15 +1,20 @@
 package enclave
 
 import (
+	"bytes"
 	"encoding/json"
-	"io/ioutil"
-	"path/filepath"
-	"strings"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/audit"
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
 	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/querier"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
 	"github.com/cozy/cozy-stack/pkg/dispers/subscribe"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,6 +22,10 @@ var (
 	in = query.InputNewQuery{
 		IsEncrypted:   false,
 		TargetProfile: "OR(OR(\"test1\",\"test2\"),OR(\"test3\",\"test4\"))",
+		LocalQuery: query.LocalQuery{
+			Doctype:     "iris",
+			FindRequest: query.FindParams{Fields: []string{"sepal_length", "sepal_width"}},
+		},
 	}
 )
 
@@ -63,13 +72,11 @@ func TestSubscribe(t *testing.T) {
 	err = json.Unmarshal(ci.Out, &outputCI)
 	assert.NoError(t, err)
 
-	var listOfInstance []string
 	docs, err := RetrieveSubscribeDoc(outputCI.Hashes[0].Hash)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(docs))
 	if len(docs) == 1 {
-		json.Unmarshal(docs[0].EncryptedInstances, &listOfInstance)
-		sizeIni := len(listOfInstance)
+		sizeIni, _ := countSubscribers(&docs[0])
 
 		// Make few instances subscribe to Cozy-DISPERS
 		encInst, _ := json.Marshal(
@@ -85,8 +92,7 @@ func TestSubscribe(t *testing.T) {
 		err = Subscribe(&inSubs)
 		assert.NoError(t, err)
 		docs, _ = RetrieveSubscribeDoc(outputCI.Hashes[0].Hash)
-		json.Unmarshal(docs[0].EncryptedInstances, &listOfInstance)
-		size := len(listOfInstance)
+		size, _ := countSubscribers(&docs[0])
 		assert.Equal(t, sizeIni+1, size)
 		encInst, _ = json.Marshal(
 			query.Instance{
@@ -101,8 +107,7 @@ func TestSubscribe(t *testing.T) {
 		err = Subscribe(&inSubs)
 		assert.NoError(t, err)
 		docs, _ = RetrieveSubscribeDoc(outputCI.Hashes[0].Hash)
-		json.Unmarshal(docs[0].EncryptedInstances, &listOfInstance)
-		size = len(listOfInstance)
+		size, _ = countSubscribers(&docs[0])
 		assert.Equal(t, sizeIni+2, size)
 		encInst, _ = json.Marshal(
 			query.Instance{
@@ -117,8 +122,7 @@ func TestSubscribe(t *testing.T) {
 		err = Subscribe(&inSubs)
 		assert.NoError(t, err)
 		docs, _ = RetrieveSubscribeDoc(outputCI.Hashes[0].Hash)
-		json.Unmarshal(docs[0].EncryptedInstances, &listOfInstance)
-		size = len(listOfInstance)
+		size, _ = countSubscribers(&docs[0])
 		assert.Equal(t, sizeIni+3, size)
 	}
 
@@ -128,9 +132,192 @@ func TestSubscribe(t *testing.T) {
 
 }
 
+func TestUnsubscribe(t *testing.T) {
+
+	inputCI := query.InputCI{
+		IsEncrypted: false,
+		Concepts:    []string{"aime le chocolat"},
+	}
+	err := CreateConceptInConductorDB(&inputCI)
+	assert.NoError(t, err)
+
+	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
+	ci.DefineDispersActor("concept/aime le chocolat/false")
+	err = ci.MakeRequest("GET", "", nil, nil)
+	assert.NoError(t, err)
+	var outputCI query.OutputCI
+	err = json.Unmarshal(ci.Out, &outputCI)
+	assert.NoError(t, err)
+
+	countInstances := func() int {
+		docs, _ := RetrieveSubscribeDoc(outputCI.Hashes[0].Hash)
+		count, _ := countSubscribers(&docs[0])
+		return count
+	}
+
+	encInst, _ := json.Marshal(query.Instance{
+		Domain:      "lucie.mycozy.cloud",
+		TokenBearer: "hfeuziyeurbyuilrz",
+	})
+	inSubs := subscribe.InputConductor{
+		Concepts:          []string{"aime le chocolat"},
+		IsEncrypted:       false,
+		EncryptedInstance: encInst,
+	}
+	assert.NoError(t, Subscribe(&inSubs))
+	assert.Equal(t, 1, countInstances())
+
+	// Another token cannot remove the instance
+	inSubs.EncryptedInstance, _ = json.Marshal(query.Instance{
+		Domain:      "lucie.mycozy.cloud",
+		TokenBearer: "nreuizonfezio",
+	})
+	assert.Error(t, Unsubscribe(&inSubs))
+	assert.Equal(t, 1, countInstances())
+
+	inSubs.EncryptedInstance = encInst
+	assert.NoError(t, Unsubscribe(&inSubs))
+	assert.Equal(t, 0, countInstances())
+
+	// Unsubscribing twice does nothing
+	assert.NoError(t, Unsubscribe(&inSubs))
+
+	ci.DefineDispersActor("concept/aime le chocolat/false")
+	err = ci.MakeRequest("DELETE", "", nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestSplitSubscribeDoc(t *testing.T) {
+
+	// A list of instances saved before the lists were split into buckets
+	instances := []query.Instance{}
+	for _, domain := range []string{"anna", "bruno", "celine"} {
+		instances = append(instances, query.Instance{
+			Domain:      domain + ".mycozy.cloud",
+			TokenBearer: "hfeuziyeurbyuilrz",
+		})
+	}
+	encInstances, _ := json.Marshal(instances)
+	doc := &subscribe.SubscribeDoc{
+		Hash:               []byte("legacy concept"),
+		EncryptedInstances: encInstances,
+	}
+	assert.NoError(t, couchdb.CreateDoc(PrefixerC, doc))
+
+	count, err := countSubscribers(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Nil(t, doc.EncryptedInstances)
+	assert.Equal(t, SubscriptionShards, doc.Shards)
+
+	buckets, err := conceptBuckets(doc.ID())
+	assert.NoError(t, err)
+	for _, instance := range instances {
+		bucket := subscribe.BucketOf(instance.Domain, doc.Shards)
+		found := false
+		for _, b := range buckets {
+			found = found || b.Bucket == bucket
+		}
+		assert.True(t, found)
+	}
+
+	for index := range buckets {
+		assert.NoError(t, couchdb.DeleteDoc(PrefixerC, &buckets[index]))
+	}
+	assert.NoError(t, couchdb.DeleteDoc(PrefixerC, doc))
+}
+
+func TestGrowSubscribeDoc(t *testing.T) {
+
+	doc := &subscribe.SubscribeDoc{Hash: []byte("growing concept"), Shards: 1}
+	assert.NoError(t, couchdb.CreateDoc(PrefixerC, doc))
+
+	instances := []query.Instance{}
+	for _, domain := range []string{"anna", "bruno", "celine", "denis", "emma"} {
+		instances = append(instances, query.Instance{
+			Domain:      domain + ".mycozy.cloud",
+			TokenBearer: "hfeuziyeurbyuilrz",
+		})
+	}
+	encInstances, _ := wire.Encode(wire.TypeInstances, instances)
+	bucket := &subscribe.BucketDoc{
+		BucketID:           subscribe.BucketID(doc.ID(), 0),
+		ConceptID:          doc.ID(),
+		EncryptedInstances: encInstances,
+		Subscribers:        len(instances),
+	}
+	assert.NoError(t, couchdb.CreateNamedDocWithDB(PrefixerC, bucket))
+
+	assert.NoError(t, growSubscribeDoc(doc, 1))
+	assert.Equal(t, 2, doc.Shards)
+	assert.Equal(t, 0, doc.NextShards)
+
+	// Another subscription has already made the concept grow
+	assert.NoError(t, growSubscribeDoc(doc, 1))
+	assert.Equal(t, 2, doc.Shards)
+
+	buckets, err := conceptBuckets(doc.ID())
+	assert.NoError(t, err)
+	count := 0
+	for _, b := range buckets {
+		var inBucket []query.Instance
+		assert.NoError(t, wire.Decode(b.EncryptedInstances, wire.TypeInstances, &inBucket))
+		assert.Equal(t, len(inBucket), b.Subscribers)
+		for _, instance := range inBucket {
+			assert.Equal(t, b.Bucket, subscribe.BucketOf(instance.Domain, 2))
+		}
+		count += b.Subscribers
+	}
+	assert.Equal(t, len(instances), count)
+
+	for index := range buckets {
+		assert.NoError(t, couchdb.DeleteDoc(PrefixerC, &buckets[index]))
+	}
+	assert.NoError(t, couchdb.DeleteDoc(PrefixerC, doc))
+}
+
+func TestWriteInputTF(t *testing.T) {
+
+	// More buckets than a page
+	conceptID := "streamed-concept"
+	domains := []string{}
+	for index := 0; index < 2*bucketsPageSize+3; index++ {
+		domain := fmt.Sprintf("instance%02d.mycozy.cloud", index)
+		domains = append(domains, domain)
+		encInstances, _ := wire.Encode(wire.TypeInstances, []query.Instance{{Domain: domain}})
+		bucket := &subscribe.BucketDoc{
+			BucketID:           subscribe.BucketID(conceptID, index),
+			ConceptID:          conceptID,
+			Bucket:             index,
+			EncryptedInstances: encInstances,
+			Subscribers:        1,
+		}
+		assert.NoError(t, couchdb.CreateNamedDocWithDB(PrefixerC, bucket))
+	}
+
+	var buf bytes.Buffer
+	inputTF := query.InputTF{MaxTargets: 10, EncryptedTargetProfile: []byte("profile")}
+	err := writeInputTF(&buf, inputTF, map[string]string{"streamed": conceptID, "empty": "unknown-concept"})
+	assert.NoError(t, err)
+
+	book := newAddressBook()
+	read, err := readInputTF(&buf, book)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, read.MaxTargets)
+	assert.Equal(t, []byte("profile"), read.EncryptedTargetProfile)
+	assert.Equal(t, domains, book.lists["streamed"])
+	assert.Equal(t, []string{}, book.lists["empty"])
+
+	buckets, err := conceptBuckets(conceptID)
+	assert.NoError(t, err)
+	for index := range buckets {
+		assert.NoError(t, couchdb.DeleteDoc(PrefixerC, &buckets[index]))
+	}
+}
+
 func TestDefineConductor(t *testing.T) {
 
-	_, err := NewQuery(&in)
+	_, err := NewQuery(&in, "", 0)
 	assert.NoError(t, err)
 }
 
@@ -164,7 +351,7 @@ func TestDecryptConcept(t *testing.T) {
 
 	// Get the three concepts' hashes from query
 	in.Concepts = []string{"julien-1", "francois-1", "paul-1"}
-	query, _ := NewQuery(&in)
+	query, _ := NewQuery(&in, "", 0)
 	query.decryptConcept()
 	assert.Equal(t, outputCI.Hashes, query.EncryptedConcepts)
 
@@ -185,7 +372,7 @@ func TestFetchListFromDB(t *testing.T) {
 	// Create the four concepts
 	err := CreateConceptInConductorDB(&query.InputCI{IsEncrypted: false, Concepts: in.Concepts})
 	assert.NoError(t, err)
-	query, _ := NewQuery(&in)
+	query, _ := NewQuery(&in, "", 0)
 	err = query.decryptConcept()
 	assert.NoError(t, err)
 	err = query.fetchListsOfInstancesFromDB()
@@ -261,15 +448,15 @@ func TestGetListsOfInstances(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	query, _ := NewQuery(&in)
+	query, _ := NewQuery(&in, "", 0)
 	err = query.decryptConcept()
 	assert.NoError(t, err)
 	err = query.fetchListsOfInstancesFromDB()
 	assert.NoError(t, err)
 	err = query.selectTargets()
 	assert.NoError(t, err)
-	var targets []string
-	_ = json.Unmarshal(query.EncryptedTargets, &targets)
+	var targets []query.Instance
+	_ = wire.Decode(query.EncryptedTargets, wire.TypeInstances, &targets)
 	assert.Equal(t, 4, len(targets))
 	// Delete the created concepts
 	ci := network.NewExternalActor(network.RoleCI, network.ModeQuery)
@@ -386,54 +573,354 @@ func TestShouldBeComputed(t *testing.T) {
 
 }
 
-func TestAggregate(t *testing.T) {
+func TestRegisterFolds(t *testing.T) {
 
-	var data []map[string]interface{}
-	absPath, _ := filepath.Abs(strings.Join([]string{"../../assets/test/dummy_dataset.json"}, ""))
-	buf, _ := ioutil.ReadFile(absPath)
-	s := string(buf)
-	json.Unmarshal([]byte(s), &data)
+	encJob, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{query.AggregationJob{
+		Job:  "sum",
+		Args: map[string]interface{}{"keys": []string{"sepal_length", "sepal_width"}},
+	}})
+	in.LayersDA = []query.LayerDA{
+		query.LayerDA{EncryptedJobs: encJob, Size: 4},
+		query.LayerDA{EncryptedJobs: encJob, Size: 1},
+	}
+	queryDoc, err := NewQuery(&in, "", 0)
+	assert.NoError(t, err)
 
-	// The first layer is going to sum each subset
-	args1 := make(map[string]interface{})
-	args1["keys"] = []string{"sepal_length", "sepal_width"}
+	// The folds have to follow the layout
+	err = queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 150,
+		Folds:        []int{75, 75},
+		QueryID:      queryDoc.ID(),
+	})
+	assert.Error(t, err)
 
-	// The second layer is going to sum each results applying a weight
-	// The weight has been passed as a new variable
-	args2 := make(map[string]interface{})
-	args2["keys"] = []string{"sepal_length", "sepal_width"}
-	args2["weight"] = "length"
-	encJob1, _ := json.Marshal([]query.AggregationJob{query.AggregationJob{
+	// The folds have to hold every row, and no fold can be empty
+	err = queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 150,
+		Folds:        []int{38, 38, 37, 36},
+		QueryID:      queryDoc.ID(),
+	})
+	assert.Error(t, err)
+	err = queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 150,
+		Folds:        []int{75, 75, 0, 0},
+		QueryID:      queryDoc.ID(),
+	})
+	assert.Error(t, err)
+	assert.False(t, queryDoc.CheckPoints["t"])
+
+	// Each fold has a host
+	err = queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 150,
+		Folds:        []int{38, 38, 37, 37},
+		QueryID:      queryDoc.ID(),
+	})
+	assert.Error(t, err)
+	assert.False(t, queryDoc.CheckPoints["t"])
+
+	hosts := [][]string{{"da1:8008"}, {"da2:8008"}, {"da1:8008"}, {"da2:8008"}}
+	err = queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 150,
+		Folds:        []int{38, 38, 37, 37},
+		Hosts:        hosts,
+		QueryID:      queryDoc.ID(),
+	})
+	assert.NoError(t, err)
+	assert.True(t, queryDoc.CheckPoints["t"])
+
+	// Only the hosts chosen by the Targets can give the results of the folds
+	fold, err := query.RetrieveAsyncTaskDA(queryDoc.ID(), 0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "da1:8008", fold.HostOf(0))
+	assert.Equal(t, "", fold.HostOf(1))
+
+	// The first layer waits for the DAs, the data are not in the QueryDoc
+	state, err := query.FetchAsyncStateLayer(queryDoc.ID(), 0, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, query.Running, state)
+	should, err := queryDoc.ShouldBeComputed(0)
+	assert.NoError(t, err)
+	assert.False(t, should)
+	assert.Error(t, queryDoc.aggregateLayer(0, &queryDoc.Layers[0]))
+
+}
+
+func TestRegisterFoldsFailure(t *testing.T) {
+
+	encJob, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{query.AggregationJob{
 		Job:  "sum",
-		Args: args1,
+		Args: map[string]interface{}{"keys": []string{"sepal_length", "sepal_width"}},
 	}})
-	encJob2, _ := json.Marshal([]query.AggregationJob{query.AggregationJob{
+	in.LayersDA = []query.LayerDA{
+		query.LayerDA{EncryptedJobs: encJob, Size: 2},
+		query.LayerDA{EncryptedJobs: encJob, Size: 1},
+	}
+	queryDoc, err := NewQuery(&in, "", 0)
+	assert.NoError(t, err)
+
+	// A Target that has not sent the folds fails the query
+	err = queryDoc.RegisterFolds(query.OutputT{
+		QueryID: queryDoc.ID(),
+		Error:   "The sending of the folds has been interrupted",
+	})
+	assert.NoError(t, err)
+	assert.True(t, queryDoc.CheckPoints["da"])
+	assert.Contains(t, queryDoc.Failure, "The sending of the folds has been interrupted")
+	assert.Nil(t, queryDoc.RunningUntil)
+
+	// The failure can be reported again by a Target taking over
+	assert.NoError(t, queryDoc.RegisterFolds(query.OutputT{
+		QueryID: queryDoc.ID(),
+		Error:   "The sending of the folds has been interrupted",
+	}))
+}
+
+func TestRegisterFoldsNotEnough(t *testing.T) {
+
+	encJob, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{query.AggregationJob{
 		Job:  "sum",
-		Args: args2,
+		Args: map[string]interface{}{"keys": []string{"sepal_length", "sepal_width"}},
 	}})
-	layers := []query.LayerDA{
-		query.LayerDA{
-			EncryptedJobs: encJob1,
-			Data:          data,
-			Size:          4,
-		},
-		query.LayerDA{
-			EncryptedJobs: encJob2,
-			Data:          data,
-			Size:          4,
-		},
+	in.LayersDA = []query.LayerDA{
+		query.LayerDA{EncryptedJobs: encJob, Size: 4},
+		query.LayerDA{EncryptedJobs: encJob, Size: 1},
 	}
-	in.LayersDA = layers
-
-	queryDoc, _ := NewQuery(&in)
-	queryDoc.Layers = layers
-	for indexLayer, layer := range queryDoc.Layers {
-		layerShouldBeComputed, _ := queryDoc.ShouldBeComputed(indexLayer)
-		if layerShouldBeComputed {
-			if err := queryDoc.aggregateLayer(indexLayer, &layer); err != nil {
-				assert.Error(t, err)
-			}
+	in.Completion = query.Completion{MinFraction: 0.8, Timeout: "10m"}
+	defer func() { in.Completion = query.Completion{} }()
+
+	// The query ends when too few instances have answered
+	queryDoc, err := NewQuery(&in, "", 0)
+	assert.NoError(t, err)
+	targets := query.TargetCounts{Responding: 7, Failed: 2, TimedOut: 1}
+	assert.NoError(t, queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 150,
+		Folds:        []int{38, 38, 37, 37},
+		Targets:      targets,
+		QueryID:      queryDoc.ID(),
+	}))
+	failed := &QueryDoc{}
+	assert.NoError(t, couchdb.GetDoc(PrefixerC, "io.cozy.query", queryDoc.ID(), failed))
+	assert.True(t, failed.CheckPoints["da"])
+	assert.False(t, failed.CheckPoints["t"])
+	assert.Equal(t, errors.ErrQuorumNotReached.Error(), failed.Failure)
+	assert.Equal(t, targets, failed.Targets)
+	assert.Nil(t, failed.RunningUntil)
+	state, err := query.FetchAsyncStateLayer(queryDoc.ID(), 0, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, query.Waiting, state)
+
+	// The query ends when the instances have given too few rows
+	queryDoc, err = NewQuery(&in, "", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 12,
+		Folds:        []int{3, 3, 3, 3},
+		Targets:      query.TargetCounts{Responding: 10},
+		QueryID:      queryDoc.ID(),
+	}))
+	failed = &QueryDoc{}
+	assert.NoError(t, couchdb.GetDoc(PrefixerC, "io.cozy.query", queryDoc.ID(), failed))
+	assert.True(t, failed.CheckPoints["da"])
+	assert.False(t, failed.CheckPoints["t"])
+	assert.Equal(t, errors.ErrNotEnoughDataToComputeQuery.Error(), failed.Failure)
+	assert.Error(t, failed.Lead())
+}
+
+func TestFailFold(t *testing.T) {
+
+	retries := MaxFoldRetries
+	defer func() { MaxFoldRetries = retries }()
+	MaxFoldRetries = 0
+
+	encJob, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{query.AggregationJob{
+		Job:  "sum",
+		Args: map[string]interface{}{"keys": []string{"sepal_length", "sepal_width"}},
+	}})
+	in.LayersDA = []query.LayerDA{
+		query.LayerDA{EncryptedJobs: encJob, Size: 2},
+		query.LayerDA{EncryptedJobs: encJob, Size: 1},
+	}
+	queryDoc, err := NewQuery(&in, "", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, queryDoc.RegisterFolds(query.OutputT{
+		NumberOfRows: 150,
+		Folds:        []int{75, 75},
+		Hosts:        [][]string{{"da1:8008"}, {"da2:8008"}},
+		QueryID:      queryDoc.ID(),
+	}))
+
+	// Without retries left, the fold fails and the query ends with an error
+	assert.NoError(t, queryDoc.FailFold(0, 1, []int{0}, errors.ErrFoldTimeout))
+	fold, err := query.RetrieveAsyncTaskDA(queryDoc.ID(), 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, query.Failed, fold.StateDA)
+
+	failed := &QueryDoc{}
+	assert.NoError(t, couchdb.GetDoc(PrefixerC, "io.cozy.query", queryDoc.ID(), failed))
+	assert.Contains(t, failed.Failure, errors.ErrFoldFailed.Error())
+	assert.Nil(t, failed.RunningUntil)
+	assert.Error(t, failed.Lead())
+}
+
+// releaseCounter counts the queries released by the conductor
+type releaseCounter struct {
+	released int
+}
+
+func (r *releaseCounter) Increment(key string, ttl time.Duration) (int64, error) {
+	return 1, nil
+}
+
+func (r *releaseCounter) Decrement(key string) error {
+	r.released++
+	return nil
+}
+
+func TestLeadEndedQuery(t *testing.T) {
+
+	counters := querier.Counters
+	defer func() { querier.Counters = counters }()
+	counter := &releaseCounter{}
+	querier.Counters = counter
+
+	encJob, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{query.AggregationJob{
+		Job:  "sum",
+		Args: map[string]interface{}{"keys": []string{"sepal_length", "sepal_width"}},
+	}})
+	in.LayersDA = []query.LayerDA{
+		query.LayerDA{EncryptedJobs: encJob, Size: 1},
+		query.LayerDA{EncryptedJobs: encJob, Size: 1},
+	}
+	queryDoc, err := NewQuery(&in, "querier-lead", 0)
+	assert.NoError(t, err)
+	for _, checkpoint := range []string{"ci", "fetch", "tf", "t"} {
+		queryDoc.CheckPoints[checkpoint] = true
+	}
+	assert.NoError(t, couchdb.UpdateDoc(PrefixerC, queryDoc))
+	for indexLayer := range in.LayersDA {
+		fold, err := query.NewAsyncTask(queryDoc.ID(), query.AsyncAggregation, indexLayer, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, fold.SetData(map[string]interface{}{"sum": 12}))
+		assert.NoError(t, fold.SetFinished())
+	}
+
+	// The query is led once more after its end, and resumed twice, but it
+	// ends only once
+	before, err := audit.Export(0, 0)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		resumed, err := NewQueryFetchingQueryDoc(queryDoc.ID(), 0)
+		assert.NoError(t, err)
+		assert.NoError(t, resumed.Lead())
+	}
+	assert.NoError(t, queryDoc.TryToEndQuery())
+
+	ended := &QueryDoc{}
+	assert.NoError(t, couchdb.GetDoc(PrefixerC, "io.cozy.query", queryDoc.ID(), ended))
+	assert.True(t, ended.CheckPoints["da"])
+	assert.Nil(t, ended.RunningUntil)
+	assert.Equal(t, 1, counter.released)
+	after, err := audit.Export(len(before), 0)
+	assert.NoError(t, err)
+	endings := 0
+	for _, entry := range after {
+		if entry.QueryID == queryDoc.ID() && entry.Event == audit.EventQueryEnded {
+			assert.Equal(t, audit.OutcomeFinished, entry.Outcome)
+			endings++
 		}
 	}
+	assert.Equal(t, 1, endings)
+}
+
+func TestFoldHostsValid(t *testing.T) {
+
+	assert.True(t, foldHostsValid([][]string{{"da1", "da2"}, {"da2", "da3"}}, 2, 2))
+	assert.False(t, foldHostsValid([][]string{{"da1", "da2"}}, 2, 2))
+	assert.False(t, foldHostsValid([][]string{{"da1"}, {"da2", "da3"}}, 2, 2))
+	// The copies of a fold are computed on distinct hosts
+	assert.False(t, foldHostsValid([][]string{{"da1", "da1"}, {"da2", "da3"}}, 2, 2))
+	assert.False(t, foldHostsValid([][]string{{""}}, 1, 1))
+}
+
+func TestFoldsCoverRows(t *testing.T) {
+
+	assert.True(t, foldsCoverRows([]int{38, 38, 37, 37}, 150, false))
+	assert.False(t, foldsCoverRows([]int{38, 38, 37, 37}, 151, false))
+	assert.False(t, foldsCoverRows([]int{150, 0}, 150, false))
+	assert.False(t, foldsCoverRows([]int{151, -1}, 150, false))
+
+	// Every Data Aggregator receives a share of every row
+	assert.True(t, foldsCoverRows([]int{150, 150, 150}, 150, true))
+	assert.False(t, foldsCoverRows([]int{50, 50, 50}, 150, true))
+	assert.False(t, foldsCoverRows([]int{0, 0, 0}, 0, true))
+}
+
+func TestCheckSecretSharing(t *testing.T) {
+
+	assert.NoError(t, checkSecretSharing([]query.LayerDA{
+		query.LayerDA{Size: 3, SecretSharing: true},
+		query.LayerDA{Size: 1},
+	}))
+
+	// A single DA would see the values
+	assert.Error(t, checkSecretSharing([]query.LayerDA{
+		query.LayerDA{Size: 1, SecretSharing: true},
+		query.LayerDA{Size: 1},
+	}))
+	// Nobody reconstructs the aggregate
+	assert.Error(t, checkSecretSharing([]query.LayerDA{
+		query.LayerDA{Size: 3, SecretSharing: true},
+	}))
+	// The shares would be split between several DAs
+	assert.Error(t, checkSecretSharing([]query.LayerDA{
+		query.LayerDA{Size: 3, SecretSharing: true},
+		query.LayerDA{Size: 2},
+	}))
+	// Only the data sent by the Targets are shared
+	assert.Error(t, checkSecretSharing([]query.LayerDA{
+		query.LayerDA{Size: 3},
+		query.LayerDA{Size: 3, SecretSharing: true},
+		query.LayerDA{Size: 1},
+	}))
+}
+
+func TestCheckPreAggregation(t *testing.T) {
+
+	assert.NoError(t, checkPreAggregation([]query.LayerDA{{Size: 2, PreAggregate: true}, {Size: 1}}))
+	assert.Error(t, checkPreAggregation([]query.LayerDA{{Size: 2}, {Size: 1, PreAggregate: true}}))
+}
+
+func TestCheckRobustJobs(t *testing.T) {
+
+	robust, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "trimmed_mean", Args: map[string]interface{}{"key": "amount", "trim": 0.1}},
+	})
+	sum, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "sum", Args: map[string]interface{}{"key": "amount"}},
+	})
+
+	assert.NoError(t, checkRobustJobs([]query.LayerDA{{Size: 1, EncryptedJobs: robust}}))
+	assert.NoError(t, checkRobustJobs([]query.LayerDA{{Size: 4, EncryptedJobs: sum}, {Size: 1, EncryptedJobs: robust}}))
+	// Each DA would only trim the values of its fold
+	assert.Error(t, checkRobustJobs([]query.LayerDA{{Size: 4, EncryptedJobs: robust}, {Size: 1, EncryptedJobs: sum}}))
+}
+
+func TestCompletion(t *testing.T) {
+
+	assert.NoError(t, checkCompletion(query.Completion{}))
+	assert.NoError(t, checkCompletion(query.Completion{MinFraction: 0.8, Timeout: "10m"}))
+	assert.Error(t, checkCompletion(query.Completion{MinFraction: 0.8}))
+	assert.Error(t, checkCompletion(query.Completion{MinFraction: 1.5, Timeout: "10m"}))
+	assert.Error(t, checkCompletion(query.Completion{Timeout: "soon"}))
+	assert.Error(t, checkCompletion(query.Completion{Timeout: "-1m"}))
+
+	now := time.Now()
+	q := &QueryDoc{}
+	assert.True(t, q.deadline(now).IsZero())
+	assert.True(t, q.quorumReached(query.TargetCounts{Responding: 1, TimedOut: 9}))
 
+	q.Completion = query.Completion{MinFraction: 0.8, Timeout: "10m"}
+	assert.Equal(t, now.Add(10*time.Minute), q.deadline(now))
+	assert.True(t, q.quorumReached(query.TargetCounts{Responding: 8, Failed: 1, TimedOut: 1}))
+	assert.False(t, q.quorumReached(query.TargetCounts{Responding: 7, Failed: 2, TimedOut: 1}))
 }
@@ -1,20 +1,41 @@
 package enclave
 
 import (
-	"encoding/json"
+	"math"
 	"reflect"
 	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
 	"github.com/cozy/cozy-stack/pkg/dispers/aggregation/functions"
 	"github.com/cozy/cozy-stack/pkg/dispers/aggregation/patches"
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation/sharing"
 	"github.com/cozy/cozy-stack/pkg/dispers/errors"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
 var prefixerDA = prefixer.DataAggregatorPrefixer
 
+// shareableFunctions are the aggregation functions whose results are sums over
+// the rows. They can be computed over additive shares. logit_map is a sum too,
+// but over the rows given by preprocess, which is not.
+var shareableFunctions = map[string]bool{
+	"sum":        true,
+	"sum_square": true,
+}
+
+// decomposableFunctions are the aggregation functions whose results over the
+// rows of every instance can be merged. The results of min and max are merged
+// with min and max, the others are summed. logit_map is a sum too, but over
+// the rows given by preprocess, which is not.
+var decomposableFunctions = map[string]bool{
+	"sum":        true,
+	"sum_square": true,
+	"min":        true,
+	"max":        true,
+}
+
 func applyAggregateFunction(indexRow int, results *map[string]interface{}, rowData map[string]interface{}, function query.AggregationFunction) error {
 
 	// Every aggegation function have the same structure in input or output
@@ -39,6 +60,11 @@ func applyAggregateFunction(indexRow int, results *map[string]interface{}, rowDa
 		return functions.LogisticRegressionMap(results, rowData, function.Args)
 	case "logit_reduce":
 		return functions.LogisticRegressionReduce(results, rowData, function.Args)
+	// From robust.go
+	case "collect":
+		return functions.Collect(results, rowData, function.Args)
+	case "group_sums":
+		return functions.GroupSums(results, rowData, function.Args)
 	default:
 		return errors.WrapErrors(errors.ErrAggrUnknown, function.Function)
 	}
@@ -52,6 +78,11 @@ func applyAggregatePatch(results *map[string]interface{}, patch query.Aggregatio
 		return patches.Division(results, patch.Args)
 	case "standard_deviation":
 		return patches.StandardDeviation(results, patch.Args)
+	// From robust.go
+	case "trimmed_mean":
+		return patches.TrimmedMean(results, patch.Args)
+	case "median_of_means":
+		return patches.MedianOfMeans(results, patch.Args)
 	default:
 		return errors.WrapErrors(errors.ErrPatchUnknown, patch.Patch)
 	}
@@ -64,10 +95,10 @@ func decryptInputDA(in *query.InputDA) ([]query.AggregationJob, []map[string]int
 	// Unmarshal bytes
 	var jobs []query.AggregationJob
 	var data []map[string]interface{}
-	if err := json.Unmarshal(in.EncryptedJobs, &jobs); err != nil {
+	if err := wire.Decode(in.EncryptedJobs, wire.TypeJobs, &jobs); err != nil {
 		return jobs, data, errors.WrapErrors(errors.ErrUnmarshal, "")
 	}
-	if err := json.Unmarshal(in.EncryptedData, &data); err != nil {
+	if err := wire.Decode(in.EncryptedData, wire.TypeData, &data); err != nil {
 		return jobs, data, errors.WrapErrors(errors.ErrUnmarshal, "")
 	}
 
@@ -167,6 +198,38 @@ func decodeAggregationJobs(job query.AggregationJob, functions *[]query.Aggregat
 	case "logit_reduce":
 		pendingFunctions = append(pendingFunctions, query.AggregationFunction{Function: job.Job, Args: job.Args})
 		pendingPatches = append(pendingPatches, query.AggregationPatch{Patch: "logit_update", Args: job.Args})
+	case "clipped_logit_map":
+		if err := aggregations.NeedArgs(job.Args, "optimize", "max_norm"); err != nil {
+			return err
+		}
+		if maxNorm, err := aggregations.AsFloat64(job.Args["max_norm"]); err != nil || maxNorm <= 0 {
+			return errors.WrapErrors(errors.ErrInvalidMaxNorm, "max_norm")
+		}
+		pendingFunctions = append(pendingFunctions, query.AggregationFunction{Function: "logit_map", Args: job.Args})
+	// From robust.go
+	case "trimmed_mean":
+		if err := aggregations.NeedArgs(job.Args, "key", "trim"); err != nil {
+			return err
+		}
+		if trim, err := aggregations.AsFloat64(job.Args["trim"]); err != nil || trim < 0 || trim >= 0.5 {
+			return errors.WrapErrors(errors.ErrInvalidTrim, "trim")
+		}
+		pendingFunctions = append(pendingFunctions, query.AggregationFunction{
+			Function: "collect",
+			Args: map[string]interface{}{
+				"key": job.Args["key"].(string),
+			},
+		})
+		pendingPatches = append(pendingPatches, query.AggregationPatch{Patch: job.Job, Args: job.Args})
+	case "median_of_means":
+		if err := aggregations.NeedArgs(job.Args, "key", "groups"); err != nil {
+			return err
+		}
+		if groups, err := aggregations.AsFloat64(job.Args["groups"]); err != nil || groups < 1 {
+			return errors.WrapErrors(errors.ErrInvalidGroups, "groups")
+		}
+		pendingFunctions = append(pendingFunctions, query.AggregationFunction{Function: "group_sums", Args: job.Args})
+		pendingPatches = append(pendingPatches, query.AggregationPatch{Patch: job.Job, Args: job.Args})
 	default:
 		return errors.ErrJobUnknown
 	}
@@ -196,9 +259,134 @@ func decodeAggregationJobs(job query.AggregationJob, functions *[]query.Aggregat
 	return nil
 }
 
+// decodeShareableJobs returns the functions of the jobs of a layer with
+// secret sharing. Those functions are applied by the Targets to each row, the
+// jobs cannot have patches.
+func decodeShareableJobs(jobs []query.AggregationJob) ([]query.AggregationFunction, error) {
+
+	funcs := []query.AggregationFunction{}
+	patches := []query.AggregationPatch{}
+	for _, job := range jobs {
+		if err := decodeAggregationJobs(job, &funcs, &patches); err != nil {
+			return nil, err
+		}
+	}
+	if len(patches) > 0 {
+		return nil, errors.WrapErrors(errors.ErrJobNotShareable, patches[0].Patch)
+	}
+	for _, function := range funcs {
+		if !shareableFunctions[function.Function] {
+			return nil, errors.WrapErrors(errors.ErrJobNotShareable, function.Function)
+		}
+	}
+
+	return funcs, nil
+}
+
+// decodeDecomposableJobs returns the functions of the jobs of a layer
+// pre-aggregated by the Targets. Those functions are applied to the rows of
+// each instance, the patches are left to the Data Aggregators.
+func decodeDecomposableJobs(jobs []query.AggregationJob) ([]query.AggregationFunction, error) {
+
+	funcs := []query.AggregationFunction{}
+	patches := []query.AggregationPatch{}
+	for _, job := range jobs {
+		if err := decodeAggregationJobs(job, &funcs, &patches); err != nil {
+			return nil, err
+		}
+	}
+	for _, function := range funcs {
+		if !decomposableFunctions[function.Function] {
+			return nil, errors.WrapErrors(errors.ErrNotDecomposable, function.Function)
+		}
+	}
+
+	return funcs, nil
+}
+
+// mergePartials merges the partial states computed by the Targets for each
+// instance. The vectors and matrices of the states have been flattened.
+func mergePartials(data []map[string]interface{}) (map[string]interface{}, error) {
+
+	merged := make(map[string]float64)
+	for _, partial := range data {
+		for key, raw := range partial {
+			value, err := aggregations.AsFloat64(raw)
+			if err != nil {
+				return nil, err
+			}
+			previous, ok := merged[key]
+			switch {
+			case !ok:
+				merged[key] = value
+			case strings.HasPrefix(key, "min_"):
+				merged[key] = math.Min(previous, value)
+			case strings.HasPrefix(key, "max_"):
+				merged[key] = math.Max(previous, value)
+			default:
+				merged[key] = previous + value
+			}
+		}
+	}
+
+	return sharing.Unflatten(merged)
+}
+
+// sumShares sums the shares received by a Data Aggregator of a layer with
+// secret sharing. The functions have been applied by the Targets: the result
+// is this Data Aggregator's share of the aggregate.
+func sumShares(in query.InputDA) (map[string]interface{}, error) {
+
+	var shares []sharing.Share
+	if err := wire.Decode(in.EncryptedData, wire.TypeShares, &shares); err != nil {
+		return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
+	}
+
+	total := make(sharing.Share)
+	for _, share := range shares {
+		total.Add(share)
+	}
+
+	return map[string]interface{}{
+		"length": len(shares),
+		"shares": total.Format(),
+	}, nil
+}
+
+// reconstruct sums the shares of the aggregate given by every Data Aggregator
+// of the previous layer. Only the aggregate is revealed: it is the single row
+// of data of this layer.
+func reconstruct(data []map[string]interface{}) ([]map[string]interface{}, error) {
+
+	if len(data) == 0 {
+		return nil, errors.WrapErrors(errors.ErrInvalidShare, "")
+	}
+
+	total := make(sharing.Share)
+	for _, row := range data {
+		share, err := sharing.Parse(row["shares"])
+		if err != nil {
+			return nil, err
+		}
+		total.Add(share)
+	}
+
+	aggregate, err := sharing.Reveal(total)
+	if err != nil {
+		return nil, err
+	}
+	aggregate["length"] = data[0]["length"]
+
+	return []map[string]interface{}{aggregate}, nil
+}
+
 // AggregateData leads an aggregation of data
 func AggregateData(in query.InputDA) (map[string]interface{}, error) {
 
+	if in.SecretSharing {
+		return sumShares(in)
+	}
+
 	// Creation of the output map
 	results := make(map[string]interface{})
 	// Creation of the array of AggregationFunctions to apply
@@ -212,6 +400,13 @@ func AggregateData(in query.InputDA) (map[string]interface{}, error) {
 		return nil, err
 	}
 
+	if in.Reconstruct {
+		data, err = reconstruct(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Stack functions and patches to compute
 	for _, job := range jobs {
 		err = decodeAggregationJobs(job, &funcs, &patches)
@@ -220,17 +415,26 @@ func AggregateData(in query.InputDA) (map[string]interface{}, error) {
 		}
 	}
 
-	// Add length to results
-	// Warning : due to that line, aggregation functions should not returns a result with key "length"
-	results["length"] = len(data)
+	if in.PreAggregated {
+		// The functions have been applied by the Targets, the length of
+		// each partial state is the number of rows of its instance
+		results, err = mergePartials(data)
+		if err != nil {
+			return nil, errors.WrapErrors(errors.ErrAggrFailed, "")
+		}
+	} else {
+		// Add length to results
+		// Warning : due to that line, aggregation functions should not returns a result with key "length"
+		results["length"] = len(data)
 
-	// Go through aggregation functions
-	for _, function := range funcs {
-		// Go through Data
-		for index, rowData := range data {
-			err = applyAggregateFunction(index, &results, rowData, function)
-			if err != nil {
-				return results, errors.WrapErrors(errors.ErrAggrFailed, "")
+		// Go through aggregation functions
+		for _, function := range funcs {
+			// Go through Data
+			for index, rowData := range data {
+				err = applyAggregateFunction(index, &results, rowData, function)
+				if err != nil {
+					return results, errors.WrapErrors(errors.ErrAggrFailed, "")
+				}
 			}
 		}
 	}
@@ -243,5 +447,13 @@ func AggregateData(in query.InputDA) (map[string]interface{}, error) {
 		}
 	}
 
+	// Intermediate results, as the values collected by the robust
+	// estimators, are not given to the conductor
+	for key := range results {
+		if strings.HasPrefix(key, "_") {
+			delete(results, key)
+		}
+	}
+
 	return results, nil
 }
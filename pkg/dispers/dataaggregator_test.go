@@ -8,7 +8,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -173,3 +175,196 @@ func TestAggregateMean(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, map[string]interface{}{"length": 4, "mean_sepal_length": 5.843333333333332, "mean_sepal_width": 3.0540000000000003, "sum_length": 150.0, "sum_sum_sepal_length": 876.4999999999998, "sum_sum_sepal_width": 458.1}, means)
 }
+
+func TestSecretSharing(t *testing.T) {
+	// Get Data From dummy_dataset
+	absPath, _ := filepath.Abs("../../assets/test/dummy_dataset.json")
+	buf, err := ioutil.ReadFile(absPath)
+	assert.NoError(t, err)
+	var data []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf, &data))
+
+	encJobs, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "sum", Args: map[string]interface{}{"key": "sepal_length"}},
+		query.AggregationJob{Job: "sum_square", Args: map[string]interface{}{"key": "sepal_width"}},
+	})
+
+	// Target splits every row into one share for each of the 3 DAs
+	layout := query.FoldLayout{Size: 3, EncryptedJobs: encJobs, SecretSharing: true}
+	payloads, sizes, err := MakeFolds(data, layout)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{150, 150, 150}, sizes)
+
+	// In-process stand-ins for the DAs of the first layer
+	shares := []map[string]interface{}{}
+	for _, payload := range payloads {
+		res, err := AggregateData(query.InputDA{
+			EncryptedJobs: encJobs,
+			EncryptedData: payload,
+			SecretSharing: true,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 150, res["length"])
+		assert.NotContains(t, res, "sum_sepal_length")
+
+		// The results go through the Conductor's database
+		buf, _ := json.Marshal(res)
+		var saved map[string]interface{}
+		assert.NoError(t, json.Unmarshal(buf, &saved))
+		shares = append(shares, saved)
+	}
+
+	// The DA of the last layer reconstructs the aggregate
+	encData, _ := wire.Encode(wire.TypeData, shares)
+	encFinalJobs, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "sum", Args: map[string]interface{}{"key": "sum_sepal_length"}},
+		query.AggregationJob{Job: "sum", Args: map[string]interface{}{"key": "sum_square_sepal_width"}},
+	})
+	res, err := AggregateData(query.InputDA{
+		EncryptedJobs: encFinalJobs,
+		EncryptedData: encData,
+		Reconstruct:   true,
+	})
+	assert.NoError(t, err)
+	assert.InDelta(t, 876.5, res["sum_sum_sepal_length"], 1e-3)
+	assert.InDelta(t, 1427.05, res["sum_sum_square_sepal_width"], 1e-3)
+
+	// The shares of a single DA are not enough
+	encData, _ = wire.Encode(wire.TypeData, shares[:1])
+	res, err = AggregateData(query.InputDA{
+		EncryptedJobs: encFinalJobs,
+		EncryptedData: encData,
+		Reconstruct:   true,
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, 876.5, res["sum_sum_sepal_length"])
+
+	// Jobs with patches cannot be computed over shares
+	layout.EncryptedJobs, _ = wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "mean", Args: map[string]interface{}{"sum": "sepal_length"}},
+	})
+	_, _, err = MakeFolds(data, layout)
+	assert.Error(t, err)
+}
+
+func TestRobustEstimators(t *testing.T) {
+
+	// A poisoned row among regular ones
+	data := []map[string]interface{}{}
+	for index := 0; index < 19; index++ {
+		data = append(data, map[string]interface{}{"amount": float64(index % 5)})
+	}
+	data = append(data, map[string]interface{}{"amount": 1e300})
+
+	encData, _ := wire.Encode(wire.TypeData, data)
+	encJobs, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "trimmed_mean", Args: map[string]interface{}{"key": "amount", "trim": 0.1}},
+		query.AggregationJob{Job: "median_of_means", Args: map[string]interface{}{"key": "amount", "groups": 5.0}},
+	})
+	res, err := AggregateData(query.InputDA{
+		EncryptedJobs: encJobs,
+		EncryptedData: encData,
+	})
+	assert.NoError(t, err)
+	assert.InDelta(t, 2.0, res["trimmed_mean_amount"], 0.2)
+	assert.Equal(t, 4, res["trimmed_rows_amount"])
+	assert.InDelta(t, 2.0, res["median_of_means_amount"], 0.2)
+
+	// The collected values are not given to the conductor
+	for key := range res {
+		assert.False(t, strings.HasPrefix(key, "_"))
+	}
+
+	for _, job := range []query.AggregationJob{
+		query.AggregationJob{Job: "trimmed_mean", Args: map[string]interface{}{"key": "amount", "trim": 0.5}},
+		query.AggregationJob{Job: "median_of_means", Args: map[string]interface{}{"key": "amount", "groups": 0.0}},
+		query.AggregationJob{Job: "clipped_logit_map", Args: map[string]interface{}{"optimize": "gd", "max_norm": -1.0}},
+	} {
+		encJobs, _ = wire.Encode(wire.TypeJobs, []query.AggregationJob{job})
+		_, err = AggregateData(query.InputDA{
+			EncryptedJobs: encJobs,
+			EncryptedData: encData,
+		})
+		assert.Error(t, err)
+	}
+}
+
+func TestPreAggregate(t *testing.T) {
+	// Get Data From dummy_dataset
+	absPath, _ := filepath.Abs("../../assets/test/dummy_dataset.json")
+	buf, err := ioutil.ReadFile(absPath)
+	assert.NoError(t, err)
+	var data []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf, &data))
+
+	encJobs, _ := wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "sum", Args: map[string]interface{}{"key": "sepal_length"}},
+		query.AggregationJob{Job: "min", Args: map[string]interface{}{"key": "sepal_width"}},
+		query.AggregationJob{Job: "max", Args: map[string]interface{}{"key": "sepal_width"}},
+	})
+	layout := query.FoldLayout{Size: 1, EncryptedJobs: encJobs, PreAggregate: true}
+
+	// Each instance holds a part of the rows and gives a single partial state
+	partials := []map[string]interface{}{}
+	for _, rows := range [][]map[string]interface{}{data[:40], data[40:100], data[100:]} {
+		partial, err := PreAggregate(rows, layout)
+		assert.NoError(t, err)
+		partials = append(partials, partial)
+	}
+	// An instance whose rows have all been rejected gives nothing
+	zero := 0.0
+	empty, err := PreAggregate(data[:1], query.FoldLayout{
+		EncryptedJobs: encJobs,
+		PreAggregate:  true,
+		Clipping:      map[string]aggregations.Bound{"sepal_width": {Max: &zero, Reject: true}},
+	})
+	assert.NoError(t, err)
+	partials = append(partials, empty)
+
+	rows, clipped, rejected := PrepareRows(partials, layout)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, 1, clipped+rejected)
+	assert.NotContains(t, rows[0], partialClipped)
+
+	// The conductor still counts the rows, not the instances
+	assert.Equal(t, 150, CountRows(rows, layout))
+	_, sizes, err := MakeFolds(rows, layout)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{150}, sizes)
+
+	encData, _ := wire.Encode(wire.TypeData, rows)
+	res, err := AggregateData(query.InputDA{
+		EncryptedJobs: encJobs,
+		EncryptedData: encData,
+		PreAggregated: true,
+	})
+	assert.NoError(t, err)
+
+	// The DA gives the same results as with every row
+	encData, _ = wire.Encode(wire.TypeData, data)
+	expected, err := AggregateData(query.InputDA{
+		EncryptedJobs: encJobs,
+		EncryptedData: encData,
+	})
+	assert.NoError(t, err)
+	assert.InDelta(t, expected["sum_sepal_length"], res["sum_sepal_length"], 1e-9)
+	assert.Equal(t, expected["min_sepal_width"], res["min_sepal_width"])
+	assert.Equal(t, expected["max_sepal_width"], res["max_sepal_width"])
+	assert.Equal(t, 150.0, res["length"])
+
+	// The robust estimators need every row
+	encJobs, _ = wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "trimmed_mean", Args: map[string]interface{}{"key": "sepal_length", "trim": 0.1}},
+	})
+	layout.EncryptedJobs = encJobs
+	_, err = PreAggregate(data, layout)
+	assert.Error(t, err)
+
+	// Neither can the gradient be computed over the rows of an instance
+	encJobs, _ = wire.Encode(wire.TypeJobs, []query.AggregationJob{
+		query.AggregationJob{Job: "logit_map", Args: map[string]interface{}{"optimize": "gd", "theta": []float64{0, 0}}},
+	})
+	layout.EncryptedJobs = encJobs
+	_, err = PreAggregate(data, layout)
+	assert.Error(t, err)
+}
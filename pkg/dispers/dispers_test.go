@@ -8,6 +8,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/audit"
 	"github.com/cozy/cozy-stack/pkg/dispers/network"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -26,6 +27,9 @@ func TestMain(m *testing.M) {
 	PrefixerCI = prefixer.TestConceptIndexorPrefixer
 	query.PrefixerC = prefixer.TestConductorPrefixer
 	query.PrefixerT = prefixer.TestTargetPrefixer
+	audit.PrefixerC = prefixer.TestConductorPrefixer
+	ConceptKey = config.GetVault().ConceptKey()
+	CatalogueKey = config.GetVault().CatalogueKey()
 
 	// Reinitiate DB
 	err := couchdb.ResetDB(PrefixerCI, "io.cozy.hashconcept")
@@ -48,6 +52,11 @@ func TestMain(m *testing.M) {
 		fmt.Printf("Cant reset db (%s, %s) %s\n", PrefixerC, "io.cozy.async", err.Error())
 		os.Exit(1)
 	}
+	err = couchdb.ResetDB(PrefixerC, "io.cozy.dispers.audit")
+	if err != nil {
+		fmt.Printf("Cant reset db (%s, %s) %s\n", PrefixerC, "io.cozy.dispers.audit", err.Error())
+		os.Exit(1)
+	}
 	couchdb.InitGlobalDB()
 
 	testutils.NeedOtherDispersServer(testDispersURL)
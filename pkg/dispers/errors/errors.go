@@ -2,6 +2,7 @@ package errors
 
 import (
 	"errors"
+	"net/http"
 
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 )
@@ -15,17 +16,32 @@ var (
 	ErrAsyncTaskNotFound   = errors.New("Async task not found")
 	ErrTooManyDoc          = errors.New("One unique doc expected, but more than one found")
 	ErrNoExecutionMetadata = errors.New("No ExecutionMetadata for this query")
+	ErrNotEnoughHosts      = errors.New("There are not enough hosts to run the copies of a fold")
+	ErrUnknownHost         = errors.New("This host is not a Cozy-DISPERS server")
 
 	// CI
 	ErrEmptyConcept           = errors.New("Concept is empty")
 	ErrConceptNotFound        = errors.New("Conceptdoc not found")
 	ErrConceptAlreadyExisting = errors.New("Concept is already existing")
 	ErrTooManyConceptDoc      = errors.New("Too many salts found for this concept")
+	ErrNoConceptKey           = errors.New("No key configured to hash the concepts")
+	ErrNoCatalogueKey         = errors.New("No key configured to draw the noise of the catalogue")
+	ErrNoNextConceptKey       = errors.New("No next key configured to rotate the concepts")
 
 	// TF / T
 	ErrInvalidTargetProfile = errors.New("Invalid target profile")
 	ErrComputeTargetProfile = errors.New("Failed to compute target profile")
 	ErrNoTargets            = errors.New("No target matches the Target Profile")
+	ErrInvalidTokenBearer   = errors.New("Unvalid token bearer")
+	ErrWrongTokenBearer     = errors.New("The token bearer does not match the subscribed instance")
+	ErrInstanceWithdrawn    = errors.New("The instance has withdrawn its consent")
+	ErrTokenExpired         = errors.New("The token of the instance has expired")
+	ErrInstanceStale        = errors.New("The token of the instance has been refused by its stack")
+	ErrInvalidFoldLayout    = errors.New("The layout of the folds is invalid")
+	ErrForbiddenField       = errors.New("This field is not allowed by the local query policy")
+	ErrForbiddenOperator    = errors.New("This operator is not allowed by the local query policy")
+	ErrMissingProjection    = errors.New("The local query does not give the fields to retrieve")
+	ErrDispatchInterrupted  = errors.New("The sending of the folds has been interrupted")
 
 	// DA
 	ErrArgNotFound       = errors.New("Arg not found")
@@ -37,6 +53,14 @@ var (
 	ErrPatchUnknown      = errors.New("Unknown aggregation patch")
 	ErrAggrFailed        = errors.New("Failed to apply aggregate function")
 	ErrLengthConsistency = errors.New("Theta and features should have the same length")
+	ErrJobNotShareable   = errors.New("This aggregation job cannot be computed over shares")
+	ErrShareOverflow     = errors.New("The value is too large to be shared")
+	ErrInvalidShare      = errors.New("Invalid share")
+	ErrInvalidClipping   = errors.New("The lower bound of a field cannot be greater than its upper bound")
+	ErrInvalidTrim       = errors.New("The trimmed fraction has to be in [0, 0.5)")
+	ErrInvalidGroups     = errors.New("The number of groups has to be positive")
+	ErrInvalidMaxNorm    = errors.New("The maximal norm of a gradient has to be positive")
+	ErrNotDecomposable   = errors.New("This aggregation job cannot be computed for each instance")
 
 	// Conductor
 	ErrHostnameConductor           = errors.New("Failed to retrieve hostname")
@@ -46,6 +70,32 @@ var (
 	ErrSubscribeDocNotFound        = errors.New("Cannot find SubscribeDoc")
 	ErrNotEnoughDataToComputeQuery = errors.New("We don't have enough data to compute the query")
 	ErrConceptAlreadyInConductorDB = errors.New("This concept already exists in Conductor's database")
+	ErrShardsChanged               = errors.New("The buckets of the concept have been split meanwhile")
+	ErrInvalidSecretSharing        = errors.New("Secret sharing needs several DAs in the first layer, followed by a single DA")
+	ErrReplicasDisagree            = errors.New("The DAs computing the same fold do not agree on the results")
+	ErrInvalidRedundancy           = errors.New("The redundancy and the tolerance of a layer cannot be negative")
+	ErrInvalidPreAggregation       = errors.New("Only the first layer can be pre-aggregated by the Targets")
+	ErrInvalidCompletion           = errors.New("The fraction of targets has to be in [0, 1], with a positive timeout")
+	ErrInvalidRobustLayer          = errors.New("A robust estimator has to be computed by a layer with a single DA")
+	ErrQuorumNotReached            = errors.New("Not enough targets have answered before the deadline")
+	ErrTargetFailed                = errors.New("The Target has not sent the folds")
+	ErrQueryFailed                 = errors.New("The query has failed and cannot be resumed")
+	ErrQueryAbandoned              = errors.New("The query has not ended in time")
+	ErrFoldTimeout                 = errors.New("The DA has not answered before the deadline of the fold")
+	ErrFoldFailed                  = errors.New("A fold has failed and cannot be retried anymore")
+
+	// Queriers
+	ErrQuerierNotFound  = errors.New("Querier not found")
+	ErrInvalidToken     = errors.New("Invalid querier token")
+	ErrNoTokenSecret    = errors.New("No secret configured to sign querier tokens")
+	ErrForbiddenDoctype = errors.New("This querier is not allowed to query this doctype")
+	ErrForbiddenJob     = errors.New("This querier is not allowed to run this aggregation job")
+	ErrNotQueryOwner    = errors.New("This query belongs to another querier")
+
+	// Quotas
+	ErrTooManyQueriesPerDay  = errors.New("The querier has reached its daily number of queries")
+	ErrTooManyRunningQueries = errors.New("The querier has reached its number of running queries")
+	ErrTooManyTargets        = errors.New("The query has more targets than allowed for the querier")
 )
 
 func WrapErrors(err error, parameter string) error {
@@ -77,12 +127,76 @@ func WrapErrors(err error, parameter string) error {
 		return jsonapi.InvalidParameter(parameter, err)
 	case ErrInvalidTargetProfile:
 		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidTokenBearer:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrWrongTokenBearer:
+		return jsonapi.Forbidden(err)
+	case ErrUnknownHost:
+		return jsonapi.Forbidden(err)
+	case ErrTokenExpired:
+		return jsonapi.InvalidParameter(parameter, err)
 	case ErrInvalidKey:
 		return jsonapi.InvalidParameter(parameter, err)
 	case ErrUnmarshal:
 		return jsonapi.BadJSON()
 	case ErrNotEnoughDataToComputeQuery:
 		return jsonapi.Forbidden(err)
+	case ErrInvalidFoldLayout:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidSecretSharing:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrNotEnoughHosts:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidRedundancy:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrJobNotShareable:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrShareOverflow:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidShare:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidClipping:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidTrim:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidGroups:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidMaxNorm:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrNotDecomposable:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidPreAggregation:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidCompletion:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrInvalidRobustLayer:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrQuorumNotReached:
+		return jsonapi.Forbidden(err)
+	case ErrQueryFailed:
+		return jsonapi.Forbidden(err)
+	case ErrQuerierNotFound:
+		return jsonapi.NotFound(err)
+	case ErrInvalidToken:
+		return jsonapi.NewError(http.StatusUnauthorized, err.Error())
+	case ErrForbiddenDoctype:
+		return jsonapi.Forbidden(err)
+	case ErrForbiddenJob:
+		return jsonapi.Forbidden(err)
+	case ErrForbiddenField:
+		return jsonapi.Forbidden(err)
+	case ErrForbiddenOperator:
+		return jsonapi.Forbidden(err)
+	case ErrMissingProjection:
+		return jsonapi.InvalidParameter(parameter, err)
+	case ErrNotQueryOwner:
+		return jsonapi.Forbidden(err)
+	case ErrTooManyQueriesPerDay:
+		return jsonapi.NewError(http.StatusTooManyRequests, err.Error())
+	case ErrTooManyRunningQueries:
+		return jsonapi.NewError(http.StatusTooManyRequests, err.Error())
+	case ErrTooManyTargets:
+		return jsonapi.NewError(http.StatusTooManyRequests, err.Error())
 	default:
 		return jsonapi.InternalServerError(err)
 	}
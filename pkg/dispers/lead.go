@@ -0,0 +1,171 @@
+package enclave
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+)
+
+// LeadDebounce is the time during which the requests to lead a query are
+// gathered into a single job, zero or a negative value pushing a job for
+// every request
+var LeadDebounce = 2 * time.Second
+
+// DoctypeLeads is the doctype of the pending leads
+const DoctypeLeads = "io.cozy.query.leads"
+
+// pendingLeadTTL is the time after which a pending lead whose job has not
+// taken it is deemed lost: the job is pushed again
+const pendingLeadTTL = time.Minute
+
+// LeadMessage is the message of the jobs leading a query
+type LeadMessage struct {
+	QueryID string `json:"query_id"`
+}
+
+// PendingLead is saved by the first request to lead a query. The requests
+// made until it is due, whatever the stack receiving them, do not push
+// another job: the job pushed with it leads the query once it is due.
+type PendingLead struct {
+	LeadID  string    `json:"_id,omitempty"`
+	LeadRev string    `json:"_rev,omitempty"`
+	Due     time.Time `json:"due"`
+}
+
+// ID returns the Doc ID
+func (l *PendingLead) ID() string {
+	return l.LeadID
+}
+
+// Rev returns the doc's version
+func (l *PendingLead) Rev() string {
+	return l.LeadRev
+}
+
+// DocType returns the DocType
+func (l *PendingLead) DocType() string {
+	return DoctypeLeads
+}
+
+// Clone copy a brand new version of the doc
+func (l *PendingLead) Clone() couchdb.Doc {
+	cloned := *l
+	return &cloned
+}
+
+// SetID set the ID
+func (l *PendingLead) SetID(id string) {
+	l.LeadID = id
+}
+
+// SetRev set the version
+func (l *PendingLead) SetRev(rev string) {
+	l.LeadRev = rev
+}
+
+// pushLeadJob pushes the job leading a query. It is replaced in the tests.
+var pushLeadJob = func(queryid string) error {
+	msg, err := job.NewMessage(LeadMessage{QueryID: queryid})
+	if err != nil {
+		return err
+	}
+	_, err = job.System().PushJob(PrefixerC, &job.JobRequest{
+		WorkerType: "conductor_lead",
+		Message:    msg,
+	})
+	return err
+}
+
+// PushLead asks for a query to be led by a conductor_lead job. The requests
+// made for the same query during LeadDebounce, like the results of the DAs
+// of a layer, produce a single job.
+func PushLead(queryid string) error {
+
+	if LeadDebounce <= 0 {
+		return pushLeadJob(queryid)
+	}
+
+	lead := &PendingLead{
+		LeadID: queryid,
+		Due:    time.Now().Add(LeadDebounce),
+	}
+	err := couchdb.CreateNamedDocWithDB(PrefixerC, lead)
+	if couchdb.IsConflictError(err) {
+		// A job is already waiting to lead the query
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// If the job cannot be pushed, the pending lead is pushed again by the
+	// check of the deadlines
+	return pushLeadJob(queryid)
+}
+
+// takePendingLead waits until the pending lead of a query is due, and deletes
+// it: the requests made from then on save a new one. A query without pending
+// lead is led at once.
+func takePendingLead(queryid string) error {
+
+	lead := &PendingLead{}
+	err := couchdb.GetDoc(PrefixerC, DoctypeLeads, queryid, lead)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if wait := time.Until(lead.Due); wait > 0 {
+		time.Sleep(wait)
+	}
+	// A job pushed again for a lost pending lead may have taken it already
+	if err := couchdb.DeleteDoc(PrefixerC, lead); err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// PushStaleLeads pushes again the jobs of the pending leads that have not
+// been taken pendingLeadTTL after they were due
+func PushStaleLeads(now time.Time) error {
+
+	var leads []*PendingLead
+	if err := couchdb.GetAllDocs(PrefixerC, DoctypeLeads, nil, &leads); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		return err
+	}
+	for _, lead := range leads {
+		if now.After(lead.Due.Add(pendingLeadTTL)) {
+			if err := pushLeadJob(lead.LeadID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LeadQuery resumes a query from its checkpoints, once its pending lead is
+// due. A query is led by one job at a time.
+func LeadQuery(queryid string) error {
+
+	if err := takePendingLead(queryid); err != nil {
+		return err
+	}
+
+	mu := lock.ReadWrite(PrefixerC, "dispers/lead/"+queryid)
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	q, err := NewQueryFetchingQueryDoc(queryid, 0)
+	if err != nil {
+		return err
+	}
+	return q.Lead()
+}
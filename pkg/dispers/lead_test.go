@@ -0,0 +1,62 @@
+package enclave
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushLead(t *testing.T) {
+
+	debounce, push := LeadDebounce, pushLeadJob
+	defer func() { LeadDebounce, pushLeadJob = debounce, push }()
+
+	pushed := make(map[string]int)
+	pushLeadJob = func(queryid string) error {
+		pushed[queryid]++
+		return nil
+	}
+
+	prefix := fmt.Sprintf("lead-%d", time.Now().UnixNano())
+	query1, query2, query3 := prefix+"-1", prefix+"-2", prefix+"-3"
+
+	// The requests are gathered until the pending lead is due
+	LeadDebounce = time.Hour
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, PushLead(query1))
+	}
+	assert.NoError(t, PushLead(query2))
+	assert.Equal(t, 1, pushed[query1])
+	assert.Equal(t, 1, pushed[query2])
+
+	// Once the job has taken the pending lead, a new request pushes a job
+	lead := &PendingLead{}
+	assert.NoError(t, couchdb.GetDoc(PrefixerC, DoctypeLeads, query1, lead))
+	lead.Due = time.Now()
+	assert.NoError(t, couchdb.UpdateDoc(PrefixerC, lead))
+	assert.NoError(t, takePendingLead(query1))
+	assert.NoError(t, PushLead(query1))
+	assert.Equal(t, 2, pushed[query1])
+
+	// The job of a pending lead that has not been taken is pushed again
+	assert.NoError(t, PushStaleLeads(time.Now()))
+	assert.Equal(t, 1, pushed[query2])
+	assert.NoError(t, PushStaleLeads(time.Now().Add(LeadDebounce+pendingLeadTTL+time.Minute)))
+	assert.Equal(t, 3, pushed[query1])
+	assert.Equal(t, 2, pushed[query2])
+
+	LeadDebounce = 0
+	assert.NoError(t, PushLead(query3))
+	assert.NoError(t, PushLead(query3))
+	assert.Equal(t, 2, pushed[query3])
+	assert.NoError(t, takePendingLead(query3))
+
+	for _, queryid := range []string{query1, query2} {
+		lead := &PendingLead{}
+		assert.NoError(t, couchdb.GetDoc(PrefixerC, DoctypeLeads, queryid, lead))
+		assert.NoError(t, couchdb.DeleteDoc(PrefixerC, lead))
+	}
+}
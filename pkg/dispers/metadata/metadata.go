@@ -22,6 +22,10 @@ type TaskMetadata struct {
 	End       time.Time `json:"end,omitempty"`
 	URL       url.URL   `json:"url,omitempty"`
 	ErrorMsg  string    `json:"error,omitempty"`
+	// Index is the Mango index used on a stack, and IndexError the error
+	// returned when it was created or deleted
+	Index      string `json:"index,omitempty"`
+	IndexError string `json:"index_error,omitempty"`
 }
 
 // NewTaskMetadata returns a new TaskMetadata object
@@ -54,6 +58,33 @@ type ExecutionMetadata struct {
 	Process              string                  `json:"process,omitempty"`
 	Host                 url.URL                 `json:"host,omitempty"`
 	Tasks                map[string]TaskMetadata `json:"tasks,omitempty"`
+	Disagreements        []Disagreement          `json:"disagreements,omitempty"`
+	Error                string                  `json:"error,omitempty"`
+}
+
+const (
+	// DisagreementResolved means that a majority of the copies of the fold
+	// agreed, the results of the outliers have been rejected
+	DisagreementResolved = "resolved"
+	// DisagreementTieBreaker means that another copy of the fold has been
+	// sent to a new host to settle the disagreement
+	DisagreementTieBreaker = "tie_breaker"
+	// DisagreementFailed means that no majority has been found, the layer
+	// has failed
+	DisagreementFailed = "failed"
+)
+
+// Disagreement is recorded when the DAs computing the same fold do not give
+// the same results. The outliers are the hosts whose results have been
+// rejected. An operator can spot a compromised or buggy aggregator thanks to
+// them.
+type Disagreement struct {
+	Layer    int       `json:"layer"`
+	Fold     int       `json:"fold"`
+	Hosts    []string  `json:"hosts"`
+	Outliers []string  `json:"outliers,omitempty"`
+	Outcome  string    `json:"outcome"`
+	At       time.Time `json:"at"`
 }
 
 func (t *ExecutionMetadata) ID() string {
@@ -108,9 +139,19 @@ func (m *ExecutionMetadata) HandleError(name string, task TaskMetadata, err erro
 	return err
 }
 
+// RecordDisagreement saves a disagreement between the DAs computing a fold
+func (m *ExecutionMetadata) RecordDisagreement(d Disagreement) error {
+	d.At = time.Now()
+	m.Disagreements = append(m.Disagreements, d)
+	return couchdb.UpdateDoc(prefixC, m)
+}
+
 // EndExecution the ExecutionMetadata in Conductor's database
 func (m *ExecutionMetadata) EndExecution(err error) error {
 	m.End = time.Now()
+	if err != nil {
+		m.Error = err.Error()
+	}
 	return couchdb.UpdateDoc(prefixC, m)
 }
 
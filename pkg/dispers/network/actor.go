@@ -2,9 +2,11 @@ package network
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -12,6 +14,7 @@ import (
 	"strings"
 
 	dispersErr "github.com/cozy/cozy-stack/pkg/dispers/errors"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 )
 
@@ -23,6 +26,14 @@ var Hosts = []url.URL{
 	},
 }
 
+// Client is the HTTP client used to call other Cozy-DISPERS actors. It is
+// replaced at startup by a client presenting this actor's certificate.
+var Client = &http.Client{}
+
+// StackClient is the HTTP client used to call Cozy stacks. Stacks do not
+// belong to the DISPERS network and are not expected to know its root CA.
+var StackClient = &http.Client{}
+
 const (
 	RoleCI        = "conceptindexor"
 	RoleTF        = "targetfinder"
@@ -35,10 +46,51 @@ const (
 	ModeStack     = "data"
 )
 
+// IdentityConductor is the organizational unit expected in a conductor's
+// certificate. Other actors use their role as organizational unit.
+const IdentityConductor = "conductor"
+
 func chooseHost() url.URL {
 	return Hosts[rand.Intn(len(Hosts))]
 }
 
+// ChooseHosts returns n distinct hosts chosen at random among the ones that
+// are not excluded. The copies of a fold are computed on distinct hosts.
+func ChooseHosts(n int, excluded ...string) ([]url.URL, error) {
+	candidates := []url.URL{}
+	for _, host := range Hosts {
+		isExcluded := false
+		for _, name := range excluded {
+			if host.Host == name {
+				isExcluded = true
+			}
+		}
+		if !isExcluded {
+			candidates = append(candidates, host)
+		}
+	}
+	if n > len(candidates) {
+		return nil, dispersErr.WrapErrors(dispersErr.ErrNotEnoughHosts, "")
+	}
+
+	hosts := make([]url.URL, n)
+	for index, candidate := range rand.Perm(len(candidates))[:n] {
+		hosts[index] = candidates[candidate]
+	}
+	return hosts, nil
+}
+
+// HostByName returns the host whose name is given, if it is a Cozy-DISPERS
+// server
+func HostByName(name string) (url.URL, bool) {
+	for _, host := range Hosts {
+		if host.Host == name {
+			return host, true
+		}
+	}
+	return url.URL{}, false
+}
+
 // ExternalActor structure gives a way to consider every Cozy-DISPERS server and
 // communicate with them. Each server can play the role of CI / TF / T / Conductor / DA
 type ExternalActor struct {
@@ -70,6 +122,12 @@ func (act *ExternalActor) DefineDispersActor(job string) {
 	act.URL.Path = strings.Join(append(act.Path, act.Role, job), "/")
 }
 
+// DefineDispersActorOn is like DefineDispersActor, on the given host
+func (act *ExternalActor) DefineDispersActorOn(host url.URL, job string) {
+	act.URL = host
+	act.URL.Path = strings.Join(append(act.Path, act.Role, job), "/")
+}
+
 func (act *ExternalActor) DefineStack(url url.URL) {
 	act.URL = url
 }
@@ -87,28 +145,144 @@ func (act *ExternalActor) MakeRequest(method string, token string, input interfa
 
 	act.Method = method
 
-	client := http.Client{}
-	request, err := http.NewRequest(act.Method, act.URL.String(), bytes.NewReader(body))
+	client := Client
+	if act.Role == RoleStack {
+		client = StackClient
+		release := acquireStackSlot()
+		defer release()
+	}
+
+	// The body sent to another actor is compressed if the actor has told it
+	// reads compressed requests. The signature covers the uncompressed body.
+	wireBody, compressed := body, false
+	if act.Role != RoleStack {
+		wireBody, compressed, err = compressBody(act.URL.Host, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(act.Method, act.URL.String(), bytes.NewReader(wireBody))
 	if err != nil {
 		return err
 	}
+	if act.Role != RoleStack {
+		if err := SignRequest(request, body); err != nil {
+			return err
+		}
+	}
 	if len(token) > 0 {
 		request.Header.Set("Authorization", token)
 	}
-	request.Header.Set("Content-Type", "application/json")
+	// The stacks only read JSON documents, and their compressed responses
+	// are read by the HTTP client
+	if act.Role == RoleStack {
+		request.Header.Set("Content-Type", "application/json")
+	} else {
+		request.Header.Set("Content-Type", wire.ContentType)
+		request.Header.Set("Accept-Encoding", EncodingGzip)
+		if compressed {
+			request.Header.Set("Content-Encoding", EncodingGzip)
+		}
+	}
+	observePayload(act.Role, directionRequest, len(body), len(wireBody))
 
 	resp, err := client.Do(request)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	if act.Role != RoleStack {
+		rememberEncodings(act.URL.Host, resp)
+		// The actor does not read compressed requests anymore
+		if compressed && resp.StatusCode == http.StatusUnsupportedMediaType {
+			gzipHosts.Delete(act.URL.Host)
+			return act.MakeRequest(method, token, nil, body)
+		}
+	}
+
+	return act.readOut(resp)
+}
+
+// MakeStreamRequest makes an HTTP request to another DISPERS Actor whose body
+// is written by write while it is sent, so that a large body is never held in
+// memory. The signature is sent in a trailer (see SignStreamedRequest). write
+// can be called twice, when the actor does not read compressed requests
+// anymore.
+func (act *ExternalActor) MakeStreamRequest(method string, write func(w io.Writer) error) error {
+
+	act.Method = method
+	_, compressed := gzipHosts.Load(act.URL.Host)
+	compressed = compressed && CompressionMinSize >= 0
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	request, err := http.NewRequest(act.Method, act.URL.String(), pr)
+	if err != nil {
+		return err
+	}
+	sign, err := SignStreamedRequest(request)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", wire.ContentType)
+	request.Header.Set("Accept-Encoding", EncodingGzip)
+	if compressed {
+		request.Header.Set("Content-Encoding", EncodingGzip)
+	}
+
+	go func() {
+		wireCounter := &countingWriter{w: pw}
+		var zw *gzip.Writer
+		var dst io.Writer = wireCounter
+		if compressed {
+			zw = gzip.NewWriter(wireCounter)
+			dst = zw
+		}
+		hash := sha256.New()
+		counter := &countingWriter{w: io.MultiWriter(dst, hash)}
+
+		err := write(counter)
+		if err == nil && zw != nil {
+			err = zw.Close()
+		}
+		if err == nil {
+			err = sign(hash.Sum(nil))
+		}
+		if err == nil {
+			observePayload(act.Role, directionRequest, counter.n, wireCounter.n)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	resp, err := Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	rememberEncodings(act.URL.Host, resp)
+	// The actor does not read compressed requests anymore
+	if compressed && resp.StatusCode == http.StatusUnsupportedMediaType {
+		gzipHosts.Delete(act.URL.Host)
+		return act.MakeStreamRequest(method, write)
+	}
+
+	return act.readOut(resp)
+}
+
+// readOut reads the response of another actor
+func (act *ExternalActor) readOut(resp *http.Response) error {
 
-	body, err = ioutil.ReadAll(resp.Body)
+	body, err := readResponse(act.Role, resp)
 	if err != nil {
 		return err
 	}
 
 	act.Outstr = string(body)
 	act.Out = body
+	act.Status = strconv.Itoa(resp.StatusCode)
 	if strings.Contains(strings.ToLower(act.Outstr), "error") {
 		return act.handleError()
 	}
@@ -25,3 +25,35 @@ func TestHandleError(t *testing.T) {
 	assert.Equal(t, "403", act.Status)
 
 }
+
+func TestChooseHosts(t *testing.T) {
+
+	hosts := Hosts
+	defer func() { Hosts = hosts }()
+	Hosts = []url.URL{
+		url.URL{Scheme: "https", Host: "da1.cozy.io"},
+		url.URL{Scheme: "https", Host: "da2.cozy.io"},
+		url.URL{Scheme: "https", Host: "da3.cozy.io"},
+	}
+
+	chosen, err := ChooseHosts(2)
+	assert.NoError(t, err)
+	assert.Len(t, chosen, 2)
+	assert.NotEqual(t, chosen[0].Host, chosen[1].Host)
+
+	// The tie-breaker runs on the host that has not computed the fold yet
+	chosen, err = ChooseHosts(1, "da1.cozy.io", "da3.cozy.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "da2.cozy.io", chosen[0].Host)
+
+	_, err = ChooseHosts(4)
+	assert.Error(t, err)
+	_, err = ChooseHosts(2, "da2.cozy.io", "da3.cozy.io")
+	assert.Error(t, err)
+
+	host, ok := HostByName("da2.cozy.io")
+	assert.True(t, ok)
+	assert.Equal(t, "https", host.Scheme)
+	_, ok = HostByName("evil.example.com")
+	assert.False(t, ok)
+}
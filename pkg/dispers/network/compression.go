@@ -0,0 +1,141 @@
+package network
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/metrics"
+)
+
+const (
+	// EncodingGzip is the only content encoding used between actors
+	EncodingGzip = "gzip"
+
+	directionRequest  = "request"
+	directionResponse = "response"
+)
+
+var (
+	// CompressionMinSize is the size in bytes from which the bodies sent to
+	// other actors are compressed. A negative size disables the compression.
+	CompressionMinSize = 1024
+
+	// gzipHosts remembers the actors that read compressed requests. An actor
+	// tells it with the Accept-Encoding header of its responses (RFC 7694), so
+	// the first request sent to an actor is never compressed.
+	gzipHosts sync.Map
+)
+
+// AcceptsGzip returns true if the value of an Accept-Encoding header allows
+// gzip
+func AcceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.TrimSpace(params[0])
+		if coding != EncodingGzip && coding != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		return accepted
+	}
+	return false
+}
+
+// compressBody returns the body to send to host, and whether it has been
+// compressed
+func compressBody(host string, body []byte) ([]byte, bool, error) {
+
+	if CompressionMinSize < 0 || len(body) < CompressionMinSize {
+		return body, false, nil
+	}
+	if _, ok := gzipHosts.Load(host); !ok {
+		return body, false, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false, err
+	}
+	// Small or random bodies do not always shrink
+	if buf.Len() >= len(body) {
+		return body, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// rememberEncodings records whether host reads compressed requests
+func rememberEncodings(host string, resp *http.Response) {
+	if AcceptsGzip(resp.Header.Get("Accept-Encoding")) {
+		gzipHosts.Store(host, true)
+	} else {
+		gzipHosts.Delete(host)
+	}
+}
+
+// countingReader counts the bytes read on the wire
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// countingWriter counts the bytes written on the wire
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// readResponse reads the body of a response, decompressed
+func readResponse(role string, resp *http.Response) ([]byte, error) {
+
+	counter := &countingReader{r: resp.Body}
+	var reader io.Reader = counter
+	if resp.Header.Get("Content-Encoding") == EncodingGzip {
+		zr, err := gzip.NewReader(counter)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	observePayload(role, directionResponse, len(body), counter.n)
+	return body, nil
+}
+
+func observePayload(role, direction string, size, wireSize int) {
+	metrics.DispersPayloadBytes.WithLabelValues(role, direction).Observe(float64(size))
+	metrics.DispersPayloadWireBytes.WithLabelValues(role, direction).Observe(float64(wireSize))
+}
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// linkBytesPerSecond simulates a 100 Mbit/s link between two actors
+const linkBytesPerSecond = 100 * 1000 * 1000 / 8
+
+// slowReader delays the reads as if the bytes came from a network link
+type slowReader struct {
+	r io.Reader
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / linkBytesPerSecond)
+	return n, err
+}
+
+// newPeer starts an actor that reads compressed requests. The encodings of
+// the requests received are recorded.
+func newPeer(throttled bool, encodings *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*encodings = append(*encodings, r.Header.Get("Content-Encoding"))
+		var body io.Reader = r.Body
+		if throttled {
+			body = &slowReader{r: body}
+		}
+		if r.Header.Get("Content-Encoding") == EncodingGzip {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		var rows []map[string]interface{}
+		if err := json.NewDecoder(body).Decode(&rows); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Accept-Encoding", EncodingGzip)
+		out := []byte(fmt.Sprintf("{\"ok\":true,\"rows\":%d}", len(rows)))
+		if AcceptsGzip(r.Header.Get("Accept-Encoding")) {
+			w.Header().Set("Content-Encoding", EncodingGzip)
+			zw := gzip.NewWriter(w)
+			zw.Write(out)
+			zw.Close()
+			return
+		}
+		w.Write(out)
+	}))
+}
+
+// rowsOfData returns data looking like the results of the targets
+func rowsOfData(n int) []map[string]interface{} {
+	rows := make([]map[string]interface{}, n)
+	for index := range rows {
+		rows[index] = map[string]interface{}{
+			"sepal_length": 4.3 + float64(index%36)/10,
+			"sepal_width":  2.0 + float64(index%24)/10,
+			"species":      []string{"setosa", "versicolor", "virginica"}[index%3],
+			"_id":          fmt.Sprintf("io.cozy.iris-%08d", index),
+		}
+	}
+	return rows
+}
+
+func peerActor(server *httptest.Server) ExternalActor {
+	act := NewExternalActor(RoleDA, ModeQuery)
+	peerURL, _ := url.Parse(server.URL)
+	act.URL = *peerURL
+	act.URL.Path = "/dispers/dataaggregator/aggregation"
+	return act
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	assert.True(t, AcceptsGzip("gzip"))
+	assert.True(t, AcceptsGzip("deflate, gzip;q=0.5"))
+	assert.True(t, AcceptsGzip("*"))
+	assert.False(t, AcceptsGzip(""))
+	assert.False(t, AcceptsGzip("identity"))
+	assert.False(t, AcceptsGzip("gzip;q=0"))
+}
+
+func TestCompressedRequests(t *testing.T) {
+
+	var encodings []string
+	server := newPeer(false, &encodings)
+	defer server.Close()
+	defer gzipHosts.Delete(peerActor(server).URL.Host)
+
+	rows := rowsOfData(1000)
+	act := peerActor(server)
+
+	// The actor has not told yet it reads compressed requests
+	assert.NoError(t, act.MakeRequest("POST", "", rows, nil))
+	assert.Equal(t, "{\"ok\":true,\"rows\":1000}", act.Outstr)
+
+	assert.NoError(t, act.MakeRequest("POST", "", rows, nil))
+	assert.Equal(t, "{\"ok\":true,\"rows\":1000}", act.Outstr)
+
+	// Small bodies are not compressed
+	assert.NoError(t, act.MakeRequest("POST", "", rowsOfData(1), nil))
+
+	assert.Equal(t, []string{"", EncodingGzip, ""}, encodings)
+}
+
+func benchmarkTransport(b *testing.B, minSize int) {
+
+	var encodings []string
+	server := newPeer(true, &encodings)
+	defer server.Close()
+	defer gzipHosts.Delete(peerActor(server).URL.Host)
+
+	previous := CompressionMinSize
+	CompressionMinSize = minSize
+	defer func() { CompressionMinSize = previous }()
+
+	rows := rowsOfData(20000)
+	body, _ := json.Marshal(rows)
+	act := peerActor(server)
+	// Learn whether the actor reads compressed requests
+	if err := act.MakeRequest("POST", "", nil, body); err != nil {
+		b.Fatal(err)
+	}
+
+	wireBody, _, err := compressBody(act.URL.Host, body)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(len(wireBody)), "wire-bytes/op")
+	b.SetBytes(int64(len(body)))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := act.MakeRequest("POST", "", nil, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTransport sends the results of 20,000 targets to a Data Aggregator
+// over a 100 Mbit/s link, with and without compression:
+//
+//	go test ./pkg/dispers/network -run XXX -bench Transport
+func BenchmarkTransport(b *testing.B) {
+	b.Run("identity", func(b *testing.B) { benchmarkTransport(b, -1) })
+	b.Run("gzip", func(b *testing.B) { benchmarkTransport(b, 1024) })
+}
@@ -0,0 +1,221 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/cache"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+const (
+	// HeaderActor contains the name of the actor that signed the request
+	HeaderActor = "X-Dispers-Actor"
+	// HeaderSignature contains the signature of the request
+	HeaderSignature = "X-Dispers-Signature"
+
+	nonceLength = 16
+)
+
+var (
+	// SignatureName is the name of this actor, as known by its peers. Requests
+	// are not signed when it is empty.
+	SignatureName string
+	// SignatureKeys contains the key shared with every peer, indexed by the
+	// peer's name. The name of a peer is also the host used to reach it.
+	SignatureKeys = map[string][]byte{}
+	// SignatureRoles contains the role of every peer, indexed by the peer's
+	// name. A peer can only call the routes reserved to its role.
+	SignatureRoles = map[string]string{}
+	// SignatureMaxAge is the maximum age of an accepted signature
+	SignatureMaxAge = time.Minute
+	// MaxPayloadSize is the size in bytes of the largest body an actor reads
+	// from another one: the rows sent by a Target to a fold are the largest
+	MaxPayloadSize int64 = 32 << 20
+	// MaxStreamedPayloadSize is the size in bytes of the largest body streamed
+	// by another actor (see MakeStreamRequest): the buckets of addresses of the
+	// concepts of a query, sent by the Conductor to the Target Finder, are the
+	// largest
+	MaxStreamedPayloadSize int64 = 512 << 20
+	// Nonces keeps track of the signatures already received to reject replays
+	Nonces = cache.New(nil)
+
+	signatureConfig = crypto.MACConfig{Name: "dispers-request"}
+
+	ErrUnsignedRequest = errors.New("The request is not signed")
+	ErrUnknownActor    = errors.New("The request is signed by an unknown actor")
+	ErrBadSignature    = errors.New("The signature of the request is invalid or expired")
+	ErrReplayedRequest = errors.New("The request has already been received")
+)
+
+// canonicalRequest returns the data covered by the signature: the sender, the
+// method, the path with its query and the hash of the body
+func canonicalRequest(actor string, req *http.Request, bodyHash []byte) []byte {
+	canonical := actor + "\n" + req.Method + "\n" + req.URL.RequestURI() + "\n" + hex.EncodeToString(bodyHash)
+	return []byte(canonical)
+}
+
+// sign returns the signature of a request made by this actor
+func sign(req *http.Request, bodyHash []byte) ([]byte, error) {
+
+	key, ok := SignatureKeys[req.URL.Host]
+	if !ok {
+		return nil, ErrUnknownActor
+	}
+
+	nonce := crypto.GenerateRandomBytes(nonceLength)
+	return crypto.EncodeAuthMessage(signatureConfig, key, nonce, canonicalRequest(SignatureName, req, bodyHash))
+}
+
+// SignRequest adds the headers proving that the request has been made by this
+// actor. The key is chosen from the host the request is sent to.
+func SignRequest(req *http.Request, body []byte) error {
+
+	if len(SignatureName) == 0 {
+		return nil
+	}
+
+	hash := sha256.Sum256(body)
+	signature, err := sign(req, hash[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(HeaderActor, SignatureName)
+	req.Header.Set(HeaderSignature, string(signature))
+	return nil
+}
+
+// SignStreamedRequest prepares a request whose body is written while it is
+// sent. The signature cannot be computed before the whole body has been
+// written, it is sent in a trailer: the returned function is called with the
+// hash of the body once it has been written, and before the body is closed.
+func SignStreamedRequest(req *http.Request) (func(bodyHash []byte) error, error) {
+
+	if len(SignatureName) == 0 {
+		return func([]byte) error { return nil }, nil
+	}
+	if _, ok := SignatureKeys[req.URL.Host]; !ok {
+		return nil, ErrUnknownActor
+	}
+
+	req.Header.Set(HeaderActor, SignatureName)
+	req.Trailer = http.Header{HeaderSignature: nil}
+	return func(bodyHash []byte) error {
+		signature, err := sign(req, bodyHash)
+		if err != nil {
+			return err
+		}
+		req.Trailer.Set(HeaderSignature, string(signature))
+		return nil
+	}, nil
+}
+
+// VerifyRequest checks the signature of a request received from another
+// actor and returns the name of this actor. A signature can only be used once.
+func VerifyRequest(req *http.Request, body []byte) (string, error) {
+
+	actor := req.Header.Get(HeaderActor)
+	signature := req.Header.Get(HeaderSignature)
+	if len(actor) == 0 || len(signature) == 0 {
+		return "", ErrUnsignedRequest
+	}
+
+	hash := sha256.Sum256(body)
+	if err := verifySignature(actor, signature, req, hash[:]); err != nil {
+		return "", err
+	}
+	return actor, nil
+}
+
+// VerifyStreamedRequest checks the signature of a request signed with
+// SignStreamedRequest. The body of the request is replaced by a reader that
+// hashes the body as it is read, and checks the signature sent in the trailer
+// when the end of the body is reached: reading the body to its end returns an
+// error instead of io.EOF if the signature is invalid. The name of the actor
+// is returned before the signature has been checked, so the handlers of the
+// streamed requests have to read the whole body before acting.
+func VerifyStreamedRequest(req *http.Request) (string, error) {
+
+	actor := req.Header.Get(HeaderActor)
+	if len(actor) == 0 {
+		return "", ErrUnsignedRequest
+	}
+	if _, ok := SignatureKeys[actor]; !ok {
+		return "", ErrUnknownActor
+	}
+
+	req.Body = &verifyingReader{
+		body:  req.Body,
+		req:   req,
+		actor: actor,
+		hash:  sha256.New(),
+	}
+	return actor, nil
+}
+
+// verifyingReader hashes the body of a streamed request and checks its
+// signature at the end of the body. An invalid signature is returned on every
+// following read.
+type verifyingReader struct {
+	body  io.ReadCloser
+	req   *http.Request
+	actor string
+	hash  hash.Hash
+	err   error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.body.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		signature := v.req.Trailer.Get(HeaderSignature)
+		if len(signature) == 0 {
+			v.err = ErrUnsignedRequest
+		} else {
+			v.err = verifySignature(v.actor, signature, v.req, v.hash.Sum(nil))
+		}
+		if v.err != nil {
+			return n, v.err
+		}
+		v.err = io.EOF
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.body.Close()
+}
+
+// verifySignature checks the signature of a request made by actor. A
+// signature can only be used once.
+func verifySignature(actor, signature string, req *http.Request, bodyHash []byte) error {
+
+	key, ok := SignatureKeys[actor]
+	if !ok {
+		return ErrUnknownActor
+	}
+
+	conf := signatureConfig
+	conf.MaxAge = SignatureMaxAge
+	nonce, err := crypto.DecodeAuthMessage(conf, key, []byte(signature), canonicalRequest(actor, req, bodyHash))
+	if err != nil {
+		return ErrBadSignature
+	}
+
+	// Signatures older than SignatureMaxAge are rejected by DecodeAuthMessage,
+	// so nonces only have to be remembered for this duration.
+	nonceKey := "dispers:nonce:" + actor + ":" + hex.EncodeToString(nonce)
+	if !Nonces.SetIfAbsent(nonceKey, []byte{1}, SignatureMaxAge) {
+		return ErrReplayedRequest
+	}
+	return nil
+}
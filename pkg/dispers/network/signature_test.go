@@ -0,0 +1,148 @@
+package network
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignRequest(t *testing.T) {
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	SignatureName = "conductor.dispers.local"
+	SignatureKeys = map[string][]byte{
+		"conductor.dispers.local": key,
+		"target.dispers.local":    key,
+	}
+	defer func() {
+		SignatureName = ""
+		SignatureKeys = map[string][]byte{}
+	}()
+
+	body := []byte("{\"queryid\":\"abc\"}")
+	req, _ := http.NewRequest("POST", "https://target.dispers.local/dispers/target/query", nil)
+	assert.NoError(t, SignRequest(req, body))
+	assert.Equal(t, "conductor.dispers.local", req.Header.Get(HeaderActor))
+
+	// The body has been tampered with
+	_, err := VerifyRequest(req, []byte("{\"queryid\":\"def\"}"))
+	assert.Equal(t, ErrBadSignature, err)
+
+	actor, err := VerifyRequest(req, body)
+	assert.NoError(t, err)
+	assert.Equal(t, "conductor.dispers.local", actor)
+
+	// The same signature cannot be used twice
+	_, err = VerifyRequest(req, body)
+	assert.Equal(t, ErrReplayedRequest, err)
+
+	// The signature does not cover another route
+	assert.NoError(t, SignRequest(req, body))
+	req.URL.Path = "/dispers/dataaggregator/aggregation"
+	_, err = VerifyRequest(req, body)
+	assert.Equal(t, ErrBadSignature, err)
+
+	req.Header.Del(HeaderSignature)
+	_, err = VerifyRequest(req, body)
+	assert.Equal(t, ErrUnsignedRequest, err)
+}
+
+func TestStreamedRequest(t *testing.T) {
+
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == EncodingGzip {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.Body = zr
+		}
+		actor, err := VerifyStreamedRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "{\"error\":%q}", err.Error())
+			return
+		}
+		received = append(received, actor+" "+string(body))
+		w.Write([]byte("{\"ok\":true}"))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	SignatureName = "conductor.dispers.local"
+	SignatureKeys = map[string][]byte{
+		"conductor.dispers.local": key,
+		serverURL.Host:            key,
+	}
+	defer func() {
+		SignatureName = ""
+		SignatureKeys = map[string][]byte{}
+	}()
+
+	write := func(w io.Writer) error {
+		for index := 0; index < 3; index++ {
+			if _, err := fmt.Fprintf(w, "[%d]", index); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	act := NewExternalActor(RoleTF, ModeQuery)
+	act.URL = *serverURL
+	act.URL.Path = "/dispers/targetfinder/addresses"
+	assert.NoError(t, act.MakeStreamRequest("POST", write))
+	assert.Equal(t, "{\"ok\":true}", act.Outstr)
+
+	// The body is compressed once the actor has told it reads compressed
+	// requests, the signature still covers the uncompressed body
+	gzipHosts.Store(serverURL.Host, true)
+	defer gzipHosts.Delete(serverURL.Host)
+	assert.NoError(t, act.MakeStreamRequest("POST", write))
+	assert.Equal(t, []string{
+		"conductor.dispers.local [0][1][2]",
+		"conductor.dispers.local [0][1][2]",
+	}, received)
+
+	// The body has been tampered with
+	req, _ := http.NewRequest("POST", server.URL+"/dispers/targetfinder/addresses", nil)
+	sign, err := SignStreamedRequest(req)
+	assert.NoError(t, err)
+	hash := sha256.Sum256([]byte("[0][1][2]"))
+	assert.NoError(t, sign(hash[:]))
+	req.Body = ioutil.NopCloser(strings.NewReader("[0][1][3]"))
+	actor, err := VerifyStreamedRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "conductor.dispers.local", actor)
+	_, err = ioutil.ReadAll(req.Body)
+	assert.Equal(t, ErrBadSignature, err)
+	_, err = req.Body.Read(make([]byte, 1))
+	assert.Equal(t, ErrBadSignature, err)
+
+	// The signature is missing
+	req, _ = http.NewRequest("POST", server.URL+"/dispers/targetfinder/addresses", nil)
+	_, err = SignStreamedRequest(req)
+	assert.NoError(t, err)
+	req.Body = ioutil.NopCloser(strings.NewReader("[0][1][2]"))
+	_, err = VerifyStreamedRequest(req)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(req.Body)
+	assert.Equal(t, ErrUnsignedRequest, err)
+}
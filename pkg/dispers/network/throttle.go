@@ -0,0 +1,25 @@
+package network
+
+// DefaultStackConcurrency is the number of requests made to the stacks at the
+// same time when none is configured
+const DefaultStackConcurrency = 16
+
+// stackSlots limits the number of requests made to the stacks at the same
+// time by this process, whatever the number of workers querying them
+var stackSlots = make(chan struct{}, DefaultStackConcurrency)
+
+// SetStackConcurrency changes the number of requests made to the stacks at
+// the same time. It is called at startup, before any request.
+func SetStackConcurrency(n int) {
+	if n > 0 {
+		stackSlots = make(chan struct{}, n)
+	}
+}
+
+// acquireStackSlot waits until a request can be made to a stack, and returns
+// the function releasing the slot
+func acquireStackSlot() func() {
+	slots := stackSlots
+	slots <- struct{}{}
+	return func() { <-slots }
+}
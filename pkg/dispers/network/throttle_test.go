@@ -0,0 +1,50 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStackConcurrency(t *testing.T) {
+
+	SetStackConcurrency(2)
+	defer SetStackConcurrency(DefaultStackConcurrency)
+
+	var running, maxRunning int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"docs": []}`))
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stack := NewExternalActor(RoleStack, ModeStack)
+			stack.DefineStack(url.URL{Scheme: "http", Host: u.Host, Path: "data/io.cozy.bank.operations/_find"})
+			assert.NoError(t, stack.MakeRequest("POST", "", map[string]interface{}{}, nil))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
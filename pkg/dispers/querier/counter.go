@@ -0,0 +1,99 @@
+package querier
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Counter is used to count the queries of the queriers. It is backed by redis
+// when the stack is configured with a rate limiting storage, and kept in
+// memory otherwise.
+type Counter interface {
+	// Increment adds one to the counter and returns its new value. The counter
+	// is removed ttl after its creation, whatever the increments since.
+	Increment(key string, ttl time.Duration) (int64, error)
+	// Decrement removes one from the counter
+	Decrement(key string) error
+}
+
+// NewCounter returns a Counter from a potentially nil redis client
+func NewCounter(client redis.UniversalClient) Counter {
+	if client != nil {
+		return &redisCounter{client}
+	}
+	return &memCounter{values: make(map[string]*memValue)}
+}
+
+type redisCounter struct {
+	client redis.UniversalClient
+}
+
+func (r *redisCounter) Increment(key string, ttl time.Duration) (int64, error) {
+	pipe := r.client.TxPipeline()
+	incr := pipe.Incr(key)
+	current := pipe.TTL(key)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	// The counter expires at the end of a fixed window, started when it has
+	// been created
+	if current.Val() < 0 {
+		if err := r.client.Expire(key, ttl).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return incr.Val(), nil
+}
+
+func (r *redisCounter) Decrement(key string) error {
+	value, err := r.client.Decr(key).Result()
+	if err != nil {
+		return err
+	}
+	// The counter may have expired before being decremented
+	if value <= 0 {
+		return r.client.Del(key).Err()
+	}
+	return nil
+}
+
+type memValue struct {
+	value     int64
+	expiredAt time.Time
+}
+
+type memCounter struct {
+	mu     sync.Mutex
+	values map[string]*memValue
+}
+
+func (m *memCounter) Increment(key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	v, ok := m.values[key]
+	if !ok || now.After(v.expiredAt) {
+		v = &memValue{expiredAt: now.Add(ttl)}
+		m.values[key] = v
+	}
+	v.value++
+	return v.value, nil
+}
+
+func (m *memCounter) Decrement(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.values[key]
+	if !ok {
+		return nil
+	}
+	v.value--
+	if v.value <= 0 || time.Now().After(v.expiredAt) {
+		delete(m.values, key)
+	}
+	return nil
+}
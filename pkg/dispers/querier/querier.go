@@ -0,0 +1,235 @@
+package querier
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+const (
+	doctypeQuerier = "io.cozy.dispers.queriers"
+
+	// Wildcard can be used in scopes to allow every doctype or every job
+	Wildcard = "*"
+)
+
+var (
+	// PrefixerC is exported to easilly pass in dev-mode
+	PrefixerC = prefixer.ConductorPrefixer
+
+	// TokenSecret is used to sign the queriers' tokens
+	TokenSecret []byte
+)
+
+// QuerierDoc is saved in the Conductor's database for every account allowed
+// to make queries. Doctypes and Jobs are the querier's scopes.
+type QuerierDoc struct {
+	QuerierID  string    `json:"_id,omitempty"`
+	QuerierRev string    `json:"_rev,omitempty"`
+	Name       string    `json:"name"`
+	IsAdmin    bool      `json:"admin,omitempty"`
+	Doctypes   []string  `json:"doctypes,omitempty"`
+	Jobs       []string  `json:"jobs,omitempty"`
+	Quotas     *Quotas   `json:"quotas,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ID returns the QuerierID
+func (q *QuerierDoc) ID() string {
+	return q.QuerierID
+}
+
+// Rev returns the doc's version
+func (q *QuerierDoc) Rev() string {
+	return q.QuerierRev
+}
+
+// DocType returns the doctype
+func (q *QuerierDoc) DocType() string {
+	return doctypeQuerier
+}
+
+// Clone copy a brand new version of the doc
+func (q *QuerierDoc) Clone() couchdb.Doc {
+	cloned := *q
+	cloned.Doctypes = append([]string{}, q.Doctypes...)
+	cloned.Jobs = append([]string{}, q.Jobs...)
+	if q.Quotas != nil {
+		quotas := *q.Quotas
+		cloned.Quotas = &quotas
+	}
+	return &cloned
+}
+
+// SetID set the QuerierID
+func (q *QuerierDoc) SetID(id string) {
+	q.QuerierID = id
+}
+
+// SetRev set the doc's version
+func (q *QuerierDoc) SetRev(rev string) {
+	q.QuerierRev = rev
+}
+
+// Claims are the claims of a querier's token
+type Claims struct {
+	jwt.StandardClaims
+}
+
+// NewQuerier saves a new querier in the Conductor's database. When created
+// without quotas, the default ones are applied to the querier.
+func NewQuerier(name string, isAdmin bool, doctypes []string, jobs []string, quotas *Quotas) (*QuerierDoc, error) {
+
+	q := &QuerierDoc{
+		Name:      name,
+		IsAdmin:   isAdmin,
+		Doctypes:  doctypes,
+		Jobs:      jobs,
+		Quotas:    quotas,
+		CreatedAt: time.Now(),
+	}
+	if err := couchdb.CreateDoc(PrefixerC, q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// GetQuerier retrieves a querier from the Conductor's database
+func GetQuerier(querierid string) (*QuerierDoc, error) {
+
+	q := &QuerierDoc{}
+	if err := couchdb.GetDoc(PrefixerC, doctypeQuerier, querierid, q); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, errors.WrapErrors(errors.ErrQuerierNotFound, "")
+		}
+		return nil, err
+	}
+	return q, nil
+}
+
+// DeleteQuerier removes a querier. Its tokens become useless.
+func DeleteQuerier(querierid string) error {
+
+	q, err := GetQuerier(querierid)
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(PrefixerC, q)
+}
+
+// NewToken issues a bearer token for the querier
+func (q *QuerierDoc) NewToken() (string, error) {
+
+	if len(TokenSecret) == 0 {
+		return "", errors.ErrNoTokenSecret
+	}
+
+	now := time.Now()
+	return crypto.NewJWT(TokenSecret, Claims{
+		jwt.StandardClaims{
+			Audience:  consts.QuerierAudience,
+			Subject:   q.ID(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(consts.QuerierTokenValidityDuration).Unix(),
+		},
+	})
+}
+
+// parseToken checks the token's signature and returns its claims
+func parseToken(token string) (*Claims, error) {
+
+	if len(TokenSecret) == 0 {
+		return nil, errors.ErrNoTokenSecret
+	}
+
+	claims := &Claims{}
+	err := crypto.ParseJWT(token, func(t *jwt.Token) (interface{}, error) {
+		return TokenSecret, nil
+	}, claims)
+	if err != nil || claims.Audience != consts.QuerierAudience || claims.Subject == "" {
+		return nil, errors.WrapErrors(errors.ErrInvalidToken, "")
+	}
+	return claims, nil
+}
+
+// Authenticate returns the querier owning the token. A token is rejected as
+// soon as its querier has been deleted.
+func Authenticate(token string) (*QuerierDoc, error) {
+
+	claims, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := GetQuerier(claims.Subject)
+	if err != nil {
+		return nil, errors.WrapErrors(errors.ErrInvalidToken, "")
+	}
+	return q, nil
+}
+
+func contains(scope []string, value string) bool {
+	for _, item := range scope {
+		if item == Wildcard || item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnrestricted(scope []string) bool {
+	for _, item := range scope {
+		if item == Wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckScopes returns an error if the query needs a doctype or an aggregation
+// job the querier is not allowed to use. The Conductor cannot read encrypted
+// queries, so they are only accepted from queriers without any restriction.
+func (q *QuerierDoc) CheckScopes(in *query.InputNewQuery) error {
+
+	if q.IsAdmin {
+		return nil
+	}
+
+	if in.IsEncrypted {
+		if !isUnrestricted(q.Doctypes) {
+			return errors.WrapErrors(errors.ErrForbiddenDoctype, "")
+		}
+		if !isUnrestricted(q.Jobs) {
+			return errors.WrapErrors(errors.ErrForbiddenJob, "")
+		}
+		return nil
+	}
+
+	if !contains(q.Doctypes, in.LocalQuery.Doctype) {
+		return errors.WrapErrors(errors.ErrForbiddenDoctype, "")
+	}
+	for _, layer := range in.LayersDA {
+		for _, job := range layer.Jobs {
+			if !contains(q.Jobs, job.Job) {
+				return errors.WrapErrors(errors.ErrForbiddenJob, "")
+			}
+		}
+	}
+	return nil
+}
+
+// CanAccess returns an error if the querier is not allowed to read, resume or
+// delete a query made by owner
+func (q *QuerierDoc) CanAccess(owner string) error {
+
+	if q.IsAdmin || q.ID() == owner {
+		return nil
+	}
+	return errors.WrapErrors(errors.ErrNotQueryOwner, "")
+}
@@ -0,0 +1,73 @@
+package querier
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken(t *testing.T) {
+
+	q := &QuerierDoc{QuerierID: "fakequerierid", Name: "insee"}
+
+	TokenSecret = nil
+	_, err := q.NewToken()
+	assert.Error(t, err)
+
+	TokenSecret = crypto.GenerateRandomBytes(64)
+	token, err := q.NewToken()
+	assert.NoError(t, err)
+
+	claims, err := parseToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "fakequerierid", claims.Subject)
+
+	_, err = parseToken(token + "a")
+	assert.Error(t, err)
+
+	TokenSecret = crypto.GenerateRandomBytes(64)
+	_, err = parseToken(token)
+	assert.Error(t, err)
+}
+
+func TestCheckScopes(t *testing.T) {
+
+	in := &query.InputNewQuery{
+		LocalQuery: query.LocalQuery{Doctype: "io.cozy.bank.operations"},
+		LayersDA: []query.LayerDA{
+			query.LayerDA{Jobs: []query.AggregationJob{query.AggregationJob{Job: "sum"}}},
+			query.LayerDA{Jobs: []query.AggregationJob{query.AggregationJob{Job: "mean"}}},
+		},
+	}
+
+	q := &QuerierDoc{
+		Doctypes: []string{"io.cozy.bank.operations"},
+		Jobs:     []string{"sum"},
+	}
+	assert.Error(t, q.CheckScopes(in))
+
+	q.Jobs = append(q.Jobs, "mean")
+	assert.NoError(t, q.CheckScopes(in))
+
+	in.LocalQuery.Doctype = "io.cozy.contacts"
+	assert.Error(t, q.CheckScopes(in))
+
+	// Encrypted queries need unrestricted scopes
+	in.IsEncrypted = true
+	assert.Error(t, q.CheckScopes(in))
+	q.Doctypes = []string{Wildcard}
+	q.Jobs = []string{Wildcard}
+	assert.NoError(t, q.CheckScopes(in))
+}
+
+func TestCanAccess(t *testing.T) {
+
+	q := &QuerierDoc{QuerierID: "alice"}
+	assert.NoError(t, q.CanAccess("alice"))
+	assert.Error(t, q.CanAccess("bob"))
+
+	q.IsAdmin = true
+	assert.NoError(t, q.CanAccess("bob"))
+}
@@ -0,0 +1,114 @@
+package querier
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+)
+
+// Quotas are the limits applied to the queries of a querier. Zero means no
+// limit.
+type Quotas struct {
+	QueriesPerDay     int `json:"queries_per_day,omitempty"`
+	ConcurrentQueries int `json:"concurrent_queries,omitempty"`
+	MaxTargets        int `json:"max_targets,omitempty"`
+}
+
+var (
+	// DefaultQuotas are applied to the queriers without their own quotas
+	DefaultQuotas Quotas
+	// RunningQueryTTL is the time after which a query that never ended stops
+	// counting in the concurrent queries of its querier
+	RunningQueryTTL = 24 * time.Hour
+	// Counters stores the number of queries of every querier
+	Counters = NewCounter(nil)
+
+	// retryRunningAfter is sent to the queriers that have too many running
+	// queries, as there is no way to know when one of them will end
+	retryRunningAfter = time.Minute
+)
+
+func dailyKey(querierid string, now time.Time) string {
+	return "dispers:quota:" + querierid + ":day:" + now.UTC().Format("2006-01-02")
+}
+
+func runningKey(querierid string) string {
+	return "dispers:quota:" + querierid + ":running"
+}
+
+// GetQuotas returns the quotas of the querier
+func (q *QuerierDoc) GetQuotas() Quotas {
+	if q.Quotas != nil {
+		return *q.Quotas
+	}
+	return DefaultQuotas
+}
+
+// AcquireQuery counts a new query for the querier. If the querier is over
+// quota, the query must not be made and the returned duration tells when the
+// querier can retry. The query has to be released with ReleaseQuery when it
+// ends.
+func (q *QuerierDoc) AcquireQuery() (time.Duration, error) {
+
+	if q.IsAdmin {
+		return 0, nil
+	}
+	quotas := q.GetQuotas()
+
+	now := time.Now()
+	if quotas.QueriesPerDay > 0 {
+		key := dailyKey(q.ID(), now)
+		count, err := Counters.Increment(key, 24*time.Hour)
+		if err != nil {
+			return 0, err
+		}
+		if count > int64(quotas.QueriesPerDay) {
+			Counters.Decrement(key)
+			tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			return tomorrow.Sub(now), errors.WrapErrors(errors.ErrTooManyQueriesPerDay, "")
+		}
+	}
+
+	if quotas.ConcurrentQueries > 0 {
+		key := runningKey(q.ID())
+		count, err := Counters.Increment(key, RunningQueryTTL)
+		if err != nil {
+			return 0, err
+		}
+		if count > int64(quotas.ConcurrentQueries) {
+			Counters.Decrement(key)
+			if quotas.QueriesPerDay > 0 {
+				Counters.Decrement(dailyKey(q.ID(), now))
+			}
+			return retryRunningAfter, errors.WrapErrors(errors.ErrTooManyRunningQueries, "")
+		}
+	}
+
+	return 0, nil
+}
+
+// TargetsLimit returns the maximal number of targets of a query, given the
+// number requested by the querier, zero meaning as many as its quota allows. A
+// query asking for more targets than the quota is refused on submission.
+func (q *QuerierDoc) TargetsLimit(requested int) (int, error) {
+
+	limit := q.GetQuotas().MaxTargets
+	if q.IsAdmin || limit <= 0 {
+		return requested, nil
+	}
+	if requested > limit {
+		return 0, errors.WrapErrors(errors.ErrTooManyTargets, "")
+	}
+	if requested <= 0 {
+		return limit, nil
+	}
+	return requested, nil
+}
+
+// ReleaseQuery is called when a query of the querier ends or is deleted
+func ReleaseQuery(querierid string) error {
+	if querierid == "" {
+		return nil
+	}
+	return Counters.Decrement(runningKey(querierid))
+}
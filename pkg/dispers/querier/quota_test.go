@@ -0,0 +1,90 @@
+package querier
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemCounter(t *testing.T) {
+
+	counter := NewCounter(nil)
+
+	count, err := counter.Increment("foo", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	count, _ = counter.Increment("foo", time.Hour)
+	assert.Equal(t, int64(2), count)
+
+	assert.NoError(t, counter.Decrement("foo"))
+	count, _ = counter.Increment("foo", time.Hour)
+	assert.Equal(t, int64(2), count)
+
+	// An expired counter starts again from zero
+	count, _ = counter.Increment("bar", -time.Second)
+	assert.Equal(t, int64(1), count)
+	count, _ = counter.Increment("bar", time.Hour)
+	assert.Equal(t, int64(1), count)
+
+	assert.NoError(t, counter.Decrement("unknown"))
+
+	// The window of a counter is not extended by the increments
+	_, _ = counter.Increment("baz", time.Minute)
+	expiredAt := counter.(*memCounter).values["baz"].expiredAt
+	count, _ = counter.Increment("baz", time.Hour)
+	assert.Equal(t, int64(2), count)
+	assert.Equal(t, expiredAt, counter.(*memCounter).values["baz"].expiredAt)
+}
+
+func TestAcquireQuery(t *testing.T) {
+
+	Counters = NewCounter(nil)
+	q := &QuerierDoc{
+		QuerierID: "fakequerierid",
+		Quotas:    &Quotas{QueriesPerDay: 3, ConcurrentQueries: 2},
+	}
+
+	_, err := q.AcquireQuery()
+	assert.NoError(t, err)
+	_, err = q.AcquireQuery()
+	assert.NoError(t, err)
+
+	// Too many running queries
+	retryAfter, err := q.AcquireQuery()
+	assert.Error(t, err)
+	assert.Equal(t, retryRunningAfter, retryAfter)
+
+	// The rejected query is not counted in the daily quota
+	assert.NoError(t, ReleaseQuery(q.ID()))
+	_, err = q.AcquireQuery()
+	assert.NoError(t, err)
+
+	assert.NoError(t, ReleaseQuery(q.ID()))
+	retryAfter, err = q.AcquireQuery()
+	assert.Error(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 24*time.Hour)
+
+	// Admin queriers have no limit
+	q.IsAdmin = true
+	_, err = q.AcquireQuery()
+	assert.NoError(t, err)
+}
+
+func TestTargetsLimit(t *testing.T) {
+
+	q := &QuerierDoc{Quotas: &Quotas{MaxTargets: 100}}
+	limit, err := q.TargetsLimit(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, limit)
+	limit, err = q.TargetsLimit(50)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, limit)
+	_, err = q.TargetsLimit(101)
+	assert.Error(t, err)
+
+	q.IsAdmin = true
+	limit, err = q.TargetsLimit(101)
+	assert.NoError(t, err)
+	assert.Equal(t, 101, limit)
+}
@@ -2,6 +2,8 @@ package query
 
 import (
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
@@ -42,9 +44,16 @@ type AsyncTask struct {
 	IndexDA    int                    `json:"da_id"`
 	StateDA    State                  `json:"da_state,omitempty"`
 	ResultDA   map[string]interface{} `json:"da_result,omitempty"`
+	// The hosts computing each copy of the fold, the ones that have failed,
+	// and the deadline of the current attempt
+	Attempts    int       `json:"da_attempts,omitempty"`
+	HostsDA     []string  `json:"da_hosts,omitempty"`
+	FailedHosts []string  `json:"da_failed_hosts,omitempty"`
+	DeadlineDA  time.Time `json:"da_deadline,omitempty"`
 	// Attributes used for AsyncQueryTarget or AsyncSendData
 	NumberOfTargets int                      `json:"t_number_targets,omitempty"`
 	Data            []map[string]interface{} `json:"t_data,omitempty"`
+	Payload         []byte                   `json:"t_payload,omitempty"`
 }
 
 // ID returns the Doc ID
@@ -89,6 +98,30 @@ func (as *AsyncTask) SetFinished() error {
 	return couchdb.UpdateDoc(PrefixerC, as)
 }
 
+// SetFailed marks the task as failed: the copies of the fold have failed or
+// disagree, and cannot be retried anymore
+func (as *AsyncTask) SetFailed(err error) error {
+	as.StateDA = Failed
+	as.TaskMetadata.EndTask(err)
+	return couchdb.UpdateDoc(PrefixerC, as)
+}
+
+// SetDispatched saves the hosts computing the copies of the fold, and the
+// time after which a silent DA is considered as failed
+func (as *AsyncTask) SetDispatched(hosts []string, deadline time.Time) error {
+	as.HostsDA = hosts
+	as.DeadlineDA = deadline
+	return couchdb.UpdateDoc(PrefixerC, as)
+}
+
+// HostOf returns the host computing a copy of the fold, if known
+func (as *AsyncTask) HostOf(replica int) string {
+	if replica < 0 || replica >= len(as.HostsDA) {
+		return ""
+	}
+	return as.HostsDA[replica]
+}
+
 func (as *AsyncTask) SetData(data ...map[string]interface{}) error {
 
 	switch as.AsyncType {
@@ -192,6 +225,13 @@ func FetchAsyncStateLayer(queryid string, indexLayer int, sizeLayer int) (State,
 		return Waiting, nil
 	}
 
+	// A fold has failed, the layer cannot be finished
+	for _, task := range out {
+		if task.StateDA == Failed {
+			return Failed, nil
+		}
+	}
+
 	// There is still some DA that havenot been launched
 	if len(out) < sizeLayer {
 		return Running, nil
@@ -209,6 +249,31 @@ func FetchAsyncStateLayer(queryid string, indexLayer int, sizeLayer int) (State,
 	return Finished, nil
 }
 
+// FetchOverdueFolds returns the folds whose DAs have not answered before the
+// deadline
+func FetchOverdueFolds(now time.Time) ([]AsyncTask, error) {
+
+	var out []AsyncTask
+	if err := couchdb.EnsureDBExist(PrefixerC, "io.cozy.async"); err != nil {
+		return nil, err
+	}
+	req := &couchdb.FindRequest{
+		Selector: mango.Equal("da_state", Running),
+		Limit:    1000,
+	}
+	if err := couchdb.FindDocs(PrefixerC, "io.cozy.async", req, &out); err != nil {
+		return nil, err
+	}
+
+	overdue := []AsyncTask{}
+	for _, task := range out {
+		if task.AsyncType == AsyncAggregation && !task.DeadlineDA.IsZero() && now.After(task.DeadlineDA) {
+			overdue = append(overdue, task)
+		}
+	}
+	return overdue, nil
+}
+
 func FetchAsyncDataDA(queryid string, indexLayer int, indexDA int) (map[string]interface{}, error) {
 
 	var out []AsyncTask
@@ -230,45 +295,53 @@ func FetchAsyncDataDA(queryid string, indexLayer int, indexDA int) (map[string]i
 	return out[0].ResultDA, nil
 }
 
+// DeleteAsyncDataT deletes the rows saved by Target for a query, and the ends
+// of the tasks of its instances
 func DeleteAsyncDataT(queryid string) error {
 
-	var tasks []AsyncTask
-	if err := couchdb.EnsureDBExist(PrefixerT, "io.cozy.async"); err != nil {
+	rows, err := fetchAsyncT(rowsPrefix(queryid))
+	if err != nil {
 		return err
 	}
-
-	req := &couchdb.FindRequest{Selector: mango.Equal("query_id", queryid)}
-	if err := couchdb.FindDocs(PrefixerT, "io.cozy.async", req, &tasks); err != nil {
+	targets, err := fetchAsyncT(targetsPrefix(queryid))
+	if err != nil {
 		return err
 	}
-
-	for _, task := range tasks {
-		if err := couchdb.DeleteDoc(PrefixerT, &task); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return deleteAsyncT(append(rows, targets...))
 }
 
+// FetchAsyncDataT returns the rows saved by Target for a query, the number of
+// instances whose task has ended, and how many of them have failed
 func FetchAsyncDataT(queryid string) (map[string]interface{}, error) {
 
-	var tasks []AsyncTask
 	var out []map[string]interface{}
-	if err := couchdb.EnsureDBExist(PrefixerT, "io.cozy.async"); err != nil {
+	rows, err := fetchAsyncT(rowsPrefix(queryid))
+	if err != nil {
 		return nil, err
 	}
-
-	req := &couchdb.FindRequest{Selector: mango.Equal("query_id", queryid)}
-	if err := couchdb.FindDocs(PrefixerT, "io.cozy.async", req, &tasks); err != nil {
+	targets, err := fetchAsyncT(targetsPrefix(queryid))
+	if err != nil {
 		return nil, err
 	}
 
-	for _, task := range tasks {
-		out = append(out, task.Data...)
+	// Only the rows of the instances whose task has ended are kept: an
+	// instance may still be read when the deadline of the query has passed
+	ended := make(map[string]bool)
+	failed := 0
+	for _, target := range targets {
+		ended[strings.TrimPrefix(target.AsyncID, targetsPrefix(queryid))] = true
+		if target.TaskMetadata.ErrorMsg != "" {
+			failed = failed + 1
+		}
+	}
+	for _, page := range rows {
+		domain := strings.TrimPrefix(page.AsyncID, rowsPrefix(queryid))
+		if index := strings.LastIndex(domain, "/"); index >= 0 && ended[domain[:index]] {
+			out = append(out, page.Data...)
+		}
 	}
 
-	return map[string]interface{}{"Data": out, "NumberOfTargets": len(tasks)}, nil
+	return map[string]interface{}{"Data": out, "NumberOfTargets": len(targets), "FailedTargets": failed}, nil
 }
 
 func FetchAsyncMetadata(queryid string) ([]metadata.TaskMetadata, error) {
@@ -0,0 +1,182 @@
+package query
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+const (
+	// FinishTimeout is the time given to a worker to send the folds of a
+	// phase. Afterwards, the worker is deemed to have stopped and another one
+	// takes over.
+	FinishTimeout = 10 * time.Minute
+
+	// PhaseRetention is the time during which an ended phase is kept, so that
+	// the instances that answer late know that their rows are not needed
+	PhaseRetention = 24 * time.Hour
+)
+
+// TargetPhase is saved by Target while it waits for the instances of a query.
+// The query gives what is needed to send the folds, without any instance.
+// Once the deadline has passed, the instances that have not answered are
+// counted as timed out, and the query goes on with the rows already saved.
+//
+// Each step of the end of the phase is saved, so that a worker that stops
+// is taken over: the folds are only sent once, and a failure is reported to
+// the Conductor until it is received.
+type TargetPhase struct {
+	PhaseID     string     `json:"_id,omitempty"`
+	PhaseRev    string     `json:"_rev,omitempty"`
+	Query       StackQuery `json:"query"`
+	Deadline    time.Time  `json:"deadline,omitempty"`
+	Completed   bool       `json:"completed,omitempty"`
+	CompletedAt time.Time  `json:"completed_at,omitempty"`
+	Dispatching bool       `json:"dispatching,omitempty"`
+	Dispatched  bool       `json:"dispatched,omitempty"`
+	Failure     string     `json:"failure,omitempty"`
+	Ended       time.Time  `json:"ended,omitempty"`
+}
+
+// ID returns the Doc ID
+func (p *TargetPhase) ID() string {
+	return p.PhaseID
+}
+
+// Rev returns the doc's version
+func (p *TargetPhase) Rev() string {
+	return p.PhaseRev
+}
+
+// DocType returns the DocType
+func (p *TargetPhase) DocType() string {
+	return "io.cozy.target.phases"
+}
+
+// Clone copy a brand new version of the doc
+func (p *TargetPhase) Clone() couchdb.Doc {
+	cloned := *p
+	return &cloned
+}
+
+// SetID set the ID
+func (p *TargetPhase) SetID(id string) {
+	p.PhaseID = id
+}
+
+// SetRev set the version
+func (p *TargetPhase) SetRev(rev string) {
+	p.PhaseRev = rev
+}
+
+// IsOverdue returns true if the deadline of the phase has passed, or if the
+// worker sending its folds has not ended it within FinishTimeout
+func (p *TargetPhase) IsOverdue(now time.Time) bool {
+	if p.Completed {
+		return p.Ended.IsZero() && now.After(p.CompletedAt.Add(FinishTimeout))
+	}
+	return !p.Deadline.IsZero() && now.After(p.Deadline)
+}
+
+// IsExpired returns true if the phase has ended for more than PhaseRetention
+func (p *TargetPhase) IsExpired(now time.Time) bool {
+	return !p.Ended.IsZero() && now.After(p.Ended.Add(PhaseRetention))
+}
+
+// Complete marks the phase as completed. Only one worker succeeds, the other
+// ones get a conflict. A worker that takes over a phase completes it again.
+func (p *TargetPhase) Complete(now time.Time) error {
+	p.Completed = true
+	p.CompletedAt = now
+	return couchdb.UpdateDoc(PrefixerT, p)
+}
+
+// BeginDispatch is called before the folds are registered by the Conductor.
+// From then on, another worker cannot send other folds for the phase.
+func (p *TargetPhase) BeginDispatch() error {
+	p.Dispatching = true
+	return couchdb.UpdateDoc(PrefixerT, p)
+}
+
+// EndDispatch is called once every fold has been sent
+func (p *TargetPhase) EndDispatch() error {
+	p.Dispatched = true
+	return couchdb.UpdateDoc(PrefixerT, p)
+}
+
+// Fail records why the folds have not been sent, before the failure is
+// reported to the Conductor
+func (p *TargetPhase) Fail(cause error) error {
+	p.Failure = cause.Error()
+	return couchdb.UpdateDoc(PrefixerT, p)
+}
+
+// End marks the phase as ended, once the folds have been sent or the failure
+// has been reported, and the rows have been deleted
+func (p *TargetPhase) End(now time.Time) error {
+	p.Ended = now
+	return couchdb.UpdateDoc(PrefixerT, p)
+}
+
+// Delete deletes the phase, once it has expired
+func (p *TargetPhase) Delete() error {
+	return couchdb.DeleteDoc(PrefixerT, p)
+}
+
+// NewTargetPhase saves the phase of a query before its instances are queried
+func NewTargetPhase(q StackQuery, deadline time.Time) (*TargetPhase, error) {
+
+	phase := &TargetPhase{
+		PhaseID:  q.QueryID,
+		Query:    q,
+		Deadline: deadline,
+	}
+	if err := couchdb.CreateNamedDocWithDB(PrefixerT, phase); err != nil {
+		return nil, err
+	}
+	return phase, nil
+}
+
+// FetchTargetPhase returns the phase of a query. The phase does not exist
+// anymore once it has expired.
+func FetchTargetPhase(queryid string) (*TargetPhase, error) {
+
+	phase := &TargetPhase{}
+	if err := couchdb.GetDoc(PrefixerT, "io.cozy.target.phases", queryid, phase); err != nil {
+		return nil, err
+	}
+	return phase, nil
+}
+
+// FetchOverdueTargetPhases returns the phases that are overdue
+func FetchOverdueTargetPhases(now time.Time) ([]TargetPhase, error) {
+	return fetchTargetPhases(func(phase *TargetPhase) bool {
+		return phase.IsOverdue(now)
+	})
+}
+
+// FetchExpiredTargetPhases returns the phases that have expired
+func FetchExpiredTargetPhases(now time.Time) ([]TargetPhase, error) {
+	return fetchTargetPhases(func(phase *TargetPhase) bool {
+		return phase.IsExpired(now)
+	})
+}
+
+func fetchTargetPhases(keep func(phase *TargetPhase) bool) ([]TargetPhase, error) {
+
+	var phases []TargetPhase
+	if err := couchdb.GetAllDocs(PrefixerT, "io.cozy.target.phases", nil, &phases); err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	kept := []TargetPhase{}
+	for index := range phases {
+		if keep(&phases[index]) {
+			kept = append(kept, phases[index])
+		}
+	}
+	return kept, nil
+}
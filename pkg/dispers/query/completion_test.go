@@ -0,0 +1,62 @@
+package query
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPhase(t *testing.T) {
+
+	now := time.Now()
+	queryid := fmt.Sprintf("phase-%d", now.UnixNano())
+	phase, err := NewTargetPhase(StackQuery{QueryID: queryid}, now.Add(-time.Minute))
+	assert.NoError(t, err)
+	overdue, err := FetchOverdueTargetPhases(now)
+	assert.NoError(t, err)
+	assert.Contains(t, phaseIDs(overdue), queryid)
+
+	// Only one worker completes the phase
+	other := *phase
+	assert.NoError(t, phase.Complete(now))
+	assert.True(t, couchdb.IsConflictError(other.Complete(now)))
+	assert.False(t, phase.IsOverdue(now))
+
+	// A worker that has stopped while sending the folds is taken over
+	later := now.Add(FinishTimeout + time.Minute)
+	assert.True(t, phase.IsOverdue(later))
+	assert.NoError(t, phase.BeginDispatch())
+	taken, err := FetchTargetPhase(queryid)
+	assert.NoError(t, err)
+	assert.True(t, taken.Dispatching)
+	assert.NoError(t, taken.Complete(later))
+	assert.True(t, couchdb.IsConflictError(phase.EndDispatch()))
+
+	// The instances answering late leave their rows until the phase expires
+	assert.NoError(t, taken.End(later))
+	assert.False(t, taken.IsOverdue(later.Add(FinishTimeout+time.Minute)))
+	assert.NoError(t, SaveTargetRows(queryid, "bob.cozy.tools", 0, []map[string]interface{}{{"amount": 12}}))
+	assert.NoError(t, EndTarget(queryid, "bob.cozy.tools", 2, metadata.NewTaskMetadata()))
+
+	assert.False(t, taken.IsExpired(later))
+	expired, err := FetchExpiredTargetPhases(later.Add(PhaseRetention + time.Minute))
+	assert.NoError(t, err)
+	assert.Contains(t, phaseIDs(expired), queryid)
+	assert.NoError(t, DeleteAsyncDataT(queryid))
+	assert.NoError(t, taken.Delete())
+	ended, err := CountEndedTargets(queryid)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, ended)
+}
+
+func phaseIDs(phases []TargetPhase) []string {
+	ids := make([]string, len(phases))
+	for index, phase := range phases {
+		ids[index] = phase.PhaseID
+	}
+	return ids
+}
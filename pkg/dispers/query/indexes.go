@@ -0,0 +1,184 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// DoctypeIndexes is the doctype of the Mango indexes used by Target on the
+// stacks of the instances
+const DoctypeIndexes = "io.cozy.target.indexes"
+
+// StackIndex records the running queries that use a Mango index on the stack
+// of an instance. The identical indexes are shared by the queries (see
+// LocalQuery.IndexName): an index created by Target is only deleted once no
+// running query uses it. The token of the last query is kept to delete it.
+type StackIndex struct {
+	IndexID     string   `json:"_id,omitempty"`
+	IndexRev    string   `json:"_rev,omitempty"`
+	Domain      string   `json:"domain"`
+	Doctype     string   `json:"doctype"`
+	Name        string   `json:"name"`
+	Created     bool     `json:"created,omitempty"`
+	TokenBearer string   `json:"token_bearer,omitempty"`
+	Queries     []string `json:"queries"`
+}
+
+// ID returns the Doc ID
+func (si *StackIndex) ID() string {
+	return si.IndexID
+}
+
+// Rev returns the doc's version
+func (si *StackIndex) Rev() string {
+	return si.IndexRev
+}
+
+// DocType returns the DocType
+func (si *StackIndex) DocType() string {
+	return DoctypeIndexes
+}
+
+// Clone copy a brand new version of the doc
+func (si *StackIndex) Clone() couchdb.Doc {
+	cloned := *si
+	cloned.Queries = append([]string{}, si.Queries...)
+	return &cloned
+}
+
+// SetID set the ID
+func (si *StackIndex) SetID(id string) {
+	si.IndexID = id
+}
+
+// SetRev set the version
+func (si *StackIndex) SetRev(rev string) {
+	si.IndexRev = rev
+}
+
+// stackIndexID returns the ID of an index. The domains never contain a slash.
+func stackIndexID(domain, name string) string {
+	return domain + "/" + name
+}
+
+func fetchStackIndex(domain, name string) (*StackIndex, error) {
+	index := &StackIndex{}
+	err := couchdb.GetDoc(PrefixerT, DoctypeIndexes, stackIndexID(domain, name), index)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// AcquireIndex records that a query uses an index on the stack of an
+// instance. It has to be called before the index is created, so that the
+// index is not deleted meanwhile by another query.
+func AcquireIndex(queryid, domain, doctype, name, token string) error {
+
+	for {
+		index, err := fetchStackIndex(domain, name)
+		if err != nil {
+			return err
+		}
+		if index == nil {
+			index = &StackIndex{
+				IndexID: stackIndexID(domain, name),
+				Domain:  domain,
+				Doctype: doctype,
+				Name:    name,
+			}
+		}
+		index.TokenBearer = token
+		if !contains(index.Queries, queryid) {
+			index.Queries = append(index.Queries, queryid)
+		}
+
+		if index.Rev() == "" {
+			err = couchdb.CreateNamedDocWithDB(PrefixerT, index)
+		} else {
+			err = couchdb.UpdateDoc(PrefixerT, index)
+		}
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+}
+
+// MarkIndexCreated records that an index has been created by Target, and not
+// by the instance itself: it will be deleted once no query uses it.
+func MarkIndexCreated(domain, name string) error {
+
+	for {
+		index, err := fetchStackIndex(domain, name)
+		if err != nil || index == nil {
+			return err
+		}
+		if index.Created {
+			return nil
+		}
+		index.Created = true
+		if err := couchdb.UpdateDoc(PrefixerT, index); !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+}
+
+// ReleaseIndex records that a query does not use an index anymore. Once no
+// query uses it, the record is deleted: the index is returned if it has been
+// created by Target, and it is up to the caller to delete it from the stack.
+// A query acquiring the index meanwhile makes the deletion of the record
+// fail with a conflict, and the index is kept.
+func ReleaseIndex(queryid, domain, name string) (*StackIndex, error) {
+
+	for {
+		index, err := fetchStackIndex(domain, name)
+		if err != nil || index == nil {
+			return nil, err
+		}
+		queries := []string{}
+		for _, id := range index.Queries {
+			if id != queryid {
+				queries = append(queries, id)
+			}
+		}
+		if len(queries) == len(index.Queries) {
+			return nil, nil
+		}
+
+		if len(queries) > 0 {
+			index.Queries = queries
+			err = couchdb.UpdateDoc(PrefixerT, index)
+		} else {
+			err = couchdb.DeleteDoc(PrefixerT, index)
+		}
+		if couchdb.IsConflictError(err) {
+			continue
+		}
+		if err != nil || len(queries) > 0 || !index.Created {
+			return nil, err
+		}
+		return index, nil
+	}
+}
+
+// TargetIndexes returns the index used on the stack of each instance whose
+// task has ended for a query, indexed by domain
+func TargetIndexes(queryid string) (map[string]string, error) {
+
+	targets, err := fetchAsyncT(targetsPrefix(queryid))
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(map[string]string)
+	for _, target := range targets {
+		if target.TaskMetadata.Index != "" {
+			domain := strings.TrimPrefix(target.AsyncID, targetsPrefix(queryid))
+			indexes[domain] = target.TaskMetadata.Index
+		}
+	}
+	return indexes, nil
+}
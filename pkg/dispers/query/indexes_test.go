@@ -0,0 +1,38 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStackIndex(t *testing.T) {
+
+	domain, name := "alice.cozy.tools", "dispers-0123456789abcdef"
+
+	// Two queries share the index created for the first one
+	assert.NoError(t, AcquireIndex("query1", domain, "io.cozy.bank.operations", name, "token1"))
+	assert.NoError(t, MarkIndexCreated(domain, name))
+	assert.NoError(t, AcquireIndex("query2", domain, "io.cozy.bank.operations", name, "token2"))
+
+	// The index is kept while the second query runs
+	index, err := ReleaseIndex("query1", domain, name)
+	assert.NoError(t, err)
+	assert.Nil(t, index)
+	index, err = ReleaseIndex("query1", domain, name)
+	assert.NoError(t, err)
+	assert.Nil(t, index)
+
+	index, err = ReleaseIndex("query2", domain, name)
+	assert.NoError(t, err)
+	if assert.NotNil(t, index) {
+		assert.Equal(t, "token2", index.TokenBearer)
+		assert.Equal(t, "io.cozy.bank.operations", index.Doctype)
+	}
+
+	// An index that already existed on the stack is never deleted
+	assert.NoError(t, AcquireIndex("query3", domain, "io.cozy.bank.operations", name, "token3"))
+	index, err = ReleaseIndex("query3", domain, name)
+	assert.NoError(t, err)
+	assert.Nil(t, index)
+}
@@ -0,0 +1,179 @@
+package query
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+)
+
+// DoctypePolicy lists the fields a local query can select, project or sort
+// on, and the Mango operators it can use, for a doctype
+type DoctypePolicy struct {
+	Fields    []string `json:"fields"`
+	Operators []string `json:"operators"`
+}
+
+// LocalQueryPolicy declares the doctypes the local queries can target. A nil
+// policy accepts every local query.
+type LocalQueryPolicy map[string]DoctypePolicy
+
+// Policy is the policy applied to the local queries, loaded from the file
+// given in the configuration
+var Policy LocalQueryPolicy
+
+// identifiers are the fields never sent back by the stacks
+var identifiers = []string{"_id", "_rev"}
+
+// LoadLocalQueryPolicy reads a policy from a JSON file
+func LoadLocalQueryPolicy(path string) (LocalQueryPolicy, error) {
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy LocalQueryPolicy
+	if err := json.Unmarshal(buf, &policy); err != nil {
+		return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
+	}
+	return policy, nil
+}
+
+func contains(list []string, item string) bool {
+	for _, elem := range list {
+		if elem == item {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSelector checks every field and every operator of a Mango selector.
+// The fields of nested objects are joined with dots.
+func (d DoctypePolicy) checkSelector(selector interface{}, prefix string) error {
+
+	switch selector := selector.(type) {
+	case map[string]interface{}:
+		for key, value := range selector {
+			field := prefix
+			if strings.HasPrefix(key, "$") {
+				if !contains(d.Operators, key) {
+					return errors.WrapErrors(errors.ErrForbiddenOperator, key)
+				}
+			} else {
+				if prefix != "" {
+					field = prefix + "." + key
+				} else {
+					field = key
+				}
+				if !contains(d.Fields, field) && !d.hasSubfields(field) {
+					return errors.WrapErrors(errors.ErrForbiddenField, field)
+				}
+			}
+			if err := d.checkSelector(value, field); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, elem := range selector {
+			if err := d.checkSelector(elem, prefix); err != nil {
+				return err
+			}
+		}
+	default:
+		// A value compared to a field
+		if prefix != "" && !contains(d.Fields, prefix) {
+			return errors.WrapErrors(errors.ErrForbiddenField, prefix)
+		}
+	}
+	return nil
+}
+
+// hasSubfields returns true if some fields allowed by the policy are nested
+// in field
+func (d DoctypePolicy) hasSubfields(field string) bool {
+	for _, allowed := range d.Fields {
+		if strings.HasPrefix(allowed, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Enforce checks that a local query targets a doctype of the policy, and only
+// uses its fields and operators. When the querier does not give the fields to
+// retrieve, the projection is set to every field of the policy. Without
+// policy, the querier has to give the fields to retrieve (see Project).
+func (p LocalQueryPolicy) Enforce(lq *LocalQuery) error {
+
+	if p == nil {
+		if len(lq.projection()) == 0 {
+			return errors.WrapErrors(errors.ErrMissingProjection, "fields")
+		}
+		return nil
+	}
+
+	d, ok := p[lq.Doctype]
+	if !ok {
+		return errors.WrapErrors(errors.ErrForbiddenDoctype, lq.Doctype)
+	}
+
+	if err := d.checkSelector(lq.FindRequest.Selector, ""); err != nil {
+		return err
+	}
+	for _, order := range lq.FindRequest.Sort {
+		for field := range order {
+			if !contains(d.Fields, field) {
+				return errors.WrapErrors(errors.ErrForbiddenField, field)
+			}
+		}
+	}
+	for _, field := range lq.FindRequest.Fields {
+		if !contains(d.Fields, field) {
+			return errors.WrapErrors(errors.ErrForbiddenField, field)
+		}
+	}
+
+	if len(lq.FindRequest.Fields) == 0 {
+		lq.FindRequest.Fields = append([]string{}, d.Fields...)
+		sort.Strings(lq.FindRequest.Fields)
+	}
+	if len(lq.projection()) == 0 {
+		return errors.WrapErrors(errors.ErrMissingProjection, "fields")
+	}
+	return nil
+}
+
+// projection returns the fields of the query, without the identifiers of the
+// documents
+func (lq *LocalQuery) projection() []string {
+	fields := []string{}
+	for _, field := range lq.FindRequest.Fields {
+		if !contains(identifiers, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Project sets the projection sent to the stacks: the fields of the query,
+// without the identifiers of the documents. A local query without fields is
+// refused, the stacks would send whole documents.
+func (lq *LocalQuery) Project() error {
+
+	fields := lq.projection()
+	if len(fields) == 0 {
+		return errors.WrapErrors(errors.ErrMissingProjection, "")
+	}
+	lq.FindRequest.Fields = fields
+	return nil
+}
+
+// StripIdentifiers removes the identifiers of a document sent by a stack
+func StripIdentifiers(doc map[string]interface{}) {
+	for _, field := range identifiers {
+		delete(doc, field)
+	}
+}
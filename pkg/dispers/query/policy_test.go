@@ -0,0 +1,74 @@
+package query
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalQueryPolicy(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dispers-policy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"io.cozy.bank.operations": {
+			"fields": ["amount", "date", "metadata.version"],
+			"operators": ["$and", "$gt", "$lt", "$in"]
+		}
+	}`), 0600))
+	policy, err := LoadLocalQueryPolicy(path)
+	assert.NoError(t, err)
+
+	parse := func(findRequest string) *LocalQuery {
+		lq := &LocalQuery{Doctype: "io.cozy.bank.operations"}
+		assert.NoError(t, json.Unmarshal([]byte(findRequest), &lq.FindRequest))
+		return lq
+	}
+
+	// The projection is set to the fields of the policy
+	lq := parse(`{"selector": {"$and": [{"amount": {"$lt": 0}}, {"metadata": {"version": {"$gt": 1}}}]}}`)
+	assert.NoError(t, policy.Enforce(lq))
+	assert.Equal(t, []string{"amount", "date", "metadata.version"}, lq.FindRequest.Fields)
+
+	lq = parse(`{"selector": {"amount": {"$in": [1, 2]}}, "fields": ["amount"], "sort": [{"date": "asc"}]}`)
+	assert.NoError(t, policy.Enforce(lq))
+	assert.Equal(t, []string{"amount"}, lq.FindRequest.Fields)
+
+	for _, findRequest := range []string{
+		`{"selector": {"label": "shop"}}`,
+		`{"selector": {"amount": {"$regex": "^1"}}}`,
+		`{"selector": {"metadata": 2}}`,
+		`{"selector": {"_id": {"$gt": null}}}`,
+		`{"selector": {"amount": {"$gt": 0}}, "fields": ["account"]}`,
+		`{"selector": {"amount": {"$gt": 0}}, "sort": [{"label": "asc"}]}`,
+	} {
+		assert.Error(t, policy.Enforce(parse(findRequest)), findRequest)
+	}
+
+	lq = parse(`{"selector": {"amount": {"$gt": 0}}}`)
+	lq.Doctype = "io.cozy.contacts"
+	assert.Error(t, policy.Enforce(lq))
+
+	// Without policy, every query giving the fields to retrieve is accepted:
+	// the stacks are never asked for whole documents
+	var none LocalQueryPolicy
+	lq = parse(`{"selector": {"label": "shop"}}`)
+	assert.Error(t, none.Enforce(lq))
+	assert.Error(t, lq.Project())
+	lq.FindRequest.Fields = []string{"_id", "_rev"}
+	assert.Error(t, none.Enforce(lq))
+	lq.FindRequest.Fields = []string{"_id", "label", "_rev"}
+	assert.NoError(t, none.Enforce(lq))
+	assert.NoError(t, lq.Project())
+	assert.Equal(t, []string{"label"}, lq.FindRequest.Fields)
+
+	doc := map[string]interface{}{"_id": "123", "_rev": "1-abc", "label": "shop"}
+	StripIdentifiers(doc)
+	assert.Equal(t, map[string]interface{}{"label": "shop"}, doc)
+}
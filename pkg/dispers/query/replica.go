@@ -0,0 +1,97 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
+)
+
+// DoctypeReplicas is the doctype of the results given by each copy of a fold,
+// when a layer of DAs is redundant
+const DoctypeReplicas = "io.cozy.async.replicas"
+
+// ReplicaTask saves the results of one of the DAs computing the same fold.
+// The Conductor compares them before accepting the results of the fold.
+type ReplicaTask struct {
+	ReplicaID    string                 `json:"_id,omitempty"`
+	ReplicaRev   string                 `json:"_rev,omitempty"`
+	QueryID      string                 `json:"query_id"`
+	IndexLayer   int                    `json:"da_layer_id"`
+	IndexDA      int                    `json:"da_id"`
+	Replica      int                    `json:"da_replica"`
+	Host         string                 `json:"da_host,omitempty"`
+	Results      map[string]interface{} `json:"da_result,omitempty"`
+	TaskMetadata metadata.TaskMetadata  `json:"task_metadata"`
+}
+
+// ID returns the Doc ID
+func (r *ReplicaTask) ID() string {
+	return r.ReplicaID
+}
+
+// Rev returns the doc's version
+func (r *ReplicaTask) Rev() string {
+	return r.ReplicaRev
+}
+
+// DocType returns the DocType
+func (r *ReplicaTask) DocType() string {
+	return DoctypeReplicas
+}
+
+// Clone copy a brand new version of the doc
+func (r *ReplicaTask) Clone() couchdb.Doc {
+	cloned := *r
+	return &cloned
+}
+
+// SetID set the ID
+func (r *ReplicaTask) SetID(id string) {
+	r.ReplicaID = id
+}
+
+// SetRev set the version
+func (r *ReplicaTask) SetRev(rev string) {
+	r.ReplicaRev = rev
+}
+
+func replicasPrefix(queryid string, indexLayer int, indexDA int) string {
+	return fmt.Sprintf("%s-%d-%d-", queryid, indexLayer, indexDA)
+}
+
+// ReplicaTaskID returns the ID of the results of a copy of a fold. Saving
+// twice the same results fails with a conflict.
+func ReplicaTaskID(queryid string, indexLayer int, indexDA int, replica int) string {
+	return fmt.Sprintf("%s%02d", replicasPrefix(queryid, indexLayer, indexDA), replica)
+}
+
+// SaveReplicaResults saves the results given by a copy of a fold. The copy
+// is identified by out.Replica and out.Host, which are not the ones reported
+// by the DA but the ones of the fold sent to the peer giving the results.
+func SaveReplicaResults(out OutputDA) error {
+	doc := &ReplicaTask{
+		ReplicaID:    ReplicaTaskID(out.QueryID, out.AggregationID[0], out.AggregationID[1], out.Replica),
+		QueryID:      out.QueryID,
+		IndexLayer:   out.AggregationID[0],
+		IndexDA:      out.AggregationID[1],
+		Replica:      out.Replica,
+		Host:         out.Host,
+		Results:      out.Results,
+		TaskMetadata: out.TaskMetadata,
+	}
+	return couchdb.CreateNamedDocWithDB(PrefixerC, doc)
+}
+
+// FetchReplicas returns the results given so far by the copies of a fold,
+// ordered by replica
+func FetchReplicas(queryid string, indexLayer int, indexDA int) ([]ReplicaTask, error) {
+	var replicas []ReplicaTask
+	prefix := replicasPrefix(queryid, indexLayer, indexDA)
+	req := &couchdb.AllDocsRequest{StartKey: prefix, EndKey: prefix + "\uFFF0"}
+	err := couchdb.GetAllDocs(PrefixerC, DoctypeReplicas, req, &replicas)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return replicas, nil
+}
@@ -1,10 +1,16 @@
 package query
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
 	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
 )
 
@@ -15,22 +21,61 @@ Conductor's Input & Output
 */
 
 type InputNewQuery struct {
-	Concepts               []string          `json:"concepts,omitempty"`
-	PseudoConcepts         map[string]string `json:"pseudo_concepts,omitempty"`
-	IsEncrypted            bool              `json:"is_encrypted"`
-	LocalQuery             LocalQuery        `json:"local_query,omitempty"`
-	TargetProfile          string            `json:"target_profile,omitempty"`
-	LayersDA               []LayerDA         `json:"layers_da,omitempty"`
-	EncryptedLocalQuery    []byte            `json:"enc_local_query,omitempty"`
-	EncryptedConcepts      []Concept         `json:"enc_concepts,omitempty"`
-	EncryptedTargetProfile []byte            `json:"enc_operation,omitempty"`
+	Concepts               []string                      `json:"concepts,omitempty"`
+	PseudoConcepts         map[string]string             `json:"pseudo_concepts,omitempty"`
+	IsEncrypted            bool                          `json:"is_encrypted"`
+	LocalQuery             LocalQuery                    `json:"local_query,omitempty"`
+	TargetProfile          string                        `json:"target_profile,omitempty"`
+	LayersDA               []LayerDA                     `json:"layers_da,omitempty"`
+	EncryptedLocalQuery    []byte                        `json:"enc_local_query,omitempty"`
+	EncryptedConcepts      []Concept                     `json:"enc_concepts,omitempty"`
+	EncryptedTargetProfile []byte                        `json:"enc_operation,omitempty"`
+	Clipping               map[string]aggregations.Bound `json:"clipping,omitempty"`
+	Completion             Completion                    `json:"completion,omitempty"`
+	MaxTargets             int                           `json:"max_targets,omitempty"`
 }
 
+// Completion tells when the Targets stop waiting for the instances. After the
+// Timeout, given as a duration like "10m", the query goes on with the data of
+// the instances that have answered, if they are at least MinFraction of the
+// targets. Without timeout, every instance is awaited.
+type Completion struct {
+	MinFraction float64 `json:"min_fraction,omitempty"`
+	Timeout     string  `json:"timeout,omitempty"`
+}
+
+// TargetCounts are the numbers of instances that have answered, failed or not
+// answered before the deadline. The instances themselves are never named.
+type TargetCounts struct {
+	Responding int `json:"responding"`
+	Failed     int `json:"failed"`
+	TimedOut   int `json:"timed_out"`
+}
+
+// LayerDA describes a layer of Data Aggregators. The data of the first layer
+// never go through the Conductor: the Targets send them to the Data
+// Aggregators.
+//
+// With SecretSharing, the Targets split the values of the first layer into
+// additive shares, one for each DA of the layer. The layer can only have
+// sum-based jobs, and the next layer has a single DA that reconstructs the
+// aggregate.
+//
+// With a Redundancy of 2 or more, each fold is sent to as many distinct DA
+// hosts, and the Conductor checks that their results agree within the
+// relative Tolerance.
+//
+// With PreAggregate, each Target applies the jobs of the first layer to the
+// rows of every instance. A single partial state leaves the Target for each
+// instance, and the DAs of the first layer merge those states.
 type LayerDA struct {
-	Data          []map[string]interface{} `json:"layer_data,omitempty"`
-	Size          int                      `json:"layer_size"`
-	EncryptedJobs []byte                   `json:"layer_enc_jobs"`
-	Jobs          []AggregationJob         `json:"layer_jobs"`
+	Size          int              `json:"layer_size"`
+	EncryptedJobs []byte           `json:"layer_enc_jobs"`
+	Jobs          []AggregationJob `json:"layer_jobs"`
+	SecretSharing bool             `json:"layer_secret_sharing,omitempty"`
+	Redundancy    int              `json:"layer_redundancy,omitempty"`
+	Tolerance     float64          `json:"layer_tolerance,omitempty"`
+	PreAggregate  bool             `json:"layer_pre_aggregate,omitempty"`
 }
 
 type InputPatchQuery struct {
@@ -49,12 +94,60 @@ Concept Indexors' Input & Output
 type Concept struct {
 	EncryptedConcept []byte `json:"enc_concept,omitempty"`
 	Hash             []byte `json:"hash,omitempty"`
+	// PreviousHash is the hash of the concept before the rotation of the
+	// Concept Indexor's key. It is only set while the keys are rotated.
+	PreviousHash []byte `json:"previous_hash,omitempty"`
+	// Parent is the concept asked to the Concept Indexor when this concept has
+	// been given as one of its descendants
+	Parent []byte `json:"parent,omitempty"`
+	// Implicit is true for the ancestors and descendants of the concepts asked
+	// to the Concept Indexor
+	Implicit bool `json:"implicit,omitempty"`
+}
+
+// ConceptSeparator separates a concept from its parent in hierarchical
+// concepts' names, like "travail>lille"
+const ConceptSeparator = ">"
+
+// ConceptAncestors returns the ancestors of a concept, from the root of the
+// hierarchy: "a>b>c" has got "a" and "a>b" for ancestors
+func ConceptAncestors(concept string) []string {
+	parts := strings.Split(concept, ConceptSeparator)
+	ancestors := []string{}
+	for index := 1; index < len(parts); index++ {
+		ancestors = append(ancestors, strings.Join(parts[:index], ConceptSeparator))
+	}
+	return ancestors
+}
+
+// IsDescendant returns true if concept is below parent in the hierarchy
+func IsDescendant(concept, parent string) bool {
+	return strings.HasPrefix(concept, parent+ConceptSeparator)
+}
+
+// ConceptMetadata describes a concept in the catalogue
+type ConceptMetadata struct {
+	Description string   `json:"description,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// ConceptInfo is what the Concept Indexor tells about a concept. The salt is
+// never given.
+type ConceptInfo struct {
+	Name string `json:"name"`
+	ConceptMetadata
+	CreatedAt    time.Time `json:"created_at"`
+	Hash         []byte    `json:"hash,omitempty"`
+	PreviousHash []byte    `json:"previous_hash,omitempty"`
 }
 
 type InputCI struct {
 	IsEncrypted       bool      `json:"is_encrypted,omitempty"`
 	Concepts          []string  `json:"concepts,omitempty"`
 	EncryptedConcepts []Concept `json:"enc_concepts,omitempty"`
+	// Metadata of the non-encrypted concepts, indexed by concept
+	Metadata map[string]ConceptMetadata `json:"metadata,omitempty"`
 }
 
 // OutputCI contains a bool and the result
@@ -128,7 +221,8 @@ const (
 // recursive way. OperationTree contains SingleNode, OrNode, AndNode
 // SingleNodes have got a value field. A value is the name of a list of strings
 // To compute the OperationTree, Compute method needs a map that matches names
-// with list of encrypted addresses.
+// with list of encrypted addresses. A SingleNode naming a parent concept is
+// the union of its list and of the lists of its descendants.
 type OperationTree struct {
 	Type      NodeType    `json:"type"`
 	Value     string      `json:"value,omitempty"`
@@ -142,6 +236,24 @@ func (o *OperationTree) Compute(listsOfAddresses map[string][]string) ([]string,
 	if o.Type == SingleNode {
 		// Retrieve list of addresses from listsOfAddresses
 		val, ok := listsOfAddresses[o.Value]
+
+		// Expand the concept with its descendants
+		descendants := []string{}
+		for name := range listsOfAddresses {
+			if IsDescendant(name, o.Value) {
+				descendants = append(descendants, name)
+			}
+		}
+		sort.Strings(descendants)
+		if len(descendants) > 0 {
+			// union appends to its first list, which belongs to the map
+			val = append([]string{}, val...)
+		}
+		for _, name := range descendants {
+			val = union(val, listsOfAddresses[name])
+			ok = true
+		}
+
 		if !ok {
 			msg := "Unknown concept : " + o.Value + " expect one of : "
 			for k := range listsOfAddresses {
@@ -227,13 +339,17 @@ func (o *OperationTree) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// InputTF contains a map that associate every concept to a list of Addresses
-// and a operation to compute to retrive the final list
+// InputTF contains a map that associate every concept to the buckets of its
+// list of Addresses and a operation to compute to retrive the final list. The
+// buckets are the last field, so that the Target Finder knows the rest of the
+// request when it reads them one by one.
 type InputTF struct {
-	IsEncrypted               bool                  `json:"is_encrypted"`
-	EncryptedListsOfAddresses map[string][]byte     `json:"enc_instances,omitempty"`
-	EncryptedTargetProfile    []byte                `json:"enc_operation,omitempty"`
-	TaskMetadata              metadata.TaskMetadata `json:"metadata_task,omitempty"`
+	IsEncrypted            bool                  `json:"is_encrypted"`
+	EncryptedTargetProfile []byte                `json:"enc_operation,omitempty"`
+	MaxTargets             int                   `json:"max_targets,omitempty"`
+	TaskMetadata           metadata.TaskMetadata `json:"metadata_task,omitempty"`
+	EncryptedBuckets       map[string][][]byte   `json:"enc_buckets,omitempty"`
+	EncryptedStale         [][]byte              `json:"enc_stale,omitempty"`
 }
 
 // OutputTF is what Target Finder send to the conductor
@@ -255,15 +371,37 @@ type InputT struct {
 	EncryptedTargets    []byte                `json:"enc_addresses,omitempty"`
 	ConductorURL        url.URL               `json:"conductor_url"`
 	QueryID             string                `json:"queryid,omitempty"`
+	Layout              FoldLayout            `json:"layout"`
+	Deadline            time.Time             `json:"deadline,omitempty"`
 	TaskMetadata        metadata.TaskMetadata `json:"metadata_task,omitempty"`
 }
 
+// FoldLayout is dictated by the Conductor to the Target. The Target shuffles
+// the rows of data and splits them into Size folds, one for each Data
+// Aggregator of the first layer, which receives the jobs of this layer. With
+// SecretSharing, every Data Aggregator receives one share of every row. The
+// values of the rows are clipped within the Clipping bounds beforehand.
+type FoldLayout struct {
+	Size          int                           `json:"size"`
+	EncryptedJobs []byte                        `json:"enc_jobs,omitempty"`
+	SecretSharing bool                          `json:"secret_sharing,omitempty"`
+	Redundancy    int                           `json:"redundancy,omitempty"`
+	Clipping      map[string]aggregations.Bound `json:"clipping,omitempty"`
+	PreAggregate  bool                          `json:"pre_aggregate,omitempty"`
+}
+
 // Instance describes the location of an instance and the token it had created
 // When Target received twice the same Instance, it needs to be able to consider the more recent item
 type Instance struct {
-	Domain      string `json:"domain"`
-	TokenBearer string `json:"token_bearer"`
-	Version     int    `json:"version"`
+	Domain         string    `json:"domain"`
+	TokenBearer    string    `json:"token_bearer"`
+	TokenExpiresAt time.Time `json:"token_expires_at,omitempty"`
+	Version        int       `json:"version"`
+}
+
+// IsExpired returns true if the instance's token has expired
+func (i *Instance) IsExpired() bool {
+	return !i.TokenExpiresAt.IsZero() && time.Now().After(i.TokenExpiresAt)
 }
 
 // StackQuery is all the information needed by the conductor's and stack to make a query
@@ -271,17 +409,46 @@ type StackQuery struct {
 	Domain          string     `json:"domain"`
 	LocalQuery      LocalQuery `json:"local_query"`
 	TokenBearer     string     `json:"token_bearer"`
+	TokenVersion    int        `json:"token_version"`
+	TokenExpiresAt  time.Time  `json:"token_expires_at,omitempty"`
 	IsEncrypted     bool       `json:"is_encrypted"`
 	ConductorURL    url.URL    `json:"conductor_url"`
 	QueryID         string     `json:"queryid"`
 	NumberOfTargets int        `json:"number_targets"`
+	Layout          FoldLayout `json:"layout"`
 }
 
-// OutputT is what Target returns to the conductor
+// OutputT is what Target returns to the conductor. The data are sent to the
+// Data Aggregators, the conductor only knows how many rows are in each fold,
+// how many rows have been clipped or rejected, and how many instances have
+// answered. Hosts gives the hosts chosen for the copies of each fold: only
+// their results are accepted by the conductor. Error is given instead when
+// the Target has not been able to send the folds.
 type OutputT struct {
-	Data         []map[string]interface{} `json:"data,omitempty"`
-	QueryID      string                   `json:"queryid,omitempty"`
-	TaskMetadata metadata.TaskMetadata    `json:"metadata_task,omitempty"`
+	NumberOfRows int                   `json:"number_rows"`
+	ClippedRows  int                   `json:"clipped_rows,omitempty"`
+	RejectedRows int                   `json:"rejected_rows,omitempty"`
+	Targets      TargetCounts          `json:"targets"`
+	Folds        []int                 `json:"folds,omitempty"`
+	Hosts        [][]string            `json:"hosts,omitempty"`
+	QueryID      string                `json:"queryid,omitempty"`
+	Error        string                `json:"error,omitempty"`
+	TaskMetadata metadata.TaskMetadata `json:"metadata_task,omitempty"`
+}
+
+// InputStale is sent by a Target to the Conductor when the token of an
+// instance has been refused by its stack
+type InputStale struct {
+	EncryptedInstance []byte `json:"enc_instance"`
+}
+
+// InputResendFold is sent by the Conductor to the Target of a query when a
+// copy of a fold of the first layer has failed: the Target sends it to the
+// given host
+type InputResendFold struct {
+	IndexDA int    `json:"da_id"`
+	Replica int    `json:"replica"`
+	Host    string `json:"host"`
 }
 
 // LocalQuery decribes which data the stack has to retrieve
@@ -292,13 +459,28 @@ type LocalQuery struct {
 	Limit       int                    `json:"limit,omitempty"`
 }
 
+// IndexName returns the name of the Mango index of a local query. It is
+// derived from a hash of the definition of the index: identical indexes are
+// shared by the queries, and different ones never use the same design doc.
+func (lq *LocalQuery) IndexName() (string, error) {
+	definition, err := json.Marshal(lq.Index)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(definition)
+	return "dispers-" + hex.EncodeToString(sum[:8]), nil
+}
+
 // FindParams describes to query to make to stacks
 // It follows CouchDB conventions
 type FindParams struct {
 	Selector map[string]interface{} `json:"selector"`
+	Fields   []string               `json:"fields,omitempty"`
 	Skip     int                    `json:"skip,omitempty"`
 	Limit    int                    `json:"limit,omitempty"`
 	Sort     []map[string]string    `json:"sort,omitempty"`
+	Bookmark string                 `json:"bookmark,omitempty"`
+	UseIndex string                 `json:"use_index,omitempty"`
 }
 
 /*
@@ -333,11 +515,28 @@ type InputDA struct {
 	EncryptedJobs []byte                `json:"enc_jobs,omitempty"`
 	EncryptedData []byte                `json:"enc_data,omitempty"`
 	TaskMetadata  metadata.TaskMetadata `json:"metadata_task,omitempty"`
+	// SecretSharing is set when the data are shares of the rows
+	SecretSharing bool `json:"secret_sharing,omitempty"`
+	// Reconstruct is set when the data are the shares of the aggregate
+	// computed by the previous layer
+	Reconstruct bool `json:"reconstruct,omitempty"`
+	// PreAggregated is set when the data are the partial states computed by
+	// the Targets for each instance
+	PreAggregated bool `json:"pre_aggregated,omitempty"`
+	// Replica and Host tell which copy of the fold this DA computes, when
+	// the layer is redundant
+	Replica int    `json:"replica,omitempty"`
+	Host    string `json:"host,omitempty"`
 }
 
+// OutputDA is what a DA returns to the conductor: the results of its fold, or
+// the error that stopped it
 type OutputDA struct {
 	Results       map[string]interface{} `json:"results,omitempty"`
 	QueryID       string                 `json:"queryid,omitempty"`
 	AggregationID [2]int                 `json:"aggregationid,omitempty"`
+	Replica       int                    `json:"replica,omitempty"`
+	Host          string                 `json:"host,omitempty"`
+	Error         string                 `json:"error,omitempty"`
 	TaskMetadata  metadata.TaskMetadata  `json:"metadata_task,omitempty"`
 }
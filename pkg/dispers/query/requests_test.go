@@ -131,3 +131,62 @@ func TestUnknownConcept(t *testing.T) {
 	assert.Error(t, err)
 
 }
+
+func TestConceptAncestors(t *testing.T) {
+
+	assert.Equal(t, []string{}, ConceptAncestors("travail"))
+	assert.Equal(t, []string{"travail", "travail>lille"}, ConceptAncestors("travail>lille>centre"))
+
+	assert.True(t, IsDescendant("travail>lille", "travail"))
+	assert.False(t, IsDescendant("travailleur", "travail"))
+	assert.False(t, IsDescendant("travail", "travail"))
+}
+
+func TestParentConcept(t *testing.T) {
+
+	m := make(map[string][]string)
+	m["travail"] = []string{"joel"}
+	m["travail>lille"] = []string{"claire", "joel"}
+	m["travail>paris"] = []string{"paul"}
+	m["travailleur"] = []string{"benjamin"}
+
+	op := OperationTree{Type: SingleNode, Value: "travail"}
+	res, err := op.Compute(m)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"joel", "claire", "paul"}, res)
+	assert.Equal(t, []string{"joel"}, m["travail"])
+
+	// The parent concept does not have to exist
+	delete(m, "travail")
+	res, err = op.Compute(m)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"claire", "joel", "paul"}, res)
+
+	op = OperationTree{Type: SingleNode, Value: "travail>lille"}
+	res, err = op.Compute(m)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"claire", "joel"}, res)
+}
+
+func TestIndexName(t *testing.T) {
+
+	lq := &LocalQuery{Doctype: "io.cozy.bank.operations"}
+	assert.NoError(t, json.Unmarshal([]byte(`{"fields": ["amount", "date"], "partial_filter_selector": {"amount": {"$lt": 0}}}`), &lq.Index))
+	name, err := lq.IndexName()
+	assert.NoError(t, err)
+	assert.Regexp(t, "^dispers-[0-9a-f]{16}$", name)
+
+	// The order of the keys does not change the index
+	same := &LocalQuery{Doctype: "io.cozy.bank.operations"}
+	assert.NoError(t, json.Unmarshal([]byte(`{"partial_filter_selector": {"amount": {"$lt": 0}}, "fields": ["amount", "date"]}`), &same.Index))
+	sameName, err := same.IndexName()
+	assert.NoError(t, err)
+	assert.Equal(t, name, sameName)
+
+	// But the order of the fields does
+	other := &LocalQuery{Doctype: "io.cozy.bank.operations"}
+	assert.NoError(t, json.Unmarshal([]byte(`{"fields": ["date", "amount"], "partial_filter_selector": {"amount": {"$lt": 0}}}`), &other.Index))
+	otherName, err := other.IndexName()
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, otherName)
+}
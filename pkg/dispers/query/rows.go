@@ -0,0 +1,164 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
+)
+
+// The rows fetched by Target are saved page by page, as soon as a stack sends
+// them. The IDs of the docs are made of the query, the instance and the page,
+// so that a retried job rewrites the same docs instead of adding rows.
+// The domains never contain a slash.
+
+func rowsPrefix(queryid string) string {
+	return queryid + "/rows/"
+}
+
+func instanceRowsPrefix(queryid, domain string) string {
+	return rowsPrefix(queryid) + domain + "/"
+}
+
+func foldsPrefix(queryid string) string {
+	return queryid + "/folds/"
+}
+
+func foldID(queryid string, indexDA int) string {
+	return fmt.Sprintf("%s%05d", foldsPrefix(queryid), indexDA)
+}
+
+func targetsPrefix(queryid string) string {
+	return queryid + "/target/"
+}
+
+// fetchAsyncT returns the docs of Target whose ID starts with prefix
+func fetchAsyncT(prefix string) ([]AsyncTask, error) {
+
+	var tasks []AsyncTask
+	if err := couchdb.EnsureDBExist(PrefixerT, "io.cozy.async"); err != nil {
+		return nil, err
+	}
+	req := &couchdb.AllDocsRequest{
+		StartKey: prefix,
+		EndKey:   prefix + "\uFFF0",
+	}
+	if err := couchdb.GetAllDocs(PrefixerT, "io.cozy.async", req, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func deleteAsyncT(tasks []AsyncTask) error {
+
+	docs := make([]couchdb.Doc, len(tasks))
+	for index := range tasks {
+		docs[index] = &tasks[index]
+	}
+	return couchdb.BulkDeleteDocs(PrefixerT, "io.cozy.async", docs)
+}
+
+// ResetTargetRows deletes the rows already saved for an instance, and the
+// end of its task, before it is queried again
+func ResetTargetRows(queryid, domain string) error {
+
+	tasks, err := fetchAsyncT(instanceRowsPrefix(queryid, domain))
+	if err != nil {
+		return err
+	}
+	var ends []AsyncTask
+	if err := couchdb.GetAllDocs(PrefixerT, "io.cozy.async", &couchdb.AllDocsRequest{
+		Keys: []string{targetsPrefix(queryid) + domain},
+	}, &ends); err != nil {
+		return err
+	}
+	for _, end := range ends {
+		if end.AsyncID != "" {
+			tasks = append(tasks, end)
+		}
+	}
+	return deleteAsyncT(tasks)
+}
+
+// SaveTargetRows saves a page of rows sent by an instance
+func SaveTargetRows(queryid, domain string, page int, rows []map[string]interface{}) error {
+
+	doc := AsyncTask{
+		AsyncID:   fmt.Sprintf("%s%05d", instanceRowsPrefix(queryid, domain), page),
+		AsyncType: AsyncQueryTarget,
+		QueryID:   queryid,
+		Data:      rows,
+	}
+	return couchdb.CreateNamedDocWithDB(PrefixerT, &doc)
+}
+
+// EndTarget records that an instance has been queried, with or without
+// success. An instance is only counted once, even if its job is retried.
+func EndTarget(queryid, domain string, numberTargets int, task metadata.TaskMetadata) error {
+
+	doc := AsyncTask{
+		AsyncID:         targetsPrefix(queryid) + domain,
+		AsyncType:       AsyncQueryTarget,
+		QueryID:         queryid,
+		NumberOfTargets: numberTargets,
+		TaskMetadata:    task,
+	}
+	err := couchdb.CreateNamedDocWithDB(PrefixerT, &doc)
+	if couchdb.IsConflictError(err) {
+		return nil
+	}
+	return err
+}
+
+// CountEndedTargets returns the number of instances whose task has ended
+func CountEndedTargets(queryid string) (int, error) {
+
+	targets, err := fetchAsyncT(targetsPrefix(queryid))
+	if err != nil {
+		return 0, err
+	}
+	return len(targets), nil
+}
+
+// SaveTargetFolds saves the folds of the first layer before they are sent, so
+// that a copy whose DA has failed can be sent to another one. The folds saved
+// by a previous attempt are replaced.
+func SaveTargetFolds(queryid string, payloads [][]byte) error {
+
+	if err := DeleteTargetFolds(queryid); err != nil {
+		return err
+	}
+	for indexDA, payload := range payloads {
+		doc := AsyncTask{
+			AsyncID:   foldID(queryid, indexDA),
+			AsyncType: AsyncQueryTarget,
+			QueryID:   queryid,
+			IndexDA:   indexDA,
+			Payload:   payload,
+		}
+		if err := couchdb.CreateNamedDocWithDB(PrefixerT, &doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchTargetFold returns a fold of the first layer saved by Target
+func FetchTargetFold(queryid string, indexDA int) ([]byte, error) {
+
+	doc := AsyncTask{}
+	if err := couchdb.GetDoc(PrefixerT, "io.cozy.async", foldID(queryid, indexDA), &doc); err != nil {
+		return nil, err
+	}
+	return doc.Payload, nil
+}
+
+// DeleteTargetFolds deletes the folds saved by Target for a query
+func DeleteTargetFolds(queryid string) error {
+
+	folds, err := fetchAsyncT(foldsPrefix(queryid))
+	if err != nil || len(folds) == 0 {
+		return err
+	}
+	return deleteAsyncT(folds)
+}
@@ -0,0 +1,31 @@
+package query
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetFolds(t *testing.T) {
+
+	queryid := fmt.Sprintf("folds-%d", time.Now().UnixNano())
+	assert.NoError(t, SaveTargetFolds(queryid, [][]byte{[]byte("fold0"), []byte("fold1")}))
+
+	// A new attempt replaces the folds
+	assert.NoError(t, SaveTargetFolds(queryid, [][]byte{[]byte("fold0'"), []byte("fold1'")}))
+	payload, err := FetchTargetFold(queryid, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fold1'"), payload)
+
+	// The folds are not rows of the instances
+	data, err := FetchAsyncDataT(queryid)
+	assert.NoError(t, err)
+	assert.Len(t, data["Data"], 0)
+
+	assert.NoError(t, DeleteTargetFolds(queryid))
+	_, err = FetchTargetFold(queryid, 0)
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
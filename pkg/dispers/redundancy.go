@@ -0,0 +1,222 @@
+package enclave
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// DefaultTolerance is the relative difference allowed between the results of
+// the copies of a fold, when the layer does not give one
+const DefaultTolerance = 1e-6
+
+// replicas returns the number of DAs computing each fold of a layer
+func replicas(redundancy int) int {
+	if redundancy < 2 {
+		return 1
+	}
+	return redundancy
+}
+
+// checkRedundancy checks that there are enough hosts to compute the copies of
+// the folds of every layer
+func checkRedundancy(layers []query.LayerDA) error {
+	for _, layer := range layers {
+		if layer.Redundancy < 0 || layer.Tolerance < 0 {
+			return errors.WrapErrors(errors.ErrInvalidRedundancy, "")
+		}
+		if replicas(layer.Redundancy) > len(network.Hosts) {
+			return errors.WrapErrors(errors.ErrNotEnoughHosts, "")
+		}
+	}
+	return nil
+}
+
+// resultsAgree compares the results of two DAs, decoded from JSON. Numbers
+// agree when their relative difference is within the tolerance.
+func resultsAgree(a, b interface{}, tolerance float64) bool {
+
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !resultsAgree(value, other, tolerance) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for index := range a {
+			if !resultsAgree(a[index], b[index], tolerance) {
+				return false
+			}
+		}
+		return true
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return false
+		}
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return math.IsNaN(a) && math.IsNaN(b)
+		}
+		scale := math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+		return math.Abs(a-b) <= tolerance*scale
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// majority returns the copy of a fold whose results agree with a strict
+// majority of the copies, and the hosts whose results are rejected
+func majority(copies []query.ReplicaTask, tolerance float64) (*query.ReplicaTask, []string) {
+
+	for index := range copies {
+		agreeing := 0
+		outliers := []string{}
+		for _, other := range copies {
+			if resultsAgree(copies[index].Results, other.Results, tolerance) {
+				agreeing++
+			} else {
+				outliers = append(outliers, other.Host)
+			}
+		}
+		if 2*agreeing > len(copies) {
+			return &copies[index], outliers
+		}
+	}
+
+	return nil, nil
+}
+
+func (q *QueryDoc) recordDisagreement(d metadata.Disagreement) error {
+	logger.WithNamespace("dispers").Warnf("The DAs computing the fold %d-%d of the query %s disagree (%s), outliers: %v",
+		d.Layer, d.Fold, q.ID(), d.Outcome, d.Outliers)
+	return executionMetadata.RecordDisagreement(d)
+}
+
+// sendTieBreaker sends another copy of a fold to a host that has not
+// computed it yet
+func (q *QueryDoc) sendTieBreaker(indexLayer int, indexDA int, replica int, used []string) error {
+
+	folds, err := q.layerFolds(indexLayer)
+	if err != nil {
+		return err
+	}
+	hosts, err := network.ChooseHosts(1, used...)
+	if err != nil {
+		return err
+	}
+
+	// The tie-breaker has its own deadline
+	fold, err := query.RetrieveAsyncTaskDA(q.ID(), indexLayer, indexDA)
+	if err != nil {
+		return err
+	}
+	for len(fold.HostsDA) <= replica {
+		fold.HostsDA = append(fold.HostsDA, "")
+	}
+	fold.HostsDA[replica] = hosts[0].Host
+	if err := fold.SetDispatched(fold.HostsDA, foldDeadline(time.Now())); err != nil {
+		return err
+	}
+	return q.sendFold(indexLayer, indexDA, replica, hosts[0], folds[indexDA])
+}
+
+// CheckReplicas saves the results given by a copy of a fold. It returns the
+// results of the fold once a strict majority of its copies agree. out.Replica
+// and out.Host have to be checked first against the actor that made the
+// request and the hosts the fold has been dispatched to.
+//
+// When the copies disagree without majority, a tie-breaker is sent to a new
+// host if the Conductor holds the data of the fold, that is after the first
+// layer. Otherwise, the fold fails. Every disagreement is recorded in the
+// ExecutionMetadata.
+func (q *QueryDoc) CheckReplicas(out query.OutputDA) (map[string]interface{}, bool, error) {
+
+	indexLayer, indexDA := out.AggregationID[0], out.AggregationID[1]
+	if indexLayer < 0 || indexLayer >= len(q.Layers) {
+		return nil, false, errors.WrapErrors(errors.ErrAsyncTaskNotFound, "")
+	}
+	layer := q.Layers[indexLayer]
+	expected := replicas(layer.Redundancy)
+	if expected == 1 {
+		return out.Results, true, nil
+	}
+
+	if err := query.SaveReplicaResults(out); err != nil {
+		// Those results have already been received
+		if couchdb.IsConflictError(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	copies, err := query.FetchReplicas(q.ID(), indexLayer, indexDA)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(copies) < expected {
+		return nil, false, nil
+	}
+
+	tolerance := layer.Tolerance
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	hosts := make([]string, len(copies))
+	for index, replica := range copies {
+		hosts[index] = replica.Host
+	}
+	disagreement := metadata.Disagreement{
+		Layer: indexLayer,
+		Fold:  indexDA,
+		Hosts: hosts,
+	}
+
+	accepted, outliers := majority(copies, tolerance)
+	if accepted != nil {
+		if len(outliers) > 0 {
+			disagreement.Outliers = outliers
+			disagreement.Outcome = metadata.DisagreementResolved
+			if err := q.recordDisagreement(disagreement); err != nil {
+				return nil, false, err
+			}
+		}
+		return accepted.Results, true, nil
+	}
+
+	if len(copies) == expected && indexLayer > 0 {
+		err := q.sendTieBreaker(indexLayer, indexDA, expected, hosts)
+		if err == nil {
+			disagreement.Outcome = metadata.DisagreementTieBreaker
+			return nil, false, q.recordDisagreement(disagreement)
+		}
+		logger.WithNamespace("dispers").Errorf("Cannot send a tie-breaker for the fold %d-%d of the query %s: %s",
+			indexLayer, indexDA, q.ID(), err)
+	}
+
+	disagreement.Outcome = metadata.DisagreementFailed
+	if err := q.recordDisagreement(disagreement); err != nil {
+		return nil, false, err
+	}
+	fold, err := query.RetrieveAsyncTaskDA(q.ID(), indexLayer, indexDA)
+	if err != nil {
+		return nil, false, err
+	}
+	return nil, false, q.failFold(fold, errors.ErrReplicasDisagree)
+}
@@ -0,0 +1,110 @@
+package enclave
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultsAgree(t *testing.T) {
+
+	a := map[string]interface{}{
+		"length": 12.0,
+		"sum":    1000.0,
+		"coeffs": []interface{}{0.5, -2.0},
+		"label":  "mean",
+	}
+	b := map[string]interface{}{
+		"length": 12.0,
+		"sum":    1000.0000001,
+		"coeffs": []interface{}{0.5, -2.0},
+		"label":  "mean",
+	}
+	assert.True(t, resultsAgree(a, b, DefaultTolerance))
+	assert.False(t, resultsAgree(a, b, 0))
+
+	b["coeffs"] = []interface{}{0.5}
+	assert.False(t, resultsAgree(a, b, DefaultTolerance))
+	b["coeffs"] = []interface{}{0.5, -2.0}
+	delete(b, "label")
+	assert.False(t, resultsAgree(a, b, DefaultTolerance))
+
+	assert.True(t, resultsAgree(math.NaN(), math.NaN(), DefaultTolerance))
+	assert.False(t, resultsAgree(math.NaN(), 1.0, DefaultTolerance))
+	assert.False(t, resultsAgree(1.0, "1", DefaultTolerance))
+}
+
+func TestMajority(t *testing.T) {
+
+	copies := []query.ReplicaTask{
+		{Host: "da1.cozy.io", Results: map[string]interface{}{"sum": 10.0}},
+		{Host: "da2.cozy.io", Results: map[string]interface{}{"sum": 42.0}},
+		{Host: "da3.cozy.io", Results: map[string]interface{}{"sum": 10.0}},
+	}
+	accepted, outliers := majority(copies, DefaultTolerance)
+	assert.NotNil(t, accepted)
+	assert.Equal(t, 10.0, accepted.Results["sum"])
+	assert.Equal(t, []string{"da2.cozy.io"}, outliers)
+
+	accepted, outliers = majority(copies[:2], DefaultTolerance)
+	assert.Nil(t, accepted)
+	assert.Nil(t, outliers)
+}
+
+func TestCheckRedundancy(t *testing.T) {
+
+	hosts := network.Hosts
+	defer func() { network.Hosts = hosts }()
+	network.Hosts = []url.URL{
+		{Scheme: "https", Host: "da1.cozy.io"},
+		{Scheme: "https", Host: "da2.cozy.io"},
+		{Scheme: "https", Host: "da3.cozy.io"},
+	}
+
+	assert.NoError(t, checkRedundancy([]query.LayerDA{{Size: 2}, {Size: 1, Redundancy: 3}}))
+	assert.Error(t, checkRedundancy([]query.LayerDA{{Size: 2, Redundancy: 4}}))
+	assert.Error(t, checkRedundancy([]query.LayerDA{{Size: 2, Redundancy: -1}}))
+	assert.Error(t, checkRedundancy([]query.LayerDA{{Size: 2, Tolerance: -0.1}}))
+}
+
+func TestRetryHosts(t *testing.T) {
+
+	hosts := network.Hosts
+	defer func() { network.Hosts = hosts }()
+	network.Hosts = []url.URL{
+		{Scheme: "https", Host: "da1.cozy.io"},
+		{Scheme: "https", Host: "da2.cozy.io"},
+		{Scheme: "https", Host: "da3.cozy.io"},
+		{Scheme: "https", Host: "da4.cozy.io"},
+	}
+
+	fold := query.AsyncTask{
+		HostsDA:     []string{"da1.cozy.io", "da2.cozy.io"},
+		FailedHosts: []string{"da3.cozy.io"},
+	}
+	retried, err := retryHosts(fold, []int{1})
+	assert.NoError(t, err)
+	assert.Equal(t, "da4.cozy.io", retried[0].Host)
+	assert.Equal(t, "da2.cozy.io", fold.HostOf(1))
+	assert.Equal(t, "", fold.HostOf(2))
+
+	_, err = retryHosts(fold, []int{0, 1})
+	assert.Error(t, err)
+}
+
+func TestFoldDeadline(t *testing.T) {
+
+	timeout := FoldTimeout
+	defer func() { FoldTimeout = timeout }()
+	now := time.Now()
+
+	FoldTimeout = time.Minute
+	assert.Equal(t, now.Add(time.Minute), foldDeadline(now))
+	FoldTimeout = -1
+	assert.True(t, foldDeadline(now).IsZero())
+}
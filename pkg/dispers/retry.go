@@ -0,0 +1,185 @@
+package enclave
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// foldDeadline returns the time after which a DA that has not answered is
+// considered as failed, zero if the DAs are awaited forever
+func foldDeadline(now time.Time) time.Time {
+	if FoldTimeout <= 0 {
+		return time.Time{}
+	}
+	return now.Add(FoldTimeout)
+}
+
+// retryHosts chooses a new host for each failed copy of a fold. The hosts
+// that have failed, and the ones computing the other copies, are excluded.
+func retryHosts(fold query.AsyncTask, failed []int) ([]url.URL, error) {
+	excluded := append(append([]string{}, fold.FailedHosts...), fold.HostsDA...)
+	return network.ChooseHosts(len(failed), excluded...)
+}
+
+// silentReplicas returns the copies of a fold whose results have not been
+// received
+func (q *QueryDoc) silentReplicas(fold query.AsyncTask) ([]int, error) {
+
+	if fold.IndexLayer >= len(q.Layers) {
+		return nil, errors.WrapErrors(errors.ErrAsyncTaskNotFound, "")
+	}
+	expected := replicas(q.Layers[fold.IndexLayer].Redundancy)
+	if expected == 1 {
+		return []int{0}, nil
+	}
+
+	copies, err := query.FetchReplicas(q.ID(), fold.IndexLayer, fold.IndexDA)
+	if err != nil {
+		return nil, err
+	}
+	answered := make(map[int]bool)
+	for _, replica := range copies {
+		answered[replica.Replica] = true
+	}
+	// A tie-breaker is a copy more
+	if len(fold.HostsDA) > expected {
+		expected = len(fold.HostsDA)
+	}
+	silent := []int{}
+	for replica := 0; replica < expected; replica++ {
+		if !answered[replica] {
+			silent = append(silent, replica)
+		}
+	}
+	return silent, nil
+}
+
+// FailFold is called when copies of a fold have failed: their DA has reported
+// an error, or has not answered before the deadline of the fold. The failed
+// copies are sent to other hosts at most MaxFoldRetries times: the Conductor
+// holds the data of the folds after the first layer, and asks the Target for
+// the ones of the first layer. Afterwards, the fold and the query fail.
+func (q *QueryDoc) FailFold(indexLayer int, indexDA int, failed []int, cause error) error {
+
+	fold, err := query.RetrieveAsyncTaskDA(q.ID(), indexLayer, indexDA)
+	if err != nil {
+		return err
+	}
+	if fold.StateDA != query.Running || len(failed) == 0 {
+		return nil
+	}
+	logger.WithNamespace("dispers").Warnf("The copies %v of the fold %d-%d of the query %s have failed: %s",
+		failed, indexLayer, indexDA, q.ID(), cause)
+
+	if fold.Attempts >= MaxFoldRetries {
+		return q.failFold(fold, cause)
+	}
+	hosts, err := retryHosts(fold, failed)
+	if err != nil {
+		return q.failFold(fold, cause)
+	}
+
+	for index, replica := range failed {
+		if host := fold.HostOf(replica); host != "" {
+			fold.FailedHosts = append(fold.FailedHosts, host)
+		}
+		for len(fold.HostsDA) <= replica {
+			fold.HostsDA = append(fold.HostsDA, "")
+		}
+		fold.HostsDA[replica] = hosts[index].Host
+	}
+	fold.Attempts = fold.Attempts + 1
+	// Only one thread succeeds in retrying the fold, the other ones get a
+	// conflict
+	if err := fold.SetDispatched(fold.HostsDA, foldDeadline(time.Now())); err != nil {
+		if couchdb.IsConflictError(err) {
+			return nil
+		}
+		return err
+	}
+
+	// The Conductor never sees the data of the first layer
+	if indexLayer == 0 {
+		for index, replica := range failed {
+			if err := q.resendTargetFold(indexDA, replica, hosts[index]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	folds, err := q.layerFolds(indexLayer)
+	if err != nil {
+		return err
+	}
+	for index, replica := range failed {
+		if err := q.sendFold(indexLayer, indexDA, replica, hosts[index], folds[indexDA]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resendTargetFold asks the Target of the query to send a copy of a fold of
+// the first layer to another host
+func (q *QueryDoc) resendTargetFold(indexDA int, replica int, host url.URL) error {
+
+	target, ok := network.HostByName(q.TargetHost)
+	if !ok {
+		return errors.WrapErrors(errors.ErrUnknownHost, "")
+	}
+	t := network.NewExternalActor(network.RoleT, network.ModeQuery)
+	t.DefineDispersActorOn(target, "query/"+q.ID()+"/folds")
+	return t.MakeRequest("POST", "", query.InputResendFold{
+		IndexDA: indexDA,
+		Replica: replica,
+		Host:    host.Host,
+	}, nil)
+}
+
+// failFold marks a fold as failed, and ends the query with an error: a layer
+// cannot be computed without one of its folds
+func (q *QueryDoc) failFold(fold query.AsyncTask, cause error) error {
+
+	if err := fold.SetFailed(cause); err != nil {
+		return err
+	}
+	return FailQuery(q.ID(), fmt.Errorf("%s (fold %d-%d): %s", errors.ErrFoldFailed, fold.IndexLayer, fold.IndexDA, cause))
+}
+
+// CheckFoldDeadlines fails the copies of the folds whose DAs have not
+// answered before the deadline
+func CheckFoldDeadlines() error {
+
+	folds, err := query.FetchOverdueFolds(time.Now())
+	if err != nil {
+		return err
+	}
+
+	log := logger.WithNamespace("dispers")
+	for _, fold := range folds {
+		q := &QueryDoc{}
+		if err := couchdb.GetDoc(PrefixerC, "io.cozy.query", fold.QueryID, q); err != nil {
+			log.Warnf("Cannot retrieve the query %s: %s", fold.QueryID, err)
+			continue
+		}
+		silent, err := q.silentReplicas(fold)
+		if err == nil && len(silent) == 0 {
+			// Every copy has answered, but the fold has not been accepted
+			err = q.failFold(fold, errors.ErrFoldTimeout)
+		} else if err == nil {
+			err = q.FailFold(fold.IndexLayer, fold.IndexDA, silent, errors.ErrFoldTimeout)
+		}
+		if err != nil {
+			log.Warnf("Cannot retry the fold %d-%d of the query %s: %s", fold.IndexLayer, fold.IndexDA, fold.QueryID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package enclave
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
+)
+
+const doctypeStaleMarks = "io.cozy.dispers.stale_marks"
+
+// StaleMarkDoc is saved by the Conductor when a Target tells that the token
+// of an instance has been refused by its stack. The Conductor cannot read the
+// instance, it forwards the marks to the Target Finder. The ID is derived from
+// the mark, a mark reported twice is saved once.
+type StaleMarkDoc struct {
+	MarkID            string    `json:"_id,omitempty"`
+	MarkRev           string    `json:"_rev,omitempty"`
+	EncryptedInstance []byte    `json:"enc_instance"`
+	ReportedAt        time.Time `json:"reported_at"`
+}
+
+// ID is used to get MarkID
+func (m *StaleMarkDoc) ID() string {
+	return m.MarkID
+}
+
+// Rev is used to get MarkRev
+func (m *StaleMarkDoc) Rev() string {
+	return m.MarkRev
+}
+
+// DocType is used to get the doc's type
+func (m *StaleMarkDoc) DocType() string {
+	return doctypeStaleMarks
+}
+
+// Clone is used to copy one doc
+func (m *StaleMarkDoc) Clone() couchdb.Doc {
+	cloned := *m
+	cloned.EncryptedInstance = append([]byte(nil), m.EncryptedInstance...)
+	return &cloned
+}
+
+// SetID is used to set doc's ID
+func (m *StaleMarkDoc) SetID(id string) {
+	m.MarkID = id
+}
+
+// SetRev is used to set doc's Rev
+func (m *StaleMarkDoc) SetRev(rev string) {
+	m.MarkRev = rev
+}
+
+// SaveStaleMark saves the mark of an instance reported by a Target
+func SaveStaleMark(encInstance []byte) error {
+
+	sum := sha256.Sum256(encInstance)
+	doc := &StaleMarkDoc{
+		MarkID:            hex.EncodeToString(sum[:]),
+		EncryptedInstance: encInstance,
+		ReportedAt:        time.Now(),
+	}
+	err := couchdb.CreateNamedDocWithDB(PrefixerC, doc)
+	if couchdb.IsConflictError(err) {
+		return nil
+	}
+	return err
+}
+
+// staleMarks returns the marks to give to the Target Finder. A mark is
+// dropped once the token it marks has expired anyway.
+func staleMarks() ([][]byte, error) {
+
+	var docs []StaleMarkDoc
+	err := couchdb.GetAllDocs(PrefixerC, doctypeStaleMarks, nil, &docs)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	marks := [][]byte{}
+	for i := range docs {
+		if time.Since(docs[i].ReportedAt) > consts.InstanceTokenValidityDuration {
+			if err := couchdb.DeleteDoc(PrefixerC, &docs[i]); err != nil && !couchdb.IsConflictError(err) {
+				return nil, err
+			}
+			continue
+		}
+		marks = append(marks, docs[i].EncryptedInstance)
+	}
+	return marks, nil
+}
+
+// ReportStale tells the Conductor of a query that the given version of the
+// token of an instance has been refused by its stack, for the Target Finder
+// to stop selecting it.
+func ReportStale(conductorURL url.URL, queryid, domain string, version int) error {
+
+	encInstance, err := wire.Encode(wire.TypeInstance, query.Instance{
+		Domain:  domain,
+		Version: version,
+	})
+	if err != nil {
+		return err
+	}
+
+	conductor := network.NewExternalActor(network.RoleConductor, network.ModeQuery)
+	conductor.DefineConductor(conductorURL, queryid)
+	conductor.URL.Path = conductor.URL.Path + "/stale"
+	return conductor.MakeRequest("POST", "", query.InputStale{EncryptedInstance: encInstance}, nil)
+}
+
+// dropStale removes the instances whose token has been reported as refused by
+// their stack. An instance that has refreshed its token since then has got a
+// new version and is kept.
+func dropStale(addresses []query.Instance, marks [][]byte) ([]query.Instance, error) {
+
+	if len(marks) == 0 {
+		return addresses, nil
+	}
+
+	stale := make(map[string]map[int]bool)
+	for _, mark := range marks {
+		var instance query.Instance
+		if err := wire.Decode(mark, wire.TypeInstance, &instance); err != nil {
+			return nil, err
+		}
+		if stale[instance.Domain] == nil {
+			stale[instance.Domain] = make(map[int]bool)
+		}
+		stale[instance.Domain][instance.Version] = true
+	}
+
+	kept := []query.Instance{}
+	for _, address := range addresses {
+		if stale[address.Domain][address.Version] {
+			continue
+		}
+		kept = append(kept, address)
+	}
+	return kept, nil
+}
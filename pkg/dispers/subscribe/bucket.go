@@ -0,0 +1,78 @@
+package subscribe
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// DoctypeBucket is the doctype of the buckets of instances
+const DoctypeBucket = "io.cozy.instances.buckets"
+
+// BucketDoc is a part of the list of instances that subscribed to a concept.
+// An instance is always saved in the same bucket of a concept, chosen by the
+// Target Finder from its domain, so that a subscription only rewrites a small
+// list. A bucket is created by the first subscription that needs it.
+type BucketDoc struct {
+	BucketID           string `json:"_id,omitempty"`
+	BucketRev          string `json:"_rev,omitempty"`
+	ConceptID          string `json:"concept_id"`
+	Bucket             int    `json:"bucket"`
+	EncryptedInstances []byte `json:"enc_instances"`
+	Subscribers        int    `json:"subscribers"`
+}
+
+// ID is used to get BucketID
+func (b *BucketDoc) ID() string {
+	return b.BucketID
+}
+
+// Rev is used to get BucketRev
+func (b *BucketDoc) Rev() string {
+	return b.BucketRev
+}
+
+// DocType is used to get the doc's type
+func (b *BucketDoc) DocType() string {
+	return DoctypeBucket
+}
+
+// Clone is used to copy one doc
+func (b *BucketDoc) Clone() couchdb.Doc {
+	cloned := *b
+	return &cloned
+}
+
+// SetID is used to set doc's ID
+func (b *BucketDoc) SetID(id string) {
+	b.BucketID = id
+}
+
+// SetRev is used to set doc's Rev
+func (b *BucketDoc) SetRev(rev string) {
+	b.BucketRev = rev
+}
+
+// BucketID returns the ID of a bucket of a concept. The buckets of a concept
+// are next to each other in the database.
+func BucketID(conceptID string, bucket int) string {
+	return fmt.Sprintf("%s-%04d", conceptID, bucket)
+}
+
+// BucketsRange returns the first and last possible IDs of the buckets of a
+// concept
+func BucketsRange(conceptID string) (string, string) {
+	return conceptID + "-", conceptID + "-\uFFF0"
+}
+
+// BucketOf returns the bucket of an instance in a concept whose list is split
+// into the given number of shards
+func BucketOf(domain string, shards int) int {
+	if shards <= 1 {
+		return 0
+	}
+	sum := sha256.Sum256([]byte(domain))
+	return int(binary.BigEndian.Uint32(sum[:4]) % uint32(shards))
+}
@@ -5,13 +5,21 @@ import (
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
 )
 
-// SubscribeDoc is used to save in Conductor's database the list of instances that subscribed
-// to a concept. Each concept is associated with a list of instances.
+// SubscribeDoc is used to save in Conductor's database the concepts instances
+// can subscribe to. The list of instances of a concept is split into Shards
+// buckets (see BucketDoc). The number of shards is doubled when a bucket gets
+// too large, NextShards being the number of shards while the buckets are
+// split.
+//
+// EncryptedInstances is the whole list of instances saved before the lists
+// were split. It is moved to the buckets the first time the concept is used.
 type SubscribeDoc struct {
 	SubscribeID        string `json:"_id,omitempty"`
 	SubscribeRev       string `json:"_rev,omitempty"`
 	Hash               []byte `json:"hash"`
-	EncryptedInstances []byte `json:"enc_instances"`
+	Shards             int    `json:"shards,omitempty"`
+	NextShards         int    `json:"next_shards,omitempty"`
+	EncryptedInstances []byte `json:"enc_instances,omitempty"`
 }
 
 // ID is used to get SubscribeID
@@ -46,10 +54,18 @@ func (t *SubscribeDoc) SetRev(rev string) {
 }
 
 type InputConductor struct {
-	IsEncrypted       bool           `json:"is_encrypted,omitempty"`
-	Concepts          []string       `json:"concepts,omitempty"`
-	Instance          query.Instance `json:"instance,omitempty"`
-	EncryptedInstance []byte         `json:"enc_instance,omitempty"`
+	IsEncrypted       bool              `json:"is_encrypted,omitempty"`
+	Concepts          []string          `json:"concepts,omitempty"`
+	Instance          query.Instance    `json:"instance,omitempty"`
+	RefreshedInstance RefreshedInstance `json:"refreshed_instance,omitempty"`
+	EncryptedInstance []byte            `json:"enc_instance,omitempty"`
+}
+
+// RefreshedInstance is given by an instance to rotate its token. The previous
+// token proves that the instance is the one that subscribed.
+type RefreshedInstance struct {
+	query.Instance
+	PreviousTokenBearer string `json:"previous_token_bearer"`
 }
 
 type InputDecrypt struct {
@@ -64,12 +80,45 @@ type InputInsert struct {
 	EncryptedInstance  []byte `json:"enc_instance"`
 }
 
+// InputEncrypt is sent by the Target. Count is the number of instances in the
+// list, so that the Conductor knows the number of subscribers of a concept.
 type InputEncrypt struct {
 	IsEncrypted        bool   `json:"is_enc,omitempty"`
 	EncryptedInstances []byte `json:"enc_instances,omitempty"`
+	Count              int    `json:"count"`
 }
 
 type OutputEncrypt struct {
 	IsEncrypted        bool   `json:"is_enc,omitempty"`
 	EncryptedInstances []byte `json:"enc_instances,omitempty"`
+	Count              int    `json:"count"`
+}
+
+// InputBucket is sent by the Conductor to know the bucket of an instance in
+// the concepts whose lists are split into the given numbers of shards
+type InputBucket struct {
+	IsEncrypted       bool   `json:"is_enc"`
+	EncryptedInstance []byte `json:"enc_instance"`
+	Shards            []int  `json:"shards"`
+}
+
+// OutputBucket gives the bucket of the instance for each number of shards
+type OutputBucket struct {
+	Buckets map[int]int `json:"buckets"`
+}
+
+// InputSplit is sent by the Conductor to split a list of instances saved
+// before the lists were split into buckets
+type InputSplit struct {
+	IsEncrypted        bool   `json:"is_enc"`
+	EncryptedInstances []byte `json:"enc_instances"`
+	Shards             int    `json:"shards"`
+}
+
+// OutputSplit gives the non-empty buckets of the list and their number of
+// instances
+type OutputSplit struct {
+	IsEncrypted bool           `json:"is_enc,omitempty"`
+	Buckets     map[int][]byte `json:"buckets"`
+	Counts      map[int]int    `json:"counts"`
 }
@@ -0,0 +1,108 @@
+package subscribe
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+)
+
+const doctypeStale = "io.cozy.dispers.stale_instances"
+
+// StaleDoc is saved in the Target's database when the token of an instance
+// has been refused by its stack. The instance is no longer queried until it
+// refreshes its token. Its ID is the domain of the instance.
+type StaleDoc struct {
+	StaleID     string    `json:"_id,omitempty"`
+	StaleRev    string    `json:"_rev,omitempty"`
+	Version     int       `json:"version"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// ID is used to get StaleID
+func (s *StaleDoc) ID() string {
+	return s.StaleID
+}
+
+// Rev is used to get StaleRev
+func (s *StaleDoc) Rev() string {
+	return s.StaleRev
+}
+
+// DocType is used to get the doc's type
+func (s *StaleDoc) DocType() string {
+	return doctypeStale
+}
+
+// Clone is used to copy one doc
+func (s *StaleDoc) Clone() couchdb.Doc {
+	cloned := *s
+	return &cloned
+}
+
+// SetID is used to set doc's ID
+func (s *StaleDoc) SetID(id string) {
+	s.StaleID = id
+}
+
+// SetRev is used to set doc's Rev
+func (s *StaleDoc) SetRev(rev string) {
+	s.StaleRev = rev
+}
+
+func getStaleDoc(domain string) (*StaleDoc, error) {
+	doc := &StaleDoc{}
+	err := couchdb.GetDoc(query.PrefixerT, doctypeStale, domain, doc)
+	if couchdb.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// RecordTokenFailure marks the given version of the instance's token as stale
+func RecordTokenFailure(domain string, version int, reason string) error {
+
+	doc, err := getStaleDoc(domain)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		doc = &StaleDoc{StaleID: domain}
+	}
+	if doc.Version != version {
+		doc.Version = version
+		doc.Failures = 0
+	}
+	doc.Failures++
+	doc.LastFailure = time.Now()
+	doc.Reason = reason
+
+	if doc.Rev() == "" {
+		return couchdb.CreateNamedDocWithDB(query.PrefixerT, doc)
+	}
+	return couchdb.UpdateDoc(query.PrefixerT, doc)
+}
+
+// ClearStale is used when an instance gives a new token
+func ClearStale(domain string) error {
+	doc, err := getStaleDoc(domain)
+	if err != nil || doc == nil {
+		return err
+	}
+	return couchdb.DeleteDoc(query.PrefixerT, doc)
+}
+
+// IsStale returns true if the given version of the instance's token has been
+// refused by its stack
+func IsStale(domain string, version int) (bool, error) {
+	doc, err := getStaleDoc(domain)
+	if err != nil || doc == nil {
+		return false, err
+	}
+	return doc.Version == version, nil
+}
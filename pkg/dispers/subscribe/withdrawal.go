@@ -0,0 +1,90 @@
+package subscribe
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+)
+
+const doctypeWithdrawal = "io.cozy.dispers.withdrawals"
+
+// WithdrawalDoc is saved in the Target's database when an instance withdraws
+// its consent. The instance is no longer queried, even by the queries that
+// were already running. Its ID is the domain of the instance.
+type WithdrawalDoc struct {
+	WithdrawalID  string    `json:"_id,omitempty"`
+	WithdrawalRev string    `json:"_rev,omitempty"`
+	WithdrawnAt   time.Time `json:"withdrawn_at"`
+}
+
+// ID is used to get WithdrawalID
+func (w *WithdrawalDoc) ID() string {
+	return w.WithdrawalID
+}
+
+// Rev is used to get WithdrawalRev
+func (w *WithdrawalDoc) Rev() string {
+	return w.WithdrawalRev
+}
+
+// DocType is used to get the doc's type
+func (w *WithdrawalDoc) DocType() string {
+	return doctypeWithdrawal
+}
+
+// Clone is used to copy one doc
+func (w *WithdrawalDoc) Clone() couchdb.Doc {
+	cloned := *w
+	return &cloned
+}
+
+// SetID is used to set doc's ID
+func (w *WithdrawalDoc) SetID(id string) {
+	w.WithdrawalID = id
+}
+
+// SetRev is used to set doc's Rev
+func (w *WithdrawalDoc) SetRev(rev string) {
+	w.WithdrawalRev = rev
+}
+
+// Withdraw records in the Target's database that an instance has withdrawn
+func Withdraw(domain string) error {
+	doc := &WithdrawalDoc{
+		WithdrawalID: domain,
+		WithdrawnAt:  time.Now(),
+	}
+	err := couchdb.CreateNamedDocWithDB(query.PrefixerT, doc)
+	if couchdb.IsConflictError(err) {
+		// The instance has already withdrawn
+		return nil
+	}
+	return err
+}
+
+// CancelWithdrawal is used when an instance subscribes again
+func CancelWithdrawal(domain string) error {
+	doc := &WithdrawalDoc{}
+	err := couchdb.GetDoc(query.PrefixerT, doctypeWithdrawal, domain, doc)
+	if couchdb.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(query.PrefixerT, doc)
+}
+
+// IsWithdrawn returns true if the instance has withdrawn its consent
+func IsWithdrawn(domain string) (bool, error) {
+	doc := &WithdrawalDoc{}
+	err := couchdb.GetDoc(query.PrefixerT, doctypeWithdrawal, domain, doc)
+	if couchdb.IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
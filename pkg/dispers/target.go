@@ -1,25 +1,73 @@
 package enclave
 
 import (
-	"encoding/json"
+	"math/rand"
 	"net/url"
-	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation/sharing"
 	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/subscribe"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
-func buildStackQuery(numberTargets int, conductorURL url.URL, queryid string, instance query.Instance, localQuery query.LocalQuery) query.StackQuery {
+var (
+	// MaxRowsPerInstance is the maximal number of rows fetched from an
+	// instance, a value lower than 1 meaning no limit
+	MaxRowsPerInstance = 10000
+
+	// DeleteIndexes tells if the Mango indexes created on the stacks are
+	// deleted once no running query uses them
+	DeleteIndexes bool
+)
+
+// StackPageSize is the number of documents asked to a stack in each request
+const StackPageSize = 100
+
+// FindPage is a page of documents sent by a stack. The bookmark is given in
+// the next request to get the following page.
+type FindPage struct {
+	Docs     []map[string]interface{} `json:"docs"`
+	Bookmark string                   `json:"bookmark,omitempty"`
+}
+
+// IsLast returns true if no more pages have to be asked: the stack sent less
+// documents than requested, or did not give a new bookmark
+func (p FindPage) IsLast(requested int, previousBookmark string) bool {
+	return len(p.Docs) < requested || p.Bookmark == "" || p.Bookmark == previousBookmark
+}
+
+// RowsLimit returns the number of rows to fetch from an instance: the limit of
+// the local query if any, within MaxRowsPerInstance. Zero means no limit.
+func RowsLimit(limit int) int {
+	if MaxRowsPerInstance > 0 && (limit <= 0 || limit > MaxRowsPerInstance) {
+		return MaxRowsPerInstance
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+func buildStackQuery(numberTargets int, conductorURL url.URL, queryid string, instance query.Instance, localQuery query.LocalQuery, layout query.FoldLayout) query.StackQuery {
 	// TODO : encrypt outputs
 	query := query.StackQuery{
 		Domain:          instance.Domain,
 		LocalQuery:      localQuery,
 		TokenBearer:     instance.TokenBearer,
+		TokenVersion:    instance.Version,
+		TokenExpiresAt:  instance.TokenExpiresAt,
 		QueryID:         queryid,
 		ConductorURL:    conductorURL,
 		NumberOfTargets: numberTargets,
+		Layout:          layout,
 	}
 
 	return query
@@ -32,15 +80,10 @@ func decryptInputT(in *query.InputT) ([]query.Instance, query.LocalQuery, error)
 
 	// TODO: Decrypt inputs if encrypted
 
-	if strings.Contains(string(in.EncryptedTargets), "\\\"") {
-		in.EncryptedTargets = []byte(strings.ReplaceAll(string(in.EncryptedTargets), "\"", ""))
-		in.EncryptedTargets = []byte(strings.ReplaceAll(string(in.EncryptedTargets), "\\", "\""))
-	}
-
-	if err := json.Unmarshal(in.EncryptedTargets, &targets); err != nil {
+	if err := wire.Decode(in.EncryptedTargets, wire.TypeInstances, &targets); err != nil {
 		return targets, localQuery, errors.WrapErrors(errors.ErrUnmarshal, "")
 	}
-	if err := json.Unmarshal(in.EncryptedLocalQuery, &localQuery); err != nil {
+	if err := wire.Decode(in.EncryptedLocalQuery, wire.TypeLocalQuery, &localQuery); err != nil {
 		return targets, localQuery, errors.WrapErrors(errors.ErrUnmarshal, "")
 	}
 
@@ -68,6 +111,102 @@ func retrieveData(in *query.InputT, queriesStack *[]query.StackQuery) error {
 	return nil
 }
 
+// PushOverdueTargets pushes a job for every query whose instances have not
+// all answered before the deadline, or whose folds have not been sent by a
+// worker that has stopped. The job sends the rows already received to the
+// Data Aggregators.
+func PushOverdueTargets() error {
+
+	phases, err := query.FetchOverdueTargetPhases(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, phase := range phases {
+		msg, err := job.NewMessage(phase)
+		if err != nil {
+			return err
+		}
+		_, err = job.System().PushJob(prefixer.TargetPrefixer, &job.JobRequest{
+			WorkerType: "query_target_completion",
+			Message:    msg,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteExpiredTargetPhases deletes the phases that have expired, with their
+// folds, and the rows and the ends of the tasks saved meanwhile by the
+// instances that have answered late
+func DeleteExpiredTargetPhases(now time.Time) error {
+
+	phases, err := query.FetchExpiredTargetPhases(now)
+	if err != nil {
+		return err
+	}
+	for index := range phases {
+		if err := query.DeleteAsyncDataT(phases[index].PhaseID); err != nil {
+			return err
+		}
+		if err := query.DeleteTargetFolds(phases[index].PhaseID); err != nil {
+			return err
+		}
+		if err := phases[index].Delete(); err != nil && !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckDeadlines checks the deadlines of the target phases and of the folds,
+// abandons the queries that have not ended in time, and pushes again the lost
+// jobs leading a query. It is run by the dispers_deadlines jobs.
+func CheckDeadlines() error {
+
+	now := time.Now()
+	err := PushOverdueTargets()
+	if errCheck := DeleteExpiredTargetPhases(now); err == nil {
+		err = errCheck
+	}
+	if errCheck := CheckFoldDeadlines(); err == nil {
+		err = errCheck
+	}
+	if errCheck := AbandonQueries(now); err == nil {
+		err = errCheck
+	}
+	if errCheck := PushStaleLeads(now); err == nil {
+		err = errCheck
+	}
+	return err
+}
+
+// dropUnreachable removes the instances that have withdrawn their consent
+// since the targets have been selected, and the ones whose token has expired
+// or has been refused by their stack
+func dropUnreachable(targets []query.Instance) ([]query.Instance, error) {
+
+	kept := []query.Instance{}
+	for _, target := range targets {
+		if target.IsExpired() {
+			continue
+		}
+		withdrawn, err := subscribe.IsWithdrawn(target.Domain)
+		if err != nil {
+			return nil, err
+		}
+		stale, err := subscribe.IsStale(target.Domain, target.Version)
+		if err != nil {
+			return nil, err
+		}
+		if !withdrawn && !stale {
+			kept = append(kept, target)
+		}
+	}
+	return kept, nil
+}
+
 // QueryTarget decrypts instance given by the conductor and build queries
 func QueryTarget(in query.InputT) error {
 
@@ -76,6 +215,24 @@ func QueryTarget(in query.InputT) error {
 		return err
 	}
 
+	// The Conductor cannot check the encrypted queries, the policy is
+	// enforced again before the stacks are queried
+	if err := query.Policy.Enforce(&localQuery); err != nil {
+		return err
+	}
+	if err := localQuery.Project(); err != nil {
+		return err
+	}
+
+	targets, err = dropUnreachable(targets)
+	if err != nil {
+		return err
+	}
+
+	if in.Layout.Size < 1 {
+		return errors.WrapErrors(errors.ErrInvalidFoldLayout, "")
+	}
+
 	queries := make([]query.StackQuery, len(targets))
 
 	if len(targets) == 0 {
@@ -83,9 +240,336 @@ func QueryTarget(in query.InputT) error {
 	}
 
 	for index, target := range targets {
-		q := buildStackQuery(len(targets), in.ConductorURL, in.QueryID, target, localQuery)
+		q := buildStackQuery(len(targets), in.ConductorURL, in.QueryID, target, localQuery, in.Layout)
 		queries[index] = q
 	}
 
+	// The phase keeps what is needed to send the folds, even if some
+	// instances never answer. A query whose phase exists is already running.
+	phase := buildStackQuery(len(targets), in.ConductorURL, in.QueryID, query.Instance{}, localQuery, in.Layout)
+	if _, err := query.NewTargetPhase(phase, in.Deadline); err != nil {
+		if couchdb.IsConflictError(err) {
+			return nil
+		}
+		return err
+	}
+
 	return retrieveData(&in, &queries)
 }
+
+// SplitInFolds shuffles the rows of data with rnd and splits them into size
+// folds. The lengths of the folds differ by one row at most.
+func SplitInFolds(data []map[string]interface{}, size int, rnd *rand.Rand) ([][]map[string]interface{}, error) {
+
+	if size < 1 {
+		return nil, errors.WrapErrors(errors.ErrInvalidFoldLayout, "")
+	}
+
+	// Shuffle Data to reduce bias
+	rnd.Shuffle(len(data), func(i, j int) {
+		data[i], data[j] = data[j], data[i]
+	})
+
+	folds := make([][]map[string]interface{}, size)
+	start := 0
+	for indexFold := range folds {
+		end := start + len(data)/size
+		if indexFold < len(data)%size {
+			end = end + 1
+		}
+		folds[indexFold] = data[start:end]
+		start = end
+	}
+
+	return folds, nil
+}
+
+// FoldSizes returns the number of rows in each fold. It is the only thing the
+// conductor knows about the data.
+func FoldSizes(folds [][]map[string]interface{}) []int {
+
+	sizes := make([]int, len(folds))
+	for indexFold, fold := range folds {
+		sizes[indexFold] = len(fold)
+	}
+	return sizes
+}
+
+// ClipRows clips the values of the rows within the bounds of the query. It
+// returns the rows that are kept, and the number of clipped and rejected rows.
+// A single Cozy cannot push an absurd value into the aggregates this way.
+func ClipRows(rows []map[string]interface{}, bounds map[string]aggregations.Bound) ([]map[string]interface{}, int, int) {
+
+	if len(bounds) == 0 {
+		return rows, 0, 0
+	}
+
+	kept := make([]map[string]interface{}, 0, len(rows))
+	clipped := 0
+	for _, row := range rows {
+		isClipped, isKept := aggregations.ClipRow(row, bounds)
+		if !isKept {
+			continue
+		}
+		if isClipped {
+			clipped++
+		}
+		kept = append(kept, row)
+	}
+
+	return kept, clipped, len(rows) - len(kept)
+}
+
+// partialClipped and partialRejected are the keys of the number of clipped
+// and rejected rows in a partial state. They are removed before the states
+// are sent to the Data Aggregators.
+const (
+	partialClipped  = "_clipped_rows"
+	partialRejected = "_rejected_rows"
+)
+
+// PreAggregate applies the functions of the jobs of the first layer to the
+// rows of an instance, once clipped. Only this partial state leaves the
+// Target, with the number of rows it sums up, and the number of clipped and
+// rejected rows. Its vectors and matrices are flattened.
+func PreAggregate(rows []map[string]interface{}, layout query.FoldLayout) (map[string]interface{}, error) {
+
+	var jobs []query.AggregationJob
+	if err := wire.Decode(layout.EncryptedJobs, wire.TypeJobs, &jobs); err != nil {
+		return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
+	}
+	funcs, err := decodeDecomposableJobs(jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	kept, clipped, rejected := ClipRows(rows, layout.Clipping)
+
+	state := make(map[string]interface{})
+	for _, function := range funcs {
+		for index, row := range kept {
+			if err := applyAggregateFunction(index, &state, row, function); err != nil {
+				return nil, errors.WrapErrors(errors.ErrAggrFailed, "")
+			}
+		}
+	}
+	values, err := sharing.Flatten(state)
+	if err != nil {
+		return nil, err
+	}
+
+	partial := make(map[string]interface{}, len(values)+3)
+	for key, value := range values {
+		partial[key] = value
+	}
+	partial["length"] = len(kept)
+	partial[partialClipped] = clipped
+	partial[partialRejected] = rejected
+	return partial, nil
+}
+
+// PrepareRows returns the rows to split into folds, with the number of
+// clipped and rejected rows. The rows are clipped, unless they are partial
+// states already clipped by PreAggregate.
+func PrepareRows(rows []map[string]interface{}, layout query.FoldLayout) ([]map[string]interface{}, int, int) {
+
+	if !layout.PreAggregate {
+		return ClipRows(rows, layout.Clipping)
+	}
+
+	// The instances whose rows have all been rejected give nothing to merge
+	kept := make([]map[string]interface{}, 0, len(rows))
+	clipped, rejected := 0, 0
+	for _, partial := range rows {
+		c, _ := aggregations.AsFloat64(partial[partialClipped])
+		r, _ := aggregations.AsFloat64(partial[partialRejected])
+		clipped, rejected = clipped+int(c), rejected+int(r)
+		delete(partial, partialClipped)
+		delete(partial, partialRejected)
+		if length, _ := aggregations.AsFloat64(partial["length"]); length > 0 {
+			kept = append(kept, partial)
+		}
+	}
+	return kept, clipped, rejected
+}
+
+// CountRows returns the number of rows of the instances held by rows. A
+// partial state given by PreAggregate holds the rows of its instance.
+func CountRows(rows []map[string]interface{}, layout query.FoldLayout) int {
+
+	if !layout.PreAggregate {
+		return len(rows)
+	}
+
+	count := 0
+	for _, partial := range rows {
+		length, _ := aggregations.AsFloat64(partial["length"])
+		count += int(length)
+	}
+	return count
+}
+
+// shareRows applies the functions of the jobs to each row, and splits the
+// contribution of the row into one share for each Data Aggregator. The Data
+// Aggregators only have to sum their shares.
+func shareRows(rows []map[string]interface{}, layout query.FoldLayout) ([][]sharing.Share, error) {
+
+	var jobs []query.AggregationJob
+	if err := wire.Decode(layout.EncryptedJobs, wire.TypeJobs, &jobs); err != nil {
+		return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
+	}
+	funcs, err := decodeShareableJobs(jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	var magnitude sharing.Magnitude
+	shares := make([][]sharing.Share, layout.Size)
+	for index, row := range rows {
+		// A partial state is already the contribution of its instance
+		contribution := row
+		if !layout.PreAggregate {
+			contribution = make(map[string]interface{})
+			for _, function := range funcs {
+				if err := applyAggregateFunction(index, &contribution, row, function); err != nil {
+					return nil, errors.WrapErrors(errors.ErrAggrFailed, "")
+				}
+			}
+		}
+		rowShares, err := magnitude.Split(contribution, layout.Size)
+		if err != nil {
+			return nil, err
+		}
+		for indexDA := range shares {
+			shares[indexDA] = append(shares[indexDA], rowShares[indexDA])
+		}
+	}
+
+	return shares, nil
+}
+
+// MakeFolds returns the payload of each Data Aggregator of the first layer,
+// and the number of rows it holds (see CountRows). With secret sharing, every
+// Data Aggregator receives one share of every row.
+func MakeFolds(rows []map[string]interface{}, layout query.FoldLayout) ([][]byte, []int, error) {
+
+	// TODO: Encrypt the folds for the Data Aggregators
+	if layout.SecretSharing {
+		shares, err := shareRows(rows, layout)
+		if err != nil {
+			return nil, nil, err
+		}
+		payloads := make([][]byte, len(shares))
+		sizes := make([]int, len(shares))
+		for indexDA, share := range shares {
+			payloads[indexDA], err = wire.Encode(wire.TypeShares, share)
+			if err != nil {
+				return nil, nil, err
+			}
+			sizes[indexDA] = CountRows(rows, layout)
+		}
+		return payloads, sizes, nil
+	}
+
+	folds, err := SplitInFolds(rows, layout.Size, rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err != nil {
+		return nil, nil, err
+	}
+	payloads := make([][]byte, len(folds))
+	sizes := make([]int, len(folds))
+	for indexDA, fold := range folds {
+		payloads[indexDA], err = wire.Encode(wire.TypeData, fold)
+		if err != nil {
+			return nil, nil, err
+		}
+		sizes[indexDA] = CountRows(fold, layout)
+	}
+	return payloads, sizes, nil
+}
+
+// ChooseFoldHosts chooses the hosts of the Data Aggregators of the first
+// layer. When the layer is redundant, the copies of a fold are sent to
+// distinct hosts. The hosts are registered by the conductor with the folds.
+func ChooseFoldHosts(layout query.FoldLayout) ([][]url.URL, error) {
+	hosts := make([][]url.URL, layout.Size)
+	for indexDA := range hosts {
+		chosen, err := network.ChooseHosts(replicas(layout.Redundancy))
+		if err != nil {
+			return nil, err
+		}
+		hosts[indexDA] = chosen
+	}
+	return hosts, nil
+}
+
+// HostNames returns the name of the hosts of each fold
+func HostNames(hosts [][]url.URL) [][]string {
+	names := make([][]string, len(hosts))
+	for indexDA, copies := range hosts {
+		names[indexDA] = make([]string, len(copies))
+		for replica, host := range copies {
+			names[indexDA][replica] = host.Host
+		}
+	}
+	return names
+}
+
+// SendFolds sends each fold to the Data Aggregators chosen by
+// ChooseFoldHosts. The Data Aggregators give their results to the conductor.
+func SendFolds(in query.StackQuery, payloads [][]byte, hosts [][]url.URL) error {
+
+	if len(hosts) != len(payloads) {
+		return errors.WrapErrors(errors.ErrInvalidFoldLayout, "")
+	}
+
+	for indexDA, payload := range payloads {
+		for replica, host := range hosts[indexDA] {
+			if err := sendFold(in, indexDA, replica, host, payload); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ResendFold sends a copy of a fold of the first layer to another host, when
+// the DA computing it has failed. The folds are kept by Target as long as the
+// phase of the query, and are only sent to Cozy-DISPERS servers.
+func ResendFold(queryid string, in query.InputResendFold) error {
+
+	host, ok := network.HostByName(in.Host)
+	if !ok {
+		return errors.WrapErrors(errors.ErrUnknownHost, "")
+	}
+	phase, err := query.FetchTargetPhase(queryid)
+	if err != nil {
+		return err
+	}
+	payload, err := query.FetchTargetFold(queryid, in.IndexDA)
+	if err != nil {
+		return err
+	}
+	return sendFold(phase.Query, in.IndexDA, in.Replica, host, payload)
+}
+
+func sendFold(in query.StackQuery, indexDA, replica int, host url.URL, payload []byte) error {
+
+	inputDA := query.InputDA{
+		QueryID:       in.QueryID,
+		ConductorURL:  in.ConductorURL,
+		IsEncrypted:   in.IsEncrypted,
+		EncryptedJobs: in.Layout.EncryptedJobs,
+		SecretSharing: in.Layout.SecretSharing,
+		PreAggregated: in.Layout.PreAggregate,
+		EncryptedData: payload,
+		AggregationID: [2]int{0, indexDA},
+		Replica:       replica,
+		Host:          host.Host,
+		TaskMetadata:  metadata.NewTaskMetadata(),
+	}
+
+	da := network.NewExternalActor(network.RoleDA, network.ModeQuery)
+	da.DefineDispersActorOn(host, "aggregation")
+	return da.MakeRequest("POST", "", inputDA, nil)
+}
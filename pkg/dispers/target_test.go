@@ -1,9 +1,12 @@
 package enclave
 
 import (
+	"math"
+	"math/rand"
 	"net/url"
 	"testing"
 
+	"github.com/cozy/cozy-stack/pkg/dispers/aggregation"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
 	"github.com/stretchr/testify/assert"
 )
@@ -19,6 +22,92 @@ func TestBuildQuery(t *testing.T) {
 		FindRequest: query.FindParams{},
 	}
 
-	out := buildStackQuery(5, url.URL{}, "fakequeryid", inst, localQuery)
+	layout := query.FoldLayout{Size: 4}
+
+	out := buildStackQuery(5, url.URL{}, "fakequeryid", inst, localQuery, layout)
 	assert.Equal(t, inst.Domain, out.Domain)
+	assert.Equal(t, layout, out.Layout)
+}
+
+func TestSplitInFolds(t *testing.T) {
+
+	data := make([]map[string]interface{}, 150)
+	for index := range data {
+		data[index] = map[string]interface{}{"row": index}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	folds, err := SplitInFolds(data, 4, rnd)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{38, 38, 37, 37}, FoldSizes(folds))
+
+	// Every row is in one fold
+	seen := make(map[int]bool)
+	for _, fold := range folds {
+		for _, row := range fold {
+			seen[row["row"].(int)] = true
+		}
+	}
+	assert.Len(t, seen, 150)
+
+	// Some folds are empty if there is less rows than folds
+	folds, err = SplitInFolds(data[:2], 4, rnd)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 1, 0, 0}, FoldSizes(folds))
+
+	_, err = SplitInFolds(data, 0, rnd)
+	assert.Error(t, err)
+}
+
+func TestClipRows(t *testing.T) {
+
+	low, high := -100.0, 100.0
+	bounds := map[string]aggregations.Bound{
+		"amount":  {Min: &low, Max: &high},
+		"balance": {Max: &high, Reject: true},
+	}
+
+	rows := []map[string]interface{}{
+		{"amount": 12.0, "balance": 50.0},
+		{"amount": 1e300},
+		{"amount": -250.0, "label": "shop"},
+		{"amount": 5.0, "balance": 1e6},
+		{"amount": "12"},
+		{"amount": math.NaN()},
+	}
+	kept, clipped, rejected := ClipRows(rows, bounds)
+	assert.Equal(t, []map[string]interface{}{
+		{"amount": 12.0, "balance": 50.0},
+		{"amount": 100.0},
+		{"amount": -100.0, "label": "shop"},
+	}, kept)
+	assert.Equal(t, 2, clipped)
+	assert.Equal(t, 3, rejected)
+
+	kept, clipped, rejected = ClipRows(rows[:1], nil)
+	assert.Len(t, kept, 1)
+	assert.Equal(t, 0, clipped+rejected)
+
+	assert.Error(t, checkClipping(map[string]aggregations.Bound{"amount": {Min: &high, Max: &low}}))
+	assert.NoError(t, checkClipping(bounds))
+}
+
+func TestFindPages(t *testing.T) {
+
+	full := FindPage{Docs: make([]map[string]interface{}, 3), Bookmark: "g1AAAA"}
+	assert.False(t, full.IsLast(3, ""))
+	// The stack sends the same bookmark when there is nothing more to read
+	assert.True(t, full.IsLast(3, "g1AAAA"))
+	assert.True(t, full.IsLast(4, ""))
+	assert.True(t, FindPage{Docs: full.Docs}.IsLast(3, ""))
+
+	max := MaxRowsPerInstance
+	defer func() { MaxRowsPerInstance = max }()
+	MaxRowsPerInstance = 500
+	assert.Equal(t, 500, RowsLimit(0))
+	assert.Equal(t, 500, RowsLimit(1000))
+	assert.Equal(t, 20, RowsLimit(20))
+	MaxRowsPerInstance = 0
+	assert.Equal(t, 0, RowsLimit(0))
+	assert.Equal(t, 1000, RowsLimit(1000))
 }
@@ -2,47 +2,160 @@ package enclave
 
 import (
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/dispers/errors"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 )
 
-func decryptInputsTF(in *query.InputTF) (string, map[string][]string, error) {
+// addressBook gathers the instances of the buckets read by the Target
+// Finder. The lists of a concept only keep the domains: an instance that
+// subscribed to several concepts has got a record in each of them, and the
+// most recently refreshed record is the one kept. While the buckets of a
+// concept are split, an instance can be in two of them: it is listed once.
+type addressBook struct {
+	lists     map[string][]string
+	listed    map[string]map[string]bool
+	instances map[string]query.Instance
+}
 
-	if in.IsEncrypted {
-		// TODO: decrypt input byte and save it in in.ListsOfAddresses
+func newAddressBook() *addressBook {
+	return &addressBook{
+		lists:     make(map[string][]string),
+		listed:    make(map[string]map[string]bool),
+		instances: make(map[string]query.Instance),
 	}
+}
 
-	compressedTP := string(in.EncryptedTargetProfile)
-	if len(compressedTP) < 4 {
-		return "", nil, errors.WrapErrors(errors.ErrInvalidTargetProfile, compressedTP)
+// addConcept makes sure a concept without any bucket has got an empty list
+func (b *addressBook) addConcept(name string) {
+	if _, ok := b.lists[name]; !ok {
+		b.lists[name] = []string{}
+		b.listed[name] = make(map[string]bool)
+	}
+}
+
+// addBucket adds the instances of a bucket to the list of a concept
+func (b *addressBook) addBucket(name string, bucket []byte) error {
+
+	// TODO: decrypt the bucket
+	var instances []query.Instance
+	if err := wire.Decode(bucket, wire.TypeInstances, &instances); err != nil {
+		return errors.WrapErrors(errors.ErrUnmarshal, "")
+	}
+
+	b.addConcept(name)
+	for _, instance := range instances {
+		if !b.listed[name][instance.Domain] {
+			b.listed[name][instance.Domain] = true
+			b.lists[name] = append(b.lists[name], instance.Domain)
+		}
+		known, ok := b.instances[instance.Domain]
+		if !ok || known.TokenExpiresAt.Before(instance.TokenExpiresAt) {
+			b.instances[instance.Domain] = instance
+		}
+	}
+	return nil
+}
+
+// addresses returns the records of the given domains
+func (b *addressBook) addresses(domains []string) []query.Instance {
+	addresses := []query.Instance{}
+	for _, domain := range domains {
+		addresses = append(addresses, b.instances[domain])
+	}
+	return addresses
+}
+
+// expectDelim reads the next token of the decoder, which has to be delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return errors.WrapErrors(errors.ErrUnmarshal, "")
 	}
+	return nil
+}
+
+// readInputTF reads the Conductor's request as a stream: the buckets are
+// decoded one by one and added to the address book, so that the whole lists
+// of instances are never held twice in memory.
+func readInputTF(r io.Reader, book *addressBook) (*query.InputTF, error) {
 
-	var listOfAddresses []string
-	listsOfAddresses := make(map[string][]string)
-	for key, encryptedList := range in.EncryptedListsOfAddresses {
-		if in.IsEncrypted {
-			listOfAddresses = []string{}
-			for _, addresse := range strings.Split(string(encryptedList)[2:len(encryptedList)-2], ",") {
-				listOfAddresses = append(listOfAddresses, addresse)
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, json.Delim('{')); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
+		}
+
+		if key != "enc_buckets" {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
 			}
-			listsOfAddresses[key] = listOfAddresses
-		} else {
-			listOfAddresses = []string{}
-			// for tests only
-			strEncryptedList := strings.ReplaceAll(string(encryptedList), "}\",\"{", "},{")
-			strEncryptedList = strings.ReplaceAll(strEncryptedList, "[\"{", "[{")
-			strEncryptedList = strings.ReplaceAll(strEncryptedList, "}\"]", "}]")
-
-			for _, addresse := range strings.Split(strEncryptedList[2:len(strEncryptedList)-2], "},{") {
-				listOfAddresses = append(listOfAddresses, "{"+addresse+"}")
+			fields[key] = value
+			continue
+		}
+
+		if err := expectDelim(dec, json.Delim('{')); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			token, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := token.(string)
+			if !ok {
+				return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
+			}
+			book.addConcept(name)
+			if err := expectDelim(dec, json.Delim('[')); err != nil {
+				return nil, err
 			}
-			listsOfAddresses[key] = listOfAddresses
+			for dec.More() {
+				var bucket []byte
+				if err := dec.Decode(&bucket); err != nil {
+					return nil, err
+				}
+				if err := book.addBucket(name, bucket); err != nil {
+					return nil, err
+				}
+			}
+			if err := expectDelim(dec, json.Delim(']')); err != nil {
+				return nil, err
+			}
+		}
+		if err := expectDelim(dec, json.Delim('}')); err != nil {
+			return nil, err
 		}
 	}
 
-	return compressedTP, listsOfAddresses, nil
+	// The other fields are small
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var in query.InputTF
+	if err := json.Unmarshal(raw, &in); err != nil {
+		return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
+	}
+	return &in, nil
 }
 
 func developpTargetProfile(compressedTP string) (string, error) {
@@ -117,12 +230,65 @@ func developpTargetProfile(compressedTP string) (string, error) {
 	return secondSplit[0], nil
 }
 
-// SelectAddresses apply the target profile over lists of addresses
-func SelectAddresses(in query.InputTF) ([]string, error) {
+// dropExpired removes the instances whose token has expired. They cannot be
+// queried until they refresh their token.
+func dropExpired(addresses []query.Instance) []query.Instance {
+
+	kept := []query.Instance{}
+	for _, address := range addresses {
+		if address.IsExpired() {
+			continue
+		}
+		kept = append(kept, address)
+	}
+	return kept
+}
+
+// SelectAddresses apply the target profile over the buckets of addresses
+func SelectAddresses(in query.InputTF) ([]query.Instance, error) {
+
+	book := newAddressBook()
+	for name, buckets := range in.EncryptedBuckets {
+		book.addConcept(name)
+		for _, bucket := range buckets {
+			if err := book.addBucket(name, bucket); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return selectAddresses(&in, book)
+}
+
+// SelectAddressesFromStream reads the Conductor's request bucket by bucket
+// and apply the target profile. It returns the request without its buckets.
+// The request is read to its end before anything is done with it, since the
+// signature of a streamed request is checked at the end of its body.
+func SelectAddressesFromStream(r io.Reader) (*query.InputTF, []query.Instance, error) {
 
-	compressedTP, listsOfAddresses, err := decryptInputsTF(&in)
+	book := newAddressBook()
+	in, err := readInputTF(r, book)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, nil, err
+	}
+	finalList, err := selectAddresses(in, book)
+	return in, finalList, err
+}
+
+func selectAddresses(in *query.InputTF, book *addressBook) ([]query.Instance, error) {
+
+	if in.IsEncrypted {
+		// TODO: decrypt the target profile
+	}
+
+	var compressedTP string
+	if err := wire.Decode(in.EncryptedTargetProfile, wire.TypeTargetProfile, &compressedTP); err != nil {
+		return nil, errors.WrapErrors(errors.ErrInvalidTargetProfile, "")
+	}
+	if len(compressedTP) < 4 {
+		return nil, errors.WrapErrors(errors.ErrInvalidTargetProfile, compressedTP)
 	}
 
 	// Translate string target profile to OperationTree
@@ -135,13 +301,22 @@ func SelectAddresses(in query.InputTF) ([]string, error) {
 		return nil, errors.WrapErrors(errors.ErrUnmarshal, "")
 	}
 
-	finalList, err := targetProfile.Compute(listsOfAddresses)
+	// The target profile is computed over the domains, since the records of
+	// an instance can differ from one concept to another
+	domains, err := targetProfile.Compute(book.lists)
 	if err != nil {
 		return nil, errors.WrapErrors(errors.ErrComputeTargetProfile, "")
 	}
+	finalList, err := dropStale(dropExpired(book.addresses(domains)), in.EncryptedStale)
+	if err != nil {
+		return nil, err
+	}
 	if len(finalList) == 0 {
 		return nil, errors.WrapErrors(errors.ErrNoTargets, "")
 	}
+	if in.MaxTargets > 0 && len(finalList) > in.MaxTargets {
+		return nil, errors.WrapErrors(errors.ErrTooManyTargets, "")
+	}
 	// TODO: Encrypt final list
 
 	return finalList, nil
@@ -1,10 +1,14 @@
 package enclave
 
 import (
+	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/subscribe"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -76,43 +80,152 @@ func TestMarshalUnmarshalOperationTree(t *testing.T) {
 
 }
 
+// bucketsOf splits the instances of each concept into two buckets
+func bucketsOf(m map[string][]string, expiresAt time.Time) map[string][][]byte {
+	encBuckets := make(map[string][][]byte)
+	for key, domains := range m {
+		buckets := make([][]query.Instance, 2)
+		for _, domain := range domains {
+			bucket := subscribe.BucketOf(domain, 2)
+			buckets[bucket] = append(buckets[bucket], query.Instance{
+				Domain:         domain,
+				TokenBearer:    key + domain,
+				TokenExpiresAt: expiresAt,
+			})
+		}
+		for _, bucket := range buckets {
+			encBucket, _ := wire.Encode(wire.TypeInstances, bucket)
+			encBuckets[key] = append(encBuckets[key], encBucket)
+		}
+	}
+	return encBuckets
+}
+
+func domainsOf(addresses []query.Instance) []string {
+	domains := []string{}
+	for _, address := range addresses {
+		domains = append(domains, address.Domain)
+	}
+	return domains
+}
+
+func profile(tp string) []byte {
+	encTP, _ := wire.Encode(wire.TypeTargetProfile, tp)
+	return encTP
+}
+
 func TestTargetFinder(t *testing.T) {
 
 	m := make(map[string][]string)
-	encLoA := make(map[string][]byte)
-	m["test1"] = []string{"{joel}", "{claire}", "{caroline}", "{françois}"}
-	m["test2"] = []string{"{paul}", "{claire}", "{françois}"}
-	m["test3"] = []string{"{paul}", "{claire}", "{françois}"}
-	m["test4"] = []string{"{paul}", "{benjamin}", "{florent}"}
-	for key, list := range m {
-		encList, _ := json.Marshal(list)
-		encLoA[key] = encList
-	}
+	m["test1"] = []string{"joel", "claire", "caroline", "françois"}
+	m["test2"] = []string{"paul", "claire", "françois"}
+	m["test3"] = []string{"paul", "claire", "françois"}
+	m["test4"] = []string{"paul", "benjamin", "florent"}
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	encBuckets := bucketsOf(m, expiresAt)
 
 	in := query.InputTF{
-		IsEncrypted:               false,
-		EncryptedListsOfAddresses: encLoA,
-		EncryptedTargetProfile:    []byte("OR(AND(\"test1\",\"test2\")AND(\"test3\",\"test4\"))"),
+		IsEncrypted:            false,
+		EncryptedBuckets:       encBuckets,
+		EncryptedTargetProfile: profile("OR(AND(\"test1\",\"test2\")AND(\"test3\",\"test4\"))"),
 	}
 	out, err := SelectAddresses(in)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"{claire}", "{françois}", "{paul}"}, out)
+	assert.ElementsMatch(t, []string{"claire", "françois", "paul"}, domainsOf(out))
 
 	in = query.InputTF{
-		IsEncrypted:               false,
-		EncryptedListsOfAddresses: encLoA,
-		EncryptedTargetProfile:    []byte("AND(OR(\"test1\",\"test2\")OR(\"test3\",\"test7\"))"),
+		IsEncrypted:            false,
+		EncryptedBuckets:       encBuckets,
+		EncryptedTargetProfile: profile("AND(OR(\"test1\",\"test2\")OR(\"test3\",\"test7\"))"),
 	}
 	_, err = SelectAddresses(in)
 	assert.Error(t, err)
 
 	in = query.InputTF{
-		IsEncrypted:               false,
-		EncryptedListsOfAddresses: encLoA,
-		EncryptedTargetProfile:    []byte("\"test4\""),
+		IsEncrypted:            false,
+		EncryptedBuckets:       encBuckets,
+		EncryptedTargetProfile: profile("\"test4\""),
 	}
 	out, err = SelectAddresses(in)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"{paul}", "{benjamin}", "{florent}"}, out)
+	assert.ElementsMatch(t, []string{"paul", "benjamin", "florent"}, domainsOf(out))
+
+	// An instance is selected once, with its latest record, even if its
+	// records differ from one concept to another
+	in.EncryptedTargetProfile = profile("AND(\"test2\",\"test3\")")
+	later := bucketsOf(map[string][]string{"test3": m["test3"]}, expiresAt.Add(time.Hour))
+	in.EncryptedBuckets = map[string][][]byte{"test2": encBuckets["test2"], "test3": later["test3"]}
+	out, err = SelectAddresses(in)
+	assert.NoError(t, err)
+	assert.Len(t, out, 3)
+	for _, address := range out {
+		assert.Equal(t, "test3"+address.Domain, address.TokenBearer)
+	}
+
+	// The Target Finder reads the request bucket by bucket
+	in.EncryptedTargetProfile = profile("OR(\"test1\",\"test4\")")
+	in.EncryptedBuckets = encBuckets
+	in.MaxTargets = 10
+	body, _ := json.Marshal(in)
+	read, out, err := SelectAddressesFromStream(bytes.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, read.MaxTargets)
+	assert.Nil(t, read.EncryptedBuckets)
+	assert.ElementsMatch(t, []string{"joel", "claire", "caroline", "françois", "paul", "benjamin", "florent"}, domainsOf(out))
+
+	// While the buckets of a concept are split, an instance can be in two
+	// buckets
+	in.EncryptedTargetProfile = profile("\"test2\"")
+	in.EncryptedBuckets = map[string][][]byte{"test2": append(encBuckets["test2"], encBuckets["test2"]...)}
+	out, err = SelectAddresses(in)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"paul", "claire", "françois"}, domainsOf(out))
 
 }
+
+func TestDropExpired(t *testing.T) {
+
+	valid := query.Instance{
+		Domain:         "joel.mycozy.cloud",
+		TokenExpiresAt: time.Now().Add(time.Hour),
+	}
+	expired := query.Instance{
+		Domain:         "claire.mycozy.cloud",
+		TokenExpiresAt: time.Now().Add(-time.Hour),
+	}
+	withoutExpiry := query.Instance{
+		Domain: "paul.mycozy.cloud",
+	}
+
+	out := dropExpired([]query.Instance{valid, expired, withoutExpiry})
+	assert.Equal(t, []query.Instance{valid, withoutExpiry}, out)
+}
+
+func TestDropStale(t *testing.T) {
+
+	joel := query.Instance{Domain: "joel.mycozy.cloud", Version: 1}
+	claire := query.Instance{Domain: "claire.mycozy.cloud", Version: 2}
+	paul := query.Instance{Domain: "paul.mycozy.cloud", Version: 1}
+
+	// Paul has refreshed his token since his mark
+	marks := [][]byte{}
+	for _, stale := range []query.Instance{
+		{Domain: "claire.mycozy.cloud", Version: 2},
+		{Domain: "paul.mycozy.cloud", Version: 0},
+	} {
+		mark, err := wire.Encode(wire.TypeInstance, stale)
+		assert.NoError(t, err)
+		marks = append(marks, mark)
+	}
+
+	out, err := dropStale([]query.Instance{joel, claire, paul}, marks)
+	assert.NoError(t, err)
+	assert.Equal(t, []query.Instance{joel, paul}, out)
+
+	out, err = dropStale([]query.Instance{joel}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []query.Instance{joel}, out)
+
+	_, err = dropStale([]query.Instance{joel}, [][]byte{[]byte("garbage")})
+	assert.Error(t, err)
+}
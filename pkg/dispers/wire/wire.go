@@ -0,0 +1,204 @@
+// Package wire defines the envelope of the payloads exchanged between the
+// actors of Cozy-DISPERS: every Encrypted* field holds an envelope. An
+// envelope starts with a header giving the version of the format and the type
+// of the message, followed by the CBOR encoding of the message.
+//
+// The payloads written before the envelopes existed (JSON documents, or raw
+// text for the target profiles) are read as the version 0 of the format.
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"strconv"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Type is the type of the message carried by an envelope
+type Type byte
+
+const (
+	// TypeInstances is a list of instances ([]query.Instance): the buckets of
+	// the subscribers of a concept, or the targets of a query
+	TypeInstances Type = iota + 1
+	// TypeInstance is an instance subscribing or leaving (query.Instance)
+	TypeInstance
+	// TypeRefreshedInstance is an instance rotating its token
+	// (subscribe.RefreshedInstance)
+	TypeRefreshedInstance
+	// TypeLocalQuery is the query made on each target (query.LocalQuery)
+	TypeLocalQuery
+	// TypeTargetProfile is the target profile of a query (string)
+	TypeTargetProfile
+	// TypeJobs are the jobs of a layer of Data Aggregators
+	// ([]query.AggregationJob)
+	TypeJobs
+	// TypeData is the data given to a Data Aggregator
+	// ([]map[string]interface{})
+	TypeData
+	// TypeShares are the additive shares of the rows given to a Data
+	// Aggregator of a layer with secret sharing ([]sharing.Share)
+	TypeShares
+)
+
+var typeNames = map[Type]string{
+	TypeInstances:         "instances",
+	TypeInstance:          "instance",
+	TypeRefreshedInstance: "refreshed_instance",
+	TypeLocalQuery:        "local_query",
+	TypeTargetProfile:     "target_profile",
+	TypeJobs:              "jobs",
+	TypeData:              "data",
+	TypeShares:            "shares",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "unknown(" + strconv.Itoa(int(t)) + ")"
+}
+
+const (
+	// Version is the version of the envelopes written by this actor
+	Version byte = 1
+
+	// MediaType is the content type of the requests between actors. Their
+	// bodies are JSON, only the payloads inside them are envelopes. Its
+	// version parameter is the version of the envelopes in the request.
+	MediaType = "application/vnd.cozy-dispers+json"
+
+	// legacyMediaType is the content type of the requests made by the actors
+	// that do not know the envelopes
+	legacyMediaType = "application/json"
+
+	headerLength = 6
+)
+
+var (
+	// ContentType is declared on every request made to another actor
+	ContentType = fmt.Sprintf("%s; version=%d", MediaType, Version)
+
+	// magic cannot start a JSON document, so that the payloads written before
+	// the envelopes are recognized
+	magic = []byte{0x00, 'D', 'S', 'P'}
+
+	handle = newHandle()
+
+	// ErrBadEnvelope is returned when a payload cannot be read
+	ErrBadEnvelope = errors.New("The payload is not a valid envelope")
+	// ErrUnsupportedVersion is returned when a payload or a request has been
+	// written with a version of the format this actor does not know
+	ErrUnsupportedVersion = errors.New("The version of the envelope is not supported")
+	// ErrWrongType is returned when an envelope does not carry the type of
+	// message expected by the reader
+	ErrWrongType = errors.New("The envelope does not carry the expected message")
+	// ErrUnsupportedMediaType is returned when a request from another actor
+	// declares a content type that is neither MediaType nor JSON
+	ErrUnsupportedMediaType = errors.New("The content type of the request is not supported")
+)
+
+func newHandle() *codec.CborHandle {
+	h := &codec.CborHandle{}
+	// The data of the Data Aggregators are read as JSON documents
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
+// Encode wraps the message in an envelope of the given type
+func Encode(t Type, message interface{}) ([]byte, error) {
+
+	var payload []byte
+	if err := codec.NewEncoderBytes(&payload, handle).Encode(message); err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, headerLength+len(payload))
+	envelope = append(envelope, magic...)
+	envelope = append(envelope, Version, byte(t))
+	return append(envelope, payload...), nil
+}
+
+// Peek returns the type and the version of an envelope. A payload written
+// before the envelopes existed has got the version 0 and no type.
+func Peek(envelope []byte) (Type, byte, error) {
+
+	if !bytes.HasPrefix(envelope, magic) {
+		return 0, 0, nil
+	}
+	if len(envelope) < headerLength {
+		return 0, 0, ErrBadEnvelope
+	}
+	version := envelope[len(magic)]
+	if version == 0 || version > Version {
+		return 0, version, ErrUnsupportedVersion
+	}
+	return Type(envelope[len(magic)+1]), version, nil
+}
+
+// Decode reads the message of an envelope of the given type
+func Decode(envelope []byte, t Type, message interface{}) error {
+
+	typ, version, err := Peek(envelope)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return decodeLegacy(envelope, message)
+	}
+	if typ != t {
+		return ErrWrongType
+	}
+
+	dec := codec.NewDecoderBytes(envelope[headerLength:], handle)
+	if err := dec.Decode(message); err != nil {
+		return ErrBadEnvelope
+	}
+	return nil
+}
+
+// decodeLegacy reads a payload of the version 0
+func decodeLegacy(payload []byte, message interface{}) error {
+
+	// The target profiles were written as raw text, even when the text is a
+	// valid JSON string, like the profile "concept"
+	if text, ok := message.(*string); ok {
+		*text = string(payload)
+		return nil
+	}
+	if err := json.Unmarshal(payload, message); err != nil {
+		return ErrBadEnvelope
+	}
+	return nil
+}
+
+// CheckContentType returns an error if a request from another actor has been
+// made with envelopes this actor cannot read. The actors that do not declare
+// the version of their envelopes send JSON documents, read as the version 0.
+// Any other content type is refused.
+func CheckContentType(contentType string) error {
+
+	if contentType == "" {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ErrUnsupportedMediaType
+	}
+	if mediaType == legacyMediaType {
+		return nil
+	}
+	if mediaType != MediaType {
+		return ErrUnsupportedMediaType
+	}
+	version, err := strconv.Atoi(params["version"])
+	if err != nil || version < 0 || version > int(Version) {
+		return ErrUnsupportedVersion
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package wire
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/subscribe"
+	"github.com/stretchr/testify/assert"
+)
+
+var instance = query.Instance{
+	Domain:         "joel.mycozy.cloud",
+	TokenBearer:    "hfeuziyeurbyuilrz",
+	TokenExpiresAt: time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC),
+	Version:        2,
+}
+
+func TestInstances(t *testing.T) {
+
+	instances := []query.Instance{instance, query.Instance{Domain: "paul.mycozy.cloud"}}
+	envelope, err := Encode(TypeInstances, instances)
+	assert.NoError(t, err)
+
+	typ, version, err := Peek(envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, TypeInstances, typ)
+	assert.Equal(t, Version, version)
+
+	var decoded []query.Instance
+	assert.NoError(t, Decode(envelope, TypeInstances, &decoded))
+	assert.Len(t, decoded, 2)
+	assert.Equal(t, instance.Domain, decoded[0].Domain)
+	assert.Equal(t, instance.TokenBearer, decoded[0].TokenBearer)
+	assert.True(t, instance.TokenExpiresAt.Equal(decoded[0].TokenExpiresAt))
+	assert.Equal(t, instance.Version, decoded[0].Version)
+	assert.Equal(t, "paul.mycozy.cloud", decoded[1].Domain)
+}
+
+func TestInstance(t *testing.T) {
+
+	envelope, err := Encode(TypeInstance, instance)
+	assert.NoError(t, err)
+	var decoded query.Instance
+	assert.NoError(t, Decode(envelope, TypeInstance, &decoded))
+	assert.Equal(t, instance.Domain, decoded.Domain)
+	assert.Equal(t, instance.TokenBearer, decoded.TokenBearer)
+}
+
+func TestRefreshedInstance(t *testing.T) {
+
+	refreshed := subscribe.RefreshedInstance{
+		Instance:            instance,
+		PreviousTokenBearer: "nreuizonfezio",
+	}
+	envelope, err := Encode(TypeRefreshedInstance, refreshed)
+	assert.NoError(t, err)
+	var decoded subscribe.RefreshedInstance
+	assert.NoError(t, Decode(envelope, TypeRefreshedInstance, &decoded))
+	assert.Equal(t, instance.Domain, decoded.Domain)
+	assert.Equal(t, "nreuizonfezio", decoded.PreviousTokenBearer)
+}
+
+func TestLocalQuery(t *testing.T) {
+
+	localQuery := query.LocalQuery{
+		Doctype: "io.cozy.bank.operations",
+		FindRequest: query.FindParams{
+			Selector: map[string]interface{}{"cozyCategoryId": "400340"},
+		},
+	}
+	envelope, err := Encode(TypeLocalQuery, localQuery)
+	assert.NoError(t, err)
+	var decoded query.LocalQuery
+	assert.NoError(t, Decode(envelope, TypeLocalQuery, &decoded))
+	assert.Equal(t, localQuery.Doctype, decoded.Doctype)
+	assert.Equal(t, localQuery.FindRequest.Selector, decoded.FindRequest.Selector)
+}
+
+func TestTargetProfile(t *testing.T) {
+
+	profile := "OR(\"test1\",\"test2\")"
+	envelope, err := Encode(TypeTargetProfile, profile)
+	assert.NoError(t, err)
+	var decoded string
+	assert.NoError(t, Decode(envelope, TypeTargetProfile, &decoded))
+	assert.Equal(t, profile, decoded)
+}
+
+func TestJobs(t *testing.T) {
+
+	jobs := []query.AggregationJob{query.AggregationJob{
+		Job:  "sum",
+		Args: map[string]interface{}{"key": "sepal_length"},
+	}}
+	envelope, err := Encode(TypeJobs, jobs)
+	assert.NoError(t, err)
+	var decoded []query.AggregationJob
+	assert.NoError(t, Decode(envelope, TypeJobs, &decoded))
+	assert.Equal(t, jobs, decoded)
+}
+
+func TestData(t *testing.T) {
+
+	data := []map[string]interface{}{
+		map[string]interface{}{"sepal_length": 5.1, "species": "setosa"},
+		map[string]interface{}{"sepal_length": 4.9, "nested": map[string]interface{}{"a": 1.5}},
+	}
+	envelope, err := Encode(TypeData, data)
+	assert.NoError(t, err)
+	var decoded []map[string]interface{}
+	assert.NoError(t, Decode(envelope, TypeData, &decoded))
+	assert.Equal(t, data, decoded)
+}
+
+func TestWrongTypeAndVersion(t *testing.T) {
+
+	envelope, err := Encode(TypeInstance, instance)
+	assert.NoError(t, err)
+	var instances []query.Instance
+	assert.Equal(t, ErrWrongType, Decode(envelope, TypeInstances, &instances))
+
+	envelope[len(magic)] = Version + 1
+	var decoded query.Instance
+	assert.Equal(t, ErrUnsupportedVersion, Decode(envelope, TypeInstance, &decoded))
+
+	assert.Equal(t, ErrBadEnvelope, Decode(magic, TypeInstance, &decoded))
+}
+
+func TestLegacyPayloads(t *testing.T) {
+
+	payload, _ := json.Marshal([]query.Instance{instance})
+	var instances []query.Instance
+	assert.NoError(t, Decode(payload, TypeInstances, &instances))
+	assert.Equal(t, instance.Domain, instances[0].Domain)
+
+	var profile string
+	assert.NoError(t, Decode([]byte("AND(\"test1\",\"test2\")"), TypeTargetProfile, &profile))
+	assert.Equal(t, "AND(\"test1\",\"test2\")", profile)
+
+	// A profile made of a single concept is a valid JSON string
+	assert.NoError(t, Decode([]byte("\"test1\""), TypeTargetProfile, &profile))
+	assert.Equal(t, "\"test1\"", profile)
+
+	assert.Equal(t, ErrBadEnvelope, Decode([]byte("{joel}"), TypeInstances, &instances))
+}
+
+func TestCheckContentType(t *testing.T) {
+
+	assert.NoError(t, CheckContentType(""))
+	assert.NoError(t, CheckContentType("application/json"))
+	assert.NoError(t, CheckContentType("application/json; charset=UTF-8"))
+	assert.NoError(t, CheckContentType(ContentType))
+	assert.NoError(t, CheckContentType(MediaType+"; version=0"))
+	assert.Equal(t, ErrUnsupportedVersion, CheckContentType(MediaType+"; version=99"))
+	assert.Equal(t, ErrUnsupportedVersion, CheckContentType(MediaType))
+	assert.Equal(t, ErrUnsupportedMediaType, CheckContentType("text/plain"))
+	assert.Equal(t, ErrUnsupportedMediaType, CheckContentType("application/vnd.cozy-dispers+cbor; version=1"))
+	assert.Equal(t, ErrUnsupportedMediaType, CheckContentType("application/"))
+}
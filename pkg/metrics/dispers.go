@@ -0,0 +1,43 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// DispersPayloadBytes is a histogram metric of the sizes in bytes of the
+// payloads exchanged with other Cozy-DISPERS actors, before compression,
+// labelled by the role of the other actor and the direction.
+var DispersPayloadBytes = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dispers",
+		Subsystem: "payload",
+		Name:      "bytes",
+
+		Help: "Sizes in bytes of the payloads exchanged with other actors, before compression, labelled by role and direction.",
+
+		// From 256B to 64MB
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	},
+	[]string{"role", "direction"},
+)
+
+// DispersPayloadWireBytes is a histogram metric of the sizes in bytes of the
+// payloads exchanged with other Cozy-DISPERS actors, as sent on the wire,
+// labelled by the role of the other actor and the direction.
+var DispersPayloadWireBytes = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dispers",
+		Subsystem: "payload",
+		Name:      "wire_bytes",
+
+		Help: "Sizes in bytes of the payloads exchanged with other actors, as sent on the wire, labelled by role and direction.",
+
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	},
+	[]string{"role", "direction"},
+)
+
+func init() {
+	prometheus.MustRegister(
+		DispersPayloadBytes,
+		DispersPayloadWireBytes,
+	)
+}
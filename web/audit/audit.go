@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/audit"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/echo"
+)
+
+func intParam(c echo.Context, name string) (int, error) {
+	param := c.QueryParam(name)
+	if param == "" {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, jsonapi.InvalidParameter(name, err)
+	}
+	if value < 0 {
+		return 0, jsonapi.InvalidParameter(name, errors.New("should be positive"))
+	}
+	return value, nil
+}
+
+// exportChain returns the entries of the audit log, starting at the index
+// given by the "since" parameter. They can be verified offline with
+// `cozy-dispers audit verify`.
+func exportChain(c echo.Context) error {
+
+	since, err := intParam(c, "since")
+	if err != nil {
+		return err
+	}
+	limit, err := intParam(c, "limit")
+	if err != nil {
+		return err
+	}
+
+	entries, err := audit.Export(since, limit)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// getKey returns the public key verifying the signatures of the entries
+func getKey(c echo.Context) error {
+
+	if audit.SigningKey == nil {
+		return jsonapi.NotFound(errors.New("The entries are not signed"))
+	}
+	key, err := audit.MarshalPublicKey(&audit.SigningKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/x-pem-file", key)
+}
+
+// Routes sets the routing for the Conductor's audit log. The log is public so
+// that the users can know what has been asked about them.
+func Routes(router *echo.Group) {
+
+	router.GET("", exportChain)
+	router.GET("/key", getKey)
+}
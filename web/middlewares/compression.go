@@ -0,0 +1,46 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/echo"
+)
+
+// Decompress reads the compressed bodies of the requests made by other
+// Cozy-DISPERS actors. The Accept-Encoding header of the responses tells the
+// actors they can compress their next requests (RFC 7694).
+//
+// A decompressed body is limited to network.MaxPayloadSize, like an
+// uncompressed one, or to network.MaxStreamedPayloadSize for the bodies
+// streamed by the actors, which are sent without a length.
+//
+// It has to run before VerifySignature, since the signature covers the
+// uncompressed body.
+func Decompress(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderAcceptEncoding, network.EncodingGzip)
+
+		req := c.Request()
+		switch req.Header.Get(echo.HeaderContentEncoding) {
+		case "", "identity":
+		case network.EncodingGzip:
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			maxSize := network.MaxPayloadSize
+			if req.ContentLength < 0 {
+				maxSize = network.MaxStreamedPayloadSize
+			}
+			req.Body = http.MaxBytesReader(c.Response(), zr, maxSize)
+			req.Header.Del(echo.HeaderContentEncoding)
+			req.ContentLength = -1
+		default:
+			return echo.NewHTTPError(http.StatusUnsupportedMediaType, "unsupported content encoding")
+		}
+
+		return next(c)
+	}
+}
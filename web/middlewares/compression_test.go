@@ -0,0 +1,64 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecompress(t *testing.T) {
+
+	var received []byte
+	var readErr error
+	read := func(c echo.Context) error {
+		received, readErr = ioutil.ReadAll(c.Request().Body)
+		return c.NoContent(http.StatusOK)
+	}
+	h := Decompress(read)
+	e := echo.New()
+
+	body := []byte("{\"enc_data\":\"c2VwYWxfbGVuZ3Ro\"}")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+
+	req, _ := http.NewRequest(echo.POST, "https://dispers.local/dispers/dataaggregator/aggregation", &buf)
+	req.Header.Set(echo.HeaderContentEncoding, "gzip")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, body, received)
+	assert.Equal(t, "gzip", rec.Header().Get(echo.HeaderAcceptEncoding))
+
+	req, _ = http.NewRequest(echo.POST, "https://dispers.local/dispers/dataaggregator/aggregation", bytes.NewReader(body))
+	assert.NoError(t, h(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(t, body, received)
+
+	// A small compressed body cannot be decompressed beyond the size of the
+	// largest payload
+	previous := network.MaxPayloadSize
+	network.MaxPayloadSize = int64(len(body)) - 1
+	defer func() { network.MaxPayloadSize = previous }()
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+	req, _ = http.NewRequest(echo.POST, "https://dispers.local/dispers/dataaggregator/aggregation", &buf)
+	req.Header.Set(echo.HeaderContentEncoding, "gzip")
+	assert.NoError(t, h(e.NewContext(req, httptest.NewRecorder())))
+	assert.Error(t, readErr)
+	assert.Equal(t, body[:len(body)-1], received)
+
+	req, _ = http.NewRequest(echo.POST, "https://dispers.local/dispers/dataaggregator/aggregation", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentEncoding, "br")
+	err := h(e.NewContext(req, httptest.NewRecorder()))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnsupportedMediaType, err.(*echo.HTTPError).Code)
+}
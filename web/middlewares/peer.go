@@ -0,0 +1,100 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
+	"github.com/cozy/echo"
+)
+
+func hasRole(role string, roles []string) bool {
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowPeers checks that the request has been made by another Cozy-DISPERS
+// actor playing one of the given roles. The role of the caller is read in the
+// organizational units of the client certificate verified during the TLS
+// handshake.
+//
+// When requests between actors are signed, the request must also have been
+// signed by a known actor playing one of the given roles (see
+// VerifySignature).
+//
+// When this actor has no certificate configured, the server does not listen
+// over TLS and the check of the certificate is skipped.
+//
+// The request is refused if it has been made with a version of the wire
+// format this actor cannot read.
+func AllowPeers(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := wire.CheckContentType(c.Request().Header.Get(echo.HeaderContentType)); err != nil {
+				return echo.NewHTTPError(http.StatusUnsupportedMediaType, err.Error())
+			}
+
+			if config.GetConfig().Dispers.SigningEnabled() {
+				actor, ok := GetSignedBy(c)
+				if !ok {
+					return echo.NewHTTPError(http.StatusUnauthorized, "missing signature")
+				}
+				if !hasRole(network.SignatureRoles[actor], roles) {
+					return echo.NewHTTPError(http.StatusForbidden, "this actor is not allowed to call this route")
+				}
+			}
+
+			if !config.GetConfig().Dispers.TLSEnabled() {
+				return next(c)
+			}
+
+			state := c.Request().TLS
+			if state == nil || len(state.VerifiedChains) == 0 {
+				return echo.NewHTTPError(http.StatusUnauthorized, "missing client certificate")
+			}
+
+			cert := state.VerifiedChains[0][0]
+			for _, unit := range cert.Subject.OrganizationalUnit {
+				if hasRole(unit, roles) {
+					return next(c)
+				}
+			}
+
+			return echo.NewHTTPError(http.StatusForbidden, "this actor is not allowed to call this route")
+		}
+	}
+}
+
+// IsPeer returns true if the request has been made by the actor reachable at
+// the given host: the actor that signed the request when requests between
+// actors are signed, or the one whose client certificate has been verified
+// during the TLS handshake. The role of the actor has to be checked by
+// AllowPeers.
+//
+// When the actors neither sign their requests nor have certificates, nothing
+// tells who made the request and any host is accepted.
+func IsPeer(c echo.Context, host string) bool {
+	if config.GetConfig().Dispers.SigningEnabled() {
+		actor, ok := GetSignedBy(c)
+		return ok && actor == host
+	}
+
+	if !config.GetConfig().Dispers.TLSEnabled() {
+		return true
+	}
+
+	state := c.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return false
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return state.VerifiedChains[0][0].VerifyHostname(host) == nil
+}
@@ -0,0 +1,113 @@
+package middlewares
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowPeers(t *testing.T) {
+	config.UseTestFile()
+	config.GetConfig().Dispers.CertificateFile = "/cert.pem"
+	config.GetConfig().Dispers.KeyFile = "/key.pem"
+	defer func() {
+		config.GetConfig().Dispers.CertificateFile = ""
+		config.GetConfig().Dispers.KeyFile = ""
+	}()
+
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	h := AllowPeers("conductor")(ok)
+
+	e := echo.New()
+	req, _ := http.NewRequest(echo.POST, "https://dispers.local/dispers/target/query", nil)
+	err := h(e.NewContext(req, httptest.NewRecorder()))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+
+	peer := func(unit string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{OrganizationalUnit: []string{unit}}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	req.TLS = peer("dataaggregator")
+	err = h(e.NewContext(req, httptest.NewRecorder()))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+
+	req.TLS = peer("conductor")
+	rec := httptest.NewRecorder()
+	err = h(e.NewContext(req, rec))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAllowSignedPeers(t *testing.T) {
+	config.UseTestFile()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	conf := &config.GetConfig().Dispers
+	conf.SignatureName = "target.dispers.local"
+	conf.SignatureKeys = map[string][]byte{"da.dispers.local": key}
+	network.SignatureKeys = conf.SignatureKeys
+	network.SignatureRoles = map[string]string{"da.dispers.local": network.RoleDA}
+	defer func() {
+		conf.SignatureName = ""
+		conf.SignatureKeys = nil
+		network.SignatureKeys = map[string][]byte{}
+		network.SignatureRoles = map[string]string{}
+	}()
+
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e := echo.New()
+	signedBy := func(actor string) echo.Context {
+		req, _ := http.NewRequest(echo.PATCH, "https://conductor.dispers.local/dispers/query/abc", nil)
+		c := e.NewContext(req, httptest.NewRecorder())
+		c.Set(contextSignedBy, actor)
+		return c
+	}
+
+	// A DA holding a key cannot call the routes of the Conductor
+	err := AllowPeers(network.IdentityConductor)(ok)(signedBy("da.dispers.local"))
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+
+	assert.NoError(t, AllowPeers(network.RoleT, network.RoleDA)(ok)(signedBy("da.dispers.local")))
+}
+
+func TestIsPeer(t *testing.T) {
+	config.UseTestFile()
+	conf := &config.GetConfig().Dispers
+	e := echo.New()
+	req, _ := http.NewRequest(echo.PATCH, "https://conductor.dispers.local/dispers/query/abc", nil)
+
+	// Without signatures nor certificates, nothing tells who made the request
+	assert.True(t, IsPeer(e.NewContext(req, httptest.NewRecorder()), "da.dispers.local"))
+
+	conf.CertificateFile = "/cert.pem"
+	conf.KeyFile = "/key.pem"
+	cert := &x509.Certificate{DNSNames: []string{"da.dispers.local"}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	assert.True(t, IsPeer(e.NewContext(req, httptest.NewRecorder()), "da.dispers.local:8008"))
+	assert.False(t, IsPeer(e.NewContext(req, httptest.NewRecorder()), "da2.dispers.local"))
+
+	conf.SignatureName = "conductor.dispers.local"
+	conf.SignatureKeys = map[string][]byte{"da.dispers.local": []byte("0123456789abcdef0123456789abcdef")}
+	defer func() {
+		conf.CertificateFile = ""
+		conf.KeyFile = ""
+		conf.SignatureName = ""
+		conf.SignatureKeys = nil
+	}()
+	c := e.NewContext(req, httptest.NewRecorder())
+	assert.False(t, IsPeer(c, "da.dispers.local"))
+	c.Set(contextSignedBy, "da.dispers.local")
+	assert.True(t, IsPeer(c, "da.dispers.local"))
+	assert.False(t, IsPeer(c, "da2.dispers.local"))
+}
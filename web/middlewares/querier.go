@@ -0,0 +1,47 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/dispers/querier"
+	"github.com/cozy/echo"
+)
+
+// contextQuerier is the echo.Context key holding the authenticated querier
+const contextQuerier = "dispers_querier"
+
+// devQuerier is used in development mode when no token is given
+var devQuerier = &querier.QuerierDoc{Name: "dev", IsAdmin: true}
+
+// RequireQuerier authenticates the querier with the bearer token given in the
+// Authorization header. In development mode, requests without token are made
+// on behalf of an admin querier.
+func RequireQuerier(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		if header == "" && config.GetConfig().DevMode {
+			c.Set(contextQuerier, devQuerier)
+			return next(c)
+		}
+
+		if !strings.HasPrefix(header, "Bearer ") {
+			return echo.NewHTTPError(http.StatusUnauthorized, "missing bearer token")
+		}
+
+		q, err := querier.Authenticate(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			return err
+		}
+
+		c.Set(contextQuerier, q)
+		return next(c)
+	}
+}
+
+// GetQuerier returns the querier authenticated by RequireQuerier
+func GetQuerier(c echo.Context) *querier.QuerierDoc {
+	q, _ := c.Get(contextQuerier).(*querier.QuerierDoc)
+	return q
+}
@@ -0,0 +1,83 @@
+package middlewares
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/echo"
+)
+
+// contextSignedBy is the echo.Context key holding the name of the actor that
+// signed the request
+const contextSignedBy = "dispers_signed_by"
+
+// VerifySignature checks the signature of the requests made by other
+// Cozy-DISPERS actors. A request carrying an invalid, stale or replayed
+// signature is rejected. Unsigned requests go through, and it is up to
+// AllowPeers to reject them on the routes reserved to the actors.
+func VerifySignature(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !config.GetConfig().Dispers.SigningEnabled() {
+			return next(c)
+		}
+
+		req := c.Request()
+		if req.Header.Get(network.HeaderSignature) == "" {
+			return next(c)
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, network.MaxPayloadSize+1))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if int64(len(body)) > network.MaxPayloadSize {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "the body of the request is too large")
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		actor, err := network.VerifyRequest(req, body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		}
+
+		c.Set(contextSignedBy, actor)
+		return next(c)
+	}
+}
+
+// VerifyStreamedSignature checks the signature of the requests whose body is
+// streamed by other Cozy-DISPERS actors (see network.MakeStreamRequest). The
+// signature is only known at the end of the body: reading the body to its end
+// fails if the signature is invalid, so the handler has to read the whole body
+// before acting. It has to run before AllowPeers.
+func VerifyStreamedSignature(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !config.GetConfig().Dispers.SigningEnabled() {
+			return next(c)
+		}
+
+		req := c.Request()
+		if req.Header.Get(network.HeaderActor) == "" || req.Header.Get(network.HeaderSignature) != "" {
+			return next(c)
+		}
+
+		req.Body = http.MaxBytesReader(c.Response(), req.Body, network.MaxStreamedPayloadSize)
+		actor, err := network.VerifyStreamedRequest(req)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		}
+
+		c.Set(contextSignedBy, actor)
+		return next(c)
+	}
+}
+
+// GetSignedBy returns the name of the actor that signed the request, if any
+func GetSignedBy(c echo.Context) (string, bool) {
+	actor, ok := c.Get(contextSignedBy).(string)
+	return actor, ok
+}
@@ -0,0 +1,80 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/dispers/querier"
+	"github.com/cozy/echo"
+)
+
+// InputQuerier describes a new querier and its scopes
+type InputQuerier struct {
+	Name     string   `json:"name"`
+	IsAdmin  bool     `json:"admin,omitempty"`
+	Doctypes []string `json:"doctypes,omitempty"`
+	Jobs     []string `json:"jobs,omitempty"`
+	// Quotas overrides the default quotas of the Conductor
+	Quotas *querier.Quotas `json:"quotas,omitempty"`
+}
+
+func createQuerier(c echo.Context) error {
+
+	var in InputQuerier
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+
+	q, err := querier.NewQuerier(in.Name, in.IsAdmin, in.Doctypes, in.Jobs, in.Quotas)
+	if err != nil {
+		return err
+	}
+
+	token, err := q.NewToken()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, echo.Map{
+		"ok":         true,
+		"querier_id": q.ID(),
+		"token":      token,
+	})
+}
+
+func newToken(c echo.Context) error {
+
+	q, err := querier.GetQuerier(c.Param("querierid"))
+	if err != nil {
+		return err
+	}
+
+	token, err := q.NewToken()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"ok":         true,
+		"querier_id": q.ID(),
+		"token":      token,
+	})
+}
+
+func deleteQuerier(c echo.Context) error {
+
+	if err := querier.DeleteQuerier(c.Param("querierid")); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AdminRoutes sets the routing to manage the queriers' accounts. Those routes
+// are only available on the administration server.
+func AdminRoutes(router *echo.Group) {
+
+	router.POST("", createQuerier)
+	router.POST("/:querierid/token", newToken)
+	router.DELETE("/:querierid", deleteQuerier)
+}
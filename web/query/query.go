@@ -4,16 +4,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/pkg/dispers"
+	dispersErr "github.com/cozy/cozy-stack/pkg/dispers/errors"
 	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
 	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/querier"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
 
 	// import workers
@@ -37,15 +43,13 @@ func createConcept(c echo.Context) error {
 		return err
 	}
 
-	for _, element := range in.EncryptedConcepts {
-		err := enclave.CreateConcept(&element, in.IsEncrypted)
-		if err != nil {
-			return err
-		}
+	hashes, err := enclave.CreateConcepts(in.EncryptedConcepts, in.IsEncrypted, in.Metadata)
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, query.OutputCI{
-		Hashes: in.EncryptedConcepts,
+		Hashes: hashes,
 	})
 }
 
@@ -62,14 +66,38 @@ func getHash(c echo.Context) error {
 		return errors.New("Failed to read concept")
 	}
 
-	out := make([]query.Concept, len(strConcepts))
-	for i, strConcept := range strConcepts {
+	// The hierarchy of the concepts can be expanded with ?expand=ancestors
+	// or ?expand=descendants
+	expand := c.QueryParam("expand")
+	ancestors := expand == "ancestors"
+	descendants := expand == "descendants"
+
+	out := []query.Concept{}
+	seen := make(map[string]int)
+	for _, strConcept := range strConcepts {
 		tmpConcept := query.Concept{EncryptedConcept: []byte(strConcept)}
-		err := enclave.GetConcept(&tmpConcept, isEncrypted)
+		if !ancestors && !descendants {
+			if err := enclave.GetConcept(&tmpConcept, isEncrypted); err != nil {
+				return err
+			}
+			out = append(out, tmpConcept)
+			continue
+		}
+
+		expanded, err := enclave.ExpandConcept(tmpConcept, isEncrypted, ancestors, descendants)
 		if err != nil {
 			return err
 		}
-		out[i] = tmpConcept
+		for _, concept := range expanded {
+			// A concept asked explicitly wins over the same implicit concept
+			index, ok := seen[string(concept.Hash)]
+			if !ok {
+				seen[string(concept.Hash)] = len(out)
+				out = append(out, concept)
+			} else if !concept.Implicit {
+				out[index] = concept
+			}
+		}
 	}
 
 	meta.EndTask(nil)
@@ -102,6 +130,63 @@ func deleteConcepts(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+func listHashes(c echo.Context) error {
+
+	hashes, err := enclave.ConceptHashes()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, query.OutputCI{
+		Hashes: hashes,
+	})
+}
+
+func deleteHashes(c echo.Context) error {
+
+	var in query.InputCI
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+
+	if err := enclave.DeleteConceptsByHash(in.EncryptedConcepts); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func rotateConcepts(c echo.Context) error {
+
+	hashes, err := enclave.RotateConcepts()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, query.OutputCI{
+		Hashes: hashes,
+	})
+}
+
+func commitRotation(c echo.Context) error {
+
+	if err := enclave.CommitRotation(); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func listConcepts(c echo.Context) error {
+
+	infos, err := enclave.ListConcepts(c.QueryParam("prefix"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, infos)
+}
+
 /*
 *
 *
@@ -111,21 +196,18 @@ TARGET FINDER'S ROUTES : those functions are used on route ./dispers/targetfinde
 */
 func selectTargets(c echo.Context) error {
 
-	var inputTF query.InputTF
-	if err := json.NewDecoder(c.Request().Body).Decode(&inputTF); err != nil {
-		return err
-	}
-
-	inputTF.TaskMetadata.Arrival = time.Now()
+	arrival := time.Now()
 
-	finallist, err := enclave.SelectAddresses(inputTF)
+	// The buckets of addresses are read one by one
+	inputTF, finallist, err := enclave.SelectAddressesFromStream(c.Request().Body)
 	if err != nil {
 		return err
 	}
+	inputTF.TaskMetadata.Arrival = arrival
 
 	// TODO : Encrypt if necessary
 
-	encTargets, err := json.Marshal(finallist)
+	encTargets, err := wire.Encode(wire.TypeInstances, finallist)
 	if err != nil {
 		return err
 	}
@@ -162,6 +244,21 @@ func queryCozy(c echo.Context) error {
 	})
 }
 
+// resendFold is called by the Conductor when a copy of a fold of the first
+// layer has failed, the Target sends it to another DA
+func resendFold(c echo.Context) error {
+
+	var in query.InputResendFold
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+	if err := enclave.ResendFold(c.Param("queryid"), in); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"ok": true})
+}
+
 /*
 *
 *
@@ -206,6 +303,10 @@ func getQuery(c echo.Context) error {
 		return err
 	}
 
+	if err := middlewares.GetQuerier(c).CanAccess(queryDoc.Owner); err != nil {
+		return err
+	}
+
 	executionMetadata, err := metadata.RetrieveExecutionMetadata(queryDoc.ID())
 	if err != nil {
 		return err
@@ -219,11 +320,32 @@ func getQuery(c echo.Context) error {
 	return c.JSON(http.StatusOK, echo.Map{
 		"Checkpoints":       queryDoc.CheckPoints,
 		"Results":           queryDoc.Results,
+		"Failure":           queryDoc.Failure,
 		"ExecutionMetadata": executionMetadata,
 		"AsyncMetadata":     asyncMetadata,
 	})
 }
 
+func getCatalogue(c echo.Context) error {
+
+	entries, err := enclave.ConceptCatalogue(c.QueryParam("prefix"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+func getSubtree(c echo.Context) error {
+
+	tree, err := enclave.ConceptSubtree(c.Param("concept"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, tree)
+}
+
 func createQuery(c echo.Context) error {
 
 	var in query.InputNewQuery
@@ -232,20 +354,45 @@ func createQuery(c echo.Context) error {
 		return err
 	}
 
-	query, err := enclave.NewQuery(&in)
+	owner := middlewares.GetQuerier(c)
+	if err := owner.CheckScopes(&in); err != nil {
+		return err
+	}
+
+	maxTargets, err := owner.TargetsLimit(in.MaxTargets)
 	if err != nil {
 		return err
 	}
 
-	err = query.Lead()
+	retryAfter, err := owner.AcquireQuery()
 	if err != nil {
+		if retryAfter > 0 {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+		}
+		return err
+	}
+
+	query, err := enclave.NewQuery(&in, owner.ID(), maxTargets)
+	if err != nil {
+		if query == nil || query.ID() == "" {
+			querier.ReleaseQuery(owner.ID())
+		}
+		return err
+	}
+
+	// The query is led by a job, the querier follows it with its metadata
+	if err := enclave.PushLead(query.ID()); err != nil {
 		return err
 	}
 
 	return c.JSON(http.StatusOK, echo.Map{"ok": true, "query_id": query.ID()})
 }
 
-func updateQueryDA(in query.OutputDA) error {
+// updateQueryDA saves the results of a fold, or the error of the DA computing
+// it. The copy of the fold is the one sent to the actor that made the request:
+// the replica and the host given by the DA are not trusted.
+func updateQueryDA(c echo.Context, in query.OutputDA) error {
 
 	queryid := in.QueryID
 
@@ -254,42 +401,62 @@ func updateQueryDA(in query.OutputDA) error {
 	if err != nil {
 		return err
 	}
-	if async.GetStateDA() == query.Running {
-		// This is the first we try to save results
-		// We can save it and try to resume query right after
-		if err := async.SetFinished(); err != nil {
-			return err
-		}
-		task := in.TaskMetadata
-		task.EndTask(nil)
-		async.TaskMetadata = task
-		if err := async.SetData(in.Results); err != nil {
-			return err
-		}
-	} else if async.GetStateDA() == query.Finished {
+	switch async.GetStateDA() {
+	case query.Finished, query.Failed:
 		// There has been a conflict but there is no problem
 		// Results have been successfully saved the first time
 		// This thread has to be killed, another one is resuming the query
 		return nil
-	} else {
+	case query.Running:
+	default:
 		return errors.New("Cannot get results from a DA that has not been launched")
 	}
 
-	// AsyncDoc has successfully been updated, now try to resume query
-	// As first security to prevent conflict, we check if indexLayer is finished
-	// There will be more check-up later in the thread
+	// A DA whose copy has been sent to another host meanwhile is refused
+	host := async.HostOf(in.Replica)
+	if host == "" || !middlewares.IsPeer(c, host) {
+		return echo.NewHTTPError(http.StatusForbidden, "this copy of the fold has not been sent to this actor")
+	}
+	in.Host = host
+
 	queryDoc, err := enclave.NewQueryFetchingQueryDoc(queryid, in.AggregationID[0]+1)
 	if err != nil {
 		return err
 	}
+
+	// The DA has failed to compute the fold
+	if in.Error != "" {
+		return queryDoc.FailFold(in.AggregationID[0], in.AggregationID[1], []int{in.Replica}, errors.New(in.Error))
+	}
+
+	// When the layer is redundant, the results of the fold are accepted once
+	// a majority of the DAs computing it agree
+	results, accepted, err := queryDoc.CheckReplicas(in)
+	if err != nil || !accepted {
+		return err
+	}
+
+	// This is the first we try to save results
+	// We can save it and try to resume query right after
+	if err := async.SetFinished(); err != nil {
+		return err
+	}
+	task := in.TaskMetadata
+	task.EndTask(nil)
+	async.TaskMetadata = task
+	if err := async.SetData(results); err != nil {
+		return err
+	}
+
+	// AsyncDoc has successfully been updated, now try to resume query
+	// As first security to prevent conflict, we check if indexLayer is finished
+	// There will be more check-up later in the thread
 	stateLayer, err := query.FetchAsyncStateLayer(queryid, in.AggregationID[0], queryDoc.Layers[in.AggregationID[0]].Size)
 	if err != nil {
 		return err
 	}
 	if stateLayer == query.Finished {
-		if err = queryDoc.Lead(); err != nil {
-			return err
-		}
+		return enclave.PushLead(queryid)
 	}
 	return nil
 }
@@ -301,13 +468,14 @@ func updateQueryT(in query.OutputT) error {
 		return err
 	}
 
-	queryDoc.Layers[0].Data = in.Data
-	queryDoc.CheckPoints["t"] = true
-
-	if err = queryDoc.Lead(); err != nil {
+	// The data are sent by the Target to the DAs once the folds are registered
+	if err := queryDoc.RegisterFolds(in); err != nil {
 		return err
 	}
-
+	// A query that has failed does not wait for the folds
+	if in.Error == "" && queryDoc.Failure != "" {
+		return dispersErr.WrapErrors(dispersErr.ErrQueryFailed, "")
+	}
 	return nil
 }
 
@@ -323,7 +491,7 @@ func updateQuery(c echo.Context) error {
 
 	switch in.Role {
 	case network.RoleDA:
-		if err := updateQueryDA(in.OutDA); err != nil {
+		if err := updateQueryDA(c, in.OutDA); err != nil {
 			return err
 		}
 	case network.RoleT:
@@ -337,33 +505,138 @@ func updateQuery(c echo.Context) error {
 	return c.JSON(http.StatusOK, echo.Map{"ok": true, "query_id": queryid})
 }
 
+func reportStale(c echo.Context) error {
+
+	var in query.InputStale
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+	if len(in.EncryptedInstance) == 0 {
+		return errors.New("The instance is missing")
+	}
+
+	if err := enclave.SaveStaleMark(in.EncryptedInstance); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"ok": true})
+}
+
+func resumeQuery(c echo.Context) error {
+
+	queryDoc, err := enclave.NewQueryFetchingQueryDoc(c.Param("queryid"), 0)
+	if err != nil {
+		return err
+	}
+
+	if err := middlewares.GetQuerier(c).CanAccess(queryDoc.Owner); err != nil {
+		return err
+	}
+
+	if err := enclave.PushLead(queryDoc.ID()); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"ok": true, "query_id": queryDoc.ID()})
+}
+
 func deleteQuery(c echo.Context) error {
 
+	queryDoc, err := enclave.NewQueryFetchingQueryDoc(c.Param("queryid"), 0)
+	if err != nil {
+		return err
+	}
+
+	if err := middlewares.GetQuerier(c).CanAccess(queryDoc.Owner); err != nil {
+		return err
+	}
+
 	// TODO: Stop workers (contact T/DA for DELETE /jobs/triggers/:trigger-id)
-	// TODO: Retrieve Query Doc
-	// TODO: Mark doc as aborted
+	if err := queryDoc.DeleteQuery(); err != nil {
+		return err
+	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
-// Routes sets the routing for the dispers service
-// ":concepts" has to be a list of concepts separated by ":"
-func Routes(router *echo.Group) {
+func rotateConceptKeys(c echo.Context) error {
 
-	// TODO : Create a route to retrieve public key
-	router.GET("/conceptindexor/concept/:concepts/:is-encrypted", getHash)
-	router.POST("/conceptindexor/concept", createConcept)
-	router.DELETE("/conceptindexor/concept/:concepts/:is-encrypted", deleteConcepts)
+	moved, err := enclave.RotateConceptKeys()
+	if err != nil {
+		return err
+	}
 
-	router.POST("/targetfinder/addresses", selectTargets)
+	return c.JSON(http.StatusOK, echo.Map{
+		"moved": moved,
+	})
+}
+
+func findOrphans(c echo.Context) error {
+
+	orphans, err := enclave.FindOrphans()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, orphans)
+}
 
-	router.POST("/target/query", queryCozy)
+func removeOrphans(c echo.Context) error {
 
-	router.POST("/dataaggregator/aggregation", aggregate)
+	orphans, err := enclave.RemoveOrphans()
+	if err != nil {
+		return err
+	}
 
-	router.GET("/query/:queryid", getQuery)
-	router.POST("/query", createQuery)
-	router.PATCH("/query/:queryid", updateQuery)
-	router.DELETE("/query/:queryid", deleteQuery)
+	return c.JSON(http.StatusOK, orphans)
+}
+
+// AdminRoutes sets the routing to maintain the concepts: rotation of the
+// Concept Indexor's key and reconciliation of the Concept Indexor's and
+// Conductor's databases. Those routes are only available on the Conductor's
+// administration server.
+func AdminRoutes(router *echo.Group) {
+
+	router.POST("/rotation", rotateConceptKeys)
+	router.GET("/orphans", findOrphans)
+	router.DELETE("/orphans", removeOrphans)
+}
+
+// Routes sets the routing for the dispers service
+// ":concepts" has to be a list of concepts separated by ":"
+func Routes(router *echo.Group) {
+
+	fromConductor := middlewares.AllowPeers(network.IdentityConductor)
+	fromWorkers := middlewares.AllowPeers(network.RoleT, network.RoleDA)
+	fromTargets := middlewares.AllowPeers(network.RoleT)
+	// The first layer of DAs receives its data from the Targets
+	fromFeeders := middlewares.AllowPeers(network.IdentityConductor, network.RoleT)
+
+	// TODO : Create a route to retrieve public key
+	router.GET("/conceptindexor/concept/:concepts/:is-encrypted", getHash, fromConductor)
+	router.POST("/conceptindexor/concept", createConcept, fromConductor)
+	router.DELETE("/conceptindexor/concept/:concepts/:is-encrypted", deleteConcepts, fromConductor)
+	router.GET("/conceptindexor/concepts", listConcepts, fromConductor)
+	router.GET("/conceptindexor/hashes", listHashes, fromConductor)
+	router.DELETE("/conceptindexor/hashes", deleteHashes, fromConductor)
+	router.POST("/conceptindexor/rotation", rotateConcepts, fromConductor)
+	router.DELETE("/conceptindexor/rotation", commitRotation, fromConductor)
+
+	// The Conductor streams the buckets of addresses
+	router.POST("/targetfinder/addresses", selectTargets, middlewares.VerifyStreamedSignature, fromConductor)
+
+	router.POST("/target/query", queryCozy, fromConductor)
+	router.POST("/target/query/:queryid/folds", resendFold, fromConductor)
+
+	router.POST("/dataaggregator/aggregation", aggregate, fromFeeders)
+
+	router.GET("/catalogue", getCatalogue, middlewares.RequireQuerier)
+	router.GET("/catalogue/:concept/subtree", getSubtree, middlewares.RequireQuerier)
+	router.GET("/query/:queryid", getQuery, middlewares.RequireQuerier)
+	router.POST("/query", createQuery, middlewares.RequireQuerier)
+	router.POST("/query/:queryid/resume", resumeQuery, middlewares.RequireQuerier)
+	router.PATCH("/query/:queryid", updateQuery, fromWorkers)
+	router.POST("/query/:queryid/stale", reportStale, fromTargets)
+	router.DELETE("/query/:queryid", deleteQuery, middlewares.RequireQuerier)
 
 }
@@ -11,11 +11,16 @@ import (
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/dispers"
+	"github.com/cozy/cozy-stack/pkg/dispers/audit"
 	"github.com/cozy/cozy-stack/pkg/dispers/network"
+	"github.com/cozy/cozy-stack/pkg/dispers/querier"
+	dispersquery "github.com/cozy/cozy-stack/pkg/dispers/query"
 	"github.com/cozy/cozy-stack/pkg/metrics"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	auditweb "github.com/cozy/cozy-stack/web/audit"
 	"github.com/cozy/cozy-stack/web/errors"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	querierweb "github.com/cozy/cozy-stack/web/querier"
 	"github.com/cozy/cozy-stack/web/query"
 	"github.com/cozy/cozy-stack/web/statik"
 	"github.com/cozy/cozy-stack/web/status"
@@ -81,6 +86,8 @@ func SetupAdminRoutes(router *echo.Echo) error {
 
 	version.Routes(router.Group("/version", mws...))
 	metrics.Routes(router.Group("/metrics", mws...))
+	querierweb.AdminRoutes(router.Group("/dispers/queriers", mws...))
+	query.AdminRoutes(router.Group("/dispers/concepts", mws...))
 
 	setupRecover(router)
 
@@ -98,6 +105,8 @@ func SetupRoutes(router *echo.Echo) (*echo.Echo, error) {
 	if config.GetConfig().DevMode {
 		enclave.PrefixerC = prefixer.TestConductorPrefixer
 		enclave.PrefixerCI = prefixer.TestConceptIndexorPrefixer
+		querier.PrefixerC = prefixer.TestConductorPrefixer
+		audit.PrefixerC = prefixer.TestConductorPrefixer
 	}
 
 	tmpHosts := []url.URL{}
@@ -116,6 +125,80 @@ func SetupRoutes(router *echo.Echo) (*echo.Echo, error) {
 		network.Hosts = []url.URL{url.URL{Host: "cozy.tools:8008", Scheme: "http"}}
 	}
 
+	network.Client = config.GetConfig().Dispers.Client
+	network.SignatureName = config.GetConfig().Dispers.SignatureName
+	network.SignatureKeys = config.GetConfig().Dispers.SignatureKeys
+	network.SignatureRoles = config.GetConfig().Dispers.SignatureRoles
+	network.SignatureMaxAge = config.GetConfig().Dispers.SignatureMaxAge
+	if minSize := config.GetConfig().Dispers.CompressionMinSize; minSize != 0 {
+		network.CompressionMinSize = minSize
+	}
+	network.Nonces = config.GetConfig().CacheStorage
+	querier.TokenSecret = config.GetConfig().Dispers.QuerierTokenSecret
+	if vault := config.GetVault(); vault != nil {
+		enclave.ConceptKey = vault.ConceptKey()
+		enclave.NextConceptKey = vault.NextConceptKey()
+		enclave.CatalogueKey = vault.CatalogueKey()
+	}
+	if len(enclave.ConceptKey) == 0 && config.GetConfig().DevMode {
+		key, err := config.DevKey("concept")
+		if err != nil {
+			return nil, fmt.Errorf("dispers: could not load the key of the concepts: %s", err)
+		}
+		enclave.ConceptKey = key
+	}
+	if len(enclave.CatalogueKey) == 0 && config.GetConfig().DevMode {
+		key, err := config.DevKey("catalogue")
+		if err != nil {
+			return nil, fmt.Errorf("dispers: could not load the key of the catalogue: %s", err)
+		}
+		enclave.CatalogueKey = key
+	}
+	querier.DefaultQuotas = querier.Quotas{
+		QueriesPerDay:     config.GetConfig().Dispers.QueriesPerDay,
+		ConcurrentQueries: config.GetConfig().Dispers.ConcurrentQueries,
+		MaxTargets:        config.GetConfig().Dispers.MaxTargets,
+	}
+	querier.RunningQueryTTL = config.GetConfig().Dispers.RunningQueryTTL
+	if epsilon := config.GetConfig().Dispers.CatalogueEpsilon; epsilon > 0 {
+		enclave.CatalogueEpsilon = epsilon
+	}
+	if shards := config.GetConfig().Dispers.SubscriptionShards; shards > 0 {
+		enclave.SubscriptionShards = shards
+	}
+	if size := config.GetConfig().Dispers.SubscriptionBucketSize; size > 0 {
+		enclave.BucketCapacity = size
+	}
+	if maxRows := config.GetConfig().Dispers.MaxRowsPerInstance; maxRows != 0 {
+		enclave.MaxRowsPerInstance = maxRows
+	}
+	network.SetStackConcurrency(config.GetConfig().Dispers.StackConcurrency)
+	enclave.DeleteIndexes = config.GetConfig().Dispers.DeleteIndexes
+	if timeout := config.GetConfig().Dispers.FoldTimeout; timeout != 0 {
+		enclave.FoldTimeout = timeout
+	}
+	if retries := config.GetConfig().Dispers.MaxFoldRetries; retries != nil {
+		enclave.MaxFoldRetries = *retries
+	}
+	if debounce := config.GetConfig().Dispers.LeadDebounce; debounce != nil {
+		enclave.LeadDebounce = *debounce
+	}
+	querier.Counters = querier.NewCounter(config.GetConfig().RateLimitingStorage.Client())
+	if path := config.GetConfig().Dispers.LocalQueryPolicyFile; path != "" {
+		policy, err := dispersquery.LoadLocalQueryPolicy(path)
+		if err != nil {
+			return nil, fmt.Errorf("dispers: could not load the policy of the local queries: %s", err)
+		}
+		dispersquery.Policy = policy
+	}
+	if path := config.GetConfig().Dispers.AuditSigningKeyFile; path != "" {
+		key, err := audit.LoadSigningKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("dispers: could not load the signing key of the audit log: %s", err)
+		}
+		audit.SigningKey = key
+	}
+
 	router.Use(timersMiddleware)
 
 	if !config.GetConfig().CSPDisabled {
@@ -134,8 +217,10 @@ func SetupRoutes(router *echo.Echo) (*echo.Echo, error) {
 
 	// other non-authentified routes
 	{
-		query.Routes(router.Group("/dispers"))
-		subscribe.Routes(router.Group("/subscribe"))
+		// The payloads exchanged by the actors are compressed
+		query.Routes(router.Group("/dispers", middlewares.Decompress, middlewares.VerifySignature, middleware.Gzip()))
+		auditweb.Routes(router.Group("/dispers/audit"))
+		subscribe.Routes(router.Group("/subscribe", middlewares.Decompress, middlewares.VerifySignature, middleware.Gzip()))
 		status.Routes(router.Group("/status"))
 		version.Routes(router.Group("/version"))
 	}
@@ -5,6 +5,8 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -130,10 +132,25 @@ func ListenAndServe() (*Servers, error) {
 		return nil, err
 	}
 
-	return &Servers{
+	tlsConfig, peersConfig, err := dispersTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := &Servers{
 		major: major,
 		admin: admin,
-	}, nil
+		tls:   tlsConfig,
+	}
+	if peersConfig != nil {
+		servers.peers = &http.Server{
+			Addr:              config.GetConfig().Dispers.PeersAddr,
+			Handler:           major,
+			ReadHeaderTimeout: ReadHeaderTimeout,
+			TLSConfig:         peersConfig,
+		}
+	}
+	return servers, nil
 }
 
 // Servers contains the started HTTP servers and implement the Shutdowner
@@ -141,9 +158,54 @@ func ListenAndServe() (*Servers, error) {
 type Servers struct {
 	major *echo.Echo
 	admin *echo.Echo
+	tls   *tls.Config
+	peers *http.Server
 	errs  chan error
 }
 
+// dispersTLSConfig returns the TLS configurations used when this actor has a
+// certificate. The major server presents the certificate to the queriers and
+// the Cozy instances, which connect without any. The other actors call the
+// DISPERS listener, which requires a client certificate signed by the DISPERS
+// root CA, so that the routes reserved to them can check their role.
+func dispersTLSConfig() (*tls.Config, *tls.Config, error) {
+	conf := config.GetConfig().Dispers
+	if !conf.TLSEnabled() {
+		return nil, nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.CertificateFile, conf.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't load the DISPERS certificate: %s", err)
+	}
+
+	// Without a root CA, any certificate signed by a public authority would
+	// be accepted as an actor
+	if conf.RootCAFile == "" {
+		return nil, nil, fmt.Errorf("The DISPERS root CA is required with a certificate")
+	}
+	pem, err := ioutil.ReadFile(conf.RootCAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't load the DISPERS root CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("No certificate found in %s", conf.RootCAFile)
+	}
+
+	public := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	peers := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return public, peers, nil
+}
+
 // Start starts the servers.
 func (e *Servers) Start() {
 	e.errs = make(chan error)
@@ -151,12 +213,20 @@ func (e *Servers) Start() {
 	go e.start(e.major, "major", &http.Server{
 		Addr:              config.ServerAddr(),
 		ReadHeaderTimeout: ReadHeaderTimeout,
+		TLSConfig:         e.tls,
 	})
 
 	go e.start(e.admin, "admin", &http.Server{
 		Addr:              config.AdminServerAddr(),
 		ReadHeaderTimeout: ReadHeaderTimeout,
 	})
+
+	if e.peers != nil {
+		go func() {
+			fmt.Printf("  https server dispers started on %q\n", e.peers.Addr)
+			e.errs <- e.peers.ListenAndServeTLS("", "")
+		}()
+	}
 }
 
 func (e *Servers) start(s *echo.Echo, name string, server *http.Server) {
@@ -171,7 +241,11 @@ func (e *Servers) Wait() <-chan error {
 
 // Shutdown gracefully stops the servers.
 func (e *Servers) Shutdown(ctx context.Context) error {
-	g := utils.NewGroupShutdown(e.admin, e.major)
+	servers := []utils.Shutdowner{e.admin, e.major}
+	if e.peers != nil {
+		servers = append(servers, e.peers)
+	}
+	g := utils.NewGroupShutdown(servers...)
 	fmt.Print("  shutting down servers...")
 	if err := g.Shutdown(ctx); err != nil {
 		fmt.Println("failed: ", err.Error())
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dispers.local", OrganizationalUnit: []string{"conductor"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := path.Join(dir, "actor.crt")
+	keyFile := path.Join(dir, "actor.key")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestDispersTLSConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dispers-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir)
+
+	conf := &config.GetConfig().Dispers
+	defer func() {
+		conf.CertificateFile, conf.KeyFile, conf.RootCAFile = "", "", ""
+	}()
+
+	public, peers, err := dispersTLSConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, public)
+	assert.Nil(t, peers)
+
+	// A certificate without root CA would trust the public authorities
+	conf.CertificateFile, conf.KeyFile = certFile, keyFile
+	_, _, err = dispersTLSConfig()
+	assert.Error(t, err)
+
+	conf.RootCAFile = certFile
+	public, peers, err = dispersTLSConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, public.ClientAuth)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, peers.ClientAuth)
+	assert.NotNil(t, peers.ClientCAs)
+}
@@ -2,12 +2,17 @@ package subscribe
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/dispers"
+	"github.com/cozy/cozy-stack/pkg/dispers/errors"
+	"github.com/cozy/cozy-stack/pkg/dispers/network"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
 	"github.com/cozy/cozy-stack/pkg/dispers/subscribe"
+	"github.com/cozy/cozy-stack/pkg/dispers/wire"
+	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
 )
 
@@ -47,9 +52,88 @@ func encryptList(c echo.Context) error {
 	return c.JSON(http.StatusOK, subscribe.OutputEncrypt{
 		IsEncrypted:        in.IsEncrypted,
 		EncryptedInstances: in.EncryptedInstances,
+		Count:              in.Count,
 	})
 }
 
+// instanceDomain reads the domain of an instance. A refreshed instance has got
+// the same domain field.
+func instanceDomain(encInstance []byte) (string, error) {
+	// TODO: Decrypt the instance
+	typ, _, err := wire.Peek(encInstance)
+	if err != nil {
+		return "", err
+	}
+	if typ == wire.TypeRefreshedInstance {
+		var refreshed subscribe.RefreshedInstance
+		if err := wire.Decode(encInstance, typ, &refreshed); err != nil {
+			return "", err
+		}
+		return refreshed.Domain, nil
+	}
+	var instance query.Instance
+	if err := wire.Decode(encInstance, wire.TypeInstance, &instance); err != nil {
+		return "", err
+	}
+	return instance.Domain, nil
+}
+
+func bucketOfInstance(c echo.Context) error {
+
+	var in subscribe.InputBucket
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+
+	domain, err := instanceDomain(in.EncryptedInstance)
+	if err != nil {
+		return err
+	}
+
+	out := subscribe.OutputBucket{Buckets: make(map[int]int)}
+	for _, shards := range in.Shards {
+		out.Buckets[shards] = subscribe.BucketOf(domain, shards)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func splitList(c echo.Context) error {
+
+	var in subscribe.InputSplit
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+	// TODO: Decrypt the list and encrypt the buckets
+
+	var listOfInstances []query.Instance
+	if in.EncryptedInstances != nil {
+		if err := wire.Decode(in.EncryptedInstances, wire.TypeInstances, &listOfInstances); err != nil {
+			return err
+		}
+	}
+
+	buckets := make(map[int][]query.Instance)
+	for _, instance := range listOfInstances {
+		bucket := subscribe.BucketOf(instance.Domain, in.Shards)
+		buckets[bucket] = append(buckets[bucket], instance)
+	}
+
+	out := subscribe.OutputSplit{
+		IsEncrypted: in.IsEncrypted,
+		Buckets:     make(map[int][]byte),
+		Counts:      make(map[int]int),
+	}
+	for bucket, instances := range buckets {
+		encInstances, err := wire.Encode(wire.TypeInstances, instances)
+		if err != nil {
+			return err
+		}
+		out.Buckets[bucket] = encInstances
+		out.Counts[bucket] = len(instances)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
 /*
 *
 *
@@ -68,16 +152,19 @@ func insert(c echo.Context) error {
 
 	var listOfInstances []query.Instance
 	if in.EncryptedInstances != nil {
-		err := json.Unmarshal(in.EncryptedInstances, &listOfInstances)
+		err := wire.Decode(in.EncryptedInstances, wire.TypeInstances, &listOfInstances)
 		if err != nil {
 			return err
 		}
 	}
 	var instance query.Instance
-	err := json.Unmarshal(in.EncryptedInstance, &instance)
+	err := wire.Decode(in.EncryptedInstance, wire.TypeInstance, &instance)
 	if err != nil {
 		return err
 	}
+	if instance.TokenExpiresAt.IsZero() {
+		instance.TokenExpiresAt = time.Now().Add(consts.InstanceTokenValidityDuration)
+	}
 
 	// Search if instance is already present in list
 	absent := true
@@ -94,10 +181,21 @@ func insert(c echo.Context) error {
 	}
 
 	if len(instance.TokenBearer) < 5 {
-		return errors.New("Unvalid token bearer")
+		return errors.WrapErrors(errors.ErrInvalidTokenBearer, "token_bearer")
+	}
+	if instance.IsExpired() {
+		return errors.WrapErrors(errors.ErrTokenExpired, "token_expires_at")
 	}
 
-	encListOfInstances, err := json.Marshal(listOfInstances)
+	// The instance gives its consent again, with a new token
+	if err := subscribe.CancelWithdrawal(instance.Domain); err != nil {
+		return err
+	}
+	if err := subscribe.ClearStale(instance.Domain); err != nil {
+		return err
+	}
+
+	encListOfInstances, err := wire.Encode(wire.TypeInstances, listOfInstances)
 	if err != nil {
 		return nil
 	}
@@ -105,6 +203,146 @@ func insert(c echo.Context) error {
 	return c.JSON(http.StatusOK, subscribe.InputEncrypt{
 		IsEncrypted:        in.IsEncrypted,
 		EncryptedInstances: encListOfInstances,
+		Count:              len(listOfInstances),
+	})
+}
+
+func remove(c echo.Context) error {
+
+	var in subscribe.InputInsert
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+	// TODO : Decrypt inputs before unmarshalling
+
+	var listOfInstances []query.Instance
+	if in.EncryptedInstances != nil {
+		err := wire.Decode(in.EncryptedInstances, wire.TypeInstances, &listOfInstances)
+		if err != nil {
+			return err
+		}
+	}
+	var instance query.Instance
+	err := wire.Decode(in.EncryptedInstance, wire.TypeInstance, &instance)
+	if err != nil {
+		return err
+	}
+
+	// Only the instance itself, knowing its token, can leave the list
+	kept := []query.Instance{}
+	for _, subscribed := range listOfInstances {
+		if subscribed.Domain != instance.Domain {
+			kept = append(kept, subscribed)
+			continue
+		}
+		if subscribed.TokenBearer != instance.TokenBearer {
+			return errors.WrapErrors(errors.ErrWrongTokenBearer, "")
+		}
+	}
+
+	encListOfInstances, err := wire.Encode(wire.TypeInstances, kept)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, subscribe.InputEncrypt{
+		IsEncrypted:        in.IsEncrypted,
+		EncryptedInstances: encListOfInstances,
+		Count:              len(kept),
+	})
+}
+
+func refresh(c echo.Context) error {
+
+	var in subscribe.InputInsert
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+	// TODO : Decrypt inputs before unmarshalling
+
+	var listOfInstances []query.Instance
+	if in.EncryptedInstances != nil {
+		err := wire.Decode(in.EncryptedInstances, wire.TypeInstances, &listOfInstances)
+		if err != nil {
+			return err
+		}
+	}
+	var refreshed subscribe.RefreshedInstance
+	if err := wire.Decode(in.EncryptedInstance, wire.TypeRefreshedInstance, &refreshed); err != nil {
+		return err
+	}
+
+	if len(refreshed.TokenBearer) < 5 {
+		return errors.WrapErrors(errors.ErrInvalidTokenBearer, "token_bearer")
+	}
+	if refreshed.TokenExpiresAt.IsZero() {
+		refreshed.TokenExpiresAt = time.Now().Add(consts.InstanceTokenValidityDuration)
+	}
+	if refreshed.IsExpired() {
+		return errors.WrapErrors(errors.ErrTokenExpired, "token_expires_at")
+	}
+
+	// The instance is authenticated by a token it has given when subscribing
+	authenticated := false
+	for index, instance := range listOfInstances {
+		if instance.Domain != refreshed.Domain {
+			continue
+		}
+		// The token may already have been rotated for this concept if the
+		// refresh is retried
+		if instance.TokenBearer == refreshed.TokenBearer {
+			authenticated = true
+			continue
+		}
+		if instance.TokenBearer != refreshed.PreviousTokenBearer {
+			return errors.WrapErrors(errors.ErrWrongTokenBearer, "")
+		}
+		authenticated = true
+		instance.TokenBearer = refreshed.TokenBearer
+		instance.TokenExpiresAt = refreshed.TokenExpiresAt
+		instance.Version = instance.Version + 1
+		listOfInstances[index] = instance
+	}
+
+	// The stale mark of an instance is only cleared with the lists it
+	// belongs to, once its token has been checked
+	if authenticated {
+		if err := subscribe.ClearStale(refreshed.Domain); err != nil {
+			return err
+		}
+	}
+
+	encListOfInstances, err := wire.Encode(wire.TypeInstances, listOfInstances)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, subscribe.InputEncrypt{
+		IsEncrypted:        in.IsEncrypted,
+		EncryptedInstances: encListOfInstances,
+		Count:              len(listOfInstances),
+	})
+}
+
+func withdraw(c echo.Context) error {
+
+	var in subscribe.InputInsert
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return err
+	}
+	// TODO : Decrypt inputs before unmarshalling
+
+	var instance query.Instance
+	if err := wire.Decode(in.EncryptedInstance, wire.TypeInstance, &instance); err != nil {
+		return err
+	}
+
+	if err := subscribe.Withdraw(instance.Domain); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"ok": true,
 	})
 }
 
@@ -133,22 +371,88 @@ func createConceptInConductorDB(c echo.Context) error {
 	})
 }
 
+func readInputConductor(c echo.Context) (*subscribe.InputConductor, error) {
+
+	var in subscribe.InputConductor
+	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
+		return nil, err
+	}
+
+	if !in.IsEncrypted {
+		encInst, err := wire.Encode(wire.TypeInstance, in.Instance)
+		if err != nil {
+			return nil, err
+		}
+		in.EncryptedInstance = encInst
+	}
+
+	return &in, nil
+}
+
 func subscribeToRequest(c echo.Context) error {
 
+	in, err := readInputConductor(c)
+	if err != nil {
+		return err
+	}
+
+	if err := enclave.Subscribe(in); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"ok": true,
+	})
+}
+
+func unsubscribeFromRequest(c echo.Context) error {
+
+	in, err := readInputConductor(c)
+	if err != nil {
+		return err
+	}
+
+	if err := enclave.Unsubscribe(in); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"ok": true,
+	})
+}
+
+func refreshToken(c echo.Context) error {
+
 	var in subscribe.InputConductor
 	if err := json.NewDecoder(c.Request().Body).Decode(&in); err != nil {
 		return err
 	}
 
 	if !in.IsEncrypted {
-		encInst, err := json.Marshal(in.Instance)
+		encInst, err := wire.Encode(wire.TypeRefreshedInstance, in.RefreshedInstance)
 		if err != nil {
 			return err
 		}
 		in.EncryptedInstance = encInst
 	}
 
-	if err := enclave.Subscribe(&in); err != nil {
+	if err := enclave.RefreshToken(&in); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"ok": true,
+	})
+}
+
+func withdrawFromAll(c echo.Context) error {
+
+	in, err := readInputConductor(c)
+	if err != nil {
+		return err
+	}
+
+	if err := enclave.Withdraw(in); err != nil {
 		return err
 	}
 
@@ -160,11 +464,21 @@ func subscribeToRequest(c echo.Context) error {
 // Routes sets the routing for the dispers service
 func Routes(router *echo.Group) {
 
-	router.POST("/targetfinder/decrypt", decryptList)
-	router.POST("/targetfinder/encrypt", encryptList)
+	fromConductor := middlewares.AllowPeers(network.IdentityConductor)
+
+	router.POST("/targetfinder/decrypt", decryptList, fromConductor)
+	router.POST("/targetfinder/encrypt", encryptList, fromConductor)
+	router.POST("/targetfinder/bucket", bucketOfInstance, fromConductor)
+	router.POST("/targetfinder/split", splitList, fromConductor)
 
-	router.POST("/target/insert", insert)
+	router.POST("/target/insert", insert, fromConductor)
+	router.POST("/target/remove", remove, fromConductor)
+	router.POST("/target/refresh", refresh, fromConductor)
+	router.POST("/target/withdraw", withdraw, fromConductor)
 
 	router.POST("/conductor/concept", createConceptInConductorDB)
 	router.POST("/conductor/subscribe", subscribeToRequest)
+	router.POST("/conductor/unsubscribe", unsubscribeFromRequest)
+	router.POST("/conductor/refresh", refreshToken)
+	router.POST("/conductor/withdraw", withdrawFromAll)
 }
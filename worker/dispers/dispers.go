@@ -8,10 +8,15 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/dispers"
+	dispersErr "github.com/cozy/cozy-stack/pkg/dispers/errors"
 	"github.com/cozy/cozy-stack/pkg/dispers/metadata"
 	"github.com/cozy/cozy-stack/pkg/dispers/network"
 	"github.com/cozy/cozy-stack/pkg/dispers/query"
+	"github.com/cozy/cozy-stack/pkg/dispers/subscribe"
+	"github.com/cozy/cozy-stack/pkg/logger"
 )
 
 func init() {
@@ -27,14 +32,29 @@ func init() {
 		MaxExecCount: 2,
 		WorkerFunc:   WorkerQueryTarget,
 	})
-}
-
-func handleError(err error) error {
-
-	if err != nil {
-		// Send err to conductor
-	}
-	return err
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "query_target_completion",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		WorkerFunc:   WorkerTargetCompletion,
+	})
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "conductor_lead",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   WorkerConductorLead,
+		WorkerCommit: commitConductorLead,
+	})
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:     "dispers_deadlines",
+		Concurrency:    1,
+		MaxExecCount:   1,
+		Timeout:        10 * time.Minute,
+		WorkerInit:     initDeadlines,
+		WorkerShutdown: stopDeadlines,
+		WorkerFunc:     WorkerDeadlines,
+	})
 }
 
 // WorkerQueryTarget is a worker that launch Target's treatment.
@@ -46,16 +66,15 @@ func WorkerQueryTarget(ctx *job.WorkerContext) error {
 	// Read Input
 	queryStack := &query.StackQuery{}
 	if err := ctx.UnmarshalMessage(queryStack); err != nil {
-		return handleError(err)
+		return err
 	}
 	if &queryStack.LocalQuery == nil {
-		return handleError(errors.New("An index is required"))
+		return errors.New("An index is required")
 	}
 
 	// Success or not, we have to sent an array of data to the conductor
 	// Query should not stop because of a particular isntance that ruine everything
 	// Conductor can decide to stop the query if there is not enough data
-	var outStack map[string]interface{}
 	var processError error
 
 	// Initialize communication with the stack
@@ -66,110 +85,497 @@ func WorkerQueryTarget(ctx *job.WorkerContext) error {
 		Path:   "data/" + queryStack.LocalQuery.Doctype + "/_index",
 	})
 
-	// Create new index
+	// Create new index, or reuse an identical one: its name is derived from
+	// its definition
+	indexName, err := queryStack.LocalQuery.IndexName()
+	if err != nil {
+		return err
+	}
 	input := map[string]interface{}{
 		"index": queryStack.LocalQuery.Index,
-		"name":  "idxdelamortquitue",
-		"ddoc":  "_design/idxdelamortquitue",
+		"name":  indexName,
+		"ddoc":  "_design/" + indexName,
 		"type":  "json",
 	}
 
 	// Create variable to save received data
 	data := []map[string]interface{}{}
-	processError = stack.MakeRequest("POST", "Bearer "+queryStack.TokenBearer, input, nil)
-
-	// Deal with pagination when target's data overflow limit
-	pagination := 0
-
-	if &queryStack.LocalQuery.Limit != nil && queryStack.LocalQuery.Limit != 0 {
-		queryStack.LocalQuery.FindRequest.Limit = queryStack.LocalQuery.Limit
-	} else {
-		queryStack.LocalQuery.FindRequest.Limit = 100
-	}
-
-	// If limit has been specified, we only need one request to get them all
-	// We keep iterrogating Cozy only if no limit has been specified
-	for pagination == 0 || outStack["next"] != nil && queryStack.LocalQuery.Limit == 0 && outStack["next"].(bool) == true {
-		if processError == nil {
-			// If we succeeded to add a new index
-			// Change URL and make request to get data
-			queryStack.LocalQuery.FindRequest.Skip = pagination * queryStack.LocalQuery.FindRequest.Limit
-			stack.URL.Path = "data/" + queryStack.LocalQuery.Doctype + "/_find"
-			processError = stack.MakeRequest("POST", "Bearer "+queryStack.TokenBearer, queryStack.LocalQuery.FindRequest, nil)
-		}
-
-		if processError == nil {
-			// If we succeded to add an index and to make the request
-			// Unmarshal outputs to get data
-			processError = json.Unmarshal(stack.Out, &outStack)
-			for _, rowData := range outStack["docs"].([]interface{}) {
-				data = append(data, rowData.(map[string]interface{}))
+	// An instance that has withdrawn since the query started, or whose token
+	// is no longer valid, is not contacted but still counted as a target
+	// without data
+	withdrawn, err := subscribe.IsWithdrawn(queryStack.Domain)
+	if err != nil {
+		return err
+	}
+	stale, err := subscribe.IsStale(queryStack.Domain, queryStack.TokenVersion)
+	if err != nil {
+		return err
+	}
+	expired := !queryStack.TokenExpiresAt.IsZero() && time.Now().After(queryStack.TokenExpiresAt)
+	switch {
+	case withdrawn:
+		processError = dispersErr.ErrInstanceWithdrawn
+	case expired:
+		processError = dispersErr.ErrTokenExpired
+	case stale:
+		processError = dispersErr.ErrInstanceStale
+	default:
+		// The index is shared with the other running queries, it is not
+		// deleted meanwhile once this query uses it
+		task.Index = indexName
+		if enclave.DeleteIndexes {
+			if err := query.AcquireIndex(queryStack.QueryID, queryStack.Domain, queryStack.LocalQuery.Doctype, indexName, queryStack.TokenBearer); err != nil {
+				return err
+			}
+		}
+		indexErr := stack.MakeRequest("POST", "Bearer "+queryStack.TokenBearer, input, nil)
+		if indexErr == nil {
+			var created struct {
+				Result string `json:"result"`
 			}
+			indexErr = json.Unmarshal(stack.Out, &created)
+			if indexErr == nil && created.Result == "created" && enclave.DeleteIndexes {
+				indexErr = query.MarkIndexCreated(queryStack.Domain, indexName)
+			}
+		}
+		switch {
+		case indexErr == nil:
+			queryStack.LocalQuery.FindRequest.UseIndex = "_design/" + indexName
+		case stack.Status == "401" || stack.Status == "403":
+			// The stack refuses the token, the instance has to refresh it
+			processError = indexErr
+			if err := subscribe.RecordTokenFailure(queryStack.Domain, queryStack.TokenVersion, processError.Error()); err != nil {
+				return err
+			}
+			if err := enclave.ReportStale(queryStack.ConductorURL, queryStack.QueryID, queryStack.Domain, queryStack.TokenVersion); err != nil {
+				return err
+			}
+		default:
+			// The documents can still be read without the index
+			task.IndexError = indexErr.Error()
+		}
+	}
+
+	// The rows saved by a previous attempt of this job are dropped
+	if err := query.ResetTargetRows(queryStack.QueryID, queryStack.Domain); err != nil {
+		return err
+	}
+
+	// The documents are read page by page with the bookmarks of the stack, up
+	// to the limit of rows of an instance. Each page is saved as soon as it is
+	// received, unless the rows of the instance are pre-aggregated.
+	limit := enclave.RowsLimit(queryStack.LocalQuery.Limit)
+	fetched, page, bookmark := 0, 0, ""
+	for processError == nil {
+		size := enclave.StackPageSize
+		if limit > 0 && limit-fetched < size {
+			size = limit - fetched
+		}
+		queryStack.LocalQuery.FindRequest.Limit = size
+		queryStack.LocalQuery.FindRequest.Bookmark = bookmark
+		// The documents skipped by the querier are only skipped once
+		if page > 0 {
+			queryStack.LocalQuery.FindRequest.Skip = 0
+		}
+		stack.URL.Path = "data/" + queryStack.LocalQuery.Doctype + "/_find"
+		if processError = stack.MakeRequest("POST", "Bearer "+queryStack.TokenBearer, queryStack.LocalQuery.FindRequest, nil); processError != nil {
+			break
+		}
+
+		var found enclave.FindPage
+		if processError = json.Unmarshal(stack.Out, &found); processError != nil {
+			break
+		}
+		for _, doc := range found.Docs {
+			query.StripIdentifiers(doc)
+		}
+		fetched = fetched + len(found.Docs)
+		if queryStack.Layout.PreAggregate {
+			data = append(data, found.Docs...)
+		} else if len(found.Docs) > 0 {
+			if err := query.SaveTargetRows(queryStack.QueryID, queryStack.Domain, page, found.Docs); err != nil {
+				return errors.New("Failed to save rows : " + err.Error())
+			}
+		}
+		page = page + 1
+
+		if found.IsLast(size, bookmark) || (limit > 0 && fetched >= limit) {
+			break
+		}
+		bookmark = found.Bookmark
+	}
+
+	// An instance that failed is counted as a target without data
+	if processError != nil && page > 0 {
+		if err := query.ResetTargetRows(queryStack.QueryID, queryStack.Domain); err != nil {
+			return err
 		}
-		pagination = pagination + 1
 	}
 
 	// Decrypt and unmarshal data
 
-	// Save data in Target's database
-	// Step 1, create a new AsyncTask doc
-	doc, err := query.NewAsyncTask(queryStack.QueryID, query.AsyncQueryTarget, queryStack.NumberOfTargets)
-	if err != nil {
-		return handleError(errors.New("Failed to create AsyncTask doc : " + err.Error()))
+	// Only the partial state of the instance is kept, when the first layer
+	// is pre-aggregated
+	if processError == nil && queryStack.Layout.PreAggregate && len(data) > 0 {
+		partial, err := enclave.PreAggregate(data, queryStack.Layout)
+		if err != nil {
+			processError = err
+		} else if err := query.SaveTargetRows(queryStack.QueryID, queryStack.Domain, 0, []map[string]interface{}{partial}); err != nil {
+			return errors.New("Failed to save rows : " + err.Error())
+		}
 	}
-	// Step 2 : end task
+
+	// The instance is counted once its task has ended
 	task.EndTask(processError)
-	doc.TaskMetadata = task
-	// Step 3 : Create an []map[string]interface{} and set data
-	// This step update the doc in database and save the TaskMetadata from step 2
-	if err := doc.SetData(data...); err != nil {
-		return handleError(errors.New("Failed set data on AsyncTask : " + err.Error()))
+	if err := query.EndTarget(queryStack.QueryID, queryStack.Domain, queryStack.NumberOfTargets, task); err != nil {
+		return errors.New("Failed to end the task of the instance : " + err.Error())
+	}
+
+	// The rows of an instance that answers after the end of the phase of the
+	// query are dropped, and its index is released: the end of the query has
+	// not seen it
+	phase, err := query.FetchTargetPhase(queryStack.QueryID)
+	if couchdb.IsNotFoundError(err) || (err == nil && phase.Completed) {
+		if task.Index != "" {
+			releaseIndex(queryStack.QueryID, queryStack.Domain, task.Index)
+		}
+		return query.ResetTargetRows(queryStack.QueryID, queryStack.Domain)
+	}
+	if err != nil {
+		return err
 	}
 
 	// Now we try to figure out if every target has been contact to fetch data
 	// Counting the number of targets
-	fetchEveryTargets, err := query.FetchAsyncDataT(queryStack.QueryID)
+	ended, err := query.CountEndedTargets(queryStack.QueryID)
 	if err != nil {
-		return handleError(errors.New("Failed fetch targets : " + err.Error()))
+		return errors.New("Failed fetch targets : " + err.Error())
 	}
-	if fetchEveryTargets["NumberOfTargets"].(int) == queryStack.NumberOfTargets {
-		// Send result to Conductor
-		out := query.InputPatchQuery{
-			OutT: query.OutputT{
-				Data:    fetchEveryTargets["Data"].([]map[string]interface{}),
-				QueryID: queryStack.QueryID,
-			},
-			Role: network.RoleT,
+	if ended == queryStack.NumberOfTargets {
+		return finishTargets(phase)
+	}
+
+	return nil
+}
+
+// finishTargets sends the rows received from the instances of a query to the
+// first layer of DAs. It is called once every instance has answered, or once
+// the deadline of the query has passed. Each step is saved in the phase, and a
+// worker that has stopped is taken over by the next check of the deadlines.
+func finishTargets(phase *query.TargetPhase) error {
+
+	// Only one worker sends the folds
+	if err := phase.Complete(time.Now()); err != nil {
+		if couchdb.IsConflictError(err) {
+			return nil
 		}
+		return err
+	}
 
-		// Contact the conductor to send data and continue the query
-		conductor := network.NewExternalActor(network.RoleConductor, network.ModeQuery)
-		conductor.DefineConductor(queryStack.ConductorURL, queryStack.QueryID)
-		if err := conductor.MakeRequest("PATCH", "", out, nil); err != nil {
-			if conductor.Status == "409" {
-				// If conflict, we try a second time
-				if err := conductor.MakeRequest("PATCH", "", out, nil); err != nil {
-					query.DeleteAsyncDataT(queryStack.QueryID)
-					return handleError(err)
-				}
-			} else {
-				query.DeleteAsyncDataT(queryStack.QueryID)
-				return handleError(err)
+	// The folds cannot be sent twice: once they may have been registered, a
+	// worker taking over only reports the failure
+	var err error
+	switch {
+	case phase.Failure != "":
+		err = errors.New(phase.Failure)
+	case phase.Dispatched:
+	case phase.Dispatching:
+		err = dispersErr.ErrDispatchInterrupted
+	default:
+		err = sendTargetFolds(phase)
+	}
+	if couchdb.IsConflictError(err) {
+		// Another worker has taken over the phase
+		return nil
+	}
+	if err != nil {
+		if phase.Failure == "" {
+			if errFail := phase.Fail(err); couchdb.IsConflictError(errFail) {
+				return nil
+			} else if errFail != nil {
+				return errFail
 			}
 		}
-		return query.DeleteAsyncDataT(queryStack.QueryID)
+		// The Conductor has to know that the query cannot go on. If it cannot
+		// be told, the phase is taken over later.
+		if errReport := reportTargetFailure(&phase.Query, err); errReport != nil {
+			return errReport
+		}
+		if err := query.DeleteTargetFolds(phase.Query.QueryID); err != nil {
+			return err
+		}
 	}
 
+	// The rows are deleted whether the folds have been sent or not, and the
+	// indexes used by the query are released. The phase is kept a while, so
+	// that the instances answering late drop their rows.
+	releaseIndexes(phase.Query.QueryID)
+	if err := query.DeleteAsyncDataT(phase.Query.QueryID); err != nil {
+		return err
+	}
+	if err := phase.End(time.Now()); err != nil && !couchdb.IsConflictError(err) {
+		return err
+	}
 	return nil
 }
 
+func sendTargetFolds(phase *query.TargetPhase) error {
+
+	queryStack := &phase.Query
+	fetchEveryTargets, err := query.FetchAsyncDataT(queryStack.QueryID)
+	if err != nil {
+		return errors.New("Failed fetch targets : " + err.Error())
+	}
+	ended := fetchEveryTargets["NumberOfTargets"].(int)
+	failed := fetchEveryTargets["FailedTargets"].(int)
+
+	// Shuffle and split data in folds for the first layer of DAs
+	// The values are clipped within the bounds of the query first
+	rows, clipped, rejected := enclave.PrepareRows(fetchEveryTargets["Data"].([]map[string]interface{}), queryStack.Layout)
+	folds, sizes, err := enclave.MakeFolds(rows, queryStack.Layout)
+	if err != nil {
+		return err
+	}
+	hosts, err := enclave.ChooseFoldHosts(queryStack.Layout)
+	if err != nil {
+		return err
+	}
+
+	// The conductor only receives the number of rows in each fold, how many
+	// rows have been clipped or rejected, how many instances have answered,
+	// and the hosts of the folds
+	out := query.OutputT{
+		NumberOfRows: enclave.CountRows(rows, queryStack.Layout),
+		ClippedRows:  clipped,
+		RejectedRows: rejected,
+		Targets: query.TargetCounts{
+			Responding: ended - failed,
+			Failed:     failed,
+			TimedOut:   queryStack.NumberOfTargets - ended,
+		},
+		Folds:   sizes,
+		Hosts:   enclave.HostNames(hosts),
+		QueryID: queryStack.QueryID,
+	}
+
+	// The folds are kept until the phase expires, so that a copy whose DA has
+	// failed can be sent to another one
+	if err := query.SaveTargetFolds(queryStack.QueryID, folds); err != nil {
+		return err
+	}
+
+	// Contact the conductor to register the folds before sending them
+	if err := phase.BeginDispatch(); err != nil {
+		return err
+	}
+	if err := patchConductor(queryStack, out); err != nil {
+		return err
+	}
+
+	// Send the folds to the DAs, the conductor never sees the data
+	if err := enclave.SendFolds(*queryStack, folds, hosts); err != nil {
+		return err
+	}
+	return phase.EndDispatch()
+}
+
+// reportTargetFailure tells the conductor that the folds of a query have not
+// been sent, so that the query fails
+func reportTargetFailure(queryStack *query.StackQuery, cause error) error {
+	return patchConductor(queryStack, query.OutputT{
+		QueryID: queryStack.QueryID,
+		Error:   cause.Error(),
+	})
+}
+
+func patchConductor(queryStack *query.StackQuery, outT query.OutputT) error {
+
+	out := query.InputPatchQuery{
+		OutT: outT,
+		Role: network.RoleT,
+	}
+	conductor := network.NewExternalActor(network.RoleConductor, network.ModeQuery)
+	conductor.DefineConductor(queryStack.ConductorURL, queryStack.QueryID)
+	if err := conductor.MakeRequest("PATCH", "", out, nil); err != nil {
+		if conductor.Status != "409" {
+			return err
+		}
+		// If conflict, we try a second time
+		if err := conductor.MakeRequest("PATCH", "", out, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WorkerTargetCompletion is a worker that ends the phase of a query whose
+// deadline has passed, with the rows of the instances that have answered.
+func WorkerTargetCompletion(ctx *job.WorkerContext) error {
+
+	// Read Input
+	in := &query.TargetPhase{}
+	if err := ctx.UnmarshalMessage(in); err != nil {
+		return err
+	}
+
+	phase, err := query.FetchTargetPhase(in.PhaseID)
+	if couchdb.IsNotFoundError(err) {
+		// The phase has ended and expired in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !phase.IsOverdue(time.Now()) {
+		return nil
+	}
+	return finishTargets(phase)
+}
+
+// releaseIndexes releases the indexes used by a query on the stacks of the
+// instances whose task has ended. A failure only leaves an index on a stack,
+// it is logged.
+func releaseIndexes(queryid string) {
+
+	if !enclave.DeleteIndexes {
+		return
+	}
+	indexes, err := query.TargetIndexes(queryid)
+	if err != nil {
+		logger.WithNamespace("dispers").Warnf("Cannot release the indexes of the query %s: %s", queryid, err)
+		return
+	}
+	for domain, name := range indexes {
+		releaseIndex(queryid, domain, name)
+	}
+}
+
+// releaseIndex releases the index used by a query on the stack of an
+// instance, and deletes it once no running query uses it
+func releaseIndex(queryid, domain, name string) {
+
+	if !enclave.DeleteIndexes {
+		return
+	}
+	index, err := query.ReleaseIndex(queryid, domain, name)
+	if err == nil && index != nil {
+		err = deleteIndex(index)
+	}
+	if err != nil {
+		logger.WithNamespace("dispers").Warnf("Cannot release the index %s of %s: %s", name, domain, err)
+	}
+}
+
+// deleteIndex deletes the design doc of an index on the stack of an instance
+func deleteIndex(index *query.StackIndex) error {
+
+	stack := network.NewExternalActor(network.RoleStack, network.ModeStack)
+	stack.DefineStack(url.URL{
+		Scheme: "http",
+		Host:   index.Domain,
+		Path:   "data/" + index.Doctype + "/_design/" + index.Name,
+	})
+	if err := stack.MakeRequest("GET", "Bearer "+index.TokenBearer, nil, nil); err != nil {
+		return err
+	}
+	var ddoc struct {
+		Rev string `json:"_rev"`
+	}
+	if err := json.Unmarshal(stack.Out, &ddoc); err != nil {
+		return err
+	}
+
+	stack.URL.RawQuery = url.Values{"rev": []string{ddoc.Rev}}.Encode()
+	return stack.MakeRequest("DELETE", "Bearer "+index.TokenBearer, nil, nil)
+}
+
+// deadlinesStop stops the ticker started by initDeadlines
+var deadlinesStop chan struct{}
+
+// initDeadlines pushes a dispers_deadlines job at every polling interval. It
+// is only called by the processes that run the job system, a negative
+// interval disabling the checks.
+func initDeadlines() error {
+
+	interval := config.GetConfig().Dispers.PollingInterval
+	if interval < 0 {
+		return nil
+	}
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	deadlinesStop = stop
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			_, err := job.System().PushJob(query.PrefixerC, &job.JobRequest{
+				WorkerType: "dispers_deadlines",
+				Message:    job.Message("{}"),
+			})
+			if err != nil {
+				logger.WithNamespace("dispers").Warnf("Cannot check the deadlines of the queries: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// stopDeadlines stops pushing the dispers_deadlines jobs when the worker is
+// shut down
+func stopDeadlines() error {
+	if deadlinesStop != nil {
+		close(deadlinesStop)
+		deadlinesStop = nil
+	}
+	return nil
+}
+
+// WorkerDeadlines is a worker that checks the deadlines of the target phases
+// and of the folds
+func WorkerDeadlines(ctx *job.WorkerContext) error {
+	return enclave.CheckDeadlines()
+}
+
+// WorkerConductorLead is a worker that resumes a query on the Conductor, once
+// it has been created or a layer has been computed.
+func WorkerConductorLead(ctx *job.WorkerContext) error {
+
+	msg := &enclave.LeadMessage{}
+	if err := ctx.UnmarshalMessage(msg); err != nil {
+		return err
+	}
+
+	return enclave.LeadQuery(msg.QueryID)
+}
+
+// commitConductorLead fails the query once its lead job has given up, so that
+// the querier is told and the query stops counting in its running queries
+func commitConductorLead(ctx *job.WorkerContext, errjob error) error {
+
+	if errjob == nil {
+		return nil
+	}
+	msg := &enclave.LeadMessage{}
+	if err := ctx.UnmarshalMessage(msg); err != nil {
+		return err
+	}
+	return enclave.FailQuery(msg.QueryID, errjob)
+}
+
 // WorkerDataAggregator is a worker that launch DataAggregator's treatment.
 func WorkerDataAggregator(ctx *job.WorkerContext) error {
 
 	// Read Input
 	in := &query.InputDA{}
 	if err := ctx.UnmarshalMessage(in); err != nil {
-		return handleError(err)
+		return err
 	}
 
 	in.TaskMetadata.Arrival = time.Now()
@@ -177,20 +583,29 @@ func WorkerDataAggregator(ctx *job.WorkerContext) error {
 	// Launch Treatment
 	res, err := enclave.AggregateData(*in)
 	if err != nil {
-		return handleError(err)
+		// The Conductor sends the fold to another DA
+		in.TaskMetadata.EndTask(err)
+		return reportFold(in, query.OutputDA{Error: err.Error()})
 	}
 
 	in.TaskMetadata.Returning = time.Now()
 
 	// Send result to Conductor
+	return reportFold(in, query.OutputDA{Results: res})
+}
+
+// reportFold sends the result of a fold, or the error that occurred, to the
+// Conductor
+func reportFold(in *query.InputDA, outDA query.OutputDA) error {
+
+	outDA.QueryID = in.QueryID
+	outDA.AggregationID = in.AggregationID
+	outDA.Replica = in.Replica
+	outDA.Host = in.Host
+	outDA.TaskMetadata = in.TaskMetadata
 	out := query.InputPatchQuery{
-		OutDA: query.OutputDA{
-			Results:       res,
-			QueryID:       in.QueryID,
-			AggregationID: in.AggregationID,
-			TaskMetadata:  in.TaskMetadata,
-		},
-		Role: network.RoleDA,
+		OutDA: outDA,
+		Role:  network.RoleDA,
 	}
 
 	conductor := network.NewExternalActor(network.RoleConductor, network.ModeQuery)
@@ -198,10 +613,10 @@ func WorkerDataAggregator(ctx *job.WorkerContext) error {
 	if err := conductor.MakeRequest("PATCH", "", out, nil); err != nil {
 		if conductor.Status == "409" {
 			if err := conductor.MakeRequest("PATCH", "", out, nil); err != nil {
-				return handleError(err)
+				return err
 			}
 		} else {
-			return handleError(err)
+			return err
 		}
 	}
 